@@ -21,14 +21,21 @@ import (
 
 // NewCmdCopy creates a new cobra.Command for the copy subcommand.
 func NewCmdCopy(options *[]crane.Option) *cobra.Command {
-	return &cobra.Command{
+	var force bool
+	cmd := &cobra.Command{
 		Use:     "copy SRC DST",
 		Aliases: []string{"cp"},
 		Short:   "Efficiently copy a remote image from src to dst while retaining the digest value",
 		Args:    cobra.ExactArgs(2),
 		RunE: func(_ *cobra.Command, args []string) error {
 			src, dst := args[0], args[1]
-			return crane.Copy(src, dst, *options...)
+			opts := append([]crane.Option{}, *options...)
+			if force {
+				opts = append(opts, crane.WithForce())
+			}
+			return crane.Copy(src, dst, opts...)
 		},
 	}
+	cmd.Flags().BoolVar(&force, "force", false, "Copy even if dst already points at the same manifest as src")
+	return cmd
 }
@@ -0,0 +1,58 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/spf13/pflag"
+)
+
+// envFlags maps the flags that have a default in the environment to their
+// environment variables, those of crane.WithEnvDefaults. Flags passed
+// explicitly take precedence, e.g. --insecure=false overrides
+// CRANE_INSECURE=true.
+var envFlags = map[string]string{
+	"insecure": crane.EnvInsecure,
+	"platform": crane.EnvPlatform,
+}
+
+// applyEnv sets each flag in fs that wasn't passed explicitly from its
+// environment variable, and returns the options for the environment variables
+// that have no flag. Invalid values are logged and ignored.
+func applyEnv(fs *pflag.FlagSet) []crane.Option {
+	for flag, env := range envFlags {
+		s := os.Getenv(env)
+		if s == "" || fs.Lookup(flag) == nil || fs.Changed(flag) {
+			continue
+		}
+		if err := fs.Set(flag, s); err != nil {
+			logs.Warn.Printf("ignoring %s=%q: %v", env, s, err)
+		}
+	}
+
+	opts := []crane.Option{}
+	if s := os.Getenv(crane.EnvJobs); s != "" {
+		if jobs, err := strconv.Atoi(s); err != nil || jobs <= 0 {
+			logs.Warn.Printf("ignoring %s=%q: must be a positive integer", crane.EnvJobs, s)
+		} else {
+			opts = append(opts, crane.WithJobs(jobs))
+		}
+	}
+	return opts
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/spf13/pflag"
+)
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv(crane.EnvInsecure, "true")
+	t.Setenv(crane.EnvPlatform, "linux/arm64")
+	t.Setenv(crane.EnvJobs, "3")
+
+	for _, tc := range []struct {
+		name         string
+		args         []string
+		wantInsecure bool
+		wantPlatform string
+	}{{
+		name:         "defaults",
+		wantInsecure: true,
+		wantPlatform: "linux/arm64",
+	}, {
+		name:         "flags win",
+		args:         []string{"--insecure=false", "--platform=linux/amd64"},
+		wantPlatform: "linux/amd64",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			insecure := false
+			platform := &platformValue{}
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			fs.BoolVar(&insecure, "insecure", false, "")
+			fs.Var(platform, "platform", "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := applyEnv(fs)
+			if insecure != tc.wantInsecure {
+				t.Errorf("insecure = %t, want %t", insecure, tc.wantInsecure)
+			}
+			if got := platform.String(); got != tc.wantPlatform {
+				t.Errorf("platform = %q, want %q", got, tc.wantPlatform)
+			}
+			if len(opts) != 1 {
+				t.Errorf("applyEnv() returned %d options, want 1 for %s", len(opts), crane.EnvJobs)
+			}
+		})
+	}
+
+	// Invalid values are ignored.
+	t.Setenv(crane.EnvInsecure, "maybe")
+	t.Setenv(crane.EnvJobs, "-1")
+	insecure := false
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.BoolVar(&insecure, "insecure", false, "")
+	if opts := applyEnv(fs); len(opts) != 0 || insecure {
+		t.Errorf("applyEnv() = %d options, insecure = %t, want none", len(opts), insecure)
+	}
+
+	// The library doesn't read the environment.
+	if o := crane.GetOptions(); o.Platform != nil {
+		t.Errorf("GetOptions().Platform = %v, want nil", o.Platform)
+	}
+}
@@ -50,6 +50,7 @@ func New(use, short string, options []crane.Option) *cobra.Command {
 		SilenceUsage:      true,
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
 			options = append(options, crane.WithContext(cmd.Context()))
+			options = append(options, applyEnv(cmd.Flags())...)
 			// TODO(jonjohnsonjr): crane.Verbose option?
 			if verbose {
 				logs.Debug.SetOutput(os.Stderr)
@@ -56,6 +56,9 @@ type Predicate func(error) (retry bool)
 // Retry retries a given function, f, until a predicate is satisfied, using
 // exponential backoff. If the predicate is never satisfied, it will return the
 // last error returned by f.
+//
+// p is only consulted when backoff allows another attempt, so a predicate
+// with side effects (e.g. counting retries) only sees errors that are retried.
 func Retry(f func() error, p Predicate, backoff wait.Backoff) (err error) {
 	if f == nil {
 		return fmt.Errorf("nil f passed to retry")
@@ -64,8 +67,19 @@ func Retry(f func() error, p Predicate, backoff wait.Backoff) (err error) {
 		return fmt.Errorf("nil p passed to retry")
 	}
 
+	// Track the steps that wait.ExponentialBackoff will take, to know when
+	// the last attempt has been made.
+	next := backoff
 	condition := func() (bool, error) {
 		err = f()
+		if next.Steps <= 1 {
+			return true, err
+		}
+		next.Step()
+		if next.Steps == 0 {
+			// The duration hit the cap, so there are no more attempts.
+			return true, err
+		}
 		if p(err) {
 			return false, nil
 		}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 )
 
 type temp struct{}
@@ -79,6 +80,49 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+func TestRetryLastAttempt(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		backoff Backoff
+		want    int
+	}{{
+		name:    "steps",
+		backoff: Backoff{Steps: 3},
+		want:    3,
+	}, {
+		name:    "single step",
+		backoff: Backoff{Steps: 1},
+		want:    1,
+	}, {
+		// The second step's duration exceeds the cap, so there's no third attempt.
+		name:    "cap",
+		backoff: Backoff{Duration: time.Millisecond, Factor: 2, Cap: 3 * time.Millisecond, Steps: 5},
+		want:    2,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			attempts, checks := 0, 0
+			f := func() error {
+				attempts++
+				return temp{}
+			}
+			p := func(err error) bool {
+				checks++
+				return IsTemporary(err)
+			}
+			if err := Retry(f, p, test.backoff); err != (temp{}) {
+				t.Errorf("Retry() = %v, want %v", err, temp{})
+			}
+			if attempts != test.want {
+				t.Errorf("attempts = %d, want %d", attempts, test.want)
+			}
+			// The predicate isn't asked about the last attempt's error.
+			if checks != test.want-1 {
+				t.Errorf("predicate checks = %d, want %d", checks, test.want-1)
+			}
+		})
+	}
+}
+
 // Make sure we don't panic.
 func TestNil(t *testing.T) {
 	if err := Retry(nil, nil, Backoff{}); err == nil {
@@ -17,11 +17,13 @@ package authn
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/docker/cli/cli/config"
 	"github.com/docker/cli/cli/config/configfile"
 	"github.com/docker/cli/cli/config/types"
+	"github.com/docker/docker-credential-helpers/client"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/mitchellh/go-homedir"
 )
@@ -172,3 +174,34 @@ func (w wrapper) Resolve(r Resource) (Authenticator, error) {
 	}
 	return FromConfig(AuthConfig{Username: u, Password: p}), nil
 }
+
+// NewKeychainFromHelperCommand returns a Keychain that runs a Docker
+// credential helper executable to get the credentials for each registry,
+// without needing a Docker config file that names it in credHelpers.
+//
+// helper is either a helper's name as it would appear in credHelpers, e.g.
+// "gcr" for docker-credential-gcr, which is looked up in $PATH, or the path of
+// an executable, e.g. "./bin/my-helper". It's invoked as "<helper> get" with
+// the registry's hostname on stdin, and is expected to print its credentials
+// as JSON, per the credential helper protocol. As with NewKeychainFromHelper,
+// registries the helper has no credentials for, or fails for, are accessed
+// anonymously.
+func NewKeychainFromHelperCommand(helper string) Keychain {
+	if !strings.ContainsRune(helper, '/') && !strings.ContainsRune(helper, filepath.Separator) {
+		helper = "docker-credential-" + helper
+	}
+	return NewKeychainFromHelper(helperCommand{client.NewShellProgramFunc(helper)})
+}
+
+// helperCommand implements Helper by running a credential helper executable.
+type helperCommand struct {
+	program client.ProgramFunc
+}
+
+func (h helperCommand) Get(serverURL string) (string, string, error) {
+	creds, err := client.Get(h.program, serverURL)
+	if err != nil {
+		return "", "", err
+	}
+	return creds.Username, creds.Secret, nil
+}
@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"testing"
 
 	"github.com/google/go-containerregistry/pkg/name"
@@ -363,3 +364,51 @@ func TestNewKeychainFromHelper(t *testing.T) {
 		}
 	})
 }
+
+// fakeHelperScript is a credential helper that has credentials for
+// example.com only.
+const fakeHelperScript = `#!/bin/sh
+read server
+if [ "$1" != get ] || [ "$server" != example.com ]; then
+	echo "credentials not found in native keychain"
+	exit 1
+fi
+echo '{"ServerURL":"example.com","Username":"helper-user","Secret":"helper-secret"}'
+`
+
+func TestNewKeychainFromHelperCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake credential helper is a shell script")
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"docker-credential-fake", "my-helper"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(fakeHelperScript), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	repo := name.MustParseReference("example.com/my/repo").Context()
+	other := name.MustParseReference("other.example.com/my/repo").Context()
+	for _, helper := range []string{"fake", filepath.Join(dir, "my-helper")} {
+		kc := NewKeychainFromHelperCommand(helper)
+		auth, err := kc.Resolve(repo)
+		if err != nil {
+			t.Fatalf("%s: Resolve(%q): %v", helper, repo, err)
+		}
+		cfg, err := auth.Authorization()
+		if err != nil {
+			t.Fatalf("%s: Authorization: %v", helper, err)
+		}
+		if cfg.Username != "helper-user" || cfg.Password != "helper-secret" {
+			t.Errorf("%s: got %q/%q, want helper-user/helper-secret", helper, cfg.Username, cfg.Password)
+		}
+
+		// Registries the helper doesn't know are anonymous.
+		if auth, err := kc.Resolve(other); err != nil {
+			t.Fatalf("%s: Resolve(%q): %v", helper, other, err)
+		} else if auth != Anonymous {
+			t.Errorf("%s: Resolve(%q) = %v, want %v", helper, other, auth, Anonymous)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compression lets callers teach this library to decompress layers
+// whose media types use a compression scheme it doesn't know about.
+//
+// Layers whose media type has no registered Decompressor are handled as they
+// always have been: they're gunzipped if they start with gzip's magic bytes,
+// and read as is otherwise.
+package compression
+
+import (
+	"io"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Decompressor returns a reader of the decompressed contents of rc. Closing
+// it must close rc.
+type Decompressor func(rc io.ReadCloser) (io.ReadCloser, error)
+
+var (
+	mu            sync.RWMutex
+	decompressors = map[types.MediaType]Decompressor{}
+)
+
+// Register makes layers with media type mt be decompressed with d when their
+// uncompressed contents are read, e.g. by v1.Layer's Uncompressed and DiffID
+// methods and by validate.Layer. Registering a media type again replaces its
+// Decompressor, and registering nil removes it.
+//
+// Register is typically called from an init function.
+func Register(mt types.MediaType, d Decompressor) {
+	mu.Lock()
+	defer mu.Unlock()
+	if d == nil {
+		delete(decompressors, mt)
+		return
+	}
+	decompressors[mt] = d
+}
+
+// Lookup returns the Decompressor registered for mt, if any.
+func Lookup(mt types.MediaType) (Decompressor, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	d, ok := decompressors[mt]
+	return d, ok
+}
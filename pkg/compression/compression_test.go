@@ -0,0 +1,153 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compression_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+// xorMediaType is a made up compression scheme that flips every bit.
+const xorMediaType types.MediaType = "application/vnd.example.layer.v1.tar+xor"
+
+func xor(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ 0xff
+	}
+	return out
+}
+
+type xorReader struct {
+	io.ReadCloser
+}
+
+func (r *xorReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	copy(p, xor(p[:n]))
+	return n, err
+}
+
+// xorLayer is a partial.CompressedLayer compressed with xor.
+type xorLayer struct {
+	compressed []byte
+}
+
+func (l *xorLayer) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(l.compressed))
+	return h, err
+}
+
+func (l *xorLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.compressed)), nil
+}
+
+func (l *xorLayer) Size() (int64, error) {
+	return int64(len(l.compressed)), nil
+}
+
+func (l *xorLayer) MediaType() (types.MediaType, error) {
+	return xorMediaType, nil
+}
+
+func TestRegister(t *testing.T) {
+	rl, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := rl.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := partial.CompressedToLayer(&xorLayer{compressed: xor(want)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a decompressor, the compressed bytes are read as is, and
+	// aren't a valid layer.
+	if err := validate.Layer(layer); err == nil {
+		t.Error("validate.Layer() succeeded without a decompressor, expected error")
+	}
+
+	compression.Register(xorMediaType, func(rc io.ReadCloser) (io.ReadCloser, error) {
+		return &xorReader{rc}, nil
+	})
+	defer compression.Register(xorMediaType, nil)
+
+	if err := validate.Layer(layer); err != nil {
+		t.Errorf("validate.Layer() = %v", err)
+	}
+	rc, err = layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("Uncompressed() didn't decompress the layer")
+	}
+
+	// Layers read from a registry are decompressed the same way.
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.NewTag(fmt.Sprintf("%s/compression/xor:latest", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	rmt, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(rmt); err != nil {
+		t.Errorf("validate.Image() = %v", err)
+	}
+}
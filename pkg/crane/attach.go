@@ -0,0 +1,66 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Attach pushes artifact, e.g. a signature or an SBOM, to the repository of
+// subjectRef as a referrer of the manifest that subjectRef resolves to, and
+// returns the digest of the artifact's manifest.
+//
+// The artifact's manifest gets the resolved manifest as its subject, so it
+// must be an OCI manifest. It's pushed by digest, and listed by
+// remote.Referrers, either by the registry's referrers API or, for registries
+// without one, in the subject's fallback tag.
+func Attach(subjectRef string, artifact v1.Image, opt ...Option) (string, error) {
+	o := makeOptions(opt...)
+	ref, err := name.ParseReference(subjectRef, o.Name...)
+	if err != nil {
+		return "", fmt.Errorf("parsing reference %q: %w", subjectRef, err)
+	}
+	mt, err := artifact.MediaType()
+	if err != nil {
+		return "", err
+	}
+	if mt != types.OCIManifestSchema1 {
+		return "", fmt.Errorf("artifact has media type %s, only %s manifests can have a subject", mt, types.OCIManifestSchema1)
+	}
+
+	desc, err := remote.Head(ref, o.Remote...)
+	if err != nil {
+		return "", fmt.Errorf("resolving %q: %w", subjectRef, err)
+	}
+	img := mutate.Subject(artifact, v1.Descriptor{
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		Digest:    desc.Digest,
+	})
+	h, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	if err := remote.Write(ref.Context().Digest(h.String()), img, o.Remote...); err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
@@ -0,0 +1,352 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"golang.org/x/sync/errgroup"
+)
+
+// The name of the file in a checkpoint directory that records which layers
+// have been completely downloaded.
+const checkpointProgress = "progress.json"
+
+// checkpointState is the contents of the progress file.
+type checkpointState struct {
+	// Layers maps the digests of completely downloaded layers to their sizes.
+	Layers map[v1.Hash]int64 `json:"layers"`
+}
+
+// checkpointer downloads layers into a work directory, recording its
+// progress so that an interrupted save can pick up where it left off.
+type checkpointer struct {
+	dir   string
+	state checkpointState
+
+	// created is set if dir didn't exist before, so cleanup removes it.
+	created bool
+}
+
+func newCheckpointer(dir string) (*checkpointer, error) {
+	_, err := os.Stat(dir)
+	created := errors.Is(err, os.ErrNotExist)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &checkpointer{
+		dir:     dir,
+		state:   checkpointState{Layers: map[v1.Hash]int64{}},
+		created: created,
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, checkpointProgress))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", checkpointProgress, err)
+	}
+	if c.state.Layers == nil {
+		c.state.Layers = map[v1.Hash]int64{}
+	}
+	return c, nil
+}
+
+func (c *checkpointer) path(h v1.Hash) string {
+	return filepath.Join(c.dir, h.Algorithm+"-"+h.Hex)
+}
+
+// complete returns whether the layer h was previously downloaded and its file
+// still has the expected digest.
+func (c *checkpointer) complete(h v1.Hash) bool {
+	size, ok := c.state.Layers[h]
+	if !ok {
+		return false
+	}
+	f, err := os.Open(c.path(h))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	got, n, err := v1.SHA256(f)
+	return err == nil && got == h && n == size
+}
+
+// download writes the layer's compressed contents to the work directory,
+// verifying them against its digest, and records it as complete.
+func (c *checkpointer) download(l v1.Layer) error {
+	h, err := l.Digest()
+	if err != nil {
+		return err
+	}
+	if c.complete(h) {
+		logs.Progress.Printf("using checkpointed layer %s", h)
+		return nil
+	}
+
+	rc, err := l.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmp := c.path(h) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	got, size, err := v1.SHA256(io.TeeReader(rc, f))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got != h {
+		return fmt.Errorf("layer %s: downloaded contents have digest %s", h, got)
+	}
+	if err := os.Rename(tmp, c.path(h)); err != nil {
+		return err
+	}
+
+	c.state.Layers[h] = size
+	return c.save()
+}
+
+// save atomically writes the progress file.
+func (c *checkpointer) save() error {
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(c.dir, checkpointProgress)
+	if err := ioutil.WriteFile(p+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// cleanup removes the layer files and the progress file, leaving anything
+// else in the work directory alone. The directory itself is only removed if
+// the checkpointer created it and it's now empty.
+func (c *checkpointer) cleanup() error {
+	for h := range c.state.Layers {
+		if err := os.Remove(c.path(h)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(c.dir, checkpointProgress)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if c.created {
+		if err := os.Remove(c.dir); err != nil {
+			logs.Debug.Printf("not removing %s: %v", c.dir, err)
+		}
+	}
+	return nil
+}
+
+// images downloads every layer of imgs and returns images whose layers read
+// from the work directory instead.
+func (c *checkpointer) images(imgs map[name.Tag]v1.Image) (map[name.Tag]v1.Image, error) {
+	out := make(map[name.Tag]v1.Image, len(imgs))
+	for tag, img := range imgs {
+		ls, err := img.Layers()
+		if err != nil {
+			return nil, err
+		}
+		local := make([]v1.Layer, 0, len(ls))
+		for _, l := range ls {
+			if err := c.download(l); err != nil {
+				return nil, fmt.Errorf("downloading layer for %s: %w", tag, err)
+			}
+			h, err := l.Digest()
+			if err != nil {
+				return nil, err
+			}
+			local = append(local, &checkpointedLayer{Layer: l, path: c.path(h)})
+		}
+		out[tag] = &checkpointedImage{Image: img, layers: local}
+	}
+	return out, nil
+}
+
+// checkpointedImage is a v1.Image whose layers have been downloaded to a
+// checkpoint directory.
+type checkpointedImage struct {
+	v1.Image
+	layers []v1.Layer
+}
+
+// Layers implements v1.Image.
+func (i *checkpointedImage) Layers() ([]v1.Layer, error) {
+	return i.layers, nil
+}
+
+// LayerByDigest implements v1.Image.
+func (i *checkpointedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.Digest(); err == nil && d == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDigest(h)
+}
+
+// checkpointedLayer is a v1.Layer whose compressed contents are read from a
+// checkpoint directory.
+type checkpointedLayer struct {
+	v1.Layer
+	path string
+}
+
+// Compressed implements v1.Layer.
+func (l *checkpointedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
+
+// copyCheckpointState is the contents of a WithCopyCheckpoint file.
+type copyCheckpointState struct {
+	// Repository is the destination the blobs were copied to.
+	Repository string `json:"repository"`
+	// Blobs maps the digests of blobs that are in Repository to their sizes.
+	Blobs map[v1.Hash]int64 `json:"blobs"`
+}
+
+// copyCheckpointer records the blobs that Copy has written to a repository.
+type copyCheckpointer struct {
+	path string
+
+	mu    sync.Mutex
+	state copyCheckpointState
+}
+
+// newCopyCheckpointer reads the checkpoint at path, if there is one. The blobs
+// it records are only trusted once verify has checked them.
+func newCopyCheckpointer(path string, repo name.Repository) (*copyCheckpointer, error) {
+	c := &copyCheckpointer{
+		path:  path,
+		state: copyCheckpointState{Repository: repo.String(), Blobs: map[v1.Hash]int64{}},
+	}
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state copyCheckpointState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if state.Repository != repo.String() {
+		logs.Warn.Printf("ignoring checkpoint %s for %s, not %s", path, state.Repository, repo)
+		return c, nil
+	}
+	if state.Blobs != nil {
+		c.state.Blobs = state.Blobs
+	}
+	return c, nil
+}
+
+// verify drops the blobs the checkpoint records that are no longer in repo.
+func (c *copyCheckpointer) verify(repo name.Repository, opts ...remote.Option) error {
+	if len(c.state.Blobs) == 0 {
+		return nil
+	}
+	recorded := c.state.Blobs
+	c.state.Blobs = map[v1.Hash]int64{}
+
+	// Don't trust the checkpoint blindly: the blobs may have been deleted,
+	// or garbage collected, since.
+	var g errgroup.Group
+	g.SetLimit(verifyJobs)
+	for h, size := range recorded {
+		h, size := h, size
+		g.Go(func() error {
+			l, err := remote.Layer(repo.Digest(h.String()), opts...)
+			if err != nil {
+				return err
+			}
+			ok, err := partial.Exists(l)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				logs.Warn.Printf("checkpointed blob %s is missing from %s", h, repo)
+				return nil
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.state.Blobs[h] = size
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("checking checkpointed blobs: %w", err)
+	}
+	logs.Progress.Printf("resuming copy to %s with %d blobs already copied", repo, len(c.state.Blobs))
+	return nil
+}
+
+// has returns whether the blob h is in the repository, according to the
+// verified checkpoint. It's passed to remote.WithKnownBlobs, so that a resumed
+// copy doesn't check or upload those blobs again.
+func (c *copyCheckpointer) has(h v1.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.state.Blobs[h]
+	return ok
+}
+
+// written records that the blob desc is in the repository. It's passed to
+// remote.WithBlobWritten, so errors saving the checkpoint are only logged:
+// they mean a later run has to check more blobs, not that the copy failed.
+func (c *copyCheckpointer) written(desc v1.Descriptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.state.Blobs[desc.Digest]; ok {
+		return
+	}
+	c.state.Blobs[desc.Digest] = desc.Size
+	if err := c.save(); err != nil {
+		logs.Warn.Printf("saving checkpoint %s: %v", c.path, err)
+	}
+}
+
+// save atomically writes the checkpoint. c.mu must be held.
+func (c *copyCheckpointer) save() error {
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(c.path+".tmp", c.path)
+}
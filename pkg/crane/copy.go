@@ -15,16 +15,27 @@
 package crane
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
 	"github.com/google/go-containerregistry/internal/legacy"
 	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 // Copy copies a remote image or index from src to dst.
+//
+// Each blob is streamed straight from the response to a GET from src into
+// the body of the upload to dst, and its digest is verified as it passes
+// through, so memory use doesn't grow with the size of the layers.
+//
+// If dst already points at the same manifest as src, nothing is copied, which
+// makes repeated mirroring cheap. Use WithForce to copy anyway, and
+// WithCopyResult to find out which happened.
 func Copy(src, dst string, opt ...Option) error {
 	o := makeOptions(opt...)
 	srcRef, err := name.ParseReference(src, o.Name...)
@@ -37,12 +48,56 @@ func Copy(src, dst string, opt ...Option) error {
 		return fmt.Errorf("parsing reference for %q: %w", dst, err)
 	}
 
+	// Check the options before anything is fetched, so that they're
+	// reported even if dst turns out to be up to date.
+	var mountRepo name.Repository
+	if o.mountRepo != "" {
+		mountRepo, err = name.NewRepository(dstRef.Context().RegistryStr()+"/"+o.mountRepo, o.Name...)
+		if err != nil {
+			return fmt.Errorf("parsing mount repository %q: %w", o.mountRepo, err)
+		}
+	}
+	var checkpoint *copyCheckpointer
+	if o.copyCheckpoint != "" {
+		checkpoint, err = newCopyCheckpointer(o.copyCheckpoint, dstRef.Context())
+		if err != nil {
+			return err
+		}
+	}
+
+	if !o.force {
+		if h, ok := upToDate(srcRef, dstRef, o); ok {
+			logs.Progress.Printf("%v is already up to date with %v at %s", dstRef, srcRef, h)
+			if o.copyCheckpoint != "" {
+				if err := os.Remove(o.copyCheckpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			}
+			if o.copyResult != nil {
+				o.copyResult(CopyResult{Digest: h.String(), UpToDate: true})
+			}
+			return nil
+		}
+	}
+
 	logs.Progress.Printf("Copying from %v to %v", srcRef, dstRef)
 	desc, err := remote.Get(srcRef, o.Remote...)
 	if err != nil {
 		return fmt.Errorf("fetching %q: %w", src, err)
 	}
 
+	// Only the writes mount from mountRepo.
+	if o.mountRepo != "" {
+		o.Remote = append(o.Remote, remote.WithMountRepository(mountRepo))
+	}
+
+	if checkpoint != nil {
+		if err := checkpoint.verify(dstRef.Context(), o.Remote...); err != nil {
+			return err
+		}
+		o.Remote = append(o.Remote, remote.WithBlobWritten(checkpoint.written), remote.WithKnownBlobs(checkpoint.has))
+	}
+
 	switch desc.MediaType {
 	case types.OCIImageIndex, types.DockerManifestList:
 		// Handle indexes separately.
@@ -68,9 +123,49 @@ func Copy(src, dst string, opt ...Option) error {
 		}
 	}
 
+	if checkpoint != nil {
+		if err := os.Remove(o.copyCheckpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if o.copyResult != nil {
+		o.copyResult(CopyResult{Digest: desc.Digest.String()})
+	}
 	return nil
 }
 
+// CopyResult describes what a Copy did. See WithCopyResult.
+type CopyResult struct {
+	// Digest is the digest of the manifest that was copied, or that dst
+	// already pointed at. When WithPlatform picks an image out of an index,
+	// it's the digest of the index.
+	Digest string
+
+	// UpToDate is true if dst already pointed at src's manifest, so nothing
+	// was copied.
+	UpToDate bool
+}
+
+// upToDate HEADs srcRef and dstRef, and returns src's digest and true if they
+// resolve to the same manifest, so copying would be a no-op. Any failure, e.g.
+// because dst doesn't exist yet, means a copy is needed.
+func upToDate(srcRef, dstRef name.Reference, o Options) (v1.Hash, bool) {
+	src, err := remote.Head(srcRef, o.Remote...)
+	if err != nil {
+		return v1.Hash{}, false
+	}
+	if src.MediaType.IsIndex() && o.Platform != nil {
+		// Only one of the index's images is copied, so dst won't point at
+		// the index.
+		return v1.Hash{}, false
+	}
+	dst, err := remote.Head(dstRef, o.Remote...)
+	if err != nil {
+		return v1.Hash{}, false
+	}
+	return src.Digest, src.Digest == dst.Digest
+}
+
 func copyImage(desc *remote.Descriptor, dstRef name.Reference, o Options) error {
 	img, err := desc.Image()
 	if err != nil {
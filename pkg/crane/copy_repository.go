@@ -0,0 +1,198 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultCopyJobs is the number of tags CopyRepository fetches or copies at
+// once, unless WithJobs is used.
+const defaultCopyJobs = 4
+
+// ErrTagsNotCopied is returned by CopyRepository when some tags couldn't be
+// copied.
+type ErrTagsNotCopied struct {
+	// Errors maps each tag that wasn't copied to the reason.
+	Errors map[string]error
+}
+
+// Error implements error.
+func (e *ErrTagsNotCopied) Error() string {
+	tags := make([]string, 0, len(e.Errors))
+	for tag := range e.Errors {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	msgs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", tag, e.Errors[tag]))
+	}
+	return fmt.Sprintf("failed to copy %d tag(s): %s", len(tags), strings.Join(msgs, "; "))
+}
+
+// CopyRepository copies every tag of the repository src to the repository
+// dst, e.g. to mirror it.
+//
+// The images and indexes of all tags are pushed together, so each blob they
+// share is only uploaded once. Use WithTagFilter to only copy some tags, and
+// WithJobs to set the concurrency.
+//
+// A tag that fails to copy doesn't stop the others: once every tag has been
+// attempted, an *ErrTagsNotCopied reports the ones that failed. Use
+// WithStopOnError to stop at the first failure instead.
+func CopyRepository(src, dst string, opt ...Option) error {
+	o := makeOptions(opt...)
+	srcRepo, err := name.NewRepository(src, o.Name...)
+	if err != nil {
+		return fmt.Errorf("parsing repo %q: %w", src, err)
+	}
+	dstRepo, err := name.NewRepository(dst, o.Name...)
+	if err != nil {
+		return fmt.Errorf("parsing repo %q: %w", dst, err)
+	}
+	jobs := o.jobs
+	if jobs <= 0 {
+		jobs = defaultCopyJobs
+	}
+
+	all, err := remote.List(srcRepo, o.Remote...)
+	if err != nil {
+		return fmt.Errorf("listing tags of %s: %w", srcRepo, err)
+	}
+	tags := []string{}
+	for _, tag := range all {
+		if o.tagFilter == nil || o.tagFilter(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	logs.Progress.Printf("Copying %d tag(s) from %s to %s", len(tags), srcRepo, dstRepo)
+
+	var mu sync.Mutex
+	failed := map[string]error{}
+	fail := func(tag string, err error) error {
+		logs.Progress.Printf("failed to copy %s: %v", tag, err)
+		mu.Lock()
+		defer mu.Unlock()
+		failed[tag] = err
+		if o.stopOnError {
+			return fmt.Errorf("copying %s: %w", tag, err)
+		}
+		return nil
+	}
+
+	// Fetch what every tag points to.
+	pushable := map[name.Reference]remote.Taggable{}
+	var g errgroup.Group
+	g.SetLimit(jobs)
+	for _, tag := range tags {
+		tag := tag
+		g.Go(func() error {
+			t, err := copyableTag(srcRepo.Tag(tag), o)
+			if err != nil {
+				return fail(tag, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			pushable[dstRepo.Tag(tag)] = t
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	// Push them all at once, so that shared blobs are only uploaded once.
+	if len(pushable) == 0 {
+		err = nil
+	} else {
+		err = remote.MultiWrite(pushable, o.Remote...)
+	}
+	if err == nil {
+		for ref := range pushable {
+			logs.Progress.Printf("copied %s", ref)
+		}
+	} else {
+		if o.stopOnError {
+			return err
+		}
+		// Find out which tags failed by pushing them one by one. The blobs
+		// that MultiWrite uploaded already exist, so they're skipped.
+		logs.Progress.Printf("retrying tags individually: %v", err)
+		g = errgroup.Group{}
+		g.SetLimit(jobs)
+		for ref, t := range pushable {
+			ref, t := ref, t
+			g.Go(func() error {
+				if err := writeTaggable(ref, t, o); err != nil {
+					return fail(ref.Identifier(), err)
+				}
+				logs.Progress.Printf("copied %s", ref)
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) != 0 {
+		return &ErrTagsNotCopied{Errors: failed}
+	}
+	return nil
+}
+
+// copyableTag returns the image or index that ref points to, converting
+// indexes to images when WithPlatform is used, like Copy.
+func copyableTag(ref name.Tag, o Options) (remote.Taggable, error) {
+	desc, err := remote.Get(ref, o.Remote...)
+	if err != nil {
+		return nil, err
+	}
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		if o.Platform != nil {
+			return desc.Image()
+		}
+		return desc.ImageIndex()
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return nil, errors.New("schema 1 images are not supported, use Copy")
+	default:
+		return desc.Image()
+	}
+}
+
+// writeTaggable writes an image or index returned by copyableTag to ref.
+func writeTaggable(ref name.Reference, t remote.Taggable, o Options) error {
+	switch t := t.(type) {
+	case v1.ImageIndex:
+		return remote.WriteIndex(ref, t, o.Remote...)
+	case v1.Image:
+		return remote.Write(ref, t, o.Remote...)
+	default:
+		return fmt.Errorf("unexpected %T", t)
+	}
+}
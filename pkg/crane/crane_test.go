@@ -17,6 +17,8 @@ package crane_test
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -26,8 +28,14 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-containerregistry/internal/compare"
 	"github.com/google/go-containerregistry/pkg/authn"
@@ -36,9 +44,13 @@ import (
 	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
 )
 
 // TODO(jonjohnsonjr): Test crane.Copy failures.
@@ -265,6 +277,161 @@ func TestCraneCopyIndex(t *testing.T) {
 	}
 }
 
+// patternReader produces n bytes of deterministic, incompressible-looking
+// data without holding it in memory.
+type patternReader struct {
+	off, n int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.off >= r.n {
+		return 0, io.EOF
+	}
+	if rem := r.n - r.off; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	for i := range p {
+		x := uint64(r.off + int64(i))
+		p[i] = byte((x * 2654435761) >> 13)
+	}
+	r.off += int64(len(p))
+	return len(p), nil
+}
+
+func TestCraneCopyStreamsLayers(t *testing.T) {
+	const size = 256 << 20
+	layerDigest, _, err := v1.SHA256(&patternReader{n: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["` + layerDigest.String() + `"]}}`)
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config:        v1.Descriptor{MediaType: types.DockerConfigJSON, Size: configSize, Digest: configDigest},
+		Layers:        []v1.Descriptor{{MediaType: types.DockerLayer, Size: size, Digest: layerDigest}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The source generates the layer on the fly, and the destination hashes
+	// and discards it, so that the only copy of the layer that could be held
+	// in memory is one made by crane.Copy.
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+		case strings.HasPrefix(r.URL.Path, "/v2/src/manifests/"):
+			w.Header().Set("Content-Type", string(types.DockerManifestSchema2))
+			w.Write(manifest)
+		case r.URL.Path == "/v2/src/blobs/"+configDigest.String():
+			w.Write(config)
+		case r.URL.Path == "/v2/src/blobs/"+layerDigest.String():
+			w.Header().Set("Content-Length", fmt.Sprint(size))
+			if r.Method == http.MethodGet {
+				io.Copy(w, &patternReader{n: size})
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer src.Close()
+
+	var mu sync.Mutex
+	uploaded := map[string]v1.Hash{}
+	dst := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/dst/blobs/uploads/":
+			w.Header().Set("Location", "/upload/"+r.URL.Query().Get("mount"))
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPatch:
+			h, _, err := v1.SHA256(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			mu.Lock()
+			uploaded[r.URL.Path] = h
+			mu.Unlock()
+			w.Header().Set("Location", r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/upload/"):
+			mu.Lock()
+			got := uploaded[r.URL.Path]
+			mu.Unlock()
+			if got.String() != r.URL.Query().Get("digest") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v2/dst/manifests/"):
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer dst.Close()
+
+	srcURL, err := url.Parse(src.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstURL, err := url.Parse(dst.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sample the heap while copying to find its high water mark.
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > peak {
+				peak = ms.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	err = crane.Copy(fmt.Sprintf("%s/src:latest", srcURL.Host), fmt.Sprintf("%s/dst:latest", dstURL.Host))
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatalf("Copy() = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	found := false
+	for _, h := range uploaded {
+		found = found || h == layerDigest
+	}
+	if !found {
+		t.Errorf("layer %s was not uploaded", layerDigest)
+	}
+	if grew := int64(peak) - int64(before.HeapInuse); grew > size/8 {
+		t.Errorf("heap grew by %d bytes copying a %d byte layer", grew, size)
+	}
+}
+
 func TestWithPlatform(t *testing.T) {
 	// Set up a fake registry with a platform-specific image.
 	s := httptest.NewServer(registry.New())
@@ -399,6 +566,88 @@ func TestCraneSaveLegacy(t *testing.T) {
 	}
 }
 
+func TestVerifyArchive(t *testing.T) {
+	t.Parallel()
+	tmp := t.TempDir()
+
+	img, err := random.Image(1024, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := filepath.Join(tmp, "good.tar")
+	if err := crane.Save(img, "test/crane", good); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.VerifyArchive(good); err != nil {
+		t.Errorf("VerifyArchive(good) = %v", err)
+	}
+
+	legacy := filepath.Join(tmp, "legacy.tar")
+	if err := crane.SaveLegacy(img, "test/crane", legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.VerifyArchive(legacy); err != nil {
+		t.Errorf("VerifyArchive(legacy) = %v", err)
+	}
+
+	// Copy the good tarball, corrupting the first byte of two layers.
+	bad := filepath.Join(tmp, "bad.tar")
+	in, err := os.Open(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	corrupted := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(hdr.Name, ".tar.gz") && corrupted < 2 {
+			b[0] ^= 0xff
+			corrupted++
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = crane.VerifyArchive(bad)
+	if err == nil {
+		t.Fatal("VerifyArchive(bad) = nil, expected error")
+	}
+	if !strings.HasPrefix(err.Error(), "2 entries failed verification") {
+		t.Errorf("VerifyArchive(bad) = %v, expected both mismatches", err)
+	}
+
+	if err := crane.VerifyArchive(filepath.Join(tmp, "missing.tar")); err == nil {
+		t.Error("VerifyArchive(missing) = nil, expected error")
+	}
+}
+
 func TestCraneSaveOCI(t *testing.T) {
 	t.Parallel()
 	// Write an image as an OCI image layout.
@@ -415,6 +664,261 @@ func TestCraneSaveOCI(t *testing.T) {
 	if err := crane.SaveOCI(img, tmp); err != nil {
 		t.Errorf("SaveLegacy: %v", err)
 	}
+
+	// Saving again should be a no-op.
+	if err := crane.SaveOCI(img, tmp); err != nil {
+		t.Errorf("SaveOCI: %v", err)
+	}
+	p, err := layout.FromPath(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ii, err := p.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ii.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(im.Manifests), 1; got != want {
+		t.Errorf("index has %d manifests after saving twice, want %d", got, want)
+	}
+	// 5 layers, config and manifest.
+	blobs, err := ioutil.ReadDir(filepath.Join(tmp, "blobs", "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(blobs), 7; got != want {
+		t.Errorf("layout has %d blobs, want %d", got, want)
+	}
+
+	// A blob that was corrupted in place, keeping its size, is rewritten.
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(tmp, "blobs", h.Algorithm, h.Hex)
+	b, err := ioutil.ReadFile(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range b[len(b)/2:] {
+		b[len(b)/2+i] = 0
+	}
+	if err := ioutil.WriteFile(blob, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.SaveOCI(img, tmp); err != nil {
+		t.Errorf("SaveOCI: %v", err)
+	}
+	p, err = layout.FromPath(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.Image(dig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Errorf("validate.Image() after re-saving a corrupt blob = %v", err)
+	}
+}
+
+func TestCraneSaveMissingLayers(t *testing.T) {
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := map[string]bool{}
+	for _, l := range layers[1:] {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		missing[h.String()] = true
+	}
+
+	reg := registry.New()
+	var heads int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/") {
+			atomic.AddInt32(&heads, 1)
+		}
+		if r.Method != http.MethodPut && missing[path.Base(r.URL.Path)] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := fmt.Sprintf("%s/test/crane:missing", u.Host)
+	if err := crane.Push(img, src); err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := crane.Pull(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	atomic.StoreInt32(&heads, 0)
+	out := filepath.Join(tmp, "image.tar")
+	err = crane.Save(pulled, src, out)
+	if err == nil {
+		t.Fatal("Save() = nil, expected missing layers")
+	}
+	for h := range missing {
+		if !strings.Contains(err.Error(), h) {
+			t.Errorf("Save() = %v, expected it to mention %s", err, h)
+		}
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("Save() wrote %s before checking layers", out)
+	}
+	if got, want := atomic.LoadInt32(&heads), int32(len(layers)); got != want {
+		t.Errorf("Save() made %d HEAD requests, want %d", got, want)
+	}
+
+	// Without the precheck, we only find out while writing.
+	atomic.StoreInt32(&heads, 0)
+	if err := crane.MultiSave(map[string]v1.Image{src: pulled}, out, crane.WithoutBlobPrecheck()); err == nil {
+		t.Error("MultiSave() = nil, expected missing layer")
+	}
+	if got := atomic.LoadInt32(&heads); got != 0 {
+		t.Errorf("MultiSave() made %d HEAD requests, want 0", got)
+	}
+}
+
+func TestCraneSaveCheckpoint(t *testing.T) {
+	img, err := random.Image(1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := layers[2].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registry.New()
+	var (
+		fail  int32 = 1
+		mu    sync.Mutex
+		pulls = map[string]int{}
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			if path.Base(r.URL.Path) == broken.String() && atomic.LoadInt32(&fail) == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			mu.Lock()
+			pulls[path.Base(r.URL.Path)]++
+			mu.Unlock()
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := fmt.Sprintf("%s/test/crane:checkpoint", u.Host)
+	if err := crane.Push(img, src); err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := crane.Pull(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := t.TempDir()
+	work := filepath.Join(tmp, "work")
+	out := filepath.Join(tmp, "image.tar")
+	imgs := map[string]v1.Image{src: pulled}
+	// Files in the work directory that aren't the checkpointer's are left alone.
+	unrelated := filepath.Join(work, "unrelated")
+	if err := os.MkdirAll(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(unrelated, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := crane.MultiSave(imgs, out, crane.WithCheckpointDir(work), crane.WithoutBlobPrecheck()); err == nil {
+		t.Fatal("MultiSave() = nil, expected broken layer to fail")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("MultiSave() wrote %s before all layers were downloaded", out)
+	}
+
+	// Resume: only the layer that failed should be downloaded again.
+	atomic.StoreInt32(&fail, 0)
+	if err := crane.MultiSave(imgs, out, crane.WithCheckpointDir(work)); err != nil {
+		t.Fatalf("MultiSave() = %v", err)
+	}
+	for i, l := range layers {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pulls[h.String()]; got != 1 {
+			t.Errorf("layer %d was downloaded %d times, want 1", i, got)
+		}
+	}
+	entries, err := ioutil.ReadDir(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "unrelated" {
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("checkpoint dir has %v after MultiSave, want only the unrelated file", names)
+	}
+
+	// A checkpoint dir that MultiSave created is removed.
+	work2 := filepath.Join(tmp, "work2")
+	if err := crane.MultiSave(imgs, out, crane.WithCheckpointDir(work2)); err != nil {
+		t.Fatalf("MultiSave() = %v", err)
+	}
+	if _, err := os.Stat(work2); !os.IsNotExist(err) {
+		t.Errorf("checkpoint dir %s wasn't removed: %v", work2, err)
+	}
+
+	loaded, err := crane.Load(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compare.Images(img, loaded); err != nil {
+		t.Errorf("loaded image differs: %v", err)
+	}
 }
 
 func TestCraneFilesystem(t *testing.T) {
@@ -518,31 +1022,228 @@ func TestStreamingAppend(t *testing.T) {
 	}
 }
 
-func TestBadInputs(t *testing.T) {
-	t.Parallel()
-	invalid := "/dev/null/@@@@@@"
-
-	// Create a valid image reference that will fail with not found.
-	s := httptest.NewServer(http.NotFoundHandler())
+func TestRebase(t *testing.T) {
+	var patches int32
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			atomic.AddInt32(&patches, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
 	u, err := url.Parse(s.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
-	valid404 := fmt.Sprintf("%s/some/image", u.Host)
 
-	// e drops the first parameter so we can use the result of a function
-	// that returns two values as an expression above. This is a bit of a go quirk.
-	e := func(_ interface{}, err error) error {
-		return err
+	oldBase, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	for _, tc := range []struct {
-		desc string
-		err  error
-	}{
-		{"Push(_, invalid)", crane.Push(nil, invalid)},
-		{"Upload(_, invalid)", crane.Upload(nil, invalid)},
-		{"Delete(invalid)", crane.Delete(invalid)},
+	newBase, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appLayer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := mutate.AppendLayers(oldBase, appLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldRef := fmt.Sprintf("%s/base:old", u.Host)
+	newRef := fmt.Sprintf("%s/base:new", u.Host)
+	origRef := fmt.Sprintf("%s/app:orig", u.Host)
+	dstRef := fmt.Sprintf("%s/app:rebased", u.Host)
+	for ref, img := range map[string]v1.Image{oldRef: oldBase, newRef: newBase, origRef: orig} {
+		if err := crane.Push(img, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt32(&patches, 0)
+	if err := crane.Rebase(origRef, oldRef, newRef, dstRef); err != nil {
+		t.Fatalf("Rebase() = %v", err)
+	}
+
+	// Only the new config should have been uploaded.
+	if got := atomic.LoadInt32(&patches); got != 1 {
+		t.Errorf("Rebase() uploaded %d blobs, want 1", got)
+	}
+
+	rebased, err := crane.Pull(dstRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := rebased.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := newBase.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, appLayer)
+	if len(got) != len(want) {
+		t.Fatalf("Rebase() has %d layers, want %d", len(got), len(want))
+	}
+	for i := range want {
+		gd, err := got[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wd, err := want[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gd != wd {
+			t.Errorf("layer %d = %s, want %s", i, gd, wd)
+		}
+	}
+
+	// newBase isn't the base of orig.
+	if err := crane.Rebase(origRef, newRef, oldRef, dstRef); err == nil {
+		t.Error("Rebase() with wrong old base succeeded, expected error")
+	} else if msg := err.Error(); !strings.Contains(msg, origRef) || !strings.Contains(msg, newRef) || !strings.Contains(msg, "not based on old base") {
+		t.Errorf("Rebase() with wrong old base = %v, expected it to name both images", err)
+	}
+}
+
+func TestLayerDiff(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := mutate.AppendLayers(base, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := mutate.AppendLayers(base, static.NewLayer([]byte("b"), types.DockerLayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refA := fmt.Sprintf("%s/test/layerdiff:a", u.Host)
+	refB := fmt.Sprintf("%s/test/layerdiff:b", u.Host)
+	if err := crane.Push(a, refA); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(b, refB); err != nil {
+		t.Fatal(err)
+	}
+
+	digests := func(img v1.Image) []v1.Hash {
+		ls, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := []v1.Hash{}
+		for _, l := range ls {
+			h, err := l.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hs = append(hs, h)
+		}
+		return hs
+	}
+	da, db := digests(a), digests(b)
+
+	onlyA, onlyB, common, err := crane.LayerDiff(refA, refB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := da[2:]; !reflect.DeepEqual(onlyA, want) {
+		t.Errorf("onlyA = %v, want %v", onlyA, want)
+	}
+	if want := db[2:]; !reflect.DeepEqual(onlyB, want) {
+		t.Errorf("onlyB = %v, want %v", onlyB, want)
+	}
+	if want := da[:2]; !reflect.DeepEqual(common, want) {
+		t.Errorf("common = %v, want %v", common, want)
+	}
+
+	if _, _, _, err := crane.LayerDiff(refA, fmt.Sprintf("%s/test/layerdiff:missing", u.Host)); err == nil {
+		t.Error("LayerDiff() with missing image = nil, expected error")
+	}
+}
+
+func TestEnvDefaults(t *testing.T) {
+	t.Setenv(crane.EnvInsecure, "true")
+	t.Setenv(crane.EnvPlatform, "linux/arm64")
+	t.Setenv(crane.EnvJobs, "not a number")
+
+	scheme := func(o crane.Options) string {
+		ref, err := name.ParseReference("example.com/foo", o.Name...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref.Context().Scheme()
+	}
+
+	// The environment is ignored unless asked for.
+	o := crane.GetOptions()
+	if o.Platform != nil {
+		t.Errorf("Platform = %v, want nil", o.Platform)
+	}
+	if got, want := scheme(o), "https"; got != want {
+		t.Errorf("Scheme() = %q, want %q", got, want)
+	}
+
+	o = crane.GetOptions(crane.WithEnvDefaults())
+	if o.Platform == nil || o.Platform.String() != "linux/arm64" {
+		t.Errorf("Platform = %v, want linux/arm64", o.Platform)
+	}
+	if got, want := scheme(o), "http"; got != want {
+		t.Errorf("Scheme() = %q, want %q", got, want)
+	}
+
+	// Explicit options take precedence, wherever WithEnvDefaults is passed.
+	o = crane.GetOptions(crane.WithPlatform(&v1.Platform{OS: "linux", Architecture: "amd64"}), crane.WithEnvDefaults())
+	if o.Platform == nil || o.Platform.String() != "linux/amd64" {
+		t.Errorf("Platform = %v, want linux/amd64", o.Platform)
+	}
+}
+
+func TestBadInputs(t *testing.T) {
+	t.Parallel()
+	invalid := "/dev/null/@@@@@@"
+
+	// Create a valid image reference that will fail with not found.
+	s := httptest.NewServer(http.NotFoundHandler())
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid404 := fmt.Sprintf("%s/some/image", u.Host)
+
+	// e drops the first parameter so we can use the result of a function
+	// that returns two values as an expression above. This is a bit of a go quirk.
+	e := func(_ interface{}, err error) error {
+		return err
+	}
+
+	for _, tc := range []struct {
+		desc string
+		err  error
+	}{
+		{"Push(_, invalid)", crane.Push(nil, invalid)},
+		{"Upload(_, invalid)", crane.Upload(nil, invalid)},
+		{"Delete(invalid)", crane.Delete(invalid)},
 		{"Delete: 404", crane.Delete(valid404)},
 		{"Save(_, invalid)", crane.Save(nil, invalid, "")},
 		{"SaveLegacy(_, invalid)", crane.SaveLegacy(nil, invalid, "")},
@@ -557,6 +1258,8 @@ func TestBadInputs(t *testing.T) {
 		{"Optimize(invalid, invalid)", crane.Optimize(invalid, invalid, []string{})},
 		{"Optimize(404, invalid)", crane.Optimize(valid404, invalid, []string{})},
 		{"Optimize(404, 404)", crane.Optimize(valid404, valid404, []string{})},
+		{"Rebase(invalid, invalid, invalid, invalid)", crane.Rebase(invalid, invalid, invalid, invalid)},
+		{"Rebase(404, 404, 404, 404)", crane.Rebase(valid404, valid404, valid404, valid404)},
 		// These return multiple values, which are hard to use as expressions.
 		{"Pull(invalid)", e(crane.Pull(invalid))},
 		{"Digest(invalid)", e(crane.Digest(invalid))},
@@ -577,3 +1280,1048 @@ func TestBadInputs(t *testing.T) {
 		}
 	}
 }
+
+func TestHistory(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := empty.Image
+	var layers []v1.Layer
+	for i, h := range []v1.History{
+		{CreatedBy: "ADD base"},
+		{CreatedBy: "ENV A=B", EmptyLayer: true},
+		{CreatedBy: "RUN make"},
+		{CreatedBy: "USER nobody", EmptyLayer: true},
+		{CreatedBy: "CMD run", EmptyLayer: true},
+		{CreatedBy: "COPY app"},
+	} {
+		add := mutate.Addendum{History: h}
+		if !h.EmptyLayer {
+			l, err := random.Layer(int64(1024*(i+1)), types.DockerLayer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			add.Layer = l
+			layers = append(layers, l)
+		}
+		img, err = mutate.Append(img, add)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ref := fmt.Sprintf("%s/test/history", u.Host)
+	if err := crane.Push(img, ref); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := crane.History(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("got %d entries, want 6", len(entries))
+	}
+	next := 0
+	for i, e := range entries {
+		if e.EmptyLayer {
+			if e.Digest != nil || e.DiffID != nil {
+				t.Errorf("entries[%d] (%s): got layer %v, want none", i, e.CreatedBy, e.Digest)
+			}
+			continue
+		}
+		l := layers[next]
+		next++
+		digest, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffID, err := l.DiffID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Digest == nil || *e.Digest != digest {
+			t.Errorf("entries[%d] (%s): Digest = %v, want %s", i, e.CreatedBy, e.Digest, digest)
+		}
+		if e.DiffID == nil || *e.DiffID != diffID {
+			t.Errorf("entries[%d] (%s): DiffID = %v, want %s", i, e.CreatedBy, e.DiffID, diffID)
+		}
+	}
+}
+
+func TestMutate(t *testing.T) {
+	var patches int32
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			atomic.AddInt32(&patches, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Env = []string{"PATH=/bin", "HOME=/root"}
+	cfg.Config.Labels = map[string]string{"keep": "me"}
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := fmt.Sprintf("%s/test/mutate:src", u.Host)
+	if err := crane.Push(img, src); err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc  string
+		opt   crane.Option
+		check func(v1.Config) bool
+	}{{
+		desc:  "labels",
+		opt:   crane.WithLabels(map[string]string{"foo": "bar"}),
+		check: func(c v1.Config) bool { return c.Labels["foo"] == "bar" && c.Labels["keep"] == "me" },
+	}, {
+		desc: "env",
+		opt:  crane.WithEnv("PATH=/usr/bin", "FOO=bar"),
+		check: func(c v1.Config) bool {
+			return reflect.DeepEqual(c.Env, []string{"PATH=/usr/bin", "HOME=/root", "FOO=bar"})
+		},
+	}, {
+		desc:  "entrypoint",
+		opt:   crane.WithEntrypoint("/bin/sh", "-c"),
+		check: func(c v1.Config) bool { return reflect.DeepEqual(c.Entrypoint, []string{"/bin/sh", "-c"}) },
+	}, {
+		desc:  "cmd",
+		opt:   crane.WithCmd("echo", "hi"),
+		check: func(c v1.Config) bool { return reflect.DeepEqual(c.Cmd, []string{"echo", "hi"}) },
+	}, {
+		desc:  "user",
+		opt:   crane.WithUser("nobody"),
+		check: func(c v1.Config) bool { return c.User == "nobody" },
+	}, {
+		desc:  "working dir",
+		opt:   crane.WithWorkingDir("/app"),
+		check: func(c v1.Config) bool { return c.WorkingDir == "/app" },
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			atomic.StoreInt32(&patches, 0)
+			dst := fmt.Sprintf("%s/test/mutate:%s", u.Host, strings.ReplaceAll(tc.desc, " ", "-"))
+			if err := crane.Mutate(src, dst, tc.opt); err != nil {
+				t.Fatalf("Mutate() = %v", err)
+			}
+			got, err := crane.Pull(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := got.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.check(cfg.Config) {
+				t.Errorf("unexpected config: %+v", cfg.Config)
+			}
+			if err := validate.Image(got); err != nil {
+				t.Errorf("validate.Image() = %v", err)
+			}
+
+			// Only the config is uploaded, and the layers are untouched.
+			if n := atomic.LoadInt32(&patches); n != 1 {
+				t.Errorf("got %d uploads, want 1", n)
+			}
+			ls, err := got.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range want {
+				wd, _ := want[i].Digest()
+				gd, _ := ls[i].Digest()
+				if wd != gd {
+					t.Errorf("layer %d = %s, want %s", i, gd, wd)
+				}
+			}
+		})
+	}
+
+	if err := crane.Mutate(src, fmt.Sprintf("%s/test/mutate:none", u.Host)); err == nil {
+		t.Error("Mutate() without changes = nil, expected error")
+	}
+}
+
+func TestLoadIncremental(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir()
+
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(base, top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseRepo := fmt.Sprintf("%s/test/base", u.Host)
+	if err := crane.Push(base, baseRepo+":latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Save the image, then drop the base image's layers from the tarball.
+	full := filepath.Join(tmp, "full.tar")
+	if err := crane.Save(img, "test/incremental", full); err != nil {
+		t.Fatal(err)
+	}
+	baseLayers, err := base.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skip := map[string]bool{}
+	for _, l := range baseLayers {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		skip[h.Hex+".tar.gz"] = true
+	}
+	incremental := filepath.Join(tmp, "incremental.tar")
+	in, err := os.Open(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(incremental)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if skip[hdr.Name] {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := crane.LoadIncremental(incremental, baseRepo)
+	if err != nil {
+		t.Fatalf("LoadIncremental() = %v", err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Errorf("validate.Image() = %v", err)
+	}
+	if err := compare.Images(img, got); err != nil {
+		t.Errorf("compare.Images() = %v", err)
+	}
+
+	// The image can be pushed without the missing layers being uploaded.
+	if err := crane.Push(got, fmt.Sprintf("%s/test/incremental:latest", u.Host)); err != nil {
+		t.Errorf("Push() = %v", err)
+	}
+
+	// The registry shares blobs between repositories, so use another one.
+	other := httptest.NewServer(registry.New())
+	defer other.Close()
+	ou, err := url.Parse(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crane.LoadIncremental(incremental, fmt.Sprintf("%s/test/base", ou.Host)); err == nil {
+		t.Error("LoadIncremental() from a repository without the layers = nil, expected error")
+	}
+}
+
+// rewriteArchive copies the tarball at src to dst, passing each entry's
+// contents through f, and dropping entries for which f returns nil.
+func rewriteArchive(t *testing.T, src, dst string, f func(name string, b []byte) []byte) {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b = f(hdr.Name, b); b == nil {
+			continue
+		}
+		hdr.Size = int64(len(b))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateDockerLoadable(t *testing.T) {
+	t.Parallel()
+	tmp := t.TempDir()
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := filepath.Join(tmp, "good.tar")
+	if err := crane.Save(img, "test/crane", good); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.ValidateDockerLoadable(good); err != nil {
+		t.Errorf("ValidateDockerLoadable(good) = %v", err)
+	}
+	legacy := filepath.Join(tmp, "legacy.tar")
+	if err := crane.SaveLegacy(img, "test/crane", legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.ValidateDockerLoadable(legacy); err != nil {
+		t.Errorf("ValidateDockerLoadable(legacy) = %v", err)
+	}
+
+	var other bytes.Buffer
+	zw := gzip.NewWriter(&other)
+	zw.Write([]byte("not the layer"))
+	zw.Close()
+
+	editManifest := func(f func([]map[string]interface{})) func(string, []byte) []byte {
+		return func(name string, b []byte) []byte {
+			if name != "manifest.json" {
+				return b
+			}
+			var m []map[string]interface{}
+			if err := json.Unmarshal(b, &m); err != nil {
+				t.Fatal(err)
+			}
+			f(m)
+			if b, err = json.Marshal(m); err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+	}
+	dropped := false
+
+	for _, tc := range []struct {
+		desc string
+		f    func(name string, b []byte) []byte
+		want error
+	}{{
+		desc: "no manifest",
+		f: func(name string, b []byte) []byte {
+			if name == "manifest.json" {
+				return nil
+			}
+			return b
+		},
+		want: crane.ErrNoManifest,
+	}, {
+		desc: "manifest is an object",
+		f: func(name string, b []byte) []byte {
+			if name == "manifest.json" {
+				return []byte("{}")
+			}
+			return b
+		},
+		want: crane.ErrInvalidManifest,
+	}, {
+		desc: "no repo tags",
+		f:    editManifest(func(m []map[string]interface{}) { delete(m[0], "RepoTags") }),
+		want: crane.ErrNoRepoTags,
+	}, {
+		desc: "invalid repo tag",
+		f:    editManifest(func(m []map[string]interface{}) { m[0]["RepoTags"] = []string{"Not A Tag"} }),
+		want: crane.ErrInvalidRepoTag,
+	}, {
+		desc: "no config",
+		f:    editManifest(func(m []map[string]interface{}) { delete(m[0], "Config") }),
+		want: crane.ErrNoConfig,
+	}, {
+		desc: "extra layer",
+		f: editManifest(func(m []map[string]interface{}) {
+			m[0]["Layers"] = append(m[0]["Layers"].([]interface{}), m[0]["Layers"].([]interface{})[0])
+		}),
+		want: crane.ErrLayerCount,
+	}, {
+		desc: "missing layer",
+		f: func(name string, b []byte) []byte {
+			if strings.HasSuffix(name, ".tar.gz") && !dropped {
+				dropped = true
+				return nil
+			}
+			return b
+		},
+		want: crane.ErrMissingFile,
+	}, {
+		desc: "wrong layer",
+		f: func(name string, b []byte) []byte {
+			if strings.HasSuffix(name, ".tar.gz") {
+				return other.Bytes()
+			}
+			return b
+		},
+		want: crane.ErrDigestMismatch,
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			bad := filepath.Join(tmp, strings.ReplaceAll(tc.desc, " ", "-")+".tar")
+			rewriteArchive(t, good, bad, tc.f)
+
+			err := crane.ValidateDockerLoadable(bad)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("ValidateDockerLoadable() = %v, want %v", err, tc.want)
+			}
+			var nl *crane.ErrNotLoadable
+			if !errors.As(err, &nl) {
+				t.Errorf("ValidateDockerLoadable() = %T, want *ErrNotLoadable", err)
+			}
+		})
+	}
+}
+
+func TestCopyRepository(t *testing.T) {
+	src := httptest.NewServer(func() http.Handler {
+		reg := registry.New()
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/manifests/broken") {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			reg.ServeHTTP(w, r)
+		})
+	}())
+	defer src.Close()
+	var uploads int32
+	dst := httptest.NewServer(func() http.Handler {
+		reg := registry.New()
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/") {
+				atomic.AddInt32(&uploads, 1)
+			}
+			reg.ServeHTTP(w, r)
+		})
+	}())
+	defer dst.Close()
+	su, err := url.Parse(src.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	du, err := url.Parse(dst.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcRepo := fmt.Sprintf("%s/test/src", su.Host)
+	dstRepo := fmt.Sprintf("%s/test/dst", du.Host)
+
+	// v1 and v2 share two layers.
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(base, top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := random.Index(1024, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"v1", "broken", "skipped"} {
+		if err := crane.Push(base, srcRepo+":"+tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := crane.Push(img, srcRepo+":v2"); err != nil {
+		t.Fatal(err)
+	}
+	idxRef, err := name.ParseReference(srcRepo + ":idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(idxRef, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := crane.WithTagFilter(func(tag string) bool { return tag != "skipped" })
+	err = crane.CopyRepository(srcRepo, dstRepo, filter)
+	var terr *crane.ErrTagsNotCopied
+	if !errors.As(err, &terr) {
+		t.Fatalf("CopyRepository() = %v, want *ErrTagsNotCopied", err)
+	}
+	if len(terr.Errors) != 1 || terr.Errors["broken"] == nil {
+		t.Errorf("failed tags = %v, want only broken", terr.Errors)
+	}
+
+	tags, err := crane.ListTags(dstRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(tags, ","), "idx,v1,v2"; got != want {
+		t.Errorf("copied tags = %s, want %s", got, want)
+	}
+	for tag, want := range map[string]interface{ Digest() (v1.Hash, error) }{"v1": base, "v2": img, "idx": idx} {
+		d, err := crane.Digest(dstRepo + ":" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, err := want.Digest(); err != nil || h.String() != d {
+			t.Errorf("%s: digest %s, want %s", tag, d, h)
+		}
+	}
+	// base: 2 layers and a config; v2: one more of each; idx: one of each.
+	if got := atomic.LoadInt32(&uploads); got != 7 {
+		t.Errorf("uploaded %d blobs, want 7", got)
+	}
+
+	if err := crane.CopyRepository(srcRepo, dstRepo, crane.WithStopOnError()); err == nil || errors.As(err, &terr) {
+		t.Errorf("CopyRepository(WithStopOnError) = %v, want the first failure", err)
+	}
+}
+
+func TestWithCreated(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := fmt.Sprintf("%s/test/created", u.Host)
+
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// build makes an image from the same layer, at a different time.
+	build := func(now time.Time) v1.Image {
+		img, err := mutate.Append(empty.Image, mutate.Addendum{
+			Layer:   layer,
+			History: v1.History{Created: v1.Time{Time: now}, CreatedBy: "build"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img, err = mutate.CreatedAt(img, v1.Time{Time: now}); err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	fixed := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, now := range []time.Time{time.Now(), time.Now().Add(time.Hour)} {
+		if err := crane.Push(build(now), fmt.Sprintf("%s:run%d", repo, i), crane.WithCreated(fixed)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := crane.Config(repo + ":run0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := crane.Config(repo + ":run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("configs differ:\n%s\n%s", first, second)
+	}
+	cf, err := v1.ParseConfigFile(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.Created.Equal(fixed) || len(cf.History) != 1 || !cf.History[0].Created.Equal(fixed) {
+		t.Errorf("created = %v, history = %v, want %v everywhere", cf.Created, cf.History, fixed)
+	}
+
+	// Without WithCreated, the times are preserved.
+	now := time.Now().Truncate(time.Second)
+	if err := crane.Push(build(now), repo+":preserved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Mutate(repo+":preserved", repo+":mutated", crane.WithCreated(fixed)); err != nil {
+		t.Fatal(err)
+	}
+	for tag, want := range map[string]time.Time{"preserved": now, "mutated": fixed} {
+		b, err := crane.Config(repo + ":" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf, err := v1.ParseConfigFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cf.Created.Equal(want) || !cf.History[0].Created.Equal(want) {
+			t.Errorf("%s: created = %v, history = %v, want %v", tag, cf.Created, cf.History, want)
+		}
+	}
+}
+
+func TestCopyWithMountRepo(t *testing.T) {
+	src := httptest.NewServer(registry.New())
+	defer src.Close()
+	srcURL, err := url.Parse(src.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	froms := map[string]string{}
+	reg := registry.New()
+	dst := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/") {
+			if mount := r.URL.Query().Get("mount"); mount != "" {
+				mu.Lock()
+				froms[mount] = r.URL.Query().Get("from")
+				mu.Unlock()
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer dst.Close()
+	dstURL, err := url.Parse(dst.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(img, fmt.Sprintf("%s/app:latest", srcURL.Host)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single-component repo isn't expanded to library/base, since the
+	// destination isn't Docker Hub.
+	if err := crane.Copy(fmt.Sprintf("%s/app:latest", srcURL.Host), fmt.Sprintf("%s/app:latest", dstURL.Host), crane.WithMountRepo("base")); err != nil {
+		t.Fatalf("Copy() = %v", err)
+	}
+
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range ls {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, ok := froms[h.String()]
+		if !ok {
+			t.Errorf("layer %s: no mount was attempted", h)
+		} else if from != "base" {
+			t.Errorf("layer %s mounted from %q, want %q", h, from, "base")
+		}
+	}
+	if _, err := crane.Digest(fmt.Sprintf("%s/app:latest", dstURL.Host)); err != nil {
+		t.Errorf("Digest() = %v", err)
+	}
+
+	if err := crane.Copy(fmt.Sprintf("%s/app:latest", srcURL.Host), fmt.Sprintf("%s/app:latest", dstURL.Host), crane.WithMountRepo("Not/Valid")); err == nil {
+		t.Error("Copy() with an invalid mount repo succeeded, expected error")
+	}
+}
+
+func TestCopyCheckpoint(t *testing.T) {
+	src := httptest.NewServer(registry.New())
+	defer src.Close()
+	srcURL, err := url.Parse(src.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		failManifests int32
+		uploads       int32
+		blobHeads     int32
+		hidden        atomic.Value // of string, the path of a blob to hide
+	)
+	hidden.Store("")
+	reg := registry.New()
+	dst := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") && atomic.LoadInt32(&failManifests) != 0:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case r.Method == http.MethodHead && r.URL.Path == hidden.Load().(string):
+			atomic.AddInt32(&blobHeads, 1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+			atomic.AddInt32(&blobHeads, 1)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/"):
+			atomic.AddInt32(&uploads, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer dst.Close()
+	dstURL, err := url.Parse(dst.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcRef := fmt.Sprintf("%s/app:latest", srcURL.Host)
+	dstRef := fmt.Sprintf("%s/mirror/app:latest", dstURL.Host)
+	if err := crane.Push(img, srcRef); err != nil {
+		t.Fatal(err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	// The copy is interrupted after the blobs are copied, before the manifest.
+	atomic.StoreInt32(&failManifests, 1)
+	if err := crane.Copy(srcRef, dstRef, crane.WithCopyCheckpoint(checkpoint)); err == nil {
+		t.Fatal("Copy() succeeded, expected the manifest PUT to fail")
+	}
+	b, err := ioutil.ReadFile(checkpoint)
+	if err != nil {
+		t.Fatalf("reading checkpoint: %v", err)
+	}
+	var state struct {
+		Repository string
+		Blobs      map[v1.Hash]int64
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%s/mirror/app", dstURL.Host); state.Repository != want {
+		t.Errorf("checkpoint repository = %q, want %q", state.Repository, want)
+	}
+	for _, d := range append([]v1.Descriptor{m.Config}, m.Layers...) {
+		if size, ok := state.Blobs[d.Digest]; !ok || size != d.Size {
+			t.Errorf("checkpoint has %s with size %d (%t), want %d", d.Digest, size, ok, d.Size)
+		}
+	}
+
+	// One of the checkpointed blobs has gone missing since, so it's the only
+	// one copied again.
+	atomic.StoreInt32(&failManifests, 0)
+	atomic.StoreInt32(&uploads, 0)
+	atomic.StoreInt32(&blobHeads, 0)
+	hidden.Store(fmt.Sprintf("/v2/mirror/app/blobs/%s", m.Layers[1].Digest))
+	if err := crane.Copy(srcRef, dstRef, crane.WithCopyCheckpoint(checkpoint)); err != nil {
+		t.Fatalf("Copy() = %v", err)
+	}
+	if got := atomic.LoadInt32(&uploads); got != 1 {
+		t.Errorf("resumed copy uploaded %d blobs, want 1", got)
+	}
+	// Each checkpointed blob is checked once, and only the missing one is
+	// checked again before it's uploaded.
+	if got, want := atomic.LoadInt32(&blobHeads), int32(len(m.Layers)+2); got != want {
+		t.Errorf("resumed copy made %d blob HEADs, want %d", got, want)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint wasn't removed: %v", err)
+	}
+	if _, err := crane.Digest(dstRef); err != nil {
+		t.Errorf("Digest() = %v", err)
+	}
+}
+
+func TestMissingBlobs(t *testing.T) {
+	// The registry shares blobs between repositories, so use two.
+	srcReg := httptest.NewServer(registry.New())
+	defer srcReg.Close()
+	su, err := url.Parse(srcReg.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstReg := httptest.NewServer(registry.New())
+	defer dstReg.Close()
+	du, err := url.Parse(dstReg.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(base, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := fmt.Sprintf("%s/test/missing/src:img", su.Host)
+	dst := fmt.Sprintf("%s/test/missing/dst", du.Host)
+	if err := crane.Push(img, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(base, dst+":base"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the new config and the extra layer need to be copied.
+	cfg, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := extra.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := crane.MissingBlobs(src, dst, crane.WithJobs(2))
+	if err != nil {
+		t.Fatalf("MissingBlobs: %v", err)
+	}
+	if want := []v1.Hash{cfg, h}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MissingBlobs = %v, want %v", got, want)
+	}
+
+	// Every image of an index is checked.
+	idx, err := random.Index(1024, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxSrc := fmt.Sprintf("%s/test/missing/src:idx", su.Host)
+	ref, err := name.ParseReference(idxSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+	got, err = crane.MissingBlobs(idxSrc, dst)
+	if err != nil {
+		t.Fatalf("MissingBlobs: %v", err)
+	}
+	// Each of the 3 images has a config and 2 layers.
+	if len(got) != 9 {
+		t.Errorf("MissingBlobs of index = %d blobs, want 9", len(got))
+	}
+	if err := crane.Copy(idxSrc, dst+":idx"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := crane.MissingBlobs(idxSrc, dst); err != nil {
+		t.Fatalf("MissingBlobs: %v", err)
+	} else if len(got) != 0 {
+		t.Errorf("MissingBlobs after Copy = %v, want none", got)
+	}
+
+	if _, err := crane.MissingBlobs(fmt.Sprintf("%s/test/missing/src:nope", su.Host), dst); err == nil {
+		t.Error("MissingBlobs() with missing image = nil, expected error")
+	}
+}
+
+func TestCopyUpToDate(t *testing.T) {
+	reg := registry.New()
+	var writes int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			atomic.AddInt32(&writes, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := fmt.Sprintf("%s/test/uptodate/src", u.Host)
+	dst := fmt.Sprintf("%s/test/uptodate/dst", u.Host)
+	if err := crane.Push(img, src); err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got crane.CopyResult
+	result := crane.WithCopyResult(func(r crane.CopyResult) { got = r })
+	if err := crane.Copy(src, dst, result); err != nil {
+		t.Fatal(err)
+	}
+	if got.UpToDate || got.Digest != want.String() {
+		t.Errorf("first Copy: got %+v, want a copy of %s", got, want)
+	}
+
+	// Copying again is a no-op.
+	atomic.StoreInt32(&writes, 0)
+	if err := crane.Copy(src, dst, result); err != nil {
+		t.Fatal(err)
+	}
+	if !got.UpToDate || got.Digest != want.String() {
+		t.Errorf("second Copy: got %+v, want up to date at %s", got, want)
+	}
+	if n := atomic.LoadInt32(&writes); n != 0 {
+		t.Errorf("second Copy made %d writes, want 0", n)
+	}
+
+	// Unless it's forced.
+	if err := crane.Copy(src, dst, result, crane.WithForce()); err != nil {
+		t.Fatal(err)
+	}
+	if got.UpToDate {
+		t.Errorf("forced Copy: got %+v, want a copy", got)
+	}
+	if n := atomic.LoadInt32(&writes); n == 0 {
+		t.Error("forced Copy made no writes")
+	}
+
+	// A different image at dst is replaced.
+	other, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(other, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Copy(src, dst, result); err != nil {
+		t.Fatal(err)
+	}
+	if got.UpToDate {
+		t.Errorf("Copy over another image: got %+v, want a copy", got)
+	}
+	if d, err := crane.Digest(dst); err != nil {
+		t.Fatal(err)
+	} else if d != want.String() {
+		t.Errorf("dst digest = %s, want %s", d, want)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := fmt.Sprintf("%s/test/attach:latest", u.Host)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(img, ref); err != nil {
+		t.Fatal(err)
+	}
+	subject, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	sig = mutate.ConfigMediaType(sig, "application/vnd.example.signature.config+json")
+	sig, err = mutate.AppendLayers(sig, static.NewLayer([]byte("signed"), "application/vnd.example.signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := crane.Attach(ref, sig)
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+
+	// The artifact was pushed with the subject.
+	pushed, err := crane.Manifest(fmt.Sprintf("%s/test/attach@%s", u.Host, got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(pushed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject == nil || m.Subject.Digest != subject {
+		t.Errorf("Subject = %v, want %s", m.Subject, subject)
+	}
+
+	// And is listed as a referrer.
+	d, err := name.NewDigest(fmt.Sprintf("%s/test/attach@%s", u.Host, subject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	referrers, err := remote.Referrers(d)
+	if err != nil {
+		t.Fatalf("Referrers: %v", err)
+	}
+	if len(referrers.Manifests) != 1 || referrers.Manifests[0].Digest.String() != got {
+		t.Errorf("Referrers = %v, want %s", referrers.Manifests, got)
+	}
+	if at := referrers.Manifests[0].ArtifactType; at != "application/vnd.example.signature.config+json" {
+		t.Errorf("ArtifactType = %q", at)
+	}
+
+	// Docker manifests can't have a subject.
+	if _, err := crane.Attach(ref, img); err == nil {
+		t.Error("Attach() with a Docker manifest = nil, expected error")
+	}
+}
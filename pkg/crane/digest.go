@@ -14,7 +14,10 @@
 
 package crane
 
-import "github.com/google/go-containerregistry/pkg/logs"
+import (
+	"github.com/google/go-containerregistry/pkg/logs"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
 
 // Digest returns the sha256 hash of the remote image at ref.
 func Digest(ref string, opt ...Option) (string, error) {
@@ -50,3 +53,16 @@ func Digest(ref string, opt ...Option) (string, error) {
 	}
 	return desc.Digest.String(), nil
 }
+
+// ManifestDigest returns the digest that img's manifest will have once it's
+// pushed, computed locally from the manifest bytes that Push uploads. Since a
+// registry identifies a manifest by the digest of exactly those bytes, this is
+// the digest it reports after the push, so e.g. a pipeline can refer to the
+// image by digest before pushing it.
+func ManifestDigest(img v1.Image) (string, error) {
+	h, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
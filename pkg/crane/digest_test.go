@@ -19,8 +19,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
@@ -59,3 +64,36 @@ func TestDigest_MissingDigest(t *testing.T) {
 		t.Errorf("Digest: expected GET to be called")
 	}
 }
+
+func TestManifestDigest(t *testing.T) {
+	reg := registry.New()
+	var pushed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg.ServeHTTP(w, r)
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+			pushed = w.Header().Get("Docker-Content-Digest")
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%v) = %v", server.URL, err)
+	}
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range []v1.Image{img, mutate.MediaType(img, types.OCIManifestSchema1)} {
+		want, err := ManifestDigest(img)
+		if err != nil {
+			t.Fatalf("ManifestDigest: %v", err)
+		}
+		if err := Push(img, fmt.Sprintf("%s/repo:latest", u.Host)); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+		if pushed != want {
+			t.Errorf("ManifestDigest: got %q, registry reported %q", want, pushed)
+		}
+	}
+}
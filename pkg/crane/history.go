@@ -0,0 +1,79 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// HistoryEntry is an entry in an image config's history, along with the layer
+// that it produced.
+type HistoryEntry struct {
+	v1.History
+
+	// Digest and DiffID identify the layer this entry produced, by its
+	// compressed and uncompressed contents respectively. They are nil for
+	// entries with EmptyLayer set, which didn't produce a layer.
+	Digest *v1.Hash
+	DiffID *v1.Hash
+}
+
+// History returns the history of the remote image ref, oldest first, with
+// each entry mapped to the layer it produced.
+func History(ref string, opt ...Option) ([]HistoryEntry, error) {
+	img, _, err := getImage(ref, opt...)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return historyEntries(cfg, m)
+}
+
+// historyEntries walks cfg's history alongside its diff IDs and m's layers,
+// skipping over empty layers.
+func historyEntries(cfg *v1.ConfigFile, m *v1.Manifest) ([]HistoryEntry, error) {
+	diffIDs := cfg.RootFS.DiffIDs
+	if len(diffIDs) != len(m.Layers) {
+		return nil, fmt.Errorf("config has %d diff ids but manifest has %d layers", len(diffIDs), len(m.Layers))
+	}
+
+	entries := make([]HistoryEntry, 0, len(cfg.History))
+	i := 0
+	for _, h := range cfg.History {
+		e := HistoryEntry{History: h}
+		if !h.EmptyLayer {
+			if i >= len(diffIDs) {
+				return nil, fmt.Errorf("history has more non-empty entries than the %d layers", len(diffIDs))
+			}
+			digest, diffID := m.Layers[i].Digest, diffIDs[i]
+			e.Digest, e.DiffID = &digest, &diffID
+			i++
+		}
+		entries = append(entries, e)
+	}
+	if len(cfg.History) != 0 && i != len(diffIDs) {
+		return nil, fmt.Errorf("history has %d non-empty entries but there are %d layers", i, len(diffIDs))
+	}
+	return entries, nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// LoadIncremental reads the single image in the tarball at src (as written
+// by Save or tarball.Write) as a v1.Image, like Load, except that the tarball
+// doesn't need to contain all of the image's layers.
+//
+// Layers that are missing from the tarball are identified by the digest in
+// their file name, and read from the repository base instead, e.g. when the
+// tarball was shipped without the layers of a base image that the recipient
+// already has. Those layers can be mounted from base when the image is pushed
+// to the same registry.
+func LoadIncremental(src, base string, opt ...Option) (v1.Image, error) {
+	o := makeOptions(opt...)
+	repo, err := name.NewRepository(base, o.Name...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing repository %q: %w", base, err)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := indexArchive(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	open := func(name string) (tarball.Opener, bool) {
+		e, ok := entries[name]
+		if !ok {
+			return nil, false
+		}
+		return func() (io.ReadCloser, error) {
+			f, err := os.Open(src)
+			if err != nil {
+				return nil, err
+			}
+			return &sectionReadCloser{
+				SectionReader: io.NewSectionReader(f, e.offset, e.size),
+				f:             f,
+			}, nil
+		}, true
+	}
+
+	mopen, ok := open("manifest.json")
+	if !ok {
+		return nil, errors.New("no manifest.json in tarball")
+	}
+	rc, err := mopen()
+	if err != nil {
+		return nil, err
+	}
+	var m tarball.Manifest
+	err = json.NewDecoder(rc).Decode(&m)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest.json: %w", err)
+	}
+	if len(m) != 1 {
+		return nil, fmt.Errorf("tarball must contain exactly one image, found %d", len(m))
+	}
+	desc := m[0]
+
+	copen, ok := open(path.Clean(desc.Config))
+	if !ok {
+		return nil, fmt.Errorf("config %s not found in tarball", desc.Config)
+	}
+	rc, err = copen()
+	if err != nil {
+		return nil, err
+	}
+	config, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	img := &incrementalImage{
+		config: config,
+		layers: map[v1.Hash]v1.Layer{},
+	}
+	ch, cs, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		return nil, err
+	}
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config: v1.Descriptor{
+			MediaType: types.DockerConfigJSON,
+			Size:      cs,
+			Digest:    ch,
+		},
+	}
+	for _, file := range desc.Layers {
+		var l v1.Layer
+		if lopen, ok := open(path.Clean(file)); ok {
+			if l, err = tarball.LayerFromOpener(lopen); err != nil {
+				return nil, fmt.Errorf("reading layer %s: %w", file, err)
+			}
+		} else {
+			h, err := digestFromName(file)
+			if err != nil {
+				return nil, fmt.Errorf("layer %s is not in the tarball: %w", file, err)
+			}
+			if l, err = remote.Layer(repo.Digest(h.String()), o.Remote...); err != nil {
+				return nil, fmt.Errorf("reading layer %s from %s: %w", h, repo, err)
+			}
+		}
+		d, err := partial.Descriptor(l)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, *d)
+		img.layers[d.Digest] = l
+	}
+	if img.manifest, err = json.Marshal(manifest); err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(img)
+}
+
+// incrementalImage implements partial.CompressedImageCore for LoadIncremental.
+type incrementalImage struct {
+	config   []byte
+	manifest []byte
+	layers   map[v1.Hash]v1.Layer
+}
+
+// RawConfigFile implements partial.CompressedImageCore.
+func (i *incrementalImage) RawConfigFile() ([]byte, error) {
+	return i.config, nil
+}
+
+// MediaType implements partial.CompressedImageCore.
+func (i *incrementalImage) MediaType() (types.MediaType, error) {
+	return types.DockerManifestSchema2, nil
+}
+
+// RawManifest implements partial.CompressedImageCore.
+func (i *incrementalImage) RawManifest() ([]byte, error) {
+	return i.manifest, nil
+}
+
+// LayerByDigest implements partial.CompressedImageCore.
+func (i *incrementalImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	if l, ok := i.layers[h]; ok {
+		return l, nil
+	}
+	return nil, fmt.Errorf("unknown blob %s", h)
+}
+
+// sectionReadCloser reads an entry of an archive, closing the archive when
+// it's closed.
+type sectionReadCloser struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (s *sectionReadCloser) Close() error {
+	return s.f.Close()
+}
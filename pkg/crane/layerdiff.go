@@ -0,0 +1,85 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// LayerDiff compares the layers of the remote images refA and refB by
+// compressed digest, returning the layers only in refA, only in refB, and in
+// both, each in the order they appear in their image.
+//
+// For example, onlyB is the set of blobs that must be copied to turn a mirror
+// of refA into a mirror of refB.
+//
+// If either reference is an index, the image for the platform given by
+// WithPlatform (linux/amd64 by default) is compared, so both sides are always
+// compared for the same platform.
+func LayerDiff(refA, refB string, opt ...Option) (onlyA, onlyB, common []v1.Hash, err error) {
+	a, err := layerDigests(refA, opt...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	b, err := layerDigests(refB, opt...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	inA := make(map[v1.Hash]bool, len(a))
+	for _, h := range a {
+		inA[h] = true
+	}
+	inB := make(map[v1.Hash]bool, len(b))
+	for _, h := range b {
+		inB[h] = true
+	}
+	for _, h := range a {
+		if inB[h] {
+			common = append(common, h)
+		} else {
+			onlyA = append(onlyA, h)
+		}
+	}
+	for _, h := range b {
+		if !inA[h] {
+			onlyB = append(onlyB, h)
+		}
+	}
+	return onlyA, onlyB, common, nil
+}
+
+// layerDigests returns the distinct layer digests of the remote image ref,
+// read from its manifest so that no layers need to be fetched.
+func layerDigests(ref string, opt ...Option) ([]v1.Hash, error) {
+	img, _, err := getImage(ref, opt...)
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[v1.Hash]bool{}
+	hs := make([]v1.Hash, 0, len(m.Layers))
+	for _, desc := range m.Layers {
+		if seen[desc.Digest] {
+			continue
+		}
+		seen[desc.Digest] = true
+		hs = append(hs, desc.Digest)
+	}
+	return hs, nil
+}
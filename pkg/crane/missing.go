@@ -0,0 +1,127 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// MissingBlobs returns the digests of the blobs that Copy would have to
+// upload to copy src into the repository dstRepo: those of src's configs and
+// layers that dstRepo doesn't have. Only manifests are read from src, and
+// dstRepo is only sent HEAD requests, up to WithJobs at a time, so it's a
+// cheap way to estimate a copy before running it.
+//
+// Like Copy, if src is an index, the blobs of all of its images are checked,
+// unless WithPlatform is given. Non-distributable layers are only checked
+// with WithNondistributable.
+func MissingBlobs(src, dstRepo string, opt ...Option) ([]v1.Hash, error) {
+	o := makeOptions(opt...)
+	srcRef, err := name.ParseReference(src, o.Name...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing reference %q: %w", src, err)
+	}
+	dst, err := name.NewRepository(dstRepo, o.Name...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing repo %q: %w", dstRepo, err)
+	}
+
+	desc, err := remote.Get(srcRef, o.Remote...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %q: %w", src, err)
+	}
+	b := &referencedBlobs{seen: map[v1.Hash]bool{}, nondistributable: o.nondistributable}
+	if desc.MediaType.IsIndex() && o.Platform == nil {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		if err := b.addIndex(idx); err != nil {
+			return nil, err
+		}
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		if err := b.addImage(img); err != nil {
+			return nil, err
+		}
+	}
+	return remote.MissingBlobs(dst, b.hs, o.Remote...)
+}
+
+// referencedBlobs collects the distinct digests of the blobs that images
+// refer to, from their manifests.
+type referencedBlobs struct {
+	hs               []v1.Hash
+	seen             map[v1.Hash]bool
+	nondistributable bool
+}
+
+func (b *referencedBlobs) add(desc v1.Descriptor) {
+	if !desc.MediaType.IsDistributable() && !b.nondistributable {
+		return
+	}
+	if b.seen[desc.Digest] {
+		return
+	}
+	b.seen[desc.Digest] = true
+	b.hs = append(b.hs, desc.Digest)
+}
+
+func (b *referencedBlobs) addImage(img v1.Image) error {
+	m, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	b.add(m.Config)
+	for _, desc := range m.Layers {
+		b.add(desc)
+	}
+	return nil
+}
+
+func (b *referencedBlobs) addIndex(idx v1.ImageIndex) error {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, desc := range im.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := b.addIndex(child); err != nil {
+				return err
+			}
+		case desc.MediaType.IsImage():
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := b.addImage(img); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// Mutate applies the config changes given by WithLabels, WithEnv,
+// WithEntrypoint, WithCmd, WithUser, WithWorkingDir and WithCreated to the
+// remote image src, and pushes the result to dst.
+//
+// Only the config is changed, so the layers of the resulting image are
+// mounted rather than uploaded when dst is in the same registry as src.
+func Mutate(src, dst string, opt ...Option) error {
+	o := makeOptions(opt...)
+	if len(o.configMutations) == 0 && o.created == nil {
+		return errors.New("no config changes given")
+	}
+
+	img, err := Pull(src, opt...)
+	if err != nil {
+		return fmt.Errorf("pulling %q: %w", src, err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	cfg = cfg.DeepCopy()
+	for _, m := range o.configMutations {
+		m(&cfg.Config)
+	}
+	mutated, err := mutate.Config(img, cfg.Config)
+	if err != nil {
+		return fmt.Errorf("mutating %q: %w", src, err)
+	}
+	return Push(mutated, dst, opt...)
+}
+
+// WithLabels is an option for Mutate that sets the given labels, replacing
+// any existing labels with the same keys.
+func WithLabels(labels map[string]string) Option {
+	return withConfigMutation(func(c *v1.Config) {
+		if c.Labels == nil {
+			c.Labels = make(map[string]string, len(labels))
+		}
+		for k, v := range labels {
+			c.Labels[k] = v
+		}
+	})
+}
+
+// WithEnv is an option for Mutate that sets environment variables, given as
+// "KEY=value". Existing variables with the same keys are replaced in place,
+// and new ones are appended.
+func WithEnv(env ...string) Option {
+	return withConfigMutation(func(c *v1.Config) {
+		for _, e := range env {
+			key := strings.SplitN(e, "=", 2)[0]
+			replaced := false
+			for i, existing := range c.Env {
+				if strings.SplitN(existing, "=", 2)[0] == key {
+					c.Env[i] = e
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				c.Env = append(c.Env, e)
+			}
+		}
+	})
+}
+
+// WithEntrypoint is an option for Mutate that replaces the entrypoint.
+func WithEntrypoint(entrypoint ...string) Option {
+	return withConfigMutation(func(c *v1.Config) {
+		c.Entrypoint = entrypoint
+	})
+}
+
+// WithCmd is an option for Mutate that replaces the command.
+func WithCmd(cmd ...string) Option {
+	return withConfigMutation(func(c *v1.Config) {
+		c.Cmd = cmd
+	})
+}
+
+// WithUser is an option for Mutate that sets the user.
+func WithUser(user string) Option {
+	return withConfigMutation(func(c *v1.Config) {
+		c.User = user
+	})
+}
+
+// WithWorkingDir is an option for Mutate that sets the working directory.
+func WithWorkingDir(dir string) Option {
+	return withConfigMutation(func(c *v1.Config) {
+		c.WorkingDir = dir
+	})
+}
+
+func withConfigMutation(f func(*v1.Config)) Option {
+	return func(o *Options) {
+		o.configMutations = append(o.configMutations, f)
+	}
+}
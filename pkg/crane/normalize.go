@@ -0,0 +1,60 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Normalize returns the canonical form of ref, so that references to the same
+// image can be compared or deduplicated. Nothing is fetched, so the result
+// doesn't tell whether the image exists. The canonical form is
+// registry/repository:tag, or registry/repository@digest, where:
+//
+//   - The registry is lowercased, since hostnames are case-insensitive, and
+//     defaults to index.docker.io, unless name.WithDefaultRegistry is among
+//     the Options' name options. docker.io is rewritten to index.docker.io.
+//   - Single-component Docker Hub repositories, like "ubuntu", are expanded
+//     to "library/ubuntu".
+//   - The tag defaults to "latest".
+//   - If ref has both a tag and a digest, the tag is dropped, since the
+//     digest alone identifies the image.
+//
+// Repositories, tags and digests are case-sensitive and aren't changed, so a
+// repository with uppercase letters is an error, as it is everywhere else.
+// For example, "Docker.io/ubuntu" and "index.docker.io/library/ubuntu:latest"
+// both normalize to "index.docker.io/library/ubuntu:latest".
+func Normalize(ref string, opt ...Option) (string, error) {
+	o := makeOptions(opt...)
+	r, err := name.ParseReference(lowerRegistry(ref), o.Name...)
+	if err != nil {
+		return "", fmt.Errorf("parsing reference %q: %w", ref, err)
+	}
+	return r.Name(), nil
+}
+
+// lowerRegistry lowercases the registry of ref, if it has one. Like
+// name.NewRepository, the first component of ref is the registry iff it
+// contains a '.' or ':'.
+func lowerRegistry(ref string) string {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && strings.ContainsAny(parts[0], ".:") {
+		return strings.ToLower(parts[0]) + "/" + parts[1]
+	}
+	return ref
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestNormalize(t *testing.T) {
+	const digest = "sha256:deadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeef"
+	for _, tc := range []struct {
+		ref  string
+		opt  []Option
+		want string
+	}{
+		{ref: "ubuntu", want: "index.docker.io/library/ubuntu:latest"},
+		{ref: "ubuntu:22.04", want: "index.docker.io/library/ubuntu:22.04"},
+		{ref: "docker.io/ubuntu", want: "index.docker.io/library/ubuntu:latest"},
+		{ref: "Docker.IO/library/ubuntu", want: "index.docker.io/library/ubuntu:latest"},
+		{ref: "index.docker.io/library/ubuntu:latest", want: "index.docker.io/library/ubuntu:latest"},
+		{ref: "jonjohnson/busybox", want: "index.docker.io/jonjohnson/busybox:latest"},
+		{ref: "GCR.io/foo/bar:TAG", want: "gcr.io/foo/bar:TAG"},
+		{ref: "localhost:5000/foo", want: "localhost:5000/foo:latest"},
+		{ref: "ubuntu@" + digest, want: "index.docker.io/library/ubuntu@" + digest},
+		{ref: "gcr.io/foo/bar:tag@" + digest, want: "gcr.io/foo/bar@" + digest},
+		{
+			ref:  "foo/bar",
+			opt:  []Option{func(o *Options) { o.Name = append(o.Name, name.WithDefaultRegistry("registry.example.com")) }},
+			want: "registry.example.com/foo/bar:latest",
+		},
+	} {
+		got, err := Normalize(tc.ref, tc.opt...)
+		if err != nil {
+			t.Errorf("Normalize(%q) = %v", tc.ref, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tc.ref, got, tc.want)
+		}
+	}
+
+	for _, ref := range []string{
+		"",
+		"Ubuntu",
+		"gcr.io/Foo/bar",
+		"ubuntu@sha256:tooshort",
+		"ubuntu:bad tag",
+	} {
+		if got, err := Normalize(ref); err == nil {
+			t.Errorf("Normalize(%q) = %q, expected error", ref, got)
+		}
+	}
+}
@@ -17,8 +17,12 @@ package crane
 import (
 	"context"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
@@ -30,6 +34,47 @@ type Options struct {
 	Remote   []remote.Option
 	Platform *v1.Platform
 	Keychain authn.Keychain
+
+	// noPrecheck disables checking that every blob exists before saving.
+	noPrecheck bool
+
+	// checkpointDir is where MultiSave downloads layers before writing.
+	checkpointDir string
+
+	// copyCheckpoint is where Copy records the blobs it has copied.
+	copyCheckpoint string
+
+	// configMutations are the changes Mutate makes to the image's config.
+	configMutations []func(*v1.Config)
+
+	// jobs is the concurrency set by WithJobs, or zero.
+	jobs int
+
+	// tagFilter, if set, selects the tags that CopyRepository copies.
+	tagFilter func(string) bool
+
+	// stopOnError makes CopyRepository stop at the first tag that fails.
+	stopOnError bool
+
+	// created, if set, is the created time that Push and Mutate set in the
+	// config and its history.
+	created *v1.Time
+
+	// mountRepo, if set, is the repository in the destination registry that
+	// Copy mounts blobs from.
+	mountRepo string
+
+	// nondistributable is set by WithNondistributable.
+	nondistributable bool
+
+	// force makes Copy copy even if the destination is up to date.
+	force bool
+
+	// copyResult, if set, is passed the outcome of each Copy.
+	copyResult func(CopyResult)
+
+	// envDefaults is set by WithEnvDefaults.
+	envDefaults bool
 }
 
 // GetOptions exposes the underlying []remote.Option, []name.Option, and
@@ -41,6 +86,16 @@ func GetOptions(opts ...Option) Options {
 }
 
 func makeOptions(opts ...Option) Options {
+	opt := applyOptions(opts)
+	if opt.envDefaults {
+		// Start over with the environment's options first, so that the ones
+		// passed explicitly take precedence.
+		opt = applyOptions(append(envOptions(), opts...))
+	}
+	return opt
+}
+
+func applyOptions(opts []Option) Options {
 	opt := Options{
 		Remote: []remote.Option{
 			remote.WithAuthFromKeychain(authn.DefaultKeychain),
@@ -53,6 +108,63 @@ func makeOptions(opts ...Option) Options {
 	return opt
 }
 
+// Environment variables that WithEnvDefaults reads.
+const (
+	// EnvInsecure, if set to a true value (as parsed by strconv.ParseBool),
+	// is equivalent to passing Insecure.
+	EnvInsecure = "CRANE_INSECURE"
+
+	// EnvPlatform, if set (e.g. "linux/arm64"), is equivalent to passing
+	// WithPlatform. See v1.ParsePlatform for the format.
+	EnvPlatform = "CRANE_PLATFORM"
+
+	// EnvJobs, if set to a positive integer, is equivalent to passing
+	// WithJobs.
+	EnvJobs = "CRANE_JOBS"
+)
+
+// WithEnvDefaults is an option that reads defaults for other options from
+// EnvInsecure, EnvPlatform and EnvJobs. They're applied before the options
+// passed explicitly, so e.g. WithPlatform overrides EnvPlatform. Invalid
+// values are logged and ignored.
+//
+// The environment is only read if this option is passed, so that programs
+// importing crane don't, e.g., disable TLS because of a variable meant for
+// the crane command.
+func WithEnvDefaults() Option {
+	return func(o *Options) {
+		o.envDefaults = true
+	}
+}
+
+// envOptions returns the Options corresponding to the environment variables
+// above.
+func envOptions() []Option {
+	opts := []Option{}
+	if s := os.Getenv(EnvInsecure); s != "" {
+		if insecure, err := strconv.ParseBool(s); err != nil {
+			logs.Warn.Printf("ignoring %s=%q: %v", EnvInsecure, s, err)
+		} else if insecure {
+			opts = append(opts, Insecure)
+		}
+	}
+	if s := os.Getenv(EnvPlatform); s != "" {
+		if platform, err := v1.ParsePlatform(s); err != nil {
+			logs.Warn.Printf("ignoring %s=%q: %v", EnvPlatform, s, err)
+		} else {
+			opts = append(opts, WithPlatform(platform))
+		}
+	}
+	if s := os.Getenv(EnvJobs); s != "" {
+		if jobs, err := strconv.Atoi(s); err != nil || jobs <= 0 {
+			logs.Warn.Printf("ignoring %s=%q: must be a positive integer", EnvJobs, s)
+		} else {
+			opts = append(opts, WithJobs(jobs))
+		}
+	}
+	return opts
+}
+
 // Option is a functional option for crane.
 type Option func(*Options)
 
@@ -116,6 +228,84 @@ func WithUserAgent(ua string) Option {
 func WithNondistributable() Option {
 	return func(o *Options) {
 		o.Remote = append(o.Remote, remote.WithNondistributable)
+		o.nondistributable = true
+	}
+}
+
+// WithJobs is a functional option for setting the number of concurrent
+// requests used when pushing. See remote.WithJobs. It also sets the number of
+// tags that CopyRepository works on at once.
+func WithJobs(jobs int) Option {
+	return func(o *Options) {
+		o.Remote = append(o.Remote, remote.WithJobs(jobs))
+		o.jobs = jobs
+	}
+}
+
+// WithoutBlobPrecheck is an option that disables checking that every layer
+// exists before MultiSave starts writing, so that a missing layer is only
+// detected once the save reaches it.
+func WithoutBlobPrecheck() Option {
+	return func(o *Options) {
+		o.noPrecheck = true
+	}
+}
+
+// WithCheckpointDir is an option that makes MultiSave resumable.
+//
+// Each layer is first downloaded to its own file in dir, and recorded in a
+// progress file once its digest has been verified. The tarball is only
+// assembled from those files once every layer is complete. If a save is
+// interrupted, running it again with the same dir skips the layers that were
+// already downloaded. Once the tarball has been written, the files that were
+// written to dir are removed, and so is dir if it didn't exist before and is
+// left empty.
+func WithCheckpointDir(dir string) Option {
+	return func(o *Options) {
+		o.checkpointDir = dir
+	}
+}
+
+// WithCopyCheckpoint is an option that makes Copy record its progress in the
+// file at path, for copies that may be interrupted, e.g. by a CI job timing
+// out.
+//
+// Each blob is recorded as soon as it's in the destination. When Copy is run
+// again with the same path and destination repository, every recorded blob is
+// first checked to still be there, and dropped from the checkpoint if it isn't.
+// The re-run then skips the recorded blobs without checking or uploading them
+// again, and copies the rest. A checkpoint for another repository is ignored.
+// The file is removed once the copy succeeds.
+func WithCopyCheckpoint(path string) Option {
+	return func(o *Options) {
+		o.copyCheckpoint = path
+	}
+}
+
+// WithTagFilter is an option that makes CopyRepository only copy the tags for
+// which keep returns true.
+func WithTagFilter(keep func(tag string) bool) Option {
+	return func(o *Options) {
+		o.tagFilter = keep
+	}
+}
+
+// WithStopOnError is an option that makes CopyRepository stop at the first
+// tag that fails to copy, rather than copying the rest and reporting all the
+// failures at the end.
+func WithStopOnError() Option {
+	return func(o *Options) {
+		o.stopOnError = true
+	}
+}
+
+// WithCreated is an option that makes Push and Mutate set the created time
+// of the image's config and of every entry in its history to t, so that
+// pushing the same layers always produces the same config, e.g. for
+// reproducible builds. By default, the times are left as they are.
+func WithCreated(t time.Time) Option {
+	return func(o *Options) {
+		o.created = &v1.Time{Time: t}
 	}
 }
 
@@ -125,3 +315,36 @@ func WithContext(ctx context.Context) Option {
 		o.Remote = append(o.Remote, remote.WithContext(ctx))
 	}
 }
+
+// WithMountRepo makes Copy mount blobs from repo, a repository in the
+// destination registry, rather than from the source, e.g. so that the layers
+// of a base image that's already been copied to "mirror/debian" are mounted
+// from there instead of uploaded again. Blobs that repo doesn't have are
+// uploaded as usual. See remote.WithMountRepository.
+//
+// repo is just the repository path, without a registry: Copy joins it to the
+// destination's registry before parsing it, so it's never mistaken for a Docker
+// Hub reference and given the implicit "library/" namespace unless the
+// destination is Docker Hub itself, where "debian" does mean "library/debian".
+func WithMountRepo(repo string) Option {
+	return func(o *Options) {
+		o.mountRepo = repo
+	}
+}
+
+// WithForce is an option that makes Copy copy src even if dst already points
+// at the same manifest, e.g. to make sure every blob is really there.
+func WithForce() Option {
+	return func(o *Options) {
+		o.force = true
+	}
+}
+
+// WithCopyResult is an option that passes what Copy did to f, once it has
+// succeeded, e.g. so a mirror job can report which images were already up to
+// date.
+func WithCopyResult(f func(CopyResult)) Option {
+	return func(o *Options) {
+		o.copyResult = f
+	}
+}
@@ -17,14 +17,19 @@ package crane
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 
 	legacy "github.com/google/go-containerregistry/pkg/legacy/tarball"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"golang.org/x/sync/errgroup"
 )
 
 // Tag applied to images that were pulled by digest. This denotes that the
@@ -32,6 +37,9 @@ import (
 // ":latest" tag which might be misleading.
 const iWasADigestTag = "i-was-a-digest"
 
+// The number of layers to check concurrently before saving.
+const precheckJobs = 8
+
 // Pull returns a v1.Image of the remote image src.
 func Pull(src string, opt ...Option) (v1.Image, error) {
 	o := makeOptions(opt...)
@@ -74,10 +82,87 @@ func MultiSave(imgMap map[string]v1.Image, path string, opt ...Option) error {
 		}
 		tagToImage[tag] = img
 	}
+	if !o.noPrecheck {
+		imgs := make([]v1.Image, 0, len(tagToImage))
+		for _, img := range tagToImage {
+			imgs = append(imgs, img)
+		}
+		if err := checkLayersExist(imgs); err != nil {
+			return err
+		}
+	}
+	if o.checkpointDir != "" {
+		c, err := newCheckpointer(o.checkpointDir)
+		if err != nil {
+			return err
+		}
+		if tagToImage, err = c.images(tagToImage); err != nil {
+			return err
+		}
+		if err := tarball.MultiWriteToFile(path, tagToImage); err != nil {
+			return err
+		}
+		return c.cleanup()
+	}
 	// no progress channel (for now)
 	return tarball.MultiWriteToFile(path, tagToImage)
 }
 
+// checkLayersExist concurrently checks that every layer of imgs exists,
+// returning an error that lists all of the missing layers.
+func checkLayersExist(imgs []v1.Image) error {
+	layers := map[v1.Hash]v1.Layer{}
+	for _, img := range imgs {
+		if img == nil {
+			// Let the writer report this.
+			continue
+		}
+		ls, err := img.Layers()
+		if err != nil {
+			return err
+		}
+		for _, l := range ls {
+			h, err := l.Digest()
+			if err != nil {
+				return err
+			}
+			layers[h] = l
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		missing []string
+	)
+	var g errgroup.Group
+	g.SetLimit(precheckJobs)
+	for h, l := range layers {
+		h, l := h, l
+		g.Go(func() error {
+			ok, err := partial.Exists(l)
+			if err == nil && ok {
+				return nil
+			}
+			msg := h.String()
+			if err != nil {
+				msg = fmt.Sprintf("%s (%v)", h, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			missing = append(missing, msg)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%d layers are missing: %s", len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 // PullLayer returns the given layer from a registry.
 func PullLayer(ref string, opt ...Option) (v1.Layer, error) {
 	o := makeOptions(opt...)
@@ -125,6 +210,12 @@ func SaveOCI(img v1.Image, path string) error {
 
 // MultiSaveOCI writes collection of v1.Image img as an OCI Image Layout at path. If a layout
 // already exists at that path, it will add the image to the index.
+//
+// Each blob is written to blobs/<algorithm>/<hex>, and blobs that are already
+// present in the layout with the right digest are skipped; ones whose contents
+// don't match their digest are rewritten. Images whose manifest is already
+// referenced by the index are not added again, so saving the same images to
+// the same path more than once is idempotent.
 func MultiSaveOCI(imgMap map[string]v1.Image, path string) error {
 	p, err := layout.FromPath(path)
 	if err != nil {
@@ -133,10 +224,34 @@ func MultiSaveOCI(imgMap map[string]v1.Image, path string) error {
 			return err
 		}
 	}
+	ii, err := p.ImageIndex()
+	if err != nil {
+		return err
+	}
+	im, err := ii.IndexManifest()
+	if err != nil {
+		return err
+	}
+	existing := map[v1.Hash]bool{}
+	for _, desc := range im.Manifests {
+		existing[desc.Digest] = true
+	}
 	for _, img := range imgMap {
+		d, err := img.Digest()
+		if err != nil {
+			return err
+		}
+		if existing[d] {
+			// Still write the image, in case any blobs are missing.
+			if err := p.WriteImage(img); err != nil {
+				return err
+			}
+			continue
+		}
 		if err = p.AppendImage(img); err != nil {
 			return err
 		}
+		existing[d] = true
 	}
 	return nil
 }
@@ -19,6 +19,7 @@ import (
 
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
@@ -44,12 +45,19 @@ func LoadTag(path, tag string, opt ...Option) (v1.Image, error) {
 }
 
 // Push pushes the v1.Image img to a registry as dst.
+//
+// See WithCreated to set the image's created times first.
 func Push(img v1.Image, dst string, opt ...Option) error {
 	o := makeOptions(opt...)
 	tag, err := name.ParseReference(dst, o.Name...)
 	if err != nil {
 		return fmt.Errorf("parsing reference %q: %w", dst, err)
 	}
+	if o.created != nil {
+		if img, err = mutate.CreatedAtAll(img, *o.created); err != nil {
+			return fmt.Errorf("setting created time: %w", err)
+		}
+	}
 	return remote.Write(tag, img, o.Remote...)
 }
 
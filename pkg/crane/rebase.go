@@ -0,0 +1,48 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// Rebase replaces the layers of oldBase in the remote image orig with the
+// layers of newBase, and pushes the result to dst.
+//
+// The layers of the resulting image retain references to the images they were
+// pulled from, so when dst is in the same registry as orig and newBase, those
+// layers will be mounted rather than uploaded.
+func Rebase(orig, oldBase, newBase, dst string, opt ...Option) error {
+	origImg, err := Pull(orig, opt...)
+	if err != nil {
+		return fmt.Errorf("pulling original %q: %w", orig, err)
+	}
+	oldBaseImg, err := Pull(oldBase, opt...)
+	if err != nil {
+		return fmt.Errorf("pulling old base %q: %w", oldBase, err)
+	}
+	newBaseImg, err := Pull(newBase, opt...)
+	if err != nil {
+		return fmt.Errorf("pulling new base %q: %w", newBase, err)
+	}
+
+	rebased, err := mutate.Rebase(origImg, oldBaseImg, newBaseImg)
+	if err != nil {
+		return fmt.Errorf("rebasing %q from old base %q: %w", orig, oldBase, err)
+	}
+	return Push(rebased, dst, opt...)
+}
@@ -0,0 +1,402 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crane
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/internal/gzip"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"golang.org/x/sync/errgroup"
+)
+
+// The number of archive entries to hash concurrently in VerifyArchive.
+const verifyJobs = 8
+
+// archiveEntry is the location of a regular file's contents within a tar.
+type archiveEntry struct {
+	offset, size int64
+}
+
+// VerifyArchive checks that every config and layer referenced by the
+// manifest.json of the tarball at path (as written by Save, MultiSave or
+// tarball.Write) has the digest it is expected to have.
+//
+// Configs and layers are expected to match the digest encoded in their file
+// name. Layers whose file names don't encode a digest, as in tarballs produced
+// by `docker save`, are expected to match the corresponding diff ID in the
+// image's config.
+//
+// Entries are hashed concurrently, and all mismatches are reported rather
+// than just the first.
+func VerifyArchive(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := indexArchive(f)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	mf, ok := entries["manifest.json"]
+	if !ok {
+		return fmt.Errorf("%s: manifest.json not found", path)
+	}
+	var m tarball.Manifest
+	if err := json.NewDecoder(io.NewSectionReader(f, mf.offset, mf.size)).Decode(&m); err != nil {
+		return fmt.Errorf("parsing manifest.json: %w", err)
+	}
+
+	want := map[string]v1.Hash{}
+	var problems []string
+	for _, desc := range m {
+		ce, ok := entries[desc.Config]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing", desc.Config))
+			continue
+		}
+		h, err := digestFromName(desc.Config)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", desc.Config, err))
+		} else {
+			want[desc.Config] = h
+		}
+
+		var diffIDs []v1.Hash
+		if cfg, err := v1.ParseConfigFile(io.NewSectionReader(f, ce.offset, ce.size)); err == nil {
+			diffIDs = cfg.RootFS.DiffIDs
+		}
+		for i, l := range desc.Layers {
+			if _, ok := entries[l]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing", l))
+				continue
+			}
+			h, err := digestFromName(l)
+			if err != nil {
+				if i >= len(diffIDs) {
+					problems = append(problems, fmt.Sprintf("%s: %v", l, err))
+					continue
+				}
+				h = diffIDs[i]
+			}
+			want[l] = h
+		}
+	}
+
+	var mu sync.Mutex
+	var g errgroup.Group
+	g.SetLimit(verifyJobs)
+	for name, h := range want {
+		name, h := name, h
+		e := entries[name]
+		g.Go(func() error {
+			got, _, err := v1.SHA256(io.NewSectionReader(f, e.offset, e.size))
+			if err != nil {
+				return fmt.Errorf("hashing %s: %w", name, err)
+			}
+			if got != h {
+				mu.Lock()
+				defer mu.Unlock()
+				problems = append(problems, fmt.Sprintf("%s: got %s, want %s", name, got, h))
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%d entries failed verification: %s", len(problems), strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// indexArchive records where the contents of each regular file in the tar
+// read from f start, so that they can be hashed concurrently later.
+func indexArchive(f *os.File) (map[string]archiveEntry, error) {
+	entries := map[string]archiveEntry{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The tar.Reader has consumed the header, so the file's current
+		// position is the start of this entry's contents.
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		entries[path.Clean(hdr.Name)] = archiveEntry{offset: offset, size: hdr.Size}
+	}
+}
+
+// digestFromName parses the digest out of an archive entry's file name, e.g.
+// "sha256:abc..." for configs or "abc....tar.gz" for layers.
+func digestFromName(name string) (v1.Hash, error) {
+	base := path.Base(name)
+	for _, ext := range []string{".tar.gz", ".tar", ".json"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+	if !strings.Contains(base, ":") {
+		base = "sha256:" + base
+	}
+	h, err := v1.NewHash(base)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("file name doesn't encode a digest: %w", err)
+	}
+	return h, nil
+}
+
+// Problems found by ValidateDockerLoadable. Use errors.Is to check whether
+// the error it returns includes one of them.
+var (
+	// ErrNoManifest means the archive has no manifest.json.
+	ErrNoManifest = errors.New("manifest.json not found")
+
+	// ErrInvalidManifest means manifest.json isn't a non-empty JSON array of
+	// images, as written by `docker save`.
+	ErrInvalidManifest = errors.New("manifest.json is not a docker save manifest")
+
+	// ErrNoConfig means an image in manifest.json has no Config.
+	ErrNoConfig = errors.New("image has no Config")
+
+	// ErrNoRepoTags means an image in manifest.json has no RepoTags, so
+	// docker would load it untagged.
+	ErrNoRepoTags = errors.New("image has no RepoTags")
+
+	// ErrInvalidRepoTag means a RepoTags entry isn't a valid tag.
+	ErrInvalidRepoTag = errors.New("invalid repo tag")
+
+	// ErrMissingFile means a file referenced by manifest.json isn't in the
+	// archive.
+	ErrMissingFile = errors.New("referenced file is missing")
+
+	// ErrInvalidConfig means an image's config can't be parsed.
+	ErrInvalidConfig = errors.New("invalid config")
+
+	// ErrLayerCount means an image has a different number of layers than
+	// diff IDs in its config.
+	ErrLayerCount = errors.New("number of layers doesn't match the config's diff IDs")
+
+	// ErrDigestMismatch means a config doesn't match the digest in its file
+	// name, or a layer doesn't match the corresponding diff ID in the
+	// image's config.
+	ErrDigestMismatch = errors.New("digest mismatch")
+)
+
+// ArchiveProblem is one reason that an archive can't be loaded by docker.
+type ArchiveProblem struct {
+	// Entry is the file in the archive the problem is with, if any.
+	Entry string
+
+	// Err is one of the problems listed above, possibly wrapped with more
+	// detail.
+	Err error
+}
+
+func (p ArchiveProblem) String() string {
+	if p.Entry == "" {
+		return p.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", p.Entry, p.Err)
+}
+
+// ErrNotLoadable is returned by ValidateDockerLoadable, listing every problem
+// it found.
+type ErrNotLoadable struct {
+	Problems []ArchiveProblem
+}
+
+// Error implements error.
+func (e *ErrNotLoadable) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		problems = append(problems, p.String())
+	}
+	return fmt.Sprintf("archive can't be loaded by docker: %s", strings.Join(problems, "; "))
+}
+
+// Is reports whether any of e's problems is target.
+func (e *ErrNotLoadable) Is(target error) bool {
+	for _, p := range e.Problems {
+		if errors.Is(p.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateDockerLoadable checks that the tarball at path is structurally what
+// `docker load` expects, returning an *ErrNotLoadable listing any problems.
+//
+// It checks that manifest.json is an array of images, each with a Config,
+// Layers and RepoTags, that every referenced file exists, that each config
+// matches the digest in its file name (if it has one), and that each layer,
+// once decompressed, matches the corresponding diff ID in its image's config,
+// which is what docker itself verifies.
+func ValidateDockerLoadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := indexArchive(f)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	section := func(e archiveEntry) *io.SectionReader {
+		return io.NewSectionReader(f, e.offset, e.size)
+	}
+
+	var (
+		mu       sync.Mutex
+		problems []ArchiveProblem
+	)
+	report := func(entry string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		problems = append(problems, ArchiveProblem{Entry: entry, Err: err})
+	}
+	done := func() error {
+		if len(problems) == 0 {
+			return nil
+		}
+		sort.SliceStable(problems, func(i, j int) bool {
+			return problems[i].Entry < problems[j].Entry
+		})
+		return &ErrNotLoadable{Problems: problems}
+	}
+
+	mf, ok := entries["manifest.json"]
+	if !ok {
+		report("", ErrNoManifest)
+		return done()
+	}
+	var m tarball.Manifest
+	if err := json.NewDecoder(section(mf)).Decode(&m); err != nil {
+		report("manifest.json", fmt.Errorf("%w: %v", ErrInvalidManifest, err))
+		return done()
+	}
+	if len(m) == 0 {
+		report("manifest.json", fmt.Errorf("%w: no images", ErrInvalidManifest))
+		return done()
+	}
+
+	// The layers to check, with the diff ID each is expected to have.
+	want := map[string]v1.Hash{}
+	for i, desc := range m {
+		image := fmt.Sprintf("manifest.json[%d]", i)
+		if len(desc.RepoTags) == 0 {
+			report(image, ErrNoRepoTags)
+		}
+		for _, tag := range desc.RepoTags {
+			if _, err := name.NewTag(tag); err != nil {
+				report(image, fmt.Errorf("%w %q: %v", ErrInvalidRepoTag, tag, err))
+			}
+		}
+		for _, l := range desc.Layers {
+			if _, ok := entries[l]; !ok {
+				report(l, ErrMissingFile)
+			}
+		}
+
+		if desc.Config == "" {
+			report(image, ErrNoConfig)
+			continue
+		}
+		ce, ok := entries[desc.Config]
+		if !ok {
+			report(desc.Config, ErrMissingFile)
+			continue
+		}
+		if h, err := digestFromName(desc.Config); err == nil {
+			if got, _, err := v1.SHA256(section(ce)); err != nil {
+				return fmt.Errorf("hashing %s: %w", desc.Config, err)
+			} else if got != h {
+				report(desc.Config, fmt.Errorf("%w: got %s, want %s", ErrDigestMismatch, got, h))
+			}
+		}
+		cfg, err := v1.ParseConfigFile(section(ce))
+		if err != nil {
+			report(desc.Config, fmt.Errorf("%w: %v", ErrInvalidConfig, err))
+			continue
+		}
+		diffIDs := cfg.RootFS.DiffIDs
+		if len(diffIDs) != len(desc.Layers) {
+			report(image, fmt.Errorf("%w: %d layers, %d diff IDs", ErrLayerCount, len(desc.Layers), len(diffIDs)))
+			continue
+		}
+		for j, l := range desc.Layers {
+			if _, ok := entries[l]; ok {
+				want[l] = diffIDs[j]
+			}
+		}
+	}
+
+	var g errgroup.Group
+	g.SetLimit(verifyJobs)
+	for name, h := range want {
+		name, h := name, h
+		e := entries[name]
+		g.Go(func() error {
+			// docker accepts both compressed and uncompressed layers.
+			var rc io.ReadCloser = ioutil.NopCloser(section(e))
+			if compressed, err := gzip.Is(section(e)); err != nil {
+				return fmt.Errorf("reading %s: %w", name, err)
+			} else if compressed {
+				if rc, err = gzip.UnzipReadCloser(rc); err != nil {
+					report(name, fmt.Errorf("%w: %v", ErrDigestMismatch, err))
+					return nil
+				}
+			}
+			defer rc.Close()
+			got, _, err := v1.SHA256(rc)
+			if err != nil {
+				report(name, fmt.Errorf("%w: %v", ErrDigestMismatch, err))
+			} else if got != h {
+				report(name, fmt.Errorf("%w: got diff ID %s, want %s", ErrDigestMismatch, got, h))
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return done()
+}
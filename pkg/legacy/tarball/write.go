@@ -29,7 +29,9 @@ import (
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/static"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 // repositoriesTarDescriptor represents the repositories file inside a `docker save` tarball.
@@ -164,9 +166,29 @@ func updateLayerSources(layerSources map[v1.Hash]v1.Descriptor, layer v1.Layer,
 	return nil
 }
 
+// WriteOption is a functional option for Write and MultiWrite.
+type WriteOption func(*writeOptions) error
+
+type writeOptions struct {
+	emptyLayers bool
+}
+
+// WithEmptyLayers is a WriteOption that also writes a layer directory for
+// each entry of the image's history that is marked empty_layer, as docker
+// save does for images built by older versions of docker. Their layer.tar is
+// an empty tarball, their json is marked throwaway, and they're part of the
+// chain of parent layer IDs, so the layer directories correspond one to one
+// with the history. manifest.json still only lists the image's actual layers.
+func WithEmptyLayers() WriteOption {
+	return func(o *writeOptions) error {
+		o.emptyLayers = true
+		return nil
+	}
+}
+
 // Write is a wrapper to write a single image in V1 format and tag to a tarball.
-func Write(ref name.Reference, img v1.Image, w io.Writer) error {
-	return MultiWrite(map[name.Reference]v1.Image{ref: img}, w)
+func Write(ref name.Reference, img v1.Image, w io.Writer, opts ...WriteOption) error {
+	return MultiWrite(map[name.Reference]v1.Image{ref: img}, w, opts...)
 }
 
 // filterEmpty filters out the history corresponding to empty layers from the
@@ -182,6 +204,33 @@ func filterEmpty(h []v1.History) []v1.History {
 	return result
 }
 
+// emptyLayer is the layer.tar written for empty layers: an empty tarball,
+// i.e. just the two zero blocks that end one.
+var emptyLayer = static.NewLayer(make([]byte, 1024), types.DockerUncompressedLayer)
+
+// historyLayer is a layer to write, along with its history.
+type historyLayer struct {
+	layer   v1.Layer
+	history v1.History
+	empty   bool
+}
+
+// withEmptyLayers interleaves layers, which have the non-empty entries of
+// history, with emptyLayer for each of the empty entries.
+func withEmptyLayers(layers []v1.Layer, history []v1.History) []historyLayer {
+	result := make([]historyLayer, 0, len(history))
+	next := 0
+	for _, h := range history {
+		if h.EmptyLayer {
+			result = append(result, historyLayer{layer: emptyLayer, history: h, empty: true})
+			continue
+		}
+		result = append(result, historyLayer{layer: layers[next], history: h})
+		next++
+	}
+	return result
+}
+
 // MultiWrite writes the contents of each image to the provided reader, in the V1 image tarball format.
 // The contents are written in the following format:
 // One manifest.json file at the top level containing information about several images.
@@ -191,7 +240,16 @@ func filterEmpty(h []v1.History) []v1.History {
 //   <layer id>.json- Layer metadata json.
 //   VERSION- Schema version string. Always set to "1.0".
 // One file for the config blob, named after its SHA.
-func MultiWrite(refToImage map[name.Reference]v1.Image, w io.Writer) error {
+//
+// See WithEmptyLayers to also write directories for empty layers.
+func MultiWrite(refToImage map[name.Reference]v1.Image, w io.Writer, opts ...WriteOption) error {
+	o := &writeOptions{}
+	for _, option := range opts {
+		if err := option(o); err != nil {
+			return err
+		}
+	}
+
 	tf := tar.NewWriter(w)
 	defer tf.Close()
 
@@ -236,22 +294,35 @@ func MultiWrite(refToImage map[name.Reference]v1.Image, w io.Writer) error {
 		} else if len(layers) != len(history) {
 			return fmt.Errorf("image config had layer history which did not match the number of layers, got len(history)=%d, len(layers)=%d, want len(history)=len(layers)", len(history), len(layers))
 		}
-		layerFiles := make([]string, len(layers))
-		var prev *v1Layer
+		entries := make([]historyLayer, len(layers))
 		for i, l := range layers {
-			if err := updateLayerSources(layerSources, l, img); err != nil {
-				return fmt.Errorf("unable to update image metadata to include undistributable layer source information: %w", err)
+			entries[i] = historyLayer{layer: l, history: history[i]}
+		}
+		if nonEmpty := filterEmpty(cfg.History); o.emptyLayers && len(nonEmpty) == len(layers) && len(nonEmpty) != len(cfg.History) {
+			entries = withEmptyLayers(layers, cfg.History)
+		}
+		layerFiles := make([]string, 0, len(layers))
+		var prev *v1Layer
+		for i, e := range entries {
+			l := e.layer
+			if !e.empty {
+				if err := updateLayerSources(layerSources, l, img); err != nil {
+					return fmt.Errorf("unable to update image metadata to include undistributable layer source information: %w", err)
+				}
 			}
 			var cur *v1Layer
-			if i < (len(layers) - 1) {
-				cur, err = newV1Layer(l, prev, history[i])
+			if i < (len(entries) - 1) {
+				cur, err = newV1Layer(l, prev, e.history)
 			} else {
-				cur, err = newTopV1Layer(l, prev, history[i], cfg, cfgBlob)
+				cur, err = newTopV1Layer(l, prev, e.history, cfg, cfgBlob)
 			}
 			if err != nil {
 				return err
 			}
-			layerFiles[i] = fmt.Sprintf("%s/layer.tar", cur.config.ID)
+			layerFile := fmt.Sprintf("%s/layer.tar", cur.config.ID)
+			if !e.empty {
+				layerFiles = append(layerFiles, layerFile)
+			}
 			if _, ok := seenLayerIDs[cur.config.ID]; ok {
 				prev = cur
 				continue
@@ -270,7 +341,7 @@ func MultiWrite(refToImage map[name.Reference]v1.Image, w io.Writer) error {
 				return err
 			}
 			defer u.Close()
-			if err := writeTarEntry(tf, layerFiles[i], u, size); err != nil {
+			if err := writeTarEntry(tf, layerFile, u, size); err != nil {
 				return err
 			}
 
@@ -16,6 +16,7 @@ package tarball
 
 import (
 	"archive/tar"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -25,7 +26,9 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/internal/compare"
+	"github.com/google/go-containerregistry/pkg/legacy"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
@@ -373,6 +376,122 @@ func TestMultiWriteHistoryEmptyLayers(t *testing.T) {
 	}
 }
 
+func TestMultiWriteWithEmptyLayers(t *testing.T) {
+	h := []v1.History{
+		{EmptyLayer: true, CreatedBy: "ENV A=b"},
+		{EmptyLayer: false, CreatedBy: "ADD a /"},
+		{EmptyLayer: true, CreatedBy: "WORKDIR /a"},
+		{EmptyLayer: false, CreatedBy: "ADD b /"},
+		{EmptyLayer: true, CreatedBy: "CMD [\"b\"]"},
+	}
+	img, err := random.Image(256, int64(len(filterEmpty(h))))
+	if err != nil {
+		t.Fatalf("Error creating random image: %v", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("Error getting image config: %v", err)
+	}
+	cfg.History = h
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag("gcr.io/foo/bar:latest", name.StrictValidation)
+	if err != nil {
+		t.Fatalf("Error creating test tag: %v", err)
+	}
+	fp, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	defer fp.Close()
+	defer os.Remove(fp.Name())
+	if err := Write(tag, img, fp, WithEmptyLayers()); err != nil {
+		t.Fatalf("Unexpected error writing tarball: %v", err)
+	}
+
+	// There's a layer directory for each entry in the history, chained by
+	// their parent IDs in the same order.
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	layers := map[string]legacy.LayerConfigFile{}
+	sizes := map[string]int64{}
+	tr := tar.NewReader(fp)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, file := filepath.Split(hdr.Name)
+		switch file {
+		case "json":
+			var lc legacy.LayerConfigFile
+			if err := json.NewDecoder(tr).Decode(&lc); err != nil {
+				t.Fatal(err)
+			}
+			layers[lc.ID] = lc
+		case "layer.tar":
+			sizes[filepath.Clean(dir)] = hdr.Size
+		}
+	}
+	if len(layers) != len(h) {
+		t.Fatalf("wrote %d layer directories, want %d", len(layers), len(h))
+	}
+	var top string
+	for id := range layers {
+		if !hasChild(layers, id) {
+			top = id
+		}
+	}
+	for i := len(h) - 1; i >= 0; i-- {
+		lc, ok := layers[top]
+		if !ok {
+			t.Fatalf("history[%d]: missing layer %q", i, top)
+		}
+		if lc.Throwaway != h[i].EmptyLayer {
+			t.Errorf("history[%d]: throwaway = %t, want %t", i, lc.Throwaway, h[i].EmptyLayer)
+		}
+		if got, want := lc.ContainerConfig.Cmd, []string{h[i].CreatedBy}; !cmp.Equal(got, want) {
+			t.Errorf("history[%d]: cmd = %v, want %v", i, got, want)
+		}
+		if h[i].EmptyLayer && sizes[top] != 1024 {
+			t.Errorf("history[%d]: layer.tar has %d bytes, want an empty tarball", i, sizes[top])
+		}
+		top = lc.Parent
+	}
+
+	// The image can still be read, with just its two layers.
+	tarImage, err := tarball.ImageFromPath(fp.Name(), &tag)
+	if err != nil {
+		t.Fatalf("Unexpected error reading tarball: %v", err)
+	}
+	if err := validate.Image(tarImage); err != nil {
+		t.Fatalf("validate.Image(): %v", err)
+	}
+	tarLayers, err := tarImage.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tarLayers) != 2 {
+		t.Errorf("read %d layers, want 2", len(tarLayers))
+	}
+}
+
+// hasChild returns true if any layer has id as its parent.
+func hasChild(layers map[string]legacy.LayerConfigFile, id string) bool {
+	for _, lc := range layers {
+		if lc.Parent == id {
+			return true
+		}
+	}
+	return false
+}
+
 func TestMultiWriteMismatchedHistory(t *testing.T) {
 	// Make a random image
 	img, err := random.Image(256, 8)
@@ -0,0 +1,36 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package empty
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// JSON is the well-known empty JSON blob, "{}", that OCI artifacts without a
+// meaningful config, e.g. signatures and SBOMs, use as their config.
+var JSON = static.NewLayer([]byte("{}"), types.OCIEmptyJSON)
+
+// JSONDescriptor is the descriptor of JSON, e.g. for the config of an artifact
+// written with remote.WriteManifestFromDescriptors.
+var JSONDescriptor = v1.Descriptor{
+	MediaType: types.OCIEmptyJSON,
+	Size:      2,
+	Digest: v1.Hash{
+		Algorithm: "sha256",
+		Hex:       "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+	},
+}
@@ -23,6 +23,7 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Hash is an unqualified digest of some content, e.g. sha256:deadbeef
@@ -74,14 +75,42 @@ func (h *Hash) UnmarshalText(text []byte) error {
 	return h.parse(string(text))
 }
 
+var (
+	hashersLock sync.RWMutex
+	hashers     = map[string]func() hash.Hash{}
+)
+
+// RegisterHasher makes the named digest algorithm available to NewHash and
+// Hasher, which allows blobs referenced by digests other than sha256 to be
+// parsed and verified. The name is the algorithm portion of the digest, e.g.
+// "sha512" in "sha512:<hex>", and the returned hash.Hash must produce the
+// digest's bytes, which are compared to its hex encoding.
+//
+// The sha256 algorithm is always supported and cannot be replaced.
+func RegisterHasher(name string, f func() hash.Hash) {
+	if name == "sha256" {
+		panic("v1: sha256 hasher cannot be replaced")
+	}
+	if f == nil {
+		panic("v1: RegisterHasher called with nil func for " + name)
+	}
+	hashersLock.Lock()
+	defer hashersLock.Unlock()
+	hashers[name] = f
+}
+
 // Hasher returns a hash.Hash for the named algorithm (e.g. "sha256")
 func Hasher(name string) (hash.Hash, error) {
-	switch name {
-	case "sha256":
+	if name == "sha256" {
 		return sha256.New(), nil
-	default:
+	}
+	hashersLock.RLock()
+	f, ok := hashers[name]
+	hashersLock.RUnlock()
+	if !ok {
 		return nil, fmt.Errorf("unsupported hash: %q", name)
 	}
+	return f(), nil
 }
 
 func (h *Hash) parse(unquoted string) error {
@@ -15,6 +15,8 @@
 package v1
 
 import (
+	"crypto/sha512"
+	"encoding/hex"
 	"encoding/json"
 	"strconv"
 	"strings"
@@ -113,3 +115,36 @@ func TestTextMarshalling(t *testing.T) {
 		t.Errorf("mismatched hash: %s != %s", h, g)
 	}
 }
+
+func TestRegisterHasher(t *testing.T) {
+	input := "asdf"
+	sum := sha512.Sum512([]byte(input))
+	s := "sha512:" + hex.EncodeToString(sum[:])
+
+	if _, err := NewHash(s); err == nil {
+		t.Fatal("NewHash() with unregistered algorithm succeeded")
+	}
+
+	RegisterHasher("sha512", sha512.New)
+
+	h, err := NewHash(s)
+	if err != nil {
+		t.Fatalf("NewHash() = %v", err)
+	}
+	if got, want := h.String(), s; got != want {
+		t.Errorf("String(); got %q, want %q", got, want)
+	}
+	hasher, err := Hasher(h.Algorithm)
+	if err != nil {
+		t.Fatalf("Hasher() = %v", err)
+	}
+	hasher.Write([]byte(input))
+	if got, want := hex.EncodeToString(hasher.Sum(nil)), h.Hex; got != want {
+		t.Errorf("Sum(); got %q, want %q", got, want)
+	}
+
+	// Wrong length for the registered algorithm.
+	if _, err := NewHash("sha512:" + strings.Repeat("a", 64)); err == nil {
+		t.Error("NewHash() with wrong length succeeded")
+	}
+}
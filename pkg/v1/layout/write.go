@@ -16,6 +16,7 @@ package layout
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -196,6 +197,24 @@ func (l Path) WriteBlob(hash v1.Hash, r io.ReadCloser) error {
 	return l.writeBlob(hash, -1, r, nil)
 }
 
+// blobMatches returns whether the contents of file have the digest hash. Blobs
+// with a digest algorithm we can't compute are assumed to match.
+func blobMatches(file string, hash v1.Hash) (bool, error) {
+	hasher, err := v1.Hasher(hash.Algorithm)
+	if err != nil {
+		return true, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)) == hash.Hex, nil
+}
+
 func (l Path) writeBlob(hash v1.Hash, size int64, rc io.ReadCloser, renamer func() (v1.Hash, error)) error {
 	if hash.Hex == "" && renamer == nil {
 		panic("writeBlob called an invalid hash and no renamer")
@@ -206,10 +225,20 @@ func (l Path) writeBlob(hash v1.Hash, size int64, rc io.ReadCloser, renamer func
 		return err
 	}
 
-	// Check if blob already exists and is the correct size
+	// Check if blob already exists and is the correct size. If we know the
+	// size, we're writing a layer, so also check its digest and rewrite it if
+	// it's been corrupted in place.
 	file := filepath.Join(dir, hash.Hex)
 	if s, err := os.Stat(file); err == nil && !s.IsDir() && (s.Size() == size || size == -1) {
-		return nil
+		if size == -1 {
+			return nil
+		}
+		if ok, err := blobMatches(file, hash); err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+		logs.Warn.Printf("existing blob %s doesn't match its digest, rewriting it", hash)
 	}
 
 	// If a renamer func was provided write to a temporary file
@@ -641,6 +641,50 @@ func TestOverwriteWithWriteLayer(t *testing.T) {
 	}
 }
 
+func TestOverwriteCorruptedWithWriteLayer(t *testing.T) {
+	l, err := Write(t.TempDir(), empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.writeLayer(layer); err != nil {
+		t.Fatalf("(Path).writeLayer() = %v", err)
+	}
+	h, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the blob without changing its size.
+	b, err := l.Bytes(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := ioutil.WriteFile(l.path("blobs", h.Algorithm, h.Hex), b, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.writeLayer(layer); err != nil {
+		t.Fatalf("(Path).writeLayer() = %v", err)
+	}
+	rc, err := l.Blob(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, _, err := v1.SHA256(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h {
+		t.Errorf("blob has digest %s after writeLayer, want %s", got, h)
+	}
+}
+
 func TestOverwriteWithReplaceImage(t *testing.T) {
 	// need to set up a basic path
 	tmp, err := ioutil.TempDir("", "overwrite-with-replace-image-test")
@@ -28,6 +28,11 @@ type Manifest struct {
 	Config        Descriptor        `json:"config"`
 	Layers        []Descriptor      `json:"layers"`
 	Annotations   map[string]string `json:"annotations,omitempty"`
+
+	// ArtifactType and Subject were added in OCI image-spec v1.1 for
+	// artifacts (e.g. signatures) that refer to another manifest.
+	ArtifactType string      `json:"artifactType,omitempty"`
+	Subject      *Descriptor `json:"subject,omitempty"`
 }
 
 // IndexManifest represents an OCI image index in a structured way.
@@ -36,6 +41,12 @@ type IndexManifest struct {
 	MediaType     types.MediaType   `json:"mediaType,omitempty"`
 	Manifests     []Descriptor      `json:"manifests"`
 	Annotations   map[string]string `json:"annotations,omitempty"`
+
+	// ArtifactType and Subject were added in OCI image-spec v1.1 for
+	// indexes that group artifacts (e.g. attestations) about another
+	// manifest, rather than images for different platforms.
+	ArtifactType string      `json:"artifactType,omitempty"`
+	Subject      *Descriptor `json:"subject,omitempty"`
 }
 
 // Descriptor holds a reference from the manifest to one of its constituent elements.
@@ -47,6 +58,10 @@ type Descriptor struct {
 	URLs        []string          `json:"urls,omitempty"`
 	Annotations map[string]string `json:"annotations,omitempty"`
 	Platform    *Platform         `json:"platform,omitempty"`
+
+	// ArtifactType is the artifact type of the manifest this describes, as
+	// listed by the OCI referrers API (added in image-spec v1.1).
+	ArtifactType string `json:"artifactType,omitempty"`
 }
 
 // ParseManifest parses the io.Reader's contents into a Manifest.
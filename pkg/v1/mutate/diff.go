@@ -0,0 +1,184 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// fileInfo captures the parts of a tar entry that we consider when
+// determining whether a file has changed between two filesystems.
+type fileInfo struct {
+	typeflag byte
+	mode     int64
+	uid, gid int
+	linkname string
+	size     int64
+	sum      [sha256.Size]byte
+}
+
+func newFileInfo(hdr *tar.Header, r io.Reader) (fileInfo, error) {
+	fi := fileInfo{
+		typeflag: hdr.Typeflag,
+		mode:     hdr.Mode,
+		uid:      hdr.Uid,
+		gid:      hdr.Gid,
+		linkname: hdr.Linkname,
+		size:     hdr.Size,
+	}
+	if hdr.Size > 0 {
+		h := sha256.New()
+		if _, err := io.CopyN(h, r, hdr.Size); err != nil {
+			return fi, err
+		}
+		copy(fi.sum[:], h.Sum(nil))
+	}
+	return fi, nil
+}
+
+// flatten reads the flattened filesystem of img into a map of paths to their
+// fileInfo.
+func flatten(img v1.Image) (map[string]fileInfo, error) {
+	rc := Extract(img)
+	defer rc.Close()
+
+	files := map[string]fileInfo{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fi, err := newFileInfo(hdr, tr)
+		if err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = fi
+	}
+}
+
+// Diff returns a single squashed v1.Layer containing the filesystem changes
+// required to turn the flattened filesystem of base into that of target.
+//
+// Files that were added or modified in target are included verbatim, and
+// files that were removed are represented by whiteout files. If an entire
+// directory was removed, only the directory itself is whited out. Timestamps
+// are not considered when determining whether a file has changed.
+//
+// To produce an image containing just the changes on top of base, use:
+//
+//	mutate.AppendLayers(base, diff)
+//
+// opts are passed to tarball.LayerFromOpener, e.g. to set the compression
+// level with tarball.WithCompressionLevel.
+func Diff(base, target v1.Image, opts ...tarball.LayerOption) (v1.Layer, error) {
+	before, err := flatten(base)
+	if err != nil {
+		return nil, fmt.Errorf("reading base filesystem: %w", err)
+	}
+	after, err := flatten(target)
+	if err != nil {
+		return nil, fmt.Errorf("reading target filesystem: %w", err)
+	}
+
+	changed := map[string]bool{}
+	for name, fi := range after {
+		if old, ok := before[name]; !ok || old != fi {
+			changed[name] = true
+		}
+	}
+
+	// Sort so that parent directories are seen before their children, which
+	// lets us skip whiteouts for children of removed directories.
+	removed := []string{}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	whiteouts := []string{}
+	deletedDirs := map[string]bool{}
+	for _, name := range removed {
+		if inWhiteoutDir(deletedDirs, name) {
+			continue
+		}
+		deletedDirs[name] = true
+		whiteouts = append(whiteouts, filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name)))
+	}
+
+	opener := func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeDiff(target, changed, whiteouts, pw))
+		}()
+		return pr, nil
+	}
+	return tarball.LayerFromOpener(opener, opts...)
+}
+
+// writeDiff writes a tar to w containing the entries of target's flattened
+// filesystem that are in changed, followed by the given whiteouts.
+func writeDiff(target v1.Image, changed map[string]bool, whiteouts []string, w io.Writer) error {
+	rc := Extract(target)
+	defer rc.Close()
+
+	tw := tar.NewWriter(w)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !changed[hdr.Name] {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Size > 0 {
+			if _, err := io.CopyN(tw, tr, hdr.Size); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range whiteouts {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,155 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutate_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+type tarEntry struct {
+	name, contents string
+	dir            bool
+}
+
+func tarLayer(t *testing.T, entries ...tarEntry) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.contents))}
+		if e.dir {
+			hdr = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestDiff(t *testing.T) {
+	base, err := mutate.AppendLayers(empty.Image, tarLayer(t,
+		tarEntry{name: "unchanged", contents: "same"},
+		tarEntry{name: "modified", contents: "before"},
+		tarEntry{name: "removed", contents: "gone"},
+		tarEntry{name: "dir", dir: true},
+		tarEntry{name: "dir/child", contents: "also gone"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := mutate.AppendLayers(base, tarLayer(t,
+		tarEntry{name: "modified", contents: "after"},
+		tarEntry{name: "added", contents: "new"},
+		tarEntry{name: ".wh.removed"},
+		tarEntry{name: ".wh.dir"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := mutate.Diff(base, target)
+	if err != nil {
+		t.Fatalf("Diff() = %v", err)
+	}
+
+	rc, err := diff.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(b)
+	}
+
+	want := map[string]string{
+		"modified":    "after",
+		"added":       "new",
+		".wh.removed": "",
+		".wh.dir":     "",
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Diff() entries (-want +got) = %s", d)
+	}
+
+	// Applying the diff to base should produce the same filesystem as target.
+	squashed, err := mutate.AppendLayers(base, diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(flattened(t, target), flattened(t, squashed)); d != "" {
+		t.Errorf("flattened filesystems differ (-target +squashed) = %s", d)
+	}
+}
+
+func flattened(t *testing.T, img v1.Image) map[string]string {
+	t.Helper()
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	files := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b)
+	}
+}
@@ -35,6 +35,7 @@ type image struct {
 	annotations     map[string]string
 	mediaType       *types.MediaType
 	configMediaType *types.MediaType
+	subject         *v1.Descriptor
 	diffIDMap       map[v1.Hash]v1.Layer
 	digestMap       map[v1.Hash]v1.Layer
 }
@@ -144,6 +145,10 @@ func (i *image) compute() error {
 		manifest.MediaType = *i.mediaType
 	}
 
+	if i.subject != nil {
+		manifest.Subject = i.subject
+	}
+
 	if i.annotations != nil {
 		if manifest.Annotations == nil {
 			manifest.Annotations = map[string]string{}
@@ -165,33 +170,29 @@ func (i *image) compute() error {
 // Layers returns the ordered collection of filesystem layers that comprise this image.
 // The order of the list is oldest/base layer first, and most-recent/top layer last.
 func (i *image) Layers() ([]v1.Layer, error) {
-	if err := i.compute(); errors.Is(err, stream.ErrNotComputed) {
-		// Image contains a streamable layer which has not yet been
-		// consumed. Just return the layers we have in case the caller
-		// is going to consume the layers.
-		layers, err := i.base.Layers()
-		if err != nil {
-			return nil, err
-		}
-		for _, add := range i.adds {
-			layers = append(layers, add.Layer)
-		}
-		return layers, nil
-	} else if err != nil {
+	// If the image contains a streamable layer which has not yet been
+	// consumed, just return the layers we have in case the caller is going
+	// to consume the layers.
+	if err := i.compute(); err != nil && !errors.Is(err, stream.ErrNotComputed) {
 		return nil, err
 	}
 
-	diffIDs, err := partial.DiffIDs(i)
+	// The layers are returned in the same order as compute puts them in the
+	// manifest and the config's diff IDs: the base's, then the appended ones.
+	// They aren't looked up by diff ID, which distinct layers with the same
+	// uncompressed contents, e.g. compressed differently, would share.
+	base, err := i.base.Layers()
 	if err != nil {
 		return nil, err
 	}
-	ls := make([]v1.Layer, 0, len(diffIDs))
-	for _, h := range diffIDs {
-		l, err := i.LayerByDiffID(h)
-		if err != nil {
-			return nil, err
+	// Copy base's layers, so that appending doesn't modify a slice it kept.
+	ls := make([]v1.Layer, 0, len(base)+len(i.adds))
+	ls = append(ls, base...)
+	for _, add := range i.adds {
+		// Empty layers only have history.
+		if add.Layer != nil {
+			ls = append(ls, add.Layer)
 		}
-		ls = append(ls, l)
 	}
 	return ls, nil
 }
@@ -26,7 +26,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/google/go-containerregistry/internal/gzip"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/match"
@@ -211,6 +210,25 @@ func CreatedAt(base v1.Image, created v1.Time) (v1.Image, error) {
 	return ConfigFile(base, cfg)
 }
 
+// CreatedAtAll is like CreatedAt, but also sets the created time of every
+// history entry, so that the config doesn't vary with when the image or its
+// layers were built, e.g. for reproducible builds. See Time to also change
+// the timestamps of the files in the layers.
+func CreatedAtAll(base v1.Image, created v1.Time) (v1.Image, error) {
+	cf, err := base.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := cf.DeepCopy()
+	cfg.Created = created
+	for i := range cfg.History {
+		cfg.History[i].Created = created
+	}
+
+	return ConfigFile(base, cfg)
+}
+
 // Extract takes an image and returns an io.ReadCloser containing the image's
 // flattened filesystem.
 //
@@ -334,7 +352,10 @@ func inWhiteoutDir(fileMap map[string]bool, file string) bool {
 }
 
 // Time sets all timestamps in an image to the given timestamp.
-func Time(img v1.Image, t time.Time) (v1.Image, error) {
+//
+// Layers whose timestamps change are recompressed; opts are passed to
+// tarball.LayerFromOpener for them, e.g. tarball.WithCompressionLevel.
+func Time(img v1.Image, t time.Time, opts ...tarball.LayerOption) (v1.Image, error) {
 	newImage := empty.Image
 
 	layers, err := img.Layers()
@@ -345,7 +366,7 @@ func Time(img v1.Image, t time.Time) (v1.Image, error) {
 	// Strip away all timestamps from layers
 	newLayers := make([]v1.Layer, len(layers))
 	for idx, layer := range layers {
-		newLayer, err := layerTime(layer, t)
+		newLayer, err := layerTime(layer, t, opts...)
 		if err != nil {
 			return nil, fmt.Errorf("setting layer times: %w", err)
 		}
@@ -390,7 +411,7 @@ func Time(img v1.Image, t time.Time) (v1.Image, error) {
 	return ConfigFile(newImage, cfg)
 }
 
-func layerTime(layer v1.Layer, t time.Time) (v1.Layer, error) {
+func layerTime(layer v1.Layer, t time.Time, opts ...tarball.LayerOption) (v1.Layer, error) {
 	layerReader, err := layer.Uncompressed()
 	if err != nil {
 		return nil, fmt.Errorf("getting layer: %w", err)
@@ -400,6 +421,9 @@ func layerTime(layer v1.Layer, t time.Time) (v1.Layer, error) {
 	tarWriter := tar.NewWriter(w)
 	defer tarWriter.Close()
 
+	// Track whether any timestamps actually change, so that we can pass the
+	// original layer through verbatim (and preserve its digest) if not.
+	changed := false
 	tarReader := tar.NewReader(layerReader)
 	for {
 		header, err := tarReader.Next()
@@ -410,6 +434,9 @@ func layerTime(layer v1.Layer, t time.Time) (v1.Layer, error) {
 			return nil, fmt.Errorf("reading layer: %w", err)
 		}
 
+		if !header.ModTime.Equal(t) {
+			changed = true
+		}
 		header.ModTime = t
 		if err := tarWriter.WriteHeader(header); err != nil {
 			return nil, fmt.Errorf("writing tar header: %w", err)
@@ -426,13 +453,16 @@ func layerTime(layer v1.Layer, t time.Time) (v1.Layer, error) {
 	if err := tarWriter.Close(); err != nil {
 		return nil, err
 	}
+	if !changed {
+		return layer, nil
+	}
 
 	b := w.Bytes()
-	// gzip the contents, then create the layer
+	// tarball will gzip the contents for us, at the requested level.
 	opener := func() (io.ReadCloser, error) {
-		return gzip.ReadCloser(ioutil.NopCloser(bytes.NewReader(b))), nil
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
 	}
-	layer, err = tarball.LayerFromOpener(opener)
+	layer, err = tarball.LayerFromOpener(opener, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("creating layer: %w", err)
 	}
@@ -441,11 +471,11 @@ func layerTime(layer v1.Layer, t time.Time) (v1.Layer, error) {
 }
 
 // Canonical is a helper function to combine Time and configFile
-// to remove any randomness during a docker build.
-func Canonical(img v1.Image) (v1.Image, error) {
+// to remove any randomness during a docker build. opts are passed to Time.
+func Canonical(img v1.Image, opts ...tarball.LayerOption) (v1.Image, error) {
 	// Set all timestamps to 0
 	created := time.Time{}
-	img, err := Time(img, created)
+	img, err := Time(img, created, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -481,6 +511,15 @@ func ConfigMediaType(img v1.Image, mt types.MediaType) v1.Image {
 	}
 }
 
+// Subject sets the subject of the given image's manifest, which makes it a
+// referrer of the manifest that subject describes, e.g. a signature of it.
+func Subject(img v1.Image, subject v1.Descriptor) v1.Image {
+	return &image{
+		base:    img,
+		subject: &subject,
+	}
+}
+
 // IndexMediaType modifies the MediaType() of the given index.
 func IndexMediaType(idx v1.ImageIndex, mt types.MediaType) v1.ImageIndex {
 	return &index{
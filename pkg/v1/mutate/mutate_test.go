@@ -17,9 +17,12 @@ package mutate_test
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"io"
 	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -28,11 +31,14 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/match"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/stream"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
@@ -324,6 +330,41 @@ func TestMutateCreatedAt(t *testing.T) {
 	}
 }
 
+func TestMutateCreatedAtAll(t *testing.T) {
+	layer, err := random.Layer(100, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := mutate.Append(sourceImage(t), mutate.Addendum{
+		Layer:   layer,
+		History: v1.History{Created: v1.Time{Time: time.Now()}, CreatedBy: "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := v1.Time{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	result, err := mutate.CreatedAtAll(source, want)
+	if err != nil {
+		t.Fatalf("CreatedAtAll: %v", err)
+	}
+
+	cf := getConfigFile(t, result)
+	if !cf.Created.Equal(want.Time) {
+		t.Errorf("config created = %v, want %v", cf.Created, want)
+	}
+	if len(cf.History) == 0 {
+		t.Fatal("no history")
+	}
+	for i, h := range cf.History {
+		if !h.Created.Equal(want.Time) {
+			t.Errorf("history[%d] created = %v, want %v", i, h.Created, want)
+		}
+	}
+	if getManifest(t, result).Layers[0].Digest != getManifest(t, source).Layers[0].Digest {
+		t.Error("CreatedAtAll changed the layers")
+	}
+}
+
 func TestMutateTime(t *testing.T) {
 	source := sourceImage(t)
 	want := time.Time{}
@@ -342,6 +383,237 @@ func TestMutateTime(t *testing.T) {
 	}
 }
 
+func TestMutateTimeUnchangedLayers(t *testing.T) {
+	source := sourceImage(t)
+	want := time.Unix(0, 0)
+	once, err := mutate.Time(source, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := mutate.Time(once, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers whose timestamps are already correct are passed through
+	// verbatim, rather than being recompressed.
+	onceLayers, twiceLayers := getLayers(t, once), getLayers(t, twice)
+	for i := range onceLayers {
+		if onceLayers[i] != twiceLayers[i] {
+			t.Errorf("layer %d was rewritten, but its timestamps didn't change", i)
+		}
+	}
+}
+
+func TestMutateTimeCompressionLevel(t *testing.T) {
+	img, err := mutate.AppendLayers(empty.Image, tarLayer(t,
+		tarEntry{name: "compressible", contents: strings.Repeat("all work and no play ", 4096)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := func(level int) int64 {
+		t.Helper()
+		timed, err := mutate.Time(img, time.Unix(1000, 0), tarball.WithCompressionLevel(level))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls := getLayers(t, timed)
+		sz, err := ls[0].Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sz
+	}
+	if none, best := size(gzip.NoCompression), size(gzip.BestCompression); none <= best {
+		t.Errorf("NoCompression size = %d, BestCompression size = %d, expected NoCompression to be larger", none, best)
+	}
+}
+
+func TestAppendPreservesRemoteLayers(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(u.Host + "/test/mutate:base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, base); err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appended, err := mutate.AppendLayers(pulled, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := ref.Context().Tag("appended")
+	if err := remote.Write(dst, appended); err != nil {
+		t.Fatal(err)
+	}
+	roundtrip, err := remote.Image(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := base.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := roundtrip.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Layers) != len(want.Layers)+1 {
+		t.Fatalf("got %d layers, want %d", len(got.Layers), len(want.Layers)+1)
+	}
+	if diff := cmp.Diff(want.Layers, got.Layers[:len(want.Layers)]); diff != "" {
+		t.Errorf("existing layers changed after round trip (-want +got): %s", diff)
+	}
+}
+
+func TestAppendOrdering(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(u.Host + "/test/mutate:ordered")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := base.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	adds := []mutate.Addendum{}
+	for i := 0; i < 4; i++ {
+		l, err := random.Layer(1024, types.DockerLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adds = append(adds, mutate.Addendum{Layer: l})
+		want = append(want, l)
+	}
+	// Two more layers with the same contents, and so the same diff ID, but
+	// compressed differently, so with different digests.
+	tarLayer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		l, err := tarball.LayerFromOpener(tarLayer.Uncompressed, tarball.WithCompressionLevel(level))
+		if err != nil {
+			t.Fatal(err)
+		}
+		adds = append(adds, mutate.Addendum{Layer: l})
+		// An empty layer in between doesn't appear in the manifest.
+		adds = append(adds, mutate.Addendum{History: v1.History{EmptyLayer: true}})
+		want = append(want, l)
+	}
+	d1, err := want[len(want)-2].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := want[len(want)-1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 == d2 {
+		t.Fatal("compressing differently produced the same digest")
+	}
+
+	img, err := mutate.Append(base, adds...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, img v1.Image) {
+		t.Helper()
+		m := getManifest(t, img)
+		cfg := getConfigFile(t, img)
+		ls := getLayers(t, img)
+		if len(m.Layers) != len(want) || len(cfg.RootFS.DiffIDs) != len(want) || len(ls) != len(want) {
+			t.Fatalf("%s: got %d manifest layers, %d diff IDs and %d layers, want %d", name, len(m.Layers), len(cfg.RootFS.DiffIDs), len(ls), len(want))
+		}
+		for i, l := range want {
+			digest, err := l.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffID, err := l.DiffID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Layers[i].Digest != digest {
+				t.Errorf("%s: manifest layer %d is %s, want %s", name, i, m.Layers[i].Digest, digest)
+			}
+			if cfg.RootFS.DiffIDs[i] != diffID {
+				t.Errorf("%s: diff ID %d is %s, want %s", name, i, cfg.RootFS.DiffIDs[i], diffID)
+			}
+			if got, err := ls[i].Digest(); err != nil {
+				t.Fatal(err)
+			} else if got != digest {
+				t.Errorf("%s: Layers()[%d] is %s, want %s", name, i, got, digest)
+			}
+		}
+	}
+	check("appended", img)
+
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("pulled", pulled)
+
+	// Pushing the pulled image again doesn't change a byte of its manifest.
+	again := ref.Context().Tag("again")
+	if err := remote.Write(again, pulled); err != nil {
+		t.Fatal(err)
+	}
+	repulled, err := remote.Image(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantManifest, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []v1.Image{pulled, repulled} {
+		gotManifest, err := got.RawManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotManifest, wantManifest) {
+			t.Errorf("manifest changed after a round trip: got %s, want %s", gotManifest, wantManifest)
+		}
+	}
+}
+
 func TestMutateMediaType(t *testing.T) {
 	want := types.OCIManifestSchema1
 	wantCfg := types.OCIConfigJSON
@@ -422,6 +694,38 @@ func TestMutateMediaType(t *testing.T) {
 	}
 }
 
+func TestSubject(t *testing.T) {
+	subject := v1.Descriptor{
+		MediaType: types.OCIManifestSchema1,
+		Size:      42,
+		Digest:    v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)},
+	}
+	img := mutate.Subject(mutate.MediaType(empty.Image, types.OCIManifestSchema1), subject)
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject == nil || !reflect.DeepEqual(*m.Subject, subject) {
+		t.Errorf("Subject = %v, want %v", m.Subject, subject)
+	}
+	if err := validate.Image(img); err != nil {
+		t.Errorf("validate.Image() = %v", err)
+	}
+
+	// Other mutations keep the subject.
+	img, err = mutate.Config(img, v1.Config{User: "nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject == nil || m.Subject.Digest != subject.Digest {
+		t.Errorf("Subject after Config = %v, want %v", m.Subject, subject)
+	}
+}
+
 func TestAppendStreamableLayer(t *testing.T) {
 	img, err := mutate.AppendLayers(
 		sourceImage(t),
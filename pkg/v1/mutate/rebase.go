@@ -34,19 +34,19 @@ func Rebase(orig, oldBase, newBase v1.Image) (v1.Image, error) {
 		return nil, err
 	}
 	if len(oldBaseLayers) > len(origLayers) {
-		return nil, fmt.Errorf("image %q is not based on %q (too few layers)", orig, oldBase)
+		return nil, fmt.Errorf("original is not based on old base: old base has %d layers, original only has %d", len(oldBaseLayers), len(origLayers))
 	}
 	for i, l := range oldBaseLayers {
 		oldLayerDigest, err := l.Digest()
 		if err != nil {
-			return nil, fmt.Errorf("failed to get digest of layer %d of %q: %w", i, oldBase, err)
+			return nil, fmt.Errorf("failed to get digest of layer %d of old base: %w", i, err)
 		}
 		origLayerDigest, err := origLayers[i].Digest()
 		if err != nil {
-			return nil, fmt.Errorf("failed to get digest of layer %d of %q: %w", i, orig, err)
+			return nil, fmt.Errorf("failed to get digest of layer %d of original: %w", i, err)
 		}
 		if oldLayerDigest != origLayerDigest {
-			return nil, fmt.Errorf("image %q is not based on %q (layer %d mismatch)", orig, oldBase, i)
+			return nil, fmt.Errorf("original is not based on old base: layer %d is %s, old base has %s", i, origLayerDigest, oldLayerDigest)
 		}
 	}
 
@@ -19,6 +19,7 @@ import (
 
 	"github.com/google/go-containerregistry/internal/and"
 	"github.com/google/go-containerregistry/internal/gzip"
+	"github.com/google/go-containerregistry/pkg/compression"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
@@ -46,11 +47,25 @@ type compressedLayerExtender struct {
 
 // Uncompressed implements v1.Layer
 func (cle *compressedLayerExtender) Uncompressed() (io.ReadCloser, error) {
+	// If our nested CompressedLayer implements Uncompressed,
+	// then delegate to it instead.
+	if wu, ok := cle.CompressedLayer.(interface {
+		Uncompressed() (io.ReadCloser, error)
+	}); ok {
+		return wu.Uncompressed()
+	}
+
 	rc, err := cle.Compressed()
 	if err != nil {
 		return nil, err
 	}
 
+	if mt, err := cle.MediaType(); err == nil {
+		if decompress, ok := compression.Lookup(mt); ok {
+			return decompress(rc)
+		}
+	}
+
 	// Often, the "compressed" bytes are not actually gzip-compressed.
 	// Peek at the first two bytes to determine whether or not it's correct to
 	// wrap this with gzip.UnzipReadCloser.
@@ -16,6 +16,9 @@ package partial
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
 	"sync"
 
@@ -46,10 +49,34 @@ type uncompressedLayerExtender struct {
 	size          int64
 	hashSizeError error
 	once          sync.Once
+
+	// known is set once hash and size have been computed, either by
+	// calcSizeHash or by reading Compressed to the end.
+	mu    sync.Mutex
+	known bool
 }
 
 // Compressed implements v1.Layer
 func (ule *uncompressedLayerExtender) Compressed() (io.ReadCloser, error) {
+	rc, err := ule.compressed()
+	if err != nil || !ule.needsCompression() {
+		return rc, err
+	}
+	// Remember the digest and size of the first complete read, so that
+	// uploading the layer doesn't require compressing it twice.
+	return &hashingReadCloser{
+		ReadCloser: rc,
+		hasher:     sha256.New(),
+		onEOF: func(h v1.Hash, size int64) {
+			ule.once.Do(func() {
+				ule.hash, ule.size = h, size
+			})
+			ule.setKnown()
+		},
+	}, nil
+}
+
+func (ule *uncompressedLayerExtender) compressed() (io.ReadCloser, error) {
 	u, err := ule.Uncompressed()
 	if err != nil {
 		return nil, err
@@ -57,6 +84,18 @@ func (ule *uncompressedLayerExtender) Compressed() (io.ReadCloser, error) {
 	return gzip.ReadCloser(u), nil
 }
 
+func (ule *uncompressedLayerExtender) needsCompression() bool {
+	ule.mu.Lock()
+	defer ule.mu.Unlock()
+	return !ule.known
+}
+
+func (ule *uncompressedLayerExtender) setKnown() {
+	ule.mu.Lock()
+	defer ule.mu.Unlock()
+	ule.known = true
+}
+
 // Digest implements v1.Layer
 func (ule *uncompressedLayerExtender) Digest() (v1.Hash, error) {
 	ule.calcSizeHash()
@@ -72,15 +111,54 @@ func (ule *uncompressedLayerExtender) Size() (int64, error) {
 func (ule *uncompressedLayerExtender) calcSizeHash() {
 	ule.once.Do(func() {
 		var r io.ReadCloser
-		r, ule.hashSizeError = ule.Compressed()
+		r, ule.hashSizeError = ule.compressed()
 		if ule.hashSizeError != nil {
 			return
 		}
 		defer r.Close()
 		ule.hash, ule.size, ule.hashSizeError = v1.SHA256(r)
+		if ule.hashSizeError == nil {
+			ule.setKnown()
+		}
 	})
 }
 
+// NeedsCompression reports whether l is a layer from UncompressedToLayer
+// whose Digest and Size haven't been computed yet, so that calling either
+// would compress the whole layer.
+//
+// Reading such a layer's Compressed contents to the end computes them as a
+// side effect, which lets callers like remote.Write compress the layer once
+// while uploading it, rather than once for its digest and again to upload it.
+func NeedsCompression(l v1.Layer) bool {
+	ule, ok := l.(*uncompressedLayerExtender)
+	return ok && ule.needsCompression()
+}
+
+// hashingReadCloser computes the digest and size of what's read through it,
+// and calls onEOF with them once it's read to the end.
+type hashingReadCloser struct {
+	io.ReadCloser
+	hasher hash.Hash
+	size   int64
+	onEOF  func(v1.Hash, int64)
+	done   bool
+}
+
+func (h *hashingReadCloser) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.hasher.Write(p[:n])
+	h.size += int64(n)
+	if err == io.EOF && !h.done {
+		h.done = true
+		h.onEOF(v1.Hash{
+			Algorithm: "sha256",
+			Hex:       hex.EncodeToString(h.hasher.Sum(nil)),
+		}, h.size)
+	}
+	return n, err
+}
+
 // UncompressedToLayer fills in the missing methods from an UncompressedLayer so that it implements v1.Layer
 func UncompressedToLayer(ul UncompressedLayer) (v1.Layer, error) {
 	return &uncompressedLayerExtender{UncompressedLayer: ul}, nil
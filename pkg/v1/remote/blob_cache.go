@@ -0,0 +1,129 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// blobCache is an LRU cache of verified blobs, keyed by digest, that holds at
+// most maxBytes. See WithMemoryBlobCache.
+type blobCache struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List // of *cachedBlob, most recently used first
+	blobs map[v1.Hash]*list.Element
+}
+
+type cachedBlob struct {
+	digest v1.Hash
+	b      []byte
+}
+
+func newBlobCache(maxBytes int64) *blobCache {
+	return &blobCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		blobs:    map[v1.Hash]*list.Element{},
+	}
+}
+
+// get returns a reader for the blob h, if it's cached. A nil cache never has
+// anything cached.
+func (c *blobCache) get(h v1.Hash) (io.ReadCloser, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blobs[h]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	// The bytes are never modified, so readers can share them.
+	return ioutil.NopCloser(bytes.NewReader(e.Value.(*cachedBlob).b)), true
+}
+
+// put caches b as the blob h, evicting the least recently used blobs to make
+// room for it.
+func (c *blobCache) put(h v1.Hash, b []byte) {
+	size := int64(len(b))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blobs[h]; ok {
+		// Another reader got here first.
+		return
+	}
+	for c.size+size > c.maxBytes {
+		oldest := c.order.Back()
+		cb := c.order.Remove(oldest).(*cachedBlob)
+		delete(c.blobs, cb.digest)
+		c.size -= int64(len(cb.b))
+	}
+	c.blobs[h] = c.order.PushFront(&cachedBlob{digest: h, b: b})
+	c.size += size
+}
+
+// fill returns a reader that reads rc, which must verify that it contains
+// the blob h, and caches the blob once it has been read completely. size is
+// the expected size, if known. A nil cache returns rc.
+func (c *blobCache) fill(rc io.ReadCloser, size int64, h v1.Hash) io.ReadCloser {
+	if c == nil || size > c.maxBytes {
+		return rc
+	}
+	return &fillingReader{ReadCloser: rc, cache: c, digest: h}
+}
+
+// fillingReader buffers what's read from the blob until it reaches io.EOF,
+// which verify.ReadCloser only returns once the digest has been checked, and
+// then adds it to the cache.
+type fillingReader struct {
+	io.ReadCloser
+	cache  *blobCache
+	digest v1.Hash
+	buf    bytes.Buffer
+	// tooBig is set once the blob has turned out to be too big to cache.
+	tooBig bool
+}
+
+func (f *fillingReader) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if !f.tooBig {
+		if int64(f.buf.Len()+n) > f.cache.maxBytes {
+			f.tooBig = true
+			f.buf = bytes.Buffer{}
+		} else {
+			f.buf.Write(p[:n])
+		}
+	}
+	if errors.Is(err, io.EOF) && !f.tooBig {
+		f.cache.put(f.digest, f.buf.Bytes())
+		f.tooBig = true // Don't cache it twice.
+	}
+	return n, err
+}
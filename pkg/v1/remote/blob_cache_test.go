@@ -0,0 +1,198 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestBlobCacheEviction(t *testing.T) {
+	hash := func(s string) v1.Hash {
+		h, _, err := v1.SHA256(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	a, b, c, big := hash("a"), hash("b"), hash("c"), hash("big")
+	has := func(cache *blobCache, h v1.Hash) bool {
+		_, ok := cache.get(h)
+		return ok
+	}
+
+	cache := newBlobCache(10)
+	cache.put(a, []byte("aaaa"))
+	cache.put(b, []byte("bbbb"))
+	// Reading a makes b the least recently used, so it's evicted for c.
+	if !has(cache, a) {
+		t.Fatal("a isn't cached")
+	}
+	cache.put(c, []byte("cccc"))
+	if has(cache, b) {
+		t.Error("b is still cached, expected it to be evicted")
+	}
+	if !has(cache, a) || !has(cache, c) {
+		t.Error("a and c should be cached")
+	}
+	if cache.size != 8 {
+		t.Errorf("size = %d, want 8", cache.size)
+	}
+
+	// Blobs bigger than the whole cache are never cached, and don't evict
+	// anything.
+	cache.put(big, make([]byte, 11))
+	if has(cache, big) {
+		t.Error("blob bigger than the cache was cached")
+	}
+	if !has(cache, a) || !has(cache, c) {
+		t.Error("caching a big blob evicted a or c")
+	}
+
+	// A nil cache has nothing.
+	var nilCache *blobCache
+	if has(nilCache, a) {
+		t.Error("nil cache has a")
+	}
+}
+
+func TestMemoryBlobCache(t *testing.T) {
+	var gets int32
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			atomic.AddInt32(&gets, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/blob/cache:latest", u.Host))
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([][]byte, len(ls))
+	for i, l := range ls {
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i], err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := WithMemoryBlobCache(1 << 20)
+	readAll := func() {
+		rmt, err := Image(ref, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rls, err := rmt.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, l := range rls {
+			rc, err := l.Compressed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want[i]) {
+				t.Errorf("layer %d has the wrong contents", i)
+			}
+		}
+	}
+
+	readAll()
+	if got := atomic.LoadInt32(&gets); got != int32(len(ls)) {
+		t.Errorf("first read made %d blob GETs, want %d", got, len(ls))
+	}
+	atomic.StoreInt32(&gets, 0)
+
+	// Everything comes from the cache the second time, even when it's read
+	// concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readAll()
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&gets); got != 0 {
+		t.Errorf("cached reads made %d blob GETs, want 0", got)
+	}
+
+	// Blobs that don't fit aren't cached.
+	atomic.StoreInt32(&gets, 0)
+	small := WithMemoryBlobCache(1)
+	for i := 0; i < 2; i++ {
+		rmt, err := Image(ref, small)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rls, err := rmt.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := rls[0].Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(rc); err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+	}
+	if got := atomic.LoadInt32(&gets); got != 2 {
+		t.Errorf("reads through a small cache made %d blob GETs, want 2", got)
+	}
+
+	if _, err := Image(ref, WithMemoryBlobCache(0)); err == nil {
+		t.Error("WithMemoryBlobCache(0) succeeded, expected error")
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/google/go-containerregistry/internal/redact"
+	"github.com/google/go-containerregistry/internal/retry"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// errCorruptPartial is returned by downloadBlob when a resumed download
+// doesn't hash to the expected digest, meaning the partial file it resumed
+// from can't be trusted.
+var errCorruptPartial = errors.New("partial download is corrupt")
+
+// PullBlobToFile downloads the blob referenced by ref to path, verifying its
+// digest.
+//
+// The blob is downloaded to path + ".partial" and only renamed to path once
+// it has been verified, so path never contains a partial or corrupt blob. If
+// the download is interrupted, calling PullBlobToFile again resumes from the
+// partial file using a Range request. If the resumed blob doesn't match its
+// digest, the partial file is discarded and the download restarts from zero.
+func PullBlobToFile(ref name.Digest, path string, options ...Option) error {
+	rewritten, o, err := makeReferenceOptions(ref, options...)
+	if err != nil {
+		return err
+	}
+	ref = rewritten.(name.Digest)
+	f, err := makeFetcher(ref, o)
+	if err != nil {
+		return err
+	}
+	h, err := v1.NewHash(ref.Identifier())
+	if err != nil {
+		return err
+	}
+	if err := checkExpectedDigest(ref, o, h); err != nil {
+		return err
+	}
+
+	partial := path + ".partial"
+	if err := f.downloadBlob(o.context, h, partial, true); err != nil {
+		if !errors.Is(err, errCorruptPartial) {
+			return err
+		}
+		if err := f.downloadBlob(o.context, h, partial, false); err != nil {
+			return err
+		}
+	}
+	return os.Rename(partial, path)
+}
+
+// downloadBlob writes the blob h to path. If resume is true, whatever is
+// already in path is assumed to be a prefix of the blob, and only the rest is
+// requested.
+func (f *fetcher) downloadBlob(ctx context.Context, h v1.Hash, path string, resume bool) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher, err := v1.Hasher(h.Algorithm)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if resume {
+		if offset, err = io.Copy(hasher, file); err != nil {
+			return err
+		}
+	}
+	restart := func() error {
+		offset = 0
+		hasher.Reset()
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		_, err := file.Seek(0, io.SeekStart)
+		return err
+	}
+	if !resume {
+		if err := restart(); err != nil {
+			return err
+		}
+	}
+
+	u := f.url("blobs", h.String())
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := f.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return redact.Error(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The registry ignored our Range header (or we didn't send one).
+		if offset > 0 {
+			if err := restart(); err != nil {
+				return err
+			}
+		}
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return fmt.Errorf("GET %s: unexpected Content-Range %q for offset %d", u.String(), resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is at least as large as the blob. If it's exactly
+		// the blob, we're done; otherwise it fails the digest check below.
+		if offset == 0 {
+			return transport.CheckError(resp, http.StatusOK)
+		}
+		return checkDownload(hasher, h, offset)
+	default:
+		return transport.CheckError(resp, http.StatusOK, http.StatusPartialContent)
+	}
+
+	if _, err := f.copyBlob(io.MultiWriter(file, hasher), resp.Body); err != nil {
+		// Leave what we have for the next attempt to resume from.
+		return err
+	}
+	if err := checkDownload(hasher, h, offset); err != nil {
+		if !errors.Is(err, errCorruptPartial) {
+			// Don't leave a bad blob around for the next attempt to resume.
+			file.Truncate(0)
+		}
+		return err
+	}
+	return file.Sync()
+}
+
+// FetchBlobTo writes the blob referenced by ref to w, verifying its digest, and
+// returns the number of bytes written. It's like PullBlobToFile, for callers
+// that manage their own storage.
+//
+// If reading the blob fails with an error that the retry predicate (see
+// WithRetryPredicate) accepts, and w is an io.Seeker, w is seeked back to the
+// end of what was written and the rest of the blob is requested with a Range
+// request. If the registry ignores the Range header, w is seeked back to where
+// it was when FetchBlobTo was called and the whole blob is written again.
+// Other writers can't be rewound, so the download is only retried if nothing
+// has been written to them yet.
+//
+// w has been written to even if the blob doesn't match its digest, so callers
+// shouldn't use what was written unless FetchBlobTo succeeds.
+func FetchBlobTo(w io.Writer, ref name.Digest, options ...Option) (int64, error) {
+	rewritten, o, err := makeReferenceOptions(ref, options...)
+	if err != nil {
+		return 0, err
+	}
+	ref = rewritten.(name.Digest)
+	f, err := makeFetcher(ref, o)
+	if err != nil {
+		return 0, err
+	}
+	h, err := v1.NewHash(ref.Identifier())
+	if err != nil {
+		return 0, err
+	}
+	if err := checkExpectedDigest(ref, o, h); err != nil {
+		return 0, err
+	}
+	hasher, err := v1.Hasher(h.Algorithm)
+	if err != nil {
+		return 0, err
+	}
+
+	bw := &blobWriter{fetcher: f, h: h, w: w, hasher: hasher}
+	if seeker, ok := w.(io.Seeker); ok {
+		if bw.start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		bw.seeker = seeker
+	}
+	resumable := false
+	err = retry.Retry(func() error {
+		var err error
+		resumable, err = bw.write(o.context)
+		return err
+	}, retryWithMetrics(func(err error) bool {
+		return resumable && o.retryPredicate(err)
+	}, o.metrics), o.retryBackoff)
+	if err != nil {
+		return bw.written, err
+	}
+	return bw.written, checkDownload(hasher, h, 0)
+}
+
+// blobWriter is the state of a FetchBlobTo download.
+type blobWriter struct {
+	*fetcher
+	h      v1.Hash
+	w      io.Writer
+	hasher hash.Hash
+
+	// seeker is w, if it can seek, and start is where it was when the
+	// download began.
+	seeker io.Seeker
+	start  int64
+
+	// written is how much of the blob has been written to w and hasher.
+	written int64
+}
+
+// write writes the rest of the blob to w, from bw.written. It returns whether
+// the download can be resumed from where it failed.
+func (bw *blobWriter) write(ctx context.Context) (bool, error) {
+	if bw.written > 0 {
+		// Whatever happened to the last write, carry on from the last byte
+		// that we know was written.
+		if err := bw.seek(bw.written); err != nil {
+			return false, err
+		}
+	}
+
+	u := bw.url("blobs", bw.h.String())
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	if bw.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", bw.written))
+	}
+	resp, err := bw.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return bw.resumable(), redact.Error(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The registry ignored our Range header (or we didn't send one).
+		if bw.written > 0 {
+			if err := bw.seek(0); err != nil {
+				return false, err
+			}
+			bw.written = 0
+			bw.hasher.Reset()
+		}
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != bw.written {
+			return false, fmt.Errorf("GET %s: unexpected Content-Range %q for offset %d", u.String(), resp.Header.Get("Content-Range"), bw.written)
+		}
+	default:
+		return false, transport.CheckError(resp, http.StatusOK, http.StatusPartialContent)
+	}
+
+	body := &bodyReader{Reader: resp.Body}
+	n, err := bw.copyBlob(io.MultiWriter(bw.w, bw.hasher), body)
+	bw.written += n
+	if err != nil && body.err == nil {
+		// Writing failed, not the download, so there's nothing to resume.
+		return false, err
+	}
+	return bw.resumable(), err
+}
+
+// resumable reports whether the download can carry on from bw.written.
+func (bw *blobWriter) resumable() bool {
+	return bw.seeker != nil || bw.written == 0
+}
+
+// seek moves w to offset within the blob.
+func (bw *blobWriter) seek(offset int64) error {
+	_, err := bw.seeker.Seek(bw.start+offset, io.SeekStart)
+	return err
+}
+
+// bodyReader records the error from reading a response body, to tell it apart
+// from an error writing what was read.
+type bodyReader struct {
+	io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// checkDownload returns an error if hasher doesn't match h. If the download
+// was resumed from offset, the error is errCorruptPartial.
+func checkDownload(hasher hash.Hash, h v1.Hash, offset int64) error {
+	got := v1.Hash{
+		Algorithm: h.Algorithm,
+		Hex:       fmt.Sprintf("%x", hasher.Sum(nil)),
+	}
+	if got == h {
+		return nil
+	}
+	if offset > 0 {
+		return fmt.Errorf("%w: got %s, want %s", errCorruptPartial, got, h)
+	}
+	return fmt.Errorf("error verifying %s checksum after reading %s", h, got)
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrChildManifests is returned by ChildManifests when some of the index's
+// child manifests can't be fetched.
+type ErrChildManifests struct {
+	// Errors maps the digest of each child that wasn't fetched to the reason.
+	Errors map[v1.Hash]error
+}
+
+// Error implements error.
+func (e *ErrChildManifests) Error() string {
+	digests := make([]v1.Hash, 0, len(e.Errors))
+	for h := range e.Errors {
+		digests = append(digests, h)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i].String() < digests[j].String()
+	})
+	msgs := make([]string, 0, len(digests))
+	for _, h := range digests {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", h, e.Errors[h]))
+	}
+	return fmt.Sprintf("failed to fetch %d child manifest(s): %s", len(digests), strings.Join(msgs, "; "))
+}
+
+// ChildManifests fetches the index ref and then the manifests of all of its
+// children, up to WithJobs at a time, returning them by digest, e.g. to plan
+// copying every platform of an index without fetching the manifests one by
+// one. All the requests share one connection setup and token exchange.
+//
+// Only the index's immediate children are fetched, including any nested
+// indexes, but not their children. Children that aren't images or indexes,
+// e.g. layers, are left out. If any child can't be fetched, the rest are still
+// returned, along with an *ErrChildManifests.
+func ChildManifests(ref name.Reference, options ...Option) (map[v1.Hash]*Descriptor, error) {
+	ref, o, err := makeReferenceOptions(ref, options...)
+	if err != nil {
+		return nil, err
+	}
+	f, err := makeFetcher(ref, o)
+	if err != nil {
+		return nil, err
+	}
+	b, desc, err := f.fetchManifest(ref, append(acceptableIndexMediaTypes, o.acceptedMediaTypes...))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExpectedDigest(ref, o, desc.Digest); err != nil {
+		return nil, err
+	}
+	if !desc.MediaType.IsIndex() {
+		return nil, fmt.Errorf("%s is not an index: %s", ref, desc.MediaType)
+	}
+	r := &remoteIndex{
+		fetcher:    *f,
+		manifest:   b,
+		mediaType:  desc.MediaType,
+		descriptor: desc,
+	}
+	index, err := r.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu       sync.Mutex
+		children = map[v1.Hash]*Descriptor{}
+		errs     = map[v1.Hash]error{}
+	)
+	var g errgroup.Group
+	g.SetLimit(o.jobs)
+	for _, child := range index.Manifests {
+		child := child
+		if !child.MediaType.IsImage() && !child.MediaType.IsIndex() {
+			continue
+		}
+		g.Go(func() error {
+			d, err := r.childDescriptor(child, o.platform)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[child.Digest] = err
+				return nil
+			}
+			d.platformMatcher = o.platformMatcher
+			d.unknownPlatforms = o.unknownPlatforms
+			children[child.Digest] = d
+			return nil
+		})
+	}
+	_ = g.Wait()
+	if len(errs) != 0 {
+		return children, &ErrChildManifests{Errors: errs}
+	}
+	return children, nil
+}
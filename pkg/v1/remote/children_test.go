@@ -0,0 +1,171 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestChildManifests(t *testing.T) {
+	idx, err := random.Index(1024, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := random.Index(1024, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: nested})
+
+	var (
+		mu             sync.Mutex
+		inFlight, peak int
+		missing        string
+	)
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/sha256:") {
+			mu.Lock()
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			skip := path.Base(r.URL.Path) == missing
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+			time.Sleep(10 * time.Millisecond)
+			if skip {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/children/index:latest", u.Host))
+	if err := WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	children, err := ChildManifests(ref, WithJobs(2))
+	if err != nil {
+		t.Fatalf("ChildManifests() = %v", err)
+	}
+	if len(children) != len(im.Manifests) {
+		t.Errorf("got %d children, want %d", len(children), len(im.Manifests))
+	}
+	for _, desc := range im.Manifests {
+		child, ok := children[desc.Digest]
+		if !ok {
+			t.Errorf("missing child %s", desc.Digest)
+			continue
+		}
+		var want []byte
+		if desc.MediaType.IsIndex() {
+			ii, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err = ii.RawManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err = img.RawManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(child.Manifest, want) {
+			t.Errorf("child %s has the wrong manifest", desc.Digest)
+		}
+		if child.MediaType != desc.MediaType {
+			t.Errorf("child %s: media type = %s, want %s", desc.Digest, child.MediaType, desc.MediaType)
+		}
+	}
+	if peak > 2 {
+		t.Errorf("fetched %d manifests at once, want at most 2", peak)
+	}
+
+	// A child that can't be fetched is reported, and the rest are returned.
+	mu.Lock()
+	missing = im.Manifests[0].Digest.String()
+	mu.Unlock()
+	children, err = ChildManifests(ref)
+	var cerr *ErrChildManifests
+	if !errors.As(err, &cerr) {
+		t.Fatalf("ChildManifests() = %v, want *ErrChildManifests", err)
+	}
+	if _, ok := cerr.Errors[im.Manifests[0].Digest]; !ok || len(cerr.Errors) != 1 {
+		t.Errorf("Errors = %v, want just %s", cerr.Errors, missing)
+	}
+	if len(children) != len(im.Manifests)-1 {
+		t.Errorf("got %d children, want %d", len(children), len(im.Manifests)-1)
+	}
+
+	// Images aren't indexes.
+	img, err := idx.Image(im.Manifests[1].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgRef := ref.Context().Tag("image")
+	if err := Write(imgRef, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ChildManifests(imgRef); err == nil {
+		t.Error("ChildManifests(image) succeeded, expected error")
+	}
+
+	// An empty index has no children.
+	emptyRef := ref.Context().Tag("empty")
+	if err := WriteIndex(emptyRef, empty.Index); err != nil {
+		t.Fatal(err)
+	}
+	children, err = ChildManifests(emptyRef)
+	if err != nil || len(children) != 0 {
+		t.Errorf("ChildManifests(empty) = %v, %v; want no children", children, err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"sync"
+	"time"
+)
+
+// ChunkResult is how a chunk of a chunked upload went. See ChunkSizer.
+type ChunkResult struct {
+	// Size is the number of bytes in the chunk. It's zero if there's no
+	// chunk to report.
+	Size int64
+
+	// Duration is how long the chunk took to send.
+	Duration time.Duration
+
+	// Err is the error sending the chunk, if it failed.
+	Err error
+}
+
+// ChunkSizer decides how large each chunk of a chunked upload is. See
+// WithChunkSize.
+type ChunkSizer interface {
+	// Next returns the size of the next chunk to send, given how the
+	// previous one went. prev is the zero ChunkResult for the first chunk of
+	// each upload and, with WithParallelChunks, whenever no chunk has
+	// finished since the last call. When a chunk fails, Next is called with
+	// its error and the result is ignored, so that the upload's next attempt
+	// starts with the adjusted size.
+	//
+	// Next may be called concurrently for uploads of different blobs.
+	Next(prev ChunkResult) int64
+}
+
+// FixedChunkSize is a ChunkSizer that always sends chunks of the same size.
+type FixedChunkSize int64
+
+// Next implements ChunkSizer.
+func (s FixedChunkSize) Next(ChunkResult) int64 {
+	return int64(s)
+}
+
+// ChunkSizerFunc adapts a function to a ChunkSizer.
+type ChunkSizerFunc func(prev ChunkResult) int64
+
+// Next implements ChunkSizer.
+func (f ChunkSizerFunc) Next(prev ChunkResult) int64 {
+	return f(prev)
+}
+
+// adaptiveChunkTarget is how long AdaptiveChunkSize aims for each chunk to
+// take to send.
+const adaptiveChunkTarget = 5 * time.Second
+
+// AdaptiveChunkSize returns a ChunkSizer that adapts the size of chunks to
+// the link they're sent over, between min and max bytes. It starts at min and
+// doubles the size after each chunk that takes less than 5 seconds to send,
+// so that fast links are used efficiently, and halves it after each chunk
+// that fails or takes more than 10 seconds, so that slow or flaky links
+// resend less when a chunk fails. The size is shared by every upload that
+// uses the ChunkSizer.
+//
+// min must be positive, and max must be at least min.
+func AdaptiveChunkSize(min, max int64) ChunkSizer {
+	return &adaptiveChunkSize{min: min, max: max, size: min}
+}
+
+type adaptiveChunkSize struct {
+	min, max int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+// Next implements ChunkSizer.
+func (a *adaptiveChunkSize) Next(prev ChunkResult) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case prev.Err != nil, prev.Size > 0 && prev.Duration > 2*adaptiveChunkTarget:
+		a.size /= 2
+	case prev.Size > 0 && prev.Duration < adaptiveChunkTarget:
+		a.size *= 2
+	}
+	if a.size < a.min {
+		a.size = a.min
+	}
+	if a.size > a.max {
+		a.size = a.max
+	}
+	return a.size
+}
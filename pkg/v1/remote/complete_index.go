@@ -0,0 +1,149 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// completeness collects the problems that make an index incomplete. See
+// WithRequireCompleteIndex.
+type completeness struct {
+	allowNondistributable bool
+
+	mu       sync.Mutex
+	problems []string
+
+	// layers are the layers still to be checked, by digest.
+	layers map[v1.Hash]v1.Layer
+}
+
+// checkIndexComplete returns an error listing every child manifest and blob
+// of ii that can't be fetched. The manifests are fetched one at a time, and
+// then the layers are checked, up to o.jobs at a time.
+func checkIndexComplete(ii v1.ImageIndex, o *options) error {
+	c := &completeness{
+		allowNondistributable: o.allowNondistributableArtifacts,
+		layers:                map[v1.Hash]v1.Layer{},
+	}
+	c.index(ii)
+
+	var g errgroup.Group
+	g.SetLimit(o.jobs)
+	for h, l := range c.layers {
+		h, l := h, l
+		g.Go(func() error {
+			if ok, err := partial.Exists(l); err != nil {
+				c.problem("blob %s: %v", h, err)
+			} else if !ok {
+				c.problem("blob %s: not found", h)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if len(c.problems) != 0 {
+		sort.Strings(c.problems)
+		return fmt.Errorf("index is incomplete: %s", strings.Join(c.problems, ", "))
+	}
+	return nil
+}
+
+func (c *completeness) problem(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+func (c *completeness) index(ii v1.ImageIndex) {
+	index, err := ii.IndexManifest()
+	if err != nil {
+		c.problem("index: %v", err)
+		return
+	}
+	for _, desc := range index.Manifests {
+		switch desc.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			child, err := ii.ImageIndex(desc.Digest)
+			if err != nil {
+				c.problem("manifest %s: %v", desc.Digest, err)
+				continue
+			}
+			c.index(child)
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+			img, err := ii.Image(desc.Digest)
+			if err != nil {
+				c.problem("manifest %s: %v", desc.Digest, err)
+				continue
+			}
+			c.image(desc.Digest, img)
+		default:
+			// Like writeIndex, treat anything else as a blob.
+			if wl, ok := ii.(withLayer); ok {
+				l, err := wl.Layer(desc.Digest)
+				if err != nil {
+					c.problem("blob %s: %v", desc.Digest, err)
+					continue
+				}
+				c.layers[desc.Digest] = l
+			}
+		}
+	}
+}
+
+func (c *completeness) image(h v1.Hash, img v1.Image) {
+	// Fetching the manifest and config is cheap, and needed to find the layers.
+	if _, err := img.RawManifest(); err != nil {
+		c.problem("manifest %s: %v", h, err)
+		return
+	}
+	if _, err := img.RawConfigFile(); err != nil {
+		c.problem("config of %s: %v", h, err)
+		return
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		c.problem("layers of %s: %v", h, err)
+		return
+	}
+	for _, l := range ls {
+		if _, ok := l.(*foreignLayer); ok {
+			continue
+		}
+		mt, err := l.MediaType()
+		if err != nil {
+			c.problem("layer of %s: %v", h, err)
+			continue
+		}
+		if !mt.IsDistributable() && !c.allowNondistributable {
+			continue
+		}
+		d, err := l.Digest()
+		if err != nil {
+			c.problem("layer of %s: %v", h, err)
+			continue
+		}
+		c.layers[d] = l
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/google/go-containerregistry/internal/gzip"
+)
+
+// decompressingReadCloser passes the compressed blob it reads through a
+// bufferedPipe to a goroutine that decompresses it for a consumer. It's shared
+// by WithLayerScanner and WithUncompressedTee.
+type decompressingReadCloser struct {
+	rc     io.ReadCloser
+	pipe   *bufferedPipe
+	done   chan error
+	err    error
+	finish func(error) error
+	// abandoned is what the consumer sees if rc is closed before it has been
+	// read completely.
+	abandoned error
+}
+
+// newDecompressingReadCloser returns a ReadCloser that reads rc while consume
+// reads its uncompressed contents, with up to buffer bytes of rc waiting to be
+// decompressed. If consume fails, reading fails with its error.
+//
+// finish, if set, is called with the result of consume once it returns, or
+// with abandoned if the ReadCloser is closed first, and its result is that of
+// the final read. Otherwise, the final read reports consume's error, if any.
+func newDecompressingReadCloser(rc io.ReadCloser, buffer int, consume func(io.Reader) error, finish func(error) error, abandoned error) io.ReadCloser {
+	d := &decompressingReadCloser{
+		rc:        rc,
+		pipe:      newBufferedPipe(buffer),
+		done:      make(chan error, 1),
+		finish:    finish,
+		abandoned: abandoned,
+	}
+	go func() {
+		err := decompress(d.pipe, consume)
+		// Fail the writes to the pipe, and so the reads of d, with err.
+		// Otherwise, drain whatever consume didn't read (e.g. what follows
+		// the end of the gzip stream), so that the transfer isn't blocked.
+		if err != nil {
+			d.pipe.closeRead(err)
+		} else {
+			io.Copy(ioutil.Discard, d.pipe)
+		}
+		d.done <- err
+	}()
+	return d
+}
+
+// decompress passes the contents of r to consume, decompressing them if
+// they're gzipped.
+func decompress(r io.Reader, consume func(io.Reader) error) error {
+	gzipped, pr, err := gzip.Peek(r)
+	if err != nil {
+		return err
+	}
+	var ur io.Reader = pr
+	if gzipped {
+		zr, err := gzip.UnzipReadCloser(ioutil.NopCloser(pr))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		ur = zr
+	}
+	return consume(ur)
+}
+
+// Read implements io.Reader.
+func (d *decompressingReadCloser) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.rc.Read(p)
+	if n > 0 {
+		if _, werr := d.pipe.Write(p[:n]); werr != nil {
+			err = werr
+		}
+	}
+	if err == io.EOF {
+		d.pipe.closeWrite(nil)
+		cerr := <-d.done
+		d.done = nil
+		if d.finish != nil {
+			cerr = d.finish(cerr)
+		}
+		if cerr != nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (d *decompressingReadCloser) Close() error {
+	if d.done != nil {
+		d.pipe.closeWrite(d.abandoned)
+		<-d.done
+		d.done = nil
+		if d.finish != nil {
+			d.finish(d.abandoned)
+		}
+	}
+	return d.rc.Close()
+}
+
+// bufferedPipe is like io.Pipe, except that writes only block once max bytes
+// are waiting to be read.
+type bufferedPipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	max  int
+	// werr is returned by reads once buf is empty; io.EOF for a clean close.
+	werr error
+	// rerr is returned by writes once the reader has failed.
+	rerr error
+}
+
+func newBufferedPipe(max int) *bufferedPipe {
+	p := &bufferedPipe{max: max}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *bufferedPipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		for p.rerr == nil && p.buf.Len() >= p.max {
+			p.cond.Wait()
+		}
+		if p.rerr != nil {
+			return written, p.rerr
+		}
+		n := p.max - p.buf.Len()
+		if n > len(b) {
+			n = len(b)
+		}
+		p.buf.Write(b[:n])
+		b = b[n:]
+		written += n
+		p.cond.Broadcast()
+	}
+	return written, nil
+}
+
+func (p *bufferedPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.buf.Len() == 0 && p.werr == nil {
+		p.cond.Wait()
+	}
+	if p.buf.Len() == 0 {
+		return 0, p.werr
+	}
+	n, _ := p.buf.Read(b)
+	p.cond.Broadcast()
+	return n, nil
+}
+
+// closeWrite makes reads return err, or io.EOF if it's nil, once everything
+// that was written has been read.
+func (p *bufferedPipe) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.werr = err
+	p.cond.Broadcast()
+}
+
+// closeRead makes writes fail with err.
+func (p *bufferedPipe) closeRead(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rerr = err
+	p.cond.Broadcast()
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBufferedPipe(t *testing.T) {
+	p := newBufferedPipe(8)
+
+	// Writes up to the buffer size don't wait for a reader.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := p.Write([]byte("12345678")); err != nil {
+			t.Errorf("Write() = %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() blocked with room in the buffer")
+	}
+
+	// Larger writes wait for the reader to catch up.
+	go func() {
+		p.Write([]byte("9abc"))
+		p.closeWrite(nil)
+	}()
+	got, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "123456789abc" {
+		t.Errorf("read %q, want %q", got, "123456789abc")
+	}
+
+	// Once the reader fails, so do writes.
+	errStop := errors.New("stop")
+	p.closeRead(errStop)
+	if _, err := p.Write([]byte("x")); !errors.Is(err, errStop) {
+		t.Errorf("Write() = %v, want %v", err, errStop)
+	}
+}
@@ -15,8 +15,10 @@
 package remote
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -24,8 +26,10 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/google/go-containerregistry/internal/and"
 	"github.com/google/go-containerregistry/internal/redact"
 	"github.com/google/go-containerregistry/internal/verify"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -53,15 +57,62 @@ func (e *ErrSchema1) Error() string {
 	return fmt.Sprintf("unsupported MediaType: %q, see https://github.com/google/go-containerregistry/issues/377", e.schema)
 }
 
+// ErrDigestMismatch is returned when a reference resolves to a digest other
+// than the one passed to WithExpectedDigest.
+type ErrDigestMismatch struct {
+	Reference name.Reference
+	Expected  v1.Hash
+	Actual    v1.Hash
+}
+
+// Error implements error.
+func (e *ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("%s resolved to %s, expected %s", e.Reference, e.Actual, e.Expected)
+}
+
+// checkExpectedDigest returns an *ErrDigestMismatch if WithExpectedDigest was
+// used and h doesn't match it.
+func checkExpectedDigest(ref name.Reference, o *options, h v1.Hash) error {
+	if o.expectedDigest == nil || *o.expectedDigest == h {
+		return nil
+	}
+	return &ErrDigestMismatch{
+		Reference: ref,
+		Expected:  *o.expectedDigest,
+		Actual:    h,
+	}
+}
+
+// isSchema1 sniffs the schemaVersion of a manifest, since registries that
+// don't set the Content-Type header correctly may still serve schema 1
+// manifests, which would otherwise fail to parse in confusing ways.
+func isSchema1(manifest []byte) bool {
+	var m struct {
+		SchemaVersion int64 `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return false
+	}
+	return m.SchemaVersion == 1
+}
+
 // Descriptor provides access to metadata about remote artifact and accessors
 // for efficiently converting it into a v1.Image or v1.ImageIndex.
 type Descriptor struct {
 	fetcher
 	v1.Descriptor
+
+	// Manifest holds the bytes of the manifest exactly as the registry
+	// served them. They're never re-serialized, so they hash to Digest
+	// (except for signed schema 1 manifests, whose digest comes from the
+	// Docker-Content-Digest header), and the RawManifest of images and
+	// indexes derived from this Descriptor returns them unchanged.
 	Manifest []byte
 
 	// So we can share this implementation with Image..
-	platform v1.Platform
+	platform         v1.Platform
+	platformMatcher  func([]v1.Descriptor) (*v1.Descriptor, error)
+	unknownPlatforms bool
 }
 
 // RawManifest exists to satisfy the Taggable interface.
@@ -73,6 +124,12 @@ func (d *Descriptor) RawManifest() ([]byte, error) {
 // the registry is left un-interpreted, for the most part. This is useful for
 // querying what kind of artifact a reference represents.
 //
+// Artifacts whose manifests use a custom config media type are served as OCI
+// manifests, so they can be fetched without extra configuration. For exotic
+// manifest media types, use WithAcceptedMediaTypes to extend the Accept header;
+// the raw bytes and media type of whatever the registry returns are available
+// via Manifest and MediaType.
+//
 // See Head if you don't need the response body.
 func Get(ref name.Reference, options ...Option) (*Descriptor, error) {
 	acceptable := []types.MediaType{
@@ -99,39 +156,64 @@ func Head(ref name.Reference, options ...Option) (*v1.Descriptor, error) {
 	acceptable = append(acceptable, acceptableImageMediaTypes...)
 	acceptable = append(acceptable, acceptableIndexMediaTypes...)
 
-	o, err := makeOptions(ref.Context(), options...)
+	ref, o, err := makeReferenceOptions(ref, options...)
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := makeFetcher(ref, o)
+	var f *fetcher
+	if o.auth == authn.Anonymous {
+		// HEADs are safe to re-send, so avoid a token exchange unless the
+		// registry actually requires one for this request.
+		f, err = makeLazyFetcher(ref, o)
+	} else {
+		f, err = makeFetcher(ref, o)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return f.headManifest(ref, acceptable)
+	desc, err := f.headManifest(ref, append(acceptable, o.acceptedMediaTypes...))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExpectedDigest(ref, o, desc.Digest); err != nil {
+		return nil, err
+	}
+	return desc, nil
 }
 
 // Handle options and fetch the manifest with the acceptable MediaTypes in the
 // Accept header.
 func get(ref name.Reference, acceptable []types.MediaType, options ...Option) (*Descriptor, error) {
-	o, err := makeOptions(ref.Context(), options...)
+	ref, o, err := makeReferenceOptions(ref, options...)
 	if err != nil {
 		return nil, err
 	}
+	return getWithOptions(ref, acceptable, o)
+}
+
+// getWithOptions is get for a ref that makeReferenceOptions has already
+// rewritten, with the options it returned.
+func getWithOptions(ref name.Reference, acceptable []types.MediaType, o *options) (*Descriptor, error) {
 	f, err := makeFetcher(ref, o)
 	if err != nil {
 		return nil, err
 	}
-	b, desc, err := f.fetchManifest(ref, acceptable)
+	b, desc, err := f.fetchManifest(ref, append(acceptable, o.acceptedMediaTypes...))
 	if err != nil {
 		return nil, err
 	}
+	if err := checkExpectedDigest(ref, o, desc.Digest); err != nil {
+		return nil, err
+	}
 	return &Descriptor{
-		fetcher:    *f,
-		Manifest:   b,
-		Descriptor: *desc,
-		platform:   o.platform,
+		fetcher:          *f,
+		Manifest:         b,
+		Descriptor:       *desc,
+		platform:         o.platform,
+		platformMatcher:  o.platformMatcher,
+		unknownPlatforms: o.unknownPlatforms,
 	}, nil
 }
 
@@ -142,7 +224,8 @@ func get(ref name.Reference, acceptable []types.MediaType, options ...Option) (*
 // If the fetched artifact is an index, it will attempt to resolve the index to
 // a child image with the appropriate platform.
 //
-// See WithPlatform to set the desired platform.
+// See WithPlatform to set the desired platform, or WithPlatformMatcher to
+// choose the child some other way.
 func (d *Descriptor) Image() (v1.Image, error) {
 	switch d.MediaType {
 	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
@@ -151,12 +234,15 @@ func (d *Descriptor) Image() (v1.Image, error) {
 		return nil, newErrSchema1(d.MediaType)
 	case types.OCIImageIndex, types.DockerManifestList:
 		// We want an image but the registry has an index, resolve it to an image.
-		return d.remoteIndex().imageByPlatform(d.platform)
+		return d.remoteIndex().imageByPlatform(d.platform, d.platformMatcher)
 	case types.OCIManifestSchema1, types.DockerManifestSchema2:
 		// These are expected. Enumerated here to allow a default case.
 	default:
 		// We could just return an error here, but some registries (e.g. static
 		// registries) don't set the Content-Type headers correctly, so instead...
+		if isSchema1(d.Manifest) {
+			return nil, newErrSchema1(types.DockerManifestSchema1)
+		}
 		logs.Warn.Printf("Unexpected media type for Image(): %s", d.MediaType)
 	}
 
@@ -187,6 +273,9 @@ func (d *Descriptor) ImageIndex() (v1.ImageIndex, error) {
 	default:
 		// We could just return an error here, but some registries (e.g. static
 		// registries) don't set the Content-Type headers correctly, so instead...
+		if isSchema1(d.Manifest) {
+			return nil, newErrSchema1(types.DockerManifestSchema1)
+		}
 		logs.Warn.Printf("Unexpected media type for ImageIndex(): %s", d.MediaType)
 	}
 	return d.remoteIndex(), nil
@@ -203,30 +292,104 @@ func (d *Descriptor) remoteImage() *remoteImage {
 
 func (d *Descriptor) remoteIndex() *remoteIndex {
 	return &remoteIndex{
-		fetcher:    d.fetcher,
-		manifest:   d.Manifest,
-		mediaType:  d.MediaType,
-		descriptor: &d.Descriptor,
+		fetcher:          d.fetcher,
+		manifest:         d.Manifest,
+		mediaType:        d.MediaType,
+		descriptor:       &d.Descriptor,
+		unknownPlatforms: d.unknownPlatforms,
 	}
 }
 
+// ErrManifestExceedsLimit is returned when a registry serves a manifest that
+// is larger than the limit set by WithMaxManifestSize.
+type ErrManifestExceedsLimit struct {
+	Reference name.Reference
+	// Limit is the size limit, in bytes.
+	Limit int64
+}
+
+// Error implements error.
+func (e *ErrManifestExceedsLimit) Error() string {
+	return fmt.Sprintf("manifest for %s exceeds the limit of %d bytes", e.Reference, e.Limit)
+}
+
 // fetcher implements methods for reading from a registry.
 type fetcher struct {
 	Ref     name.Reference
 	Client  *http.Client
 	context context.Context
+
+	// blobAcceptEncoding is sent as Accept-Encoding when fetching blobs.
+	blobAcceptEncoding string
+
+	// See WithExistingBlobs.
+	hasBlob  func(v1.Hash) bool
+	openBlob func(v1.Hash) (io.ReadCloser, error)
+
+	// offline is set by WithOffline, in which case Client fails every
+	// request and blobs are only read from openBlob.
+	offline bool
+
+	// See WithLayerScanner.
+	layerScanner LayerScanner
+
+	// maxManifestSize is the largest manifest fetchManifest will read.
+	maxManifestSize int64
+
+	// See WithMemoryBlobCache.
+	blobCache *blobCache
+
+	// readBufferSize, if positive, is set by WithReadBufferSize.
+	readBufferSize int
+}
+
+// newFetcher returns a fetcher for ref that makes requests with client, as
+// configured by o.
+func newFetcher(ref name.Reference, o *options, client *http.Client) *fetcher {
+	return &fetcher{
+		Ref:     ref,
+		Client:  client,
+		context: o.context,
+
+		blobAcceptEncoding: o.blobAcceptEncoding,
+		hasBlob:            o.hasBlob,
+		openBlob:           o.openBlob,
+		offline:            o.offline,
+		layerScanner:       o.layerScanner,
+		maxManifestSize:    o.maxManifestSize,
+		blobCache:          o.blobCache,
+		readBufferSize:     o.readBufferSize,
+	}
 }
 
 func makeFetcher(ref name.Reference, o *options) (*fetcher, error) {
-	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, []string{ref.Scope(transport.PullScope)})
+	if o.offline {
+		return makeOfflineFetcher(ref, o), nil
+	}
+	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, addScopes([]string{ref.Scope(transport.PullScope)}, o))
 	if err != nil {
 		return nil, err
 	}
-	return &fetcher{
-		Ref:     ref,
-		Client:  &http.Client{Transport: tr},
-		context: o.context,
-	}, nil
+	return newFetcher(ref, o, &http.Client{Transport: tr}), nil
+}
+
+// makeOfflineFetcher returns a fetcher for WithOffline, which skips the
+// handshake with the registry, since it would fail.
+func makeOfflineFetcher(ref name.Reference, o *options) *fetcher {
+	return newFetcher(ref, o, &http.Client{Transport: o.transport})
+}
+
+// makeLazyFetcher is like makeFetcher, but defers any token exchange until the
+// registry challenges a request. See transport.NewLazyWithContext.
+func makeLazyFetcher(ref name.Reference, o *options) (*fetcher, error) {
+	if o.offline {
+		return makeOfflineFetcher(ref, o), nil
+	}
+	tr, err := transport.NewLazyWithContext(o.context, ref.Context().Registry, o.auth, o.transport, addScopes([]string{ref.Scope(transport.PullScope)}, o))
+	if err != nil {
+		return nil, err
+	}
+	return newFetcher(ref, o, &http.Client{Transport: tr}), nil
 }
 
 // url returns a url.Url for the specified path in the context of this remote image reference.
@@ -239,6 +402,10 @@ func (f *fetcher) url(resource, identifier string) url.URL {
 }
 
 func (f *fetcher) fetchManifest(ref name.Reference, acceptable []types.MediaType) ([]byte, *v1.Descriptor, error) {
+	if manifest, desc, ok, err := f.existingManifest(ref); ok {
+		return manifest, desc, err
+	}
+
 	u := f.url("manifests", ref.Identifier())
 	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
@@ -260,10 +427,21 @@ func (f *fetcher) fetchManifest(ref name.Reference, acceptable []types.MediaType
 		return nil, nil, err
 	}
 
-	manifest, err := ioutil.ReadAll(resp.Body)
+	// Don't let a registry exhaust our memory with an enormous manifest.
+	if f.maxManifestSize > 0 && resp.ContentLength > f.maxManifestSize {
+		return nil, nil, &ErrManifestExceedsLimit{Reference: ref, Limit: f.maxManifestSize}
+	}
+	body := io.Reader(resp.Body)
+	if f.maxManifestSize > 0 {
+		body = io.LimitReader(resp.Body, f.maxManifestSize+1)
+	}
+	manifest, err := ioutil.ReadAll(body)
 	if err != nil {
 		return nil, nil, err
 	}
+	if f.maxManifestSize > 0 && int64(len(manifest)) > f.maxManifestSize {
+		return nil, nil, &ErrManifestExceedsLimit{Reference: ref, Limit: f.maxManifestSize}
+	}
 
 	digest, size, err := v1.SHA256(bytes.NewReader(manifest))
 	if err != nil {
@@ -360,11 +538,21 @@ func (f *fetcher) headManifest(ref name.Reference, acceptable []types.MediaType)
 }
 
 func (f *fetcher) fetchBlob(ctx context.Context, size int64, h v1.Hash) (io.ReadCloser, error) {
+	if rc, ok, err := f.existingBlob(size, h); ok {
+		return rc, err
+	}
+	if rc, ok := f.blobCache.get(h); ok {
+		return rc, nil
+	}
+
 	u := f.url("blobs", h.String())
 	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	if f.blobAcceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", f.blobAcceptEncoding)
+	}
 
 	resp, err := f.Client.Do(req.WithContext(ctx))
 	if err != nil {
@@ -387,7 +575,29 @@ func (f *fetcher) fetchBlob(ctx context.Context, size int64, h v1.Hash) (io.Read
 		}
 	}
 
-	return verify.ReadCloser(resp.Body, size, h)
+	rc, err := verify.ReadCloser(f.bufferBody(resp.Body), size, h)
+	if err != nil {
+		return nil, err
+	}
+	return f.blobCache.fill(rc, size, h), nil
+}
+
+// bufferBody returns body, read f.readBufferSize bytes at a time, if that's
+// set, however small the reads from the returned ReadCloser are.
+func (f *fetcher) bufferBody(body io.ReadCloser) io.ReadCloser {
+	if f.readBufferSize <= 0 {
+		return body
+	}
+	return &and.ReadCloser{Reader: bufio.NewReaderSize(body, f.readBufferSize), CloseFunc: body.Close}
+}
+
+// copyBlob copies src to dst like io.Copy, using a buffer of
+// f.readBufferSize bytes, if that's set.
+func (f *fetcher) copyBlob(dst io.Writer, src io.Reader) (int64, error) {
+	if f.readBufferSize <= 0 {
+		return io.Copy(dst, src)
+	}
+	return io.CopyBuffer(dst, src, make([]byte, f.readBufferSize))
 }
 
 func (f *fetcher) headBlob(h v1.Hash) (*http.Response, error) {
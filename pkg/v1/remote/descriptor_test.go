@@ -15,18 +15,25 @@
 package remote
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
@@ -92,6 +99,71 @@ func TestGetSchema1(t *testing.T) {
 	}
 }
 
+func TestGetSchema1WrongMediaType(t *testing.T) {
+	expectedRepo := "foo/bar"
+	manifestPath := fmt.Sprintf("/v2/%s/manifests/latest", expectedRepo)
+	blob := []byte("blobs don't care about schemas")
+	blobDigest, _, err := v1.SHA256(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobPath := fmt.Sprintf("/v2/%s/blobs/%s", expectedRepo, blobDigest)
+	manifest := fmt.Sprintf(`{"schemaVersion":1,"name":%q,"tag":"latest","fsLayers":[{"blobSum":%q}]}`, expectedRepo, blobDigest)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case manifestPath:
+			// Some registries don't set the Content-Type correctly.
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(manifest))
+		case blobPath:
+			w.Write(blob)
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%v) = %v", server.URL, err)
+	}
+
+	tag := mustNewTag(t, fmt.Sprintf("%s/%s:latest", u.Host, expectedRepo))
+
+	desc, err := Get(tag)
+	if err != nil {
+		t.Fatalf("Get(%s) = %v", tag, err)
+	}
+
+	var s1err *ErrSchema1
+	if _, err := desc.Image(); !errors.As(err, &s1err) {
+		t.Errorf("Image() = %v, expected remote.ErrSchema1", err)
+	}
+	if _, err := desc.ImageIndex(); !errors.As(err, &s1err) {
+		t.Errorf("ImageIndex() = %v, expected remote.ErrSchema1", err)
+	}
+
+	// Blobs are schema-agnostic, so we should still be able to read them.
+	l, err := Layer(tag.Context().Digest(blobDigest.String()))
+	if err != nil {
+		t.Fatalf("Layer() = %v", err)
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		t.Fatalf("Compressed() = %v", err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Errorf("Compressed() = %q, want %q", got, blob)
+	}
+}
+
 func TestGetImageAsIndex(t *testing.T) {
 	expectedRepo := "foo/bar"
 	manifestPath := fmt.Sprintf("/v2/%s/manifests/latest", expectedRepo)
@@ -257,3 +329,457 @@ func (errTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	return nil, fmt.Errorf("error reaching %s", req.URL.String())
 }
+
+func TestHeadLazyTokenExchange(t *testing.T) {
+	expectedRepo := "foo/bar"
+	fakeDigest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	manifestPath := fmt.Sprintf("/v2/%s/manifests/latest", expectedRepo)
+
+	for _, tc := range []struct {
+		name        string
+		requireAuth bool
+		wantTokens  int32
+	}{{
+		name:       "anonymous allowed",
+		wantTokens: 0,
+	}, {
+		name:        "auth required",
+		requireAuth: true,
+		wantTokens:  1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var tokens int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				challenge := fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host)
+				switch r.URL.Path {
+				case "/v2/":
+					w.Header().Set("WWW-Authenticate", challenge)
+					w.WriteHeader(http.StatusUnauthorized)
+				case "/token":
+					atomic.AddInt32(&tokens, 1)
+					w.Write([]byte(`{"token": "mytoken"}`))
+				case manifestPath:
+					if tc.requireAuth && r.Header.Get("Authorization") != "Bearer mytoken" {
+						w.Header().Set("WWW-Authenticate", challenge)
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					w.Header().Set("Content-Type", string(types.DockerManifestSchema2))
+					w.Header().Set("Content-Length", "2")
+					w.Header().Set("Docker-Content-Digest", fakeDigest)
+				default:
+					t.Fatalf("Unexpected path: %v", r.URL.Path)
+				}
+			}))
+			defer server.Close()
+			u, err := url.Parse(server.URL)
+			if err != nil {
+				t.Fatalf("url.Parse(%v) = %v", server.URL, err)
+			}
+
+			tag := mustNewTag(t, fmt.Sprintf("%s/%s:latest", u.Host, expectedRepo))
+			desc, err := Head(tag)
+			if err != nil {
+				t.Fatalf("Head(%s) = %v", tag, err)
+			}
+			if desc.Digest.String() != fakeDigest {
+				t.Errorf("Descriptor.Digest = %q, expected %q", desc.Digest, fakeDigest)
+			}
+			if got := atomic.LoadInt32(&tokens); got != tc.wantTokens {
+				t.Errorf("token requests = %d, want %d", got, tc.wantTokens)
+			}
+		})
+	}
+}
+
+func TestExpectedDigest(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(fmt.Sprintf("%s/pinned/image:latest", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(tag, img); err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The expected digest is fine.
+	if _, err := Image(tag, WithExpectedDigest(want)); err != nil {
+		t.Errorf("Image() = %v", err)
+	}
+	if _, err := Head(tag, WithExpectedDigest(want)); err != nil {
+		t.Errorf("Head() = %v", err)
+	}
+
+	// Move the tag.
+	other, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(tag, other); err != nil {
+		t.Fatal(err)
+	}
+	got, err := other.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld, err := ls[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		f      func() error
+		actual v1.Hash
+	}{{
+		name: "Get",
+		f: func() error {
+			_, err := Get(tag, WithExpectedDigest(want))
+			return err
+		},
+		actual: got,
+	}, {
+		name: "Head",
+		f: func() error {
+			_, err := Head(tag, WithExpectedDigest(want))
+			return err
+		},
+		actual: got,
+	}, {
+		name: "Image",
+		f: func() error {
+			_, err := Image(tag, WithExpectedDigest(want))
+			return err
+		},
+		actual: got,
+	}, {
+		name: "Layer",
+		f: func() error {
+			_, err := Layer(tag.Context().Digest(ld.String()), WithExpectedDigest(want))
+			return err
+		},
+		actual: ld,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.f()
+			var mismatch *ErrDigestMismatch
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("got %v, want ErrDigestMismatch", err)
+			}
+			if mismatch.Expected != want || mismatch.Actual != tc.actual {
+				t.Errorf("got expected %s and actual %s, want %s and %s", mismatch.Expected, mismatch.Actual, want, tc.actual)
+			}
+		})
+	}
+}
+
+func TestGetArtifact(t *testing.T) {
+	expectedRepo := "foo/bar"
+	manifestPath := fmt.Sprintf("/v2/%s/manifests/latest", expectedRepo)
+	artifactType := types.MediaType("application/vnd.example.artifact.v1+json")
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.example.config.v1+json","size":2,"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[]}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case manifestPath:
+			accept := r.Header.Get("Accept")
+			for _, mt := range []types.MediaType{types.OCIManifestSchema1, types.OCIImageIndex, artifactType} {
+				if !strings.Contains(accept, string(mt)) {
+					t.Errorf("Accept = %q, missing %q", accept, mt)
+				}
+			}
+			w.Header().Set("Content-Type", string(types.OCIManifestSchema1))
+			w.Write(manifest)
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%v) = %v", server.URL, err)
+	}
+
+	tag := mustNewTag(t, fmt.Sprintf("%s/%s:latest", u.Host, expectedRepo))
+	desc, err := Get(tag, WithAcceptedMediaTypes(artifactType))
+	if err != nil {
+		t.Fatalf("Get(%s) = %v", tag, err)
+	}
+	if desc.MediaType != types.OCIManifestSchema1 {
+		t.Errorf("MediaType = %q, want %q", desc.MediaType, types.OCIManifestSchema1)
+	}
+	if diff := cmp.Diff(manifest, desc.Manifest); diff != "" {
+		t.Errorf("Manifest (-want +got) = %s", diff)
+	}
+}
+
+func TestReferenceRewriter(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirrorRepo := func(repo string) name.Repository {
+		r, err := name.NewRepository(fmt.Sprintf("%s/mirror/%s", u.Host, repo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirrored := mirrorRepo("library/foo").Tag("latest")
+	if err := Write(mirrored, img); err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens on upstream.invalid, so any request that isn't
+	// rewritten fails.
+	rewrite := WithReferenceRewriter(func(ref name.Reference) name.Reference {
+		if ref.Context().RegistryStr() != "upstream.invalid" {
+			return ref
+		}
+		repo := mirrorRepo(ref.Context().RepositoryStr())
+		if _, ok := ref.(name.Digest); ok {
+			// Drop the digest to check that it is preserved.
+			return repo.Tag("latest")
+		}
+		return repo.Tag(ref.Identifier())
+	})
+
+	tag, err := name.NewTag("upstream.invalid/library/foo:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Image(tag, rewrite)
+	if err != nil {
+		t.Fatalf("Image(%s) = %v", tag, err)
+	}
+	if d, err := got.Digest(); err != nil {
+		t.Fatal(err)
+	} else if d != dgst {
+		t.Errorf("Image(%s).Digest() = %s, want %s", tag, d, dgst)
+	}
+	ls, err := got.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml, ok := ls[0].(*MountableLayer)
+	if !ok {
+		t.Fatalf("layer is %T, want *MountableLayer", ls[0])
+	}
+	if want := mirrored.Context(); ml.Reference.Context() != want {
+		t.Errorf("MountableLayer.Reference = %s, want repository %s", ml.Reference, want)
+	}
+
+	digest := tag.Context().Digest(dgst.String())
+	desc, err := Head(digest, rewrite)
+	if err != nil {
+		t.Fatalf("Head(%s) = %v", digest, err)
+	}
+	if desc.Digest != dgst {
+		t.Errorf("Head(%s).Digest = %s, want %s", digest, desc.Digest, dgst)
+	}
+	if _, err := Get(digest, rewrite); err != nil {
+		t.Errorf("Get(%s) = %v", digest, err)
+	}
+
+	ld, err := ls[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Layer(tag.Context().Digest(ld.String()), rewrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Size(); err != nil {
+		t.Errorf("Layer().Size() = %v", err)
+	}
+
+	// A digest that the mirror doesn't have shouldn't silently resolve to
+	// whatever the rewritten tag points at.
+	other := tag.Context().Digest("sha256:" + strings.Repeat("0", 64))
+	if _, err := Get(other, rewrite); err == nil {
+		t.Errorf("Get(%s) = nil, expected error", other)
+	}
+}
+
+func TestRawManifestVerbatim(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host)).Context()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(repo.Tag("img"), img); err != nil {
+		t.Fatal(err)
+	}
+
+	// Serialize the manifests in ways that re-marshaling wouldn't reproduce:
+	// indented, with keys out of order, and with a trailing newline.
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb = append(mb, '\n')
+	mh, msz, err := v1.SHA256(bytes.NewReader(mb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Put(repo.Digest(mh.String()), &rawManifest{raw: mb, mediaType: m.MediaType}); err != nil {
+		t.Fatal(err)
+	}
+	ib := []byte(fmt.Sprintf(`{"manifests":[{"size":%d,"digest":%q,"mediaType":%q,"platform":{"os":"linux","architecture":"amd64"}}],"mediaType":%q,"schemaVersion":2}`+"\n",
+		msz, mh, m.MediaType, types.OCIImageIndex))
+	ih, _, err := v1.SHA256(bytes.NewReader(ib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Put(repo.Digest(ih.String()), &rawManifest{raw: ib, mediaType: types.OCIImageIndex}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(desc string, want []byte, h v1.Hash, got []byte, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %s, want %s", desc, got, want)
+		}
+		if gh, _, err := v1.SHA256(bytes.NewReader(got)); err != nil || gh != h {
+			t.Errorf("%s: bytes hash to %s, want %s", desc, gh, h)
+		}
+	}
+
+	d, err := Get(repo.Digest(mh.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("Get(image)", mb, mh, d.Manifest, nil)
+	ri, err := d.Image()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ri.RawManifest()
+	check("Image().RawManifest()", mb, mh, b, err)
+
+	d, err = Get(repo.Digest(ih.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("Get(index)", ib, ih, d.Manifest, nil)
+	idx, err := d.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = idx.RawManifest()
+	check("ImageIndex().RawManifest()", ib, ih, b, err)
+	child, err := idx.Image(mh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = child.RawManifest()
+	check("child RawManifest()", mb, mh, b, err)
+
+	// Resolving the index to an image by platform must not re-serialize it.
+	ri, err = d.Image()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ri.RawManifest()
+	check("Image() of index", mb, mh, b, err)
+}
+
+func TestMaxManifestSize(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pad the manifest out to 8 KiB.
+	m.Annotations = map[string]string{"padding": strings.Repeat("x", 8<<10)}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("chunked %t", chunked), func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					return
+				}
+				w.Header().Set("Content-Type", string(m.MediaType))
+				if chunked {
+					// Flushing before writing the body omits Content-Length.
+					w.(http.Flusher).Flush()
+				}
+				w.Write(b)
+			}))
+			defer s.Close()
+			u, err := url.Parse(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+			if _, err := Get(ref); err != nil {
+				t.Errorf("Get() with the default limit = %v", err)
+			}
+			_, err = Get(ref, WithMaxManifestSize(4<<10))
+			var lerr *ErrManifestExceedsLimit
+			if !errors.As(err, &lerr) {
+				t.Fatalf("Get() = %v, want *ErrManifestExceedsLimit", err)
+			}
+			if lerr.Limit != 4<<10 {
+				t.Errorf("Limit = %d, want %d", lerr.Limit, 4<<10)
+			}
+		})
+	}
+
+	if _, err := makeOptions(nil, WithMaxManifestSize(0)); err == nil {
+		t.Error("WithMaxManifestSize(0) = nil")
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/internal/and"
+	"github.com/google/go-containerregistry/internal/gzip"
+	"github.com/google/go-containerregistry/internal/redact"
+	"github.com/google/go-containerregistry/internal/verify"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// extractWindow is how much of an uncompressed layer ExtractFile requests at
+// a time while it looks through the layer's tar headers.
+const extractWindow = 64 << 10
+
+// ExtractFile returns the contents of the regular file at filePath in the
+// layer referenced by ref, e.g. to read /etc/os-release without pulling the
+// whole layer. filePath is matched against the names in the layer's tar
+// after cleaning both, so "etc/os-release" and "./etc/os-release" match too.
+// If the layer has no such file, the error wraps os.ErrNotExist.
+//
+// If the layer is an uncompressed tar and the registry supports Range
+// requests, only the tar headers up to the file and the file itself are
+// downloaded. Otherwise, e.g. for gzipped layers, the layer is streamed up to
+// the end of the file.
+//
+// Either way, the layer is never read completely, so the file can't be
+// verified against the layer's digest.
+func ExtractFile(ref name.Digest, filePath string, options ...Option) (io.ReadCloser, error) {
+	rewritten, o, err := makeReferenceOptions(ref, options...)
+	if err != nil {
+		return nil, err
+	}
+	ref = rewritten.(name.Digest)
+	f, err := makeFetcher(ref, o)
+	if err != nil {
+		return nil, err
+	}
+	h, err := v1.NewHash(ref.Identifier())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExpectedDigest(ref, o, h); err != nil {
+		return nil, err
+	}
+
+	e := &extractor{fetcher: f, ctx: o.context, h: h, path: cleanTarPath(filePath)}
+	rc, err := e.extract()
+	if err != nil {
+		return nil, fmt.Errorf("extracting %s from %s: %w", filePath, ref, err)
+	}
+	return rc, nil
+}
+
+// extractor finds a file in the layer h.
+type extractor struct {
+	*fetcher
+	ctx  context.Context
+	h    v1.Hash
+	path string
+
+	// buf holds the bytes of the layer starting at off, as read by ReadAt.
+	buf []byte
+	off int64
+}
+
+func (e *extractor) extract() (io.ReadCloser, error) {
+	// Read the first tar header to see whether we can use Range requests.
+	resp, err := e.getRange(0, 511)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		// The registry ignored our Range header, so we might as well use what
+		// it's sending.
+		return e.scan(resp.Body)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	size := contentRangeSize(resp.Header.Get("Content-Range"))
+	if size < 0 || !isUstar(b) {
+		// Compressed, or we can't tell where it ends.
+		rc, err := e.fetchBlob(e.ctx, verify.SizeUnknown, e.h)
+		if err != nil {
+			return nil, err
+		}
+		return e.scan(rc)
+	}
+	e.buf, e.off = b, 0
+	return e.seek(size)
+}
+
+// seek walks the tar headers of an uncompressed layer of the given size with
+// Range requests, skipping over the contents of the other files.
+func (e *extractor) seek(size int64) (io.ReadCloser, error) {
+	sr := io.NewSectionReader(e, 0, size)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cleanTarPath(hdr.Name) != e.path {
+			continue
+		}
+		if err := checkRegular(hdr); err != nil {
+			return nil, err
+		}
+		if isSparse(hdr) {
+			// The file's contents aren't stored in one piece, so let tar put
+			// them back together.
+			return ioutil.NopCloser(tr), nil
+		}
+		if hdr.Size == 0 {
+			return ioutil.NopCloser(bytes.NewReader(nil)), nil
+		}
+		// tar has read up to the start of the file's contents.
+		start, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := e.getRange(start, start+hdr.Size-1)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.checkPartial(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return &and.ReadCloser{
+			Reader:    io.LimitReader(resp.Body, hdr.Size),
+			CloseFunc: resp.Body.Close,
+		}, nil
+	}
+}
+
+// scan reads the layer from rc until it finds the file.
+func (e *extractor) scan(rc io.ReadCloser) (io.ReadCloser, error) {
+	gzipped, pr, err := gzip.Peek(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	var ur io.Reader = pr
+	closeAll := rc.Close
+	if gzipped {
+		zr, err := gzip.UnzipReadCloser(ioutil.NopCloser(pr))
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		ur = zr
+		closeAll = func() error {
+			zr.Close()
+			return rc.Close()
+		}
+	}
+
+	tr := tar.NewReader(ur)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			closeAll()
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if cleanTarPath(hdr.Name) != e.path {
+			continue
+		}
+		if err := checkRegular(hdr); err != nil {
+			closeAll()
+			return nil, err
+		}
+		return &and.ReadCloser{Reader: tr, CloseFunc: closeAll}, nil
+	}
+}
+
+// ReadAt implements io.ReaderAt for the layer, requesting extractWindow bytes
+// at a time.
+func (e *extractor) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		at := off + int64(n)
+		if at < e.off || at >= e.off+int64(len(e.buf)) {
+			if err := e.fill(at); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], e.buf[at-e.off:])
+	}
+	return n, nil
+}
+
+func (e *extractor) fill(off int64) error {
+	resp, err := e.getRange(off, off+extractWindow-1)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := e.checkPartial(resp); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	e.buf, e.off = b, off
+	return nil
+}
+
+// getRange requests the bytes from start to end, inclusive, of the layer. The
+// response is either 206 Partial Content or, if the registry ignored the Range
+// header, 200 OK.
+func (e *extractor) getRange(start, end int64) (*http.Response, error) {
+	u := e.url("blobs", e.h.String())
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if e.blobAcceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", e.blobAcceptEncoding)
+	}
+	resp, err := e.Client.Do(req.WithContext(e.ctx))
+	if err != nil {
+		return nil, redact.Error(err)
+	}
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkPartial returns an error if the registry ignored the Range header of a
+// request after honoring an earlier one.
+func (e *extractor) checkPartial(resp *http.Response) error {
+	if resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+	u := e.url("blobs", e.h.String())
+	return fmt.Errorf("GET %s: expected %d for a Range request, got %d", u.String(), http.StatusPartialContent, resp.StatusCode)
+}
+
+// contentRangeSize returns the complete length from a Content-Range header,
+// or -1 if it's missing or unknown.
+func contentRangeSize(cr string) int64 {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return -1
+	}
+	return size
+}
+
+// isUstar reports whether b starts with a POSIX or GNU tar header.
+func isUstar(b []byte) bool {
+	return len(b) >= 263 && bytes.HasPrefix(b[257:], []byte("ustar"))
+}
+
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRegular(hdr *tar.Header) error {
+	if !hdr.FileInfo().Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", hdr.Name)
+	}
+	return nil
+}
+
+func cleanTarPath(p string) string {
+	return path.Clean("/" + p)
+}
@@ -0,0 +1,189 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// countingWriter counts the bytes of the response bodies it writes.
+type countingWriter struct {
+	http.ResponseWriter
+	n *int
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	*w.n += len(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestExtractFile(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 1<<20)
+	osRelease := []byte("ID=test\n")
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, f := range []struct {
+		name     string
+		typeflag byte
+		contents []byte
+	}{
+		{name: "usr/", typeflag: tar.TypeDir},
+		{name: "usr/big", typeflag: tar.TypeReg, contents: big},
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "./etc/os-release", typeflag: tar.TypeReg, contents: osRelease},
+		{name: "etc/empty", typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     f.name,
+			Typeflag: f.typeflag,
+			Mode:     0644,
+			Size:     int64(len(f.contents)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	if _, err := zw.Write(layer.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := map[string][]byte{}
+	for _, b := range [][]byte{layer.Bytes(), gzipped.Bytes()} {
+		h, _, err := v1.SHA256(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs[h.String()] = b
+	}
+
+	served := 0
+	ignoreRange := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		b, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/foo/blobs/")]
+		if !ok {
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(countingWriter{w, &served}, r, "", time.Time{}, bytes.NewReader(b))
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := func(b []byte) name.Digest {
+		h, _, err := v1.SHA256(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.NewDigest(fmt.Sprintf("%s/foo@%s", u.Host, h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		blob        []byte
+		path        string
+		ignoreRange bool
+		want        []byte
+		// maxServed, if set, is the most of the layer that should be read.
+		maxServed int
+	}{{
+		desc:      "range",
+		blob:      layer.Bytes(),
+		path:      "/etc/os-release",
+		want:      osRelease,
+		maxServed: 2 * extractWindow,
+	}, {
+		desc:      "range empty file",
+		blob:      layer.Bytes(),
+		path:      "etc/empty",
+		want:      []byte{},
+		maxServed: 2 * extractWindow,
+	}, {
+		desc:        "range ignored",
+		blob:        layer.Bytes(),
+		path:        "etc/os-release",
+		ignoreRange: true,
+		want:        osRelease,
+	}, {
+		desc: "gzipped",
+		blob: gzipped.Bytes(),
+		path: "etc/os-release",
+		want: osRelease,
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			served, ignoreRange = 0, tc.ignoreRange
+			rc, err := ExtractFile(digest(tc.blob), tc.path)
+			if err != nil {
+				t.Fatalf("ExtractFile() = %v", err)
+			}
+			defer rc.Close()
+			got, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("ExtractFile() = %q, want %q", got, tc.want)
+			}
+			if tc.maxServed != 0 && served > tc.maxServed {
+				t.Errorf("served %d bytes of a %d byte layer, want at most %d", served, len(tc.blob), tc.maxServed)
+			}
+		})
+	}
+
+	for _, blob := range [][]byte{layer.Bytes(), gzipped.Bytes()} {
+		if _, err := ExtractFile(digest(blob), "etc/missing"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("ExtractFile(missing) = %v, want %v", err, os.ErrNotExist)
+		}
+		if _, err := ExtractFile(digest(blob), "usr"); err == nil {
+			t.Error("ExtractFile(directory) = nil, expected error")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// foreignMediaType returns the non-distributable equivalent of a layer
+// media type.
+func foreignMediaType(mt types.MediaType) types.MediaType {
+	switch mt {
+	case types.OCILayer:
+		return types.OCIRestrictedLayer
+	case types.OCIUncompressedLayer:
+		return types.OCIUncompressedRestrictedLayer
+	case types.DockerLayer, types.DockerUncompressedLayer:
+		return types.DockerForeignLayer
+	}
+	return mt
+}
+
+// withForeignURLs marks the layers of img that have an entry in urls as
+// foreign, replacing their descriptors' URLs and media types. Layers without
+// an entry are left as they are.
+func withForeignURLs(img v1.Image, urls map[v1.Hash][]string) (v1.Image, error) {
+	return redescribeLayers(img, func(l v1.Layer, desc *v1.Descriptor) (v1.Layer, error) {
+		u, ok := urls[desc.Digest]
+		if !ok {
+			return l, nil
+		}
+		desc.URLs = u
+		desc.MediaType = foreignMediaType(desc.MediaType)
+		return &foreignLayer{describedLayer{Layer: l, desc: *desc}}, nil
+	})
+}
+
+// foreignLayer is a layer whose blob lives at the URLs in its descriptor
+// rather than in the registry.
+type foreignLayer struct {
+	describedLayer
+}
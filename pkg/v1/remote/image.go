@@ -16,14 +16,18 @@ package remote
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"sync"
 
+	"github.com/google/go-containerregistry/internal/and"
+	"github.com/google/go-containerregistry/internal/gzip"
 	"github.com/google/go-containerregistry/internal/redact"
 	"github.com/google/go-containerregistry/internal/verify"
+	"github.com/google/go-containerregistry/pkg/compression"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
@@ -59,6 +63,27 @@ func Image(ref name.Reference, options ...Option) (v1.Image, error) {
 	return desc.Image()
 }
 
+// ConfigFile fetches the manifest of the remote image ref and then just its
+// config blob, returning the parsed config file. No layers are fetched.
+//
+// If ref refers to an index, it is resolved to the child image matching the
+// platform set by WithPlatform (linux/amd64 by default), and an error is
+// returned if the index has no such child.
+func ConfigFile(ref name.Reference, options ...Option) (*v1.ConfigFile, error) {
+	desc, err := Get(ref, options...)
+	if err != nil {
+		return nil, err
+	}
+	img, err := desc.Image()
+	if err != nil {
+		if desc.MediaType.IsIndex() {
+			return nil, fmt.Errorf("%s is an index, use remote.WithPlatform to select an image: %w", ref, err)
+		}
+		return nil, err
+	}
+	return img.ConfigFile()
+}
+
 func (r *remoteImage) MediaType() (types.MediaType, error) {
 	if string(r.mediaType) != "" {
 		return r.mediaType, nil
@@ -144,6 +169,21 @@ func (rl *remoteImageLayer) Digest() (v1.Hash, error) {
 
 // Compressed implements partial.CompressedLayer
 func (rl *remoteImageLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := rl.compressed()
+	if err != nil || rl.ri.layerScanner == nil {
+		return rc, err
+	}
+	// The config blob isn't a layer.
+	if m, err := partial.Manifest(rl.ri); err != nil {
+		rc.Close()
+		return nil, err
+	} else if m.Config.Digest == rl.digest {
+		return rc, nil
+	}
+	return scanLayer(rc, rl.digest, rl.ri.layerScanner), nil
+}
+
+func (rl *remoteImageLayer) compressed() (io.ReadCloser, error) {
 	urls := []url.URL{rl.ri.url("blobs", rl.digest.String())}
 
 	// Add alternative layer sources from URLs (usually none).
@@ -155,6 +195,9 @@ func (rl *remoteImageLayer) Compressed() (io.ReadCloser, error) {
 	if d.Data != nil {
 		return verify.ReadCloser(ioutil.NopCloser(bytes.NewReader(d.Data)), d.Size, d.Digest)
 	}
+	if rc, ok := rl.ri.blobCache.get(rl.digest); ok {
+		return rc, nil
+	}
 
 	// We don't want to log binary layers -- this can break terminals.
 	ctx := redact.NewContext(rl.ri.context, "omitting binary blobs from logs")
@@ -177,6 +220,9 @@ func (rl *remoteImageLayer) Compressed() (io.ReadCloser, error) {
 		if err != nil {
 			return nil, err
 		}
+		if rl.ri.blobAcceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", rl.ri.blobAcceptEncoding)
+		}
 
 		resp, err := rl.ri.Client.Do(req.WithContext(ctx))
 		if err != nil {
@@ -190,12 +236,85 @@ func (rl *remoteImageLayer) Compressed() (io.ReadCloser, error) {
 			continue
 		}
 
-		return verify.ReadCloser(resp.Body, d.Size, rl.digest)
+		rc, err := verify.ReadCloser(rl.ri.bufferBody(resp.Body), d.Size, rl.digest)
+		if err != nil {
+			return nil, err
+		}
+		return rl.ri.blobCache.fill(rc, d.Size, rl.digest), nil
 	}
 
 	return nil, lastErr
 }
 
+// Uncompressed implements partial.UncompressedLayer. If the image's config file
+// has a DiffID for the layer, the uncompressed contents are verified against
+// it, so that a registry can't serve correctly compressed bytes that
+// decompress to something other than what the image claims. Layers of images
+// whose config has no diff_ids, like artifacts, aren't verified.
+func (rl *remoteImageLayer) Uncompressed() (io.ReadCloser, error) {
+	return uncompressedLayer(rl, rl.Compressed)
+}
+
+// uncompressedLayer decompresses the blob returned by compressed, verifying
+// it against rl's DiffID if it has one.
+func uncompressedLayer(rl *remoteImageLayer, compressed func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	rc, err := compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	// The config blob has no DiffID, but it's never compressed, and Compressed
+	// has already verified its digest.
+	if m, err := partial.Manifest(rl.ri); err != nil {
+		rc.Close()
+		return nil, err
+	} else if m.Config.Digest == rl.digest {
+		return rc, nil
+	}
+
+	// Artifacts' configs, like the empty JSON blob, don't have diff_ids.
+	diffID, diffIDErr := rl.DiffID()
+	verified := func(urc io.ReadCloser) (io.ReadCloser, error) {
+		if diffIDErr != nil {
+			return urc, nil
+		}
+		return verify.ReadCloser(urc, verify.SizeUnknown, diffID)
+	}
+
+	if mt, err := rl.MediaType(); err == nil {
+		if decompress, ok := compression.Lookup(mt); ok {
+			urc, err := decompress(rc)
+			if err != nil {
+				rc.Close()
+				return nil, err
+			}
+			return verified(urc)
+		}
+	}
+
+	// Often, the "compressed" bytes are not actually gzip-compressed.
+	// Peek at the first two bytes to determine whether or not it's correct to
+	// wrap this with gzip.UnzipReadCloser.
+	gzipped, pr, err := gzip.Peek(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	var urc io.ReadCloser = &and.ReadCloser{
+		Reader:    pr,
+		CloseFunc: rc.Close,
+	}
+	if gzipped {
+		urc, err = gzip.UnzipReadCloser(urc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+
+	return verified(urc)
+}
+
 // Manifest implements partial.WithManifest so that we can use partial.BlobSize below.
 func (rl *remoteImageLayer) Manifest() (*v1.Manifest, error) {
 	return partial.Manifest(rl.ri)
@@ -241,8 +360,36 @@ func (rl *remoteImageLayer) Exists() (bool, error) {
 
 // LayerByDigest implements partial.CompressedLayer
 func (r *remoteImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
-	return &remoteImageLayer{
+	rl := &remoteImageLayer{
 		ri:     r,
 		digest: h,
-	}, nil
+	}
+	if r.hasBlob != nil && r.hasBlob(h) {
+		return &existingImageLayer{rl}, nil
+	}
+	return rl, nil
+}
+
+// existingImageLayer is a remoteImageLayer whose contents are available
+// locally. See WithExistingBlobs.
+type existingImageLayer struct {
+	*remoteImageLayer
+}
+
+// Compressed implements partial.CompressedLayer
+func (el *existingImageLayer) Compressed() (io.ReadCloser, error) {
+	size, err := el.Size()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := el.ri.openBlob(el.digest)
+	if err != nil {
+		return nil, err
+	}
+	return verify.ReadCloser(rc, size, el.digest)
+}
+
+// Uncompressed implements partial.UncompressedLayer
+func (el *existingImageLayer) Uncompressed() (io.ReadCloser, error) {
+	return uncompressedLayer(el.remoteImageLayer, el.Compressed)
 }
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -25,6 +26,8 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -34,9 +37,11 @@ import (
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/static"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/go-containerregistry/pkg/v1/validate"
 )
@@ -739,3 +744,565 @@ func TestData(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUncompressedVerifiesDiffID(t *testing.T) {
+	img := randomImage(t)
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Claim the layer decompresses to something else entirely.
+	cf.RootFS.DiffIDs[0] = v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}
+	cb, err := json.Marshal(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config.Data = cb
+	manifest.Config.Digest, manifest.Config.Size, err = v1.SHA256(bytes.NewReader(cb))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Layers[0].Data = lb
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/test/manifests/latest":
+			w.Write(rawManifest)
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%v) = %v", server.URL, err)
+	}
+	ref, err := newReference(u.Host, "test", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmt, err := Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rls, err := rmt.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The compressed bytes are fine.
+	crc, err := rls[0].Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, crc); err != nil {
+		t.Errorf("reading Compressed() = %v", err)
+	}
+
+	// But the uncompressed bytes don't match the DiffID.
+	urc, err := rls[0].Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer urc.Close()
+	if _, err := io.Copy(ioutil.Discard, urc); err == nil {
+		t.Error("reading Uncompressed() succeeded, expected DiffID mismatch")
+	}
+}
+
+func TestUncompressedWithoutDiffIDs(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository(fmt.Sprintf("%s/artifact", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An artifact, whose empty JSON config has no diff_ids.
+	layer, err := random.Layer(1024, types.OCILayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLayer(repo, layer); err != nil {
+		t.Fatal(err)
+	}
+	config := []byte("{}")
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLayer(repo, static.NewLayer(config, types.OCIEmptyJSON)); err != nil {
+		t.Fatal(err)
+	}
+	ld, err := partial.Descriptor(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: types.OCIEmptyJSON,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []v1.Descriptor{*ld},
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := repo.Tag("latest")
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/v2/artifact/manifests/latest", s.URL), bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", string(types.OCIManifestSchema1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT manifest = %d", resp.StatusCode)
+	}
+
+	img, err := Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a DiffID to check, the layer is still decompressed.
+	urc, err := ls[0].Uncompressed()
+	if err != nil {
+		t.Fatalf("Uncompressed() = %v", err)
+	}
+	defer urc.Close()
+	got, err := ioutil.ReadAll(urc)
+	if err != nil {
+		t.Fatalf("reading Uncompressed() = %v", err)
+	}
+	want, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer want.Close()
+	wb, err := ioutil.ReadAll(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, wb) {
+		t.Error("Uncompressed() returned different contents than were pushed")
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registry.New()
+	var blobs []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			blobs = append(blobs, path.Base(r.URL.Path))
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s/config/file:image", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ConfigFile(ref)
+	if err != nil {
+		t.Fatalf("ConfigFile() = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ConfigFile() (-want +got) = %s", diff)
+	}
+	if diff := cmp.Diff([]string{m.Config.Digest.String()}, blobs); diff != "" {
+		t.Errorf("ConfigFile() fetched unexpected blobs (-want +got) = %s", diff)
+	}
+
+	// An index needs a platform that matches one of its children.
+	platform := v1.Platform{OS: "linux", Architecture: "arm64"}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: img,
+		Descriptor: v1.Descriptor{
+			Platform: &platform,
+		},
+	})
+	idxRef := ref.Context().Tag("index")
+	if err := WriteIndex(idxRef, idx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConfigFile(idxRef); err == nil {
+		t.Error("ConfigFile(index) with default platform succeeded, expected error")
+	} else if !strings.Contains(err.Error(), "WithPlatform") {
+		t.Errorf("ConfigFile(index) = %v, expected hint about WithPlatform", err)
+	}
+	got, err = ConfigFile(idxRef, WithPlatform(platform))
+	if err != nil {
+		t.Fatalf("ConfigFile(index) = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ConfigFile(index) (-want +got) = %s", diff)
+	}
+}
+
+func TestPlatformMatcher(t *testing.T) {
+	amd64, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s390x, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: s390x,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: "linux", Architecture: "s390x"},
+		},
+	}, mutate.IndexAddendum{
+		Add: amd64,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+		},
+	})
+
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s/platform/matcher:index", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prefer arm64, but accept amd64.
+	ranked := func(descs []v1.Descriptor) (*v1.Descriptor, error) {
+		for _, arch := range []string{"arm64", "amd64"} {
+			for _, d := range descs {
+				if d.Platform != nil && d.Platform.Architecture == arch {
+					d := d
+					return &d, nil
+				}
+			}
+		}
+		return nil, nil
+	}
+	img, err := Image(ref, WithPlatformMatcher(ranked))
+	if err != nil {
+		t.Fatalf("Image() = %v", err)
+	}
+	got, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := amd64.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Image() = %s, want %s", got, want)
+	}
+
+	none := func([]v1.Descriptor) (*v1.Descriptor, error) { return nil, nil }
+	if _, err := Image(ref, WithPlatformMatcher(none)); err == nil {
+		t.Error("Image() with matcher selecting nothing succeeded, expected error")
+	} else if !strings.Contains(err.Error(), "selected none") {
+		t.Errorf("Image() = %v, expected error about no selection", err)
+	}
+
+	errNope := errors.New("nope")
+	fail := func([]v1.Descriptor) (*v1.Descriptor, error) { return nil, errNope }
+	if _, err := Image(ref, WithPlatformMatcher(fail)); !errors.Is(err, errNope) {
+		t.Errorf("Image() = %v, want %v", err, errNope)
+	}
+}
+
+func TestUnknownPlatforms(t *testing.T) {
+	attestation, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// BuildKit puts each attestation next to the image it describes.
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: attestation,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: "unknown", Architecture: "unknown"},
+			Annotations: map[string]string{
+				"vnd.docker.reference.type": "attestation-manifest",
+			},
+		},
+	}, mutate.IndexAddendum{
+		Add: amd64,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+		},
+	})
+
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s/unknown/platforms:index", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	first := func(descs []v1.Descriptor) (*v1.Descriptor, error) {
+		if len(descs) == 0 {
+			return nil, nil
+		}
+		return &descs[0], nil
+	}
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want v1.Image
+	}{{
+		name: "default",
+		want: amd64,
+	}, {
+		name: "matcher",
+		opts: []Option{WithPlatformMatcher(first)},
+		want: amd64,
+	}, {
+		name: "matcher with unknown platforms",
+		opts: []Option{WithPlatformMatcher(first), WithUnknownPlatforms()},
+		want: attestation,
+	}, {
+		name: "unknown platform",
+		opts: []Option{WithPlatform(v1.Platform{OS: "unknown", Architecture: "unknown"})},
+		want: attestation,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := Image(ref, tc.opts...)
+			if err != nil {
+				t.Fatalf("Image() = %v", err)
+			}
+			got, err := img.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := tc.want.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("Image() = %s, want %s", got, want)
+			}
+		})
+	}
+
+	// Copying the whole index keeps the attestation.
+	src, err := Index(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.ParseReference(fmt.Sprintf("%s/unknown/copy:index", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIndex(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Image(dst.Context().Digest(mustDigest(t, attestation).String())); err != nil {
+		t.Errorf("attestation wasn't copied: %v", err)
+	}
+}
+
+func TestExistingBlobs(t *testing.T) {
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the first two layers are already available locally.
+	local := map[v1.Hash][]byte{}
+	for _, l := range ls[:2] {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		local[h] = b
+	}
+	has := func(h v1.Hash) bool {
+		_, ok := local[h]
+		return ok
+	}
+	open := func(h v1.Hash) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(local[h])), nil
+	}
+
+	reg := registry.New()
+	fetched := map[string]int{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			fetched[path.Base(r.URL.Path)]++
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s/repo:latest", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Image(ref, WithExistingBlobs(has, open))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Errorf("validate.Image() = %v", err)
+	}
+
+	for i, l := range ls {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := fetched[h.String()]; has(h) && n != 0 {
+			t.Errorf("layer %d was fetched %d times, expected local blob to be used", i, n)
+		} else if !has(h) && n == 0 {
+			t.Errorf("layer %d was not fetched from the registry", i)
+		}
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake credential helper is a shell script")
+	}
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "helper-user" || p != "helper-secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/helper/app:latest", u.Host))
+
+	// The helper only has credentials for this registry.
+	helper := filepath.Join(t.TempDir(), "helper")
+	script := fmt.Sprintf(`#!/bin/sh
+read server
+if [ "$server" != %q ]; then
+	echo "credentials not found in native keychain"
+	exit 1
+fi
+echo '{"Username":"helper-user","Secret":"helper-secret"}'
+`, u.Host)
+	if err := ioutil.WriteFile(helper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err == nil {
+		t.Error("Write() without credentials succeeded, expected error")
+	}
+	if err := Write(ref, img, WithCredentialHelper(helper)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if _, err := Image(ref, WithCredentialHelper(helper)); err != nil {
+		t.Errorf("Image() = %v", err)
+	}
+	if _, err := Image(ref, WithCredentialHelper(helper), WithAuth(authn.Anonymous)); err == nil {
+		t.Error("Image() with both WithCredentialHelper and WithAuth succeeded, expected error")
+	}
+}
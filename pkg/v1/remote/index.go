@@ -38,6 +38,9 @@ type remoteIndex struct {
 	manifest     []byte
 	mediaType    types.MediaType
 	descriptor   *v1.Descriptor
+
+	// unknownPlatforms is set by WithUnknownPlatforms.
+	unknownPlatforms bool
 }
 
 // Index provides access to a remote index reference.
@@ -134,6 +137,7 @@ func (r *remoteIndex) Layer(h v1.Hash) (v1.Layer, error) {
 			l, err := partial.CompressedToLayer(&remoteLayer{
 				fetcher: r.fetcher,
 				digest:  h,
+				size:    childDesc.Size,
 			})
 			if err != nil {
 				return nil, err
@@ -181,7 +185,14 @@ func (r *remoteIndex) Manifests() ([]partial.Describable, error) {
 	return manifests, nil
 }
 
-func (r *remoteIndex) imageByPlatform(platform v1.Platform) (v1.Image, error) {
+func (r *remoteIndex) imageByPlatform(platform v1.Platform, match func([]v1.Descriptor) (*v1.Descriptor, error)) (v1.Image, error) {
+	if match != nil {
+		desc, err := r.childByMatcher(platform, match)
+		if err != nil {
+			return nil, err
+		}
+		return desc.Image()
+	}
 	desc, err := r.childByPlatform(platform)
 	if err != nil {
 		return nil, err
@@ -204,6 +215,10 @@ func (r *remoteIndex) childByPlatform(platform v1.Platform) (*Descriptor, error)
 		return nil, err
 	}
 	for _, childDesc := range index.Manifests {
+		if r.skipUnknown(childDesc) && !isUnknownPlatform(&platform) {
+			continue
+		}
+
 		// If platform is missing from child descriptor, assume it's amd64/linux.
 		p := defaultPlatform
 		if childDesc.Platform != nil {
@@ -217,6 +232,39 @@ func (r *remoteIndex) childByPlatform(platform v1.Platform) (*Descriptor, error)
 	return nil, fmt.Errorf("no child with platform %+v in index %s", platform, r.Ref)
 }
 
+// childByMatcher returns the child selected by match, which must be one of
+// the index's manifests. The child resolves nested indexes with match too.
+func (r *remoteIndex) childByMatcher(platform v1.Platform, match func([]v1.Descriptor) (*v1.Descriptor, error)) (*Descriptor, error) {
+	index, err := r.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]v1.Descriptor, 0, len(index.Manifests))
+	for _, childDesc := range index.Manifests {
+		if !r.skipUnknown(childDesc) {
+			candidates = append(candidates, childDesc)
+		}
+	}
+	chosen, err := match(candidates)
+	if err != nil {
+		return nil, fmt.Errorf("matching platform in index %s: %w", r.Ref, err)
+	}
+	if chosen == nil {
+		return nil, fmt.Errorf("platform matcher selected none of the %d children of index %s", len(candidates), r.Ref)
+	}
+	for _, childDesc := range candidates {
+		if childDesc.Digest == chosen.Digest {
+			desc, err := r.childDescriptor(childDesc, platform)
+			if err != nil {
+				return nil, err
+			}
+			desc.platformMatcher = match
+			return desc, nil
+		}
+	}
+	return nil, fmt.Errorf("platform matcher selected %s, which is not a child of index %s", chosen.Digest, r.Ref)
+}
+
 func (r *remoteIndex) childByHash(h v1.Hash) (*Descriptor, error) {
 	index, err := r.IndexManifest()
 	if err != nil {
@@ -248,18 +296,35 @@ func (r *remoteIndex) childDescriptor(child v1.Descriptor, platform v1.Platform)
 			return nil, err
 		}
 	}
+	// The child is fetched just like the index, but by its own digest.
+	f := r.fetcher
+	f.Ref = ref
 	return &Descriptor{
-		fetcher: fetcher{
-			Ref:     ref,
-			Client:  r.Client,
-			context: r.context,
-		},
-		Manifest:   manifest,
-		Descriptor: child,
-		platform:   platform,
+		fetcher:          f,
+		Manifest:         manifest,
+		Descriptor:       child,
+		platform:         platform,
+		unknownPlatforms: r.unknownPlatforms,
 	}, nil
 }
 
+// unknownPlatform is the platform of the attestation manifests that BuildKit
+// adds to the indexes it builds, which aren't runnable images.
+var unknownPlatform = v1.Platform{
+	Architecture: "unknown",
+	OS:           "unknown",
+}
+
+func isUnknownPlatform(p *v1.Platform) bool {
+	return p != nil && p.OS == unknownPlatform.OS && p.Architecture == unknownPlatform.Architecture
+}
+
+// skipUnknown reports whether child should be left out when resolving the
+// index to an image, because it has the unknown platform.
+func (r *remoteIndex) skipUnknown(child v1.Descriptor) bool {
+	return !r.unknownPlatforms && isUnknownPlatform(child.Platform)
+}
+
 // matchesPlatform checks if the given platform matches the required platforms.
 // The given platform matches the required platform if
 // - architecture and OS are identical.
@@ -0,0 +1,54 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"net/http"
+)
+
+// insecureHostsTransport sends requests for the given hosts over plain HTTP,
+// leaving requests for every other host untouched. See
+// WithAllowedInsecureHosts.
+type insecureHostsTransport struct {
+	inner http.RoundTripper
+	hosts map[string]bool
+}
+
+func newInsecureHostsTransport(inner http.RoundTripper, hosts []string) *insecureHostsTransport {
+	t := &insecureHostsTransport{
+		inner: inner,
+		hosts: map[string]bool{},
+	}
+	for _, h := range hosts {
+		t.hosts[h] = true
+	}
+	return t
+}
+
+// allowed returns whether req is for one of t's hosts, either by host and
+// port or, for hosts that were given without a port, by hostname alone.
+func (t *insecureHostsTransport) allowed(req *http.Request) bool {
+	return t.hosts[req.URL.Host] || t.hosts[req.URL.Hostname()]
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *insecureHostsTransport) RoundTrip(in *http.Request) (*http.Response, error) {
+	if in.URL.Scheme == "https" && t.allowed(in) {
+		out := in.Clone(in.Context())
+		out.URL.Scheme = "http"
+		return t.inner.RoundTrip(out)
+	}
+	return t.inner.RoundTrip(in)
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+type schemeRecorder struct {
+	schemes map[string]string
+}
+
+func (r *schemeRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.schemes[req.URL.Host] = req.URL.Scheme
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestInsecureHostsTransport(t *testing.T) {
+	rec := &schemeRecorder{schemes: map[string]string{}}
+	tr := newInsecureHostsTransport(rec, []string{"registry.internal:5000", "plain.example"})
+
+	for host, want := range map[string]string{
+		"registry.internal:5000": "http",
+		"registry.internal:6000": "https",
+		"plain.example":          "http",
+		"plain.example:1234":     "http",
+		"gcr.io":                 "https",
+		"index.docker.io":        "https",
+	} {
+		req, err := http.NewRequest(http.MethodGet, "https://"+host+"/v2/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := rec.schemes[host]; got != want {
+			t.Errorf("%s: got scheme %q, want %q", host, got, want)
+		}
+		if req.URL.Scheme != "https" {
+			t.Errorf("%s: the original request was modified", host)
+		}
+	}
+}
+
+func TestWithAllowedInsecureHosts(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+
+	// Resolve a hostname that name doesn't already consider insecure (like
+	// localhost) to the test server.
+	const host = "registry.internal:5000"
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, s.Listener.Addr().String())
+		},
+	}
+	ref := mustNewTag(t, host+"/repo:latest")
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Write(ref, img, WithTransport(tr)); err == nil {
+		t.Fatal("Write() over HTTPS to a plain HTTP registry = nil, expected error")
+	}
+
+	if err := Write(ref, img, WithTransport(tr), WithAllowedInsecureHosts([]string{host})); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if _, err := Image(ref, WithTransport(tr), WithAllowedInsecureHosts([]string{"registry.internal"})); err != nil {
+		t.Fatalf("Image() = %v", err)
+	}
+
+	if _, err := Image(ref, WithTransport(tr), WithAllowedInsecureHosts([]string{"other.internal"})); err == nil {
+		t.Error("Image() for a host that isn't allowed = nil, expected error")
+	}
+}
@@ -16,6 +16,7 @@ package remote
 
 import (
 	"io"
+	"io/ioutil"
 
 	"github.com/google/go-containerregistry/internal/redact"
 	"github.com/google/go-containerregistry/internal/verify"
@@ -29,23 +30,49 @@ import (
 type remoteLayer struct {
 	fetcher
 	digest v1.Hash
+
+	// size is the size of the blob, if it is known from a referencing
+	// descriptor. Zero means we have to ask the registry.
+	size int64
 }
 
 // Compressed implements partial.CompressedLayer
 func (rl *remoteLayer) Compressed() (io.ReadCloser, error) {
 	// We don't want to log binary layers -- this can break terminals.
 	ctx := redact.NewContext(rl.context, "omitting binary blobs from logs")
-	return rl.fetchBlob(ctx, verify.SizeUnknown, rl.digest)
+	rc, err := rl.fetchBlob(ctx, verify.SizeUnknown, rl.digest)
+	if err != nil || rl.layerScanner == nil {
+		return rc, err
+	}
+	return scanLayer(rc, rl.digest, rl.layerScanner), nil
 }
 
-// Compressed implements partial.CompressedLayer
+// Size implements partial.CompressedLayer
 func (rl *remoteLayer) Size() (int64, error) {
+	if rl.size > 0 {
+		return rl.size, nil
+	}
 	resp, err := rl.headBlob(rl.digest)
 	if err != nil {
 		return -1, err
 	}
 	defer resp.Body.Close()
-	return resp.ContentLength, nil
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength, nil
+	}
+
+	// Some registries omit Content-Length, so as a last resort, read the
+	// whole blob and count the bytes.
+	rc, err := rl.Compressed()
+	if err != nil {
+		return -1, err
+	}
+	defer rc.Close()
+	n, err := io.Copy(ioutil.Discard, rc)
+	if err != nil {
+		return -1, err
+	}
+	return n, nil
 }
 
 // Digest implements partial.CompressedLayer
@@ -68,10 +95,12 @@ func (rl *remoteLayer) Exists() (bool, error) {
 // digest of the blob to be read and the repository portion is the repo where
 // that blob lives.
 func Layer(ref name.Digest, options ...Option) (v1.Layer, error) {
-	o, err := makeOptions(ref.Context(), options...)
+	rewritten, o, err := makeReferenceOptions(ref, options...)
 	if err != nil {
 		return nil, err
 	}
+	// rewriteReference always preserves digests.
+	ref = rewritten.(name.Digest)
 	f, err := makeFetcher(ref, o)
 	if err != nil {
 		return nil, err
@@ -80,6 +109,9 @@ func Layer(ref name.Digest, options ...Option) (v1.Layer, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := checkExpectedDigest(ref, o, h); err != nil {
+		return nil, err
+	}
 	l, err := partial.CompressedToLayer(&remoteLayer{
 		fetcher: *f,
 		digest:  h,
@@ -15,14 +15,29 @@
 package remote
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 
 	"github.com/google/go-containerregistry/internal/compare"
+	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
@@ -146,3 +161,600 @@ func TestRemoteLayerDescriptor(t *testing.T) {
 		t.Errorf("Exists() = %t != %t", got, want)
 	}
 }
+
+// noContentLength strips Content-Length from blob responses and forces GETs
+// to use chunked encoding.
+type noContentLength struct {
+	http.ResponseWriter
+}
+
+func (w *noContentLength) WriteHeader(code int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *noContentLength) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.ResponseWriter.(http.Flusher).Flush()
+	return n, err
+}
+
+func TestRemoteLayerSizeWithoutContentLength(t *testing.T) {
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := layer.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registry.New()
+	var heads, gets int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/blobs/") {
+			reg.ServeHTTP(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodHead:
+			heads++
+		case http.MethodGet:
+			gets++
+		}
+		reg.ServeHTTP(&noContentLength{w}, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := name.NewDigest(fmt.Sprintf("%s/some/path@%s", u.Host, digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLayer(ref.Context(), layer); err != nil {
+		t.Fatalf("failed to WriteLayer: %v", err)
+	}
+
+	t.Run("Layer", func(t *testing.T) {
+		heads, gets = 0, 0
+		got, err := Layer(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := got.Size()
+		if err != nil {
+			t.Fatalf("Size() = %v", err)
+		}
+		if size != want {
+			t.Errorf("Size() = %d, want %d", size, want)
+		}
+		if heads != 1 || gets != 1 {
+			t.Errorf("Size() made %d HEADs and %d GETs, want 1 and 1", heads, gets)
+		}
+	})
+
+	t.Run("index", func(t *testing.T) {
+		idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+			Add: layer,
+		})
+		tag := ref.Context().Tag("index")
+		if err := WriteIndex(tag, idx); err != nil {
+			t.Fatal(err)
+		}
+		pulled, err := Index(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		heads, gets = 0, 0
+		l, err := pulled.(*remoteIndex).Layer(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := l.Size()
+		if err != nil {
+			t.Fatalf("Size() = %v", err)
+		}
+		if size != want {
+			t.Errorf("Size() = %d, want %d", size, want)
+		}
+		if heads != 0 || gets != 0 {
+			t.Errorf("Size() made %d HEADs and %d GETs, want the size from the index", heads, gets)
+		}
+	})
+}
+
+func TestRemoteLayerAcceptEncoding(t *testing.T) {
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// This server mislabels already compressed blobs as having gzip transfer
+	// encoding whenever the client will accept it, as some proxies do.
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			if got := r.Header.Get("Accept-Encoding"); strings.Contains(got, "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.NewDigest(fmt.Sprintf("%s/some/path@%s", u.Host, digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLayer(ref.Context(), layer); err != nil {
+		t.Fatalf("failed to WriteLayer: %v", err)
+	}
+
+	// By default, we ask for identity encoding and get the raw blob.
+	got, err := Layer(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Layer(got); err != nil {
+		t.Errorf("validate.Layer() = %v", err)
+	}
+
+	// Letting the transport negotiate compression corrupts the blob.
+	got, err = Layer(ref, WithBlobAcceptEncoding(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Layer(got); err == nil {
+		t.Error("validate.Layer() = nil, expected digest mismatch")
+	}
+
+	// The layers of a pulled image are fetched the same way.
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(fmt.Sprintf("%s/some/image:latest", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(tag, img); err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := Image(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := pulled.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range ls {
+		if err := validate.Layer(l); err != nil {
+			t.Errorf("validate.Layer(image layer) = %v", err)
+		}
+	}
+}
+
+func TestPullBlobToFile(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	h, _, err := v1.SHA256(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ranges []string
+	ignoreRange := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/foo/blobs/" + h.String():
+			ranges = append(ranges, r.Header.Get("Range"))
+			if ignoreRange {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.NewDigest(fmt.Sprintf("%s/foo@%s", u.Host, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		partial     []byte
+		ignoreRange bool
+		wantRanges  []string
+	}{{
+		desc:       "fresh",
+		wantRanges: []string{""},
+	}, {
+		desc:       "resume",
+		partial:    blob[:1000],
+		wantRanges: []string{"bytes=1000-"},
+	}, {
+		desc:       "complete",
+		partial:    blob,
+		wantRanges: []string{fmt.Sprintf("bytes=%d-", len(blob))},
+	}, {
+		desc:       "corrupt",
+		partial:    bytes.Repeat([]byte("x"), 1000),
+		wantRanges: []string{"bytes=1000-", ""},
+	}, {
+		desc:       "too long",
+		partial:    append(append([]byte{}, blob...), 'x'),
+		wantRanges: []string{fmt.Sprintf("bytes=%d-", len(blob)+1), ""},
+	}, {
+		desc:        "range ignored",
+		partial:     blob[:1000],
+		ignoreRange: true,
+		wantRanges:  []string{"bytes=1000-"},
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			ranges, ignoreRange = nil, tc.ignoreRange
+			path := filepath.Join(t.TempDir(), "blob")
+			if tc.partial != nil {
+				if err := ioutil.WriteFile(path+".partial", tc.partial, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := PullBlobToFile(ref, path); err != nil {
+				t.Fatalf("PullBlobToFile() = %v", err)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Errorf("downloaded %d bytes that don't match the blob", len(got))
+			}
+			if _, err := os.Stat(path + ".partial"); !os.IsNotExist(err) {
+				t.Errorf("partial file still exists: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantRanges, ranges); diff != "" {
+				t.Errorf("Range headers (-want +got) = %s", diff)
+			}
+		})
+	}
+
+	t.Run("mismatch", func(t *testing.T) {
+		ranges, ignoreRange = nil, false
+		blob = []byte("not the blob")
+		path := filepath.Join(t.TempDir(), "blob")
+		if err := PullBlobToFile(ref, path); err == nil {
+			t.Fatal("PullBlobToFile() = nil, expected digest error")
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("unverified blob was written to %s: %v", path, err)
+		}
+	})
+}
+
+func TestFetchBlobTo(t *testing.T) {
+	// Debug logging reads whole bodies to dump them.
+	defer logs.Debug.SetOutput(logs.Debug.Writer())
+	logs.Debug.SetOutput(ioutil.Discard)
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	h, _, err := v1.SHA256(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ranges []string
+	interrupt, ignoreRange := false, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/foo/blobs/" + h.String():
+			ranges = append(ranges, r.Header.Get("Range"))
+			if interrupt {
+				// Drop the connection after the first 1000 bytes.
+				interrupt = false
+				w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+				w.Write(blob[:1000])
+				return
+			}
+			if ignoreRange {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.NewDigest(fmt.Sprintf("%s/foo@%s", u.Host, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backoff := WithRetryBackoff(Backoff{Steps: 3})
+
+	for _, tc := range []struct {
+		desc        string
+		interrupt   bool
+		ignoreRange bool
+		wantRanges  []string
+	}{{
+		desc:       "fresh",
+		wantRanges: []string{""},
+	}, {
+		desc:       "resume",
+		interrupt:  true,
+		wantRanges: []string{"", "bytes=1000-"},
+	}, {
+		desc:        "range ignored",
+		interrupt:   true,
+		ignoreRange: true,
+		wantRanges:  []string{"", "bytes=1000-"},
+	}} {
+		t.Run("seekable "+tc.desc, func(t *testing.T) {
+			ranges, interrupt, ignoreRange = nil, tc.interrupt, tc.ignoreRange
+			f, err := os.Create(filepath.Join(t.TempDir(), "blob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			// The blob is written after whatever is already in the file.
+			prefix := []byte("prefix")
+			if _, err := f.Write(prefix); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := FetchBlobTo(f, ref, backoff)
+			if err != nil {
+				t.Fatalf("FetchBlobTo() = %v", err)
+			}
+			if n != int64(len(blob)) {
+				t.Errorf("FetchBlobTo() = %d, want %d", n, len(blob))
+			}
+			got, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, append(prefix, blob...)) {
+				t.Errorf("wrote %d bytes that don't match the blob", len(got))
+			}
+			if diff := cmp.Diff(tc.wantRanges, ranges); diff != "" {
+				t.Errorf("Range headers (-want +got) = %s", diff)
+			}
+		})
+	}
+
+	t.Run("non-seekable", func(t *testing.T) {
+		ranges, interrupt, ignoreRange = nil, false, false
+		var buf bytes.Buffer
+		n, err := FetchBlobTo(&buf, ref, backoff)
+		if err != nil {
+			t.Fatalf("FetchBlobTo() = %v", err)
+		}
+		if n != int64(len(blob)) || !bytes.Equal(buf.Bytes(), blob) {
+			t.Errorf("FetchBlobTo() wrote %d bytes that don't match the blob", n)
+		}
+	})
+
+	t.Run("non-seekable interrupted", func(t *testing.T) {
+		ranges, interrupt, ignoreRange = nil, true, false
+		var buf bytes.Buffer
+		n, err := FetchBlobTo(&buf, ref, backoff)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("FetchBlobTo() = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+		if n != 1000 {
+			t.Errorf("FetchBlobTo() = %d, want 1000", n)
+		}
+		if diff := cmp.Diff([]string{""}, ranges); diff != "" {
+			t.Errorf("Range headers (-want +got) = %s", diff)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		ranges, interrupt, ignoreRange = nil, false, false
+		blob = []byte("not the blob")
+		if _, err := FetchBlobTo(ioutil.Discard, ref, backoff); err == nil {
+			t.Error("FetchBlobTo() = nil, expected digest error")
+		}
+	})
+}
+
+// readRecorder is a transport whose blob response bodies record the largest
+// read from them, and take latency to return from each read, like a
+// high-latency link.
+type readRecorder struct {
+	inner   http.RoundTripper
+	latency time.Duration
+	largest int64
+}
+
+func (r *readRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.inner.RoundTrip(req)
+	if err == nil && strings.Contains(req.URL.Path, "/blobs/") {
+		resp.Body = &recordedBody{ReadCloser: resp.Body, r: r}
+	}
+	return resp, err
+}
+
+type recordedBody struct {
+	io.ReadCloser
+	r *readRecorder
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	for {
+		largest := atomic.LoadInt64(&b.r.largest)
+		if int64(len(p)) <= largest || atomic.CompareAndSwapInt64(&b.r.largest, largest, int64(len(p))) {
+			break
+		}
+	}
+	time.Sleep(b.r.latency)
+	return b.ReadCloser.Read(p)
+}
+
+func TestReadBufferSize(t *testing.T) {
+	// Debug logging reads whole bodies to dump them.
+	defer logs.Debug.SetOutput(logs.Debug.Writer())
+	logs.Debug.SetOutput(ioutil.Discard)
+
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository(fmt.Sprintf("%s/read/buffer", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := random.Layer(1<<20, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLayer(repo, l); err != nil {
+		t.Fatal(err)
+	}
+	h, err := l.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := repo.Digest(h.String())
+
+	const size = 256 << 10
+	tr := &readRecorder{inner: http.DefaultTransport}
+	got, err := Layer(ref, WithTransport(tr), WithReadBufferSize(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compare.Layers(l, got); err != nil {
+		t.Errorf("compare.Layers: %v", err)
+	}
+	if tr.largest != size {
+		t.Errorf("largest read = %d, want %d", tr.largest, size)
+	}
+
+	tr = &readRecorder{inner: http.DefaultTransport}
+	path := filepath.Join(t.TempDir(), "blob")
+	if err := PullBlobToFile(ref, path, WithTransport(tr), WithReadBufferSize(size)); err != nil {
+		t.Fatalf("PullBlobToFile() = %v", err)
+	}
+	if tr.largest != size {
+		t.Errorf("PullBlobToFile largest read = %d, want %d", tr.largest, size)
+	}
+
+	// Layers of images are buffered too.
+	img, err := random.Image(1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgRef := repo.Tag("image")
+	if err := Write(imgRef, img); err != nil {
+		t.Fatal(err)
+	}
+	tr = &readRecorder{inner: http.DefaultTransport}
+	rimg, err := Image(imgRef, WithTransport(tr), WithReadBufferSize(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := rimg.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range ls {
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+	}
+	if tr.largest != size {
+		t.Errorf("image layer largest read = %d, want %d", tr.largest, size)
+	}
+
+	if _, err := Layer(ref, WithReadBufferSize(0)); err == nil {
+		t.Error("Layer() with WithReadBufferSize(0) = nil, expected error")
+	}
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	repo, err := name.NewRepository(strings.TrimPrefix(s.URL, "http://") + "/bench/read")
+	if err != nil {
+		b.Fatal(err)
+	}
+	l, err := random.Layer(8<<20, types.DockerLayer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := WriteLayer(repo, l); err != nil {
+		b.Fatal(err)
+	}
+	h, err := l.Digest()
+	if err != nil {
+		b.Fatal(err)
+	}
+	size, err := l.Size()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"1MiB", []Option{WithReadBufferSize(1 << 20)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			// Each read waits for a round trip.
+			tr := &readRecorder{inner: http.DefaultTransport, latency: 50 * time.Microsecond}
+			opts := append([]Option{WithTransport(tr)}, bc.opts...)
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				rl, err := Layer(repo.Digest(h.String()), opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				rc, err := rl.Compressed()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+					b.Fatal(err)
+				}
+				rc.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"net/http"
+)
+
+// limitTransport bounds the number of requests that are in flight through it
+// at once. See WithMaxConcurrentRequests.
+type limitTransport struct {
+	inner http.RoundTripper
+	sem   chan struct{}
+}
+
+func newLimitTransport(inner http.RoundTripper, n int) *limitTransport {
+	return &limitTransport{
+		inner: inner,
+		sem:   make(chan struct{}, n),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitTransport) RoundTrip(in *http.Request) (*http.Response, error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-in.Context().Done():
+		return nil, in.Context().Err()
+	}
+	// Release as soon as the response headers arrive, rather than once the
+	// body is closed, since callers may hold a blob's body open while making
+	// other requests (e.g. to fetch the config), which would deadlock.
+	defer func() { <-t.sem }()
+	return t.inner.RoundTrip(in)
+}
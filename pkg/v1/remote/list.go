@@ -46,7 +46,7 @@ func List(repo name.Repository, options ...Option) ([]string, error) {
 		return nil, err
 	}
 	scopes := []string{repo.Scope(transport.PullScope)}
-	tr, err := transport.NewWithContext(o.context, repo.Registry, o.auth, o.transport, scopes)
+	tr, err := transport.NewWithContext(o.context, repo.Registry, o.auth, o.transport, addScopes(scopes, o))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,101 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// mediaTypedImage is a v1.Image whose manifest declares a different media
+// type than the image it wraps.
+type mediaTypedImage struct {
+	v1.Image
+
+	mediaType types.MediaType
+	manifest  *v1.Manifest
+}
+
+var _ v1.Image = (*mediaTypedImage)(nil)
+
+// withManifestMediaType makes img's manifest declare mt, after checking that
+// a manifest of that type can refer to img's config and layers.
+func withManifestMediaType(img v1.Image, mt types.MediaType) (v1.Image, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	descs := append([]v1.Descriptor{m.Config}, m.Layers...)
+	for _, desc := range descs {
+		if !compatibleMediaTypes(mt, desc.MediaType) {
+			return nil, fmt.Errorf("a manifest of type %s can't refer to %s with media type %s", mt, desc.Digest, desc.MediaType)
+		}
+	}
+	if m.MediaType == mt {
+		return img, nil
+	}
+	m = m.DeepCopy()
+	m.MediaType = mt
+	return &mediaTypedImage{
+		Image:     img,
+		mediaType: mt,
+		manifest:  m,
+	}, nil
+}
+
+// compatibleMediaTypes reports whether a manifest of type mt can refer to a
+// blob of type blob. Docker manifests can't refer to OCI media types, and
+// vice versa; media types of neither vendor, like those of artifacts, are
+// allowed in either.
+func compatibleMediaTypes(mt, blob types.MediaType) bool {
+	var other string
+	switch mt {
+	case types.DockerManifestSchema2:
+		other = types.OCIVendorPrefix
+	case types.OCIManifestSchema1:
+		other = types.DockerVendorPrefix
+	}
+	return !strings.HasPrefix(string(blob), "application/"+other+".")
+}
+
+// MediaType implements v1.Image.
+func (i *mediaTypedImage) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+// Manifest implements v1.Image.
+func (i *mediaTypedImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.Image.
+func (i *mediaTypedImage) RawManifest() ([]byte, error) {
+	return json.Marshal(i.manifest)
+}
+
+// Digest implements v1.Image.
+func (i *mediaTypedImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+// Size implements v1.Image.
+func (i *mediaTypedImage) Size() (int64, error) {
+	return partial.Size(i)
+}
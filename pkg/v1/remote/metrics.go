@@ -0,0 +1,162 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/internal/retry"
+)
+
+// Metrics receives callbacks about the HTTP requests made by remote
+// operations, e.g. to export them to Prometheus. See WithMetrics.
+//
+// Implementations must be safe for concurrent use. Embed NopMetrics to only
+// implement some of the callbacks.
+type Metrics interface {
+	// Request is called when a request completes. kind is "blob",
+	// "manifest" or "other". statusCode is 0 if no response was received,
+	// and latency is the time until the response headers were received.
+	Request(kind, method string, statusCode int, latency time.Duration)
+
+	// BytesTransferred is called once the body of a request's response has
+	// been closed, with the number of bytes sent in the request body and
+	// read from the response body.
+	BytesTransferred(kind string, sent, received int64)
+
+	// Retry is called each time a request that failed with err is about to
+	// be retried, whether by transport-level retries of network errors or by
+	// retried blob uploads and manifest PUTs. A final attempt that fails
+	// isn't reported.
+	Retry(err error)
+}
+
+// NopMetrics implements Metrics by doing nothing.
+type NopMetrics struct{}
+
+var _ Metrics = NopMetrics{}
+
+// Request implements Metrics.
+func (NopMetrics) Request(kind, method string, statusCode int, latency time.Duration) {}
+
+// BytesTransferred implements Metrics.
+func (NopMetrics) BytesTransferred(kind string, sent, received int64) {}
+
+// Retry implements Metrics.
+func (NopMetrics) Retry(err error) {}
+
+// retryWithMetrics wraps predicate to report retryable errors to m, if set.
+// retry.Retry only consults predicate when another attempt is possible, so
+// each reported error is actually retried.
+func retryWithMetrics(predicate retry.Predicate, m Metrics) retry.Predicate {
+	if m == nil {
+		return predicate
+	}
+	return func(err error) bool {
+		if predicate(err) {
+			m.Retry(err)
+			return true
+		}
+		return false
+	}
+}
+
+// requestKind classifies a request by the registry API it targets.
+func requestKind(req *http.Request) string {
+	switch {
+	case strings.Contains(req.URL.Path, "/blobs/"):
+		return "blob"
+	case strings.Contains(req.URL.Path, "/manifests/"):
+		return "manifest"
+	default:
+		return "other"
+	}
+}
+
+// metricsTransport reports every request that passes through it to metrics.
+type metricsTransport struct {
+	inner   http.RoundTripper
+	metrics Metrics
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *metricsTransport) RoundTrip(in *http.Request) (*http.Response, error) {
+	kind := requestKind(in)
+
+	sent := &countingReadCloser{}
+	if in.Body != nil && in.Body != http.NoBody {
+		sent.ReadCloser = in.Body
+		in = in.Clone(in.Context())
+		in.Body = sent
+	}
+
+	start := time.Now()
+	resp, err := t.inner.RoundTrip(in)
+	latency := time.Since(start)
+	if err != nil {
+		t.metrics.Request(kind, in.Method, 0, latency)
+		t.metrics.BytesTransferred(kind, sent.count(), 0)
+		return nil, err
+	}
+	t.metrics.Request(kind, in.Method, resp.StatusCode, latency)
+
+	resp.Body = &countingReadCloser{
+		ReadCloser: resp.Body,
+		onClose: func(received int64) {
+			t.metrics.BytesTransferred(kind, sent.count(), received)
+		},
+	}
+	return resp, nil
+}
+
+// countingReadCloser counts the bytes read through it, and calls onClose
+// (at most once) with that count when it's closed.
+type countingReadCloser struct {
+	io.ReadCloser
+	onClose func(int64)
+
+	mu   sync.Mutex
+	n    int64
+	once sync.Once
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	c.n += int64(n)
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	if c.ReadCloser == nil {
+		return nil
+	}
+	err := c.ReadCloser.Close()
+	if c.onClose != nil {
+		c.once.Do(func() { c.onClose(c.count()) })
+	}
+	return err
+}
+
+func (c *countingReadCloser) count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+type recordingMetrics struct {
+	NopMetrics
+
+	sync.Mutex
+	requests map[string]int
+	sent     map[string]int64
+	received map[string]int64
+	retries  int
+}
+
+func (m *recordingMetrics) Request(kind, method string, statusCode int, latency time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests[kind+" "+method]++
+}
+
+func (m *recordingMetrics) BytesTransferred(kind string, sent, received int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.sent[kind] += sent
+	m.received[kind] += received
+}
+
+func (m *recordingMetrics) Retry(err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.retries++
+}
+
+func TestMetrics(t *testing.T) {
+	reg := registry.New()
+	var failed int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first manifest PUT so that it's retried.
+		if r.Method == http.MethodPut && requestKind(r) == "manifest" && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &recordingMetrics{
+		requests: map[string]int{},
+		sent:     map[string]int64{},
+		received: map[string]int64{},
+	}
+	backoff := Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+	if err := Write(ref, img, WithMetrics(m), WithRetryBackoff(backoff)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	got, err := Image(ref, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Fatalf("validate.Image() = %v", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	for _, want := range []string{"blob HEAD", "blob PATCH", "blob PUT", "blob GET", "manifest PUT", "manifest GET"} {
+		if m.requests[want] == 0 {
+			t.Errorf("no %q requests recorded: %v", want, m.requests)
+		}
+	}
+	if got := m.requests["manifest PUT"]; got != 2 {
+		t.Errorf("manifest PUTs = %d, want 2", got)
+	}
+	if m.retries != 1 {
+		t.Errorf("retries = %d, want 1", m.retries)
+	}
+	if m.sent["blob"] == 0 || m.received["blob"] == 0 {
+		t.Errorf("blob bytes sent = %d, received = %d, want both > 0", m.sent["blob"], m.received["blob"])
+	}
+	if m.sent["manifest"] == 0 || m.received["manifest"] == 0 {
+		t.Errorf("manifest bytes sent = %d, received = %d, want both > 0", m.sent["manifest"], m.received["manifest"])
+	}
+}
+
+func TestMetricsBlobRetries(t *testing.T) {
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.New()
+	var attempts int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail every blob commit, so that each attempt fails.
+		if r.Method == http.MethodPut && requestKind(r) == "blob" {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository(fmt.Sprintf("%s/repo", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &recordingMetrics{
+		requests: map[string]int{},
+		sent:     map[string]int64{},
+		received: map[string]int64{},
+	}
+	backoff := Backoff{Duration: time.Millisecond, Factor: 1, Steps: 5}
+	err = WriteLayer(repo, layer, WithMetrics(m), WithRetryBackoff(backoff), WithMaxRetriesPerBlob(3))
+	var rerr *ErrBlobRetriesExhausted
+	if !errors.As(err, &rerr) {
+		t.Fatalf("WriteLayer() = %v, wanted *ErrBlobRetriesExhausted", err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+
+	// Only the attempts that were followed by another one are retries.
+	m.Lock()
+	defer m.Unlock()
+	if m.retries != 2 {
+		t.Errorf("retries = %d, want 2", m.retries)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// MissingBlobs returns the blobs in hs that repo doesn't have, in the order
+// they're given, by HEADing each of them, up to WithJobs at a time. Nothing is
+// downloaded, so it's cheap to find out how much a copy into repo will have to
+// upload before starting it.
+func MissingBlobs(repo name.Repository, hs []v1.Hash, options ...Option) ([]v1.Hash, error) {
+	if len(hs) == 0 {
+		return nil, nil
+	}
+	ref := repo.Digest(hs[0].String())
+	o, err := makeOptions(repo, options...)
+	if err != nil {
+		return nil, err
+	}
+	f, err := makeFetcher(ref, o)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	missing := map[v1.Hash]bool{}
+	var g errgroup.Group
+	g.SetLimit(o.jobs)
+	for _, h := range hs {
+		h := h
+		g.Go(func() error {
+			ok, err := f.blobExists(h)
+			if err != nil {
+				return fmt.Errorf("checking for %s: %w", h, err)
+			}
+			if !ok {
+				mu.Lock()
+				defer mu.Unlock()
+				missing[h] = true
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	out := []v1.Hash{}
+	for _, h := range hs {
+		if missing[h] {
+			out = append(out, h)
+			delete(missing, h)
+		}
+	}
+	return out, nil
+}
@@ -15,23 +15,87 @@
 package remote
 
 import (
+	"errors"
+
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 // MountableLayer wraps a v1.Layer in a shim that enables the layer to be
 // "mounted" when published to another registry.
+//
+// MountableLayer holds no mutable state of its own, so its methods are safe
+// to call from multiple goroutines (e.g. during a concurrent Write) as long as
+// the methods of the embedded Layer are. All layers returned by this package
+// are safe for concurrent use. Callers must not modify Reference or
+// Annotations while the layer is in use.
 type MountableLayer struct {
 	v1.Layer
 
 	Reference name.Reference
+
+	// Annotations are merged into the layer's descriptor, taking precedence
+	// over any annotations already present on the underlying layer. This
+	// allows callers to attach metadata to a layer that will be written into
+	// the manifest, e.g. via mutate.AppendLayers.
+	Annotations map[string]string
+
+	// desc is the descriptor of this layer in the manifest it was read from,
+	// if any. Layers don't always know their own media type (e.g. those
+	// returned by Layer, which only have a digest), so this takes precedence.
+	desc *v1.Descriptor
+}
+
+// MediaType implements v1.Layer, preferring the media type from the manifest
+// this layer was read from.
+func (ml *MountableLayer) MediaType() (types.MediaType, error) {
+	if ml.desc != nil && ml.desc.MediaType != "" {
+		return ml.desc.MediaType, nil
+	}
+	return ml.Layer.MediaType()
 }
 
 // Descriptor retains the original descriptor from an image manifest.
 // See partial.Descriptor.
 func (ml *MountableLayer) Descriptor() (*v1.Descriptor, error) {
-	return partial.Descriptor(ml.Layer)
+	desc, err := partial.Descriptor(ml.Layer)
+	if err != nil {
+		return nil, err
+	}
+	if ml.desc != nil && ml.desc.MediaType != "" && desc.MediaType != ml.desc.MediaType {
+		desc = desc.DeepCopy()
+		desc.MediaType = ml.desc.MediaType
+	}
+	if len(ml.Annotations) == 0 {
+		return desc, nil
+	}
+
+	// Don't modify the underlying layer's descriptor.
+	desc = desc.DeepCopy()
+	if desc.Annotations == nil {
+		desc.Annotations = make(map[string]string, len(ml.Annotations))
+	}
+	for k, v := range ml.Annotations {
+		desc.Annotations[k] = v
+	}
+	return desc, nil
+}
+
+// BlobRef returns a reference to this layer's blob in the repository it was
+// read from, e.g. to fetch it again with Layer. The repository (including its
+// registry, and any options it was parsed with) comes from Reference, whether
+// that's a tag or a digest, and the digest is the layer's own.
+func (ml *MountableLayer) BlobRef() (name.Digest, error) {
+	if ml.Reference == nil {
+		return name.Digest{}, errors.New("mountable layer has no reference")
+	}
+	h, err := ml.Layer.Digest()
+	if err != nil {
+		return name.Digest{}, err
+	}
+	return ml.Reference.Context().Digest(h.String()), nil
 }
 
 // Exists is a hack. See partial.Exists.
@@ -48,6 +112,31 @@ type mountableImage struct {
 	Reference name.Reference
 }
 
+// mountable wraps l in a MountableLayer, remembering its descriptor in the
+// image's manifest.
+func (mi *mountableImage) mountable(l v1.Layer) (*MountableLayer, error) {
+	ml := &MountableLayer{
+		Layer:     l,
+		Reference: mi.Reference,
+	}
+	h, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	m, err := mi.Image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range m.Layers {
+		if desc.Digest == h {
+			desc := desc
+			ml.desc = &desc
+			break
+		}
+	}
+	return ml, nil
+}
+
 // Layers implements v1.Image
 func (mi *mountableImage) Layers() ([]v1.Layer, error) {
 	ls, err := mi.Image.Layers()
@@ -56,10 +145,11 @@ func (mi *mountableImage) Layers() ([]v1.Layer, error) {
 	}
 	mls := make([]v1.Layer, 0, len(ls))
 	for _, l := range ls {
-		mls = append(mls, &MountableLayer{
-			Layer:     l,
-			Reference: mi.Reference,
-		})
+		ml, err := mi.mountable(l)
+		if err != nil {
+			return nil, err
+		}
+		mls = append(mls, ml)
 	}
 	return mls, nil
 }
@@ -70,10 +160,7 @@ func (mi *mountableImage) LayerByDigest(d v1.Hash) (v1.Layer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MountableLayer{
-		Layer:     l,
-		Reference: mi.Reference,
-	}, nil
+	return mi.mountable(l)
 }
 
 // LayerByDiffID implements v1.Image
@@ -82,10 +169,7 @@ func (mi *mountableImage) LayerByDiffID(d v1.Hash) (v1.Layer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MountableLayer{
-		Layer:     l,
-		Reference: mi.Reference,
-	}, nil
+	return mi.mountable(l)
 }
 
 // Descriptor retains the original descriptor from an index manifest.
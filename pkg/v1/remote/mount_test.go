@@ -15,11 +15,23 @@
 package remote
 
 import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestMountableImage(t *testing.T) {
@@ -53,3 +65,317 @@ func TestMountableImage(t *testing.T) {
 		}
 	}
 }
+
+func TestMountableLayerAnnotations(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s/test/annotations", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rl, err := random.Layer(1024, "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"org.example.provenance": "built-by-ci"}
+	img, err := mutate.AppendLayers(empty.Image, &MountableLayer{
+		Layer:       rl,
+		Reference:   ref,
+		Annotations: want,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	got, err := Image(ref)
+	if err != nil {
+		t.Fatalf("Image() = %v", err)
+	}
+	m, err := got.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 1 {
+		t.Fatalf("len(Layers) = %d, want 1", len(m.Layers))
+	}
+	if diff := cmp.Diff(want, m.Layers[0].Annotations); diff != "" {
+		t.Errorf("manifest annotations (-want +got) = %s", diff)
+	}
+
+	// Layers from the re-pulled image should retain their annotations too.
+	ls, err := got.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml, ok := ls[0].(*MountableLayer)
+	if !ok {
+		t.Fatalf("layer is %T, want *MountableLayer", ls[0])
+	}
+	desc, err := ml.Descriptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, desc.Annotations); diff != "" {
+		t.Errorf("layer annotations (-want +got) = %s", diff)
+	}
+}
+
+func TestMountableLayerBlobRef(t *testing.T) {
+	l, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := l.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := "sha256:" + strings.Repeat("a", 64)
+
+	for _, tc := range []struct {
+		ref  string
+		opts []name.Option
+		want string
+	}{{
+		ref:  "ubuntu",
+		want: "index.docker.io/library/ubuntu@" + h.String(),
+	}, {
+		ref:  "gcr.io/foo/bar:tag",
+		want: "gcr.io/foo/bar@" + h.String(),
+	}, {
+		ref:  "localhost:5000/a/b/c@" + manifest,
+		want: "localhost:5000/a/b/c@" + h.String(),
+	}, {
+		ref:  "registry.example.com:8080/some/repo:y",
+		opts: []name.Option{name.Insecure},
+		want: "registry.example.com:8080/some/repo@" + h.String(),
+	}} {
+		t.Run(tc.ref, func(t *testing.T) {
+			ref, err := name.ParseReference(tc.ref, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ml := &MountableLayer{Layer: l, Reference: ref}
+			got, err := ml.BlobRef()
+			if err != nil {
+				t.Fatalf("BlobRef() = %v", err)
+			}
+			if got.Name() != tc.want {
+				t.Errorf("BlobRef() = %s, want %s", got.Name(), tc.want)
+			}
+			// The registry keeps the options it was parsed with.
+			if got, want := got.Context().Registry.Scheme(), ref.Context().Registry.Scheme(); got != want {
+				t.Errorf("BlobRef() scheme = %s, want %s", got, want)
+			}
+		})
+	}
+
+	if _, err := (&MountableLayer{Layer: l}).BlobRef(); err == nil {
+		t.Error("BlobRef() without a Reference succeeded, expected error")
+	}
+
+	// The reference can be used to fetch the layer again.
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(fmt.Sprintf("%s/blob/ref:latest", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(tag, img); err != nil {
+		t.Fatal(err)
+	}
+	rmt, err := Image(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := rmt.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := ls[0].(*MountableLayer).BlobRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Layer(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := again.Digest(); err != nil || got != h {
+		t.Errorf("Layer(BlobRef()).Digest() = %v, %v; want %s", got, err, h)
+	}
+}
+
+func TestMountableLayerMediaType(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := mustNewTag(t, fmt.Sprintf("%s/test/oci:src", u.Host))
+	dst := mustNewTag(t, fmt.Sprintf("%s/test/oci:dst", u.Host))
+
+	img := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	for i := 0; i < 2; i++ {
+		l, err := random.Layer(1024, types.OCILayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err = mutate.AppendLayers(img, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Write(src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-push the pulled image, and check the OCI media types survive.
+	pulled, err := Image(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(dst, pulled); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Image(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := got.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MediaType != types.OCIManifestSchema1 {
+		t.Errorf("manifest MediaType = %s, want %s", m.MediaType, types.OCIManifestSchema1)
+	}
+	for i, desc := range m.Layers {
+		if desc.MediaType != types.OCILayer {
+			t.Errorf("layers[%d] MediaType = %s, want %s", i, desc.MediaType, types.OCILayer)
+		}
+	}
+
+	// The manifest's media type wins over the layer's own, e.g. for blobs
+	// read with Layer, which can only guess at their media type.
+	ls, err := pulled.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ls[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := Layer(src.Context().Digest(h.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := pulled.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := &mountableImage{Image: &layerOverride{Image: pulled, layer: blob}, Reference: src}
+	ml, err := mi.LayerByDigest(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt, err := ml.MediaType(); err != nil || mt != types.OCILayer {
+		t.Errorf("MediaType() = %s, %v; want %s", mt, err, types.OCILayer)
+	}
+	desc, err := partial.Descriptor(ml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.MediaType != pm.Layers[0].MediaType {
+		t.Errorf("Descriptor().MediaType = %s, want %s", desc.MediaType, pm.Layers[0].MediaType)
+	}
+}
+
+// layerOverride returns layer from LayerByDigest.
+type layerOverride struct {
+	v1.Image
+	layer v1.Layer
+}
+
+func (i *layerOverride) LayerByDigest(v1.Hash) (v1.Layer, error) {
+	return i.layer, nil
+}
+
+// TestMountableLayerConcurrency is mostly useful when run with -race.
+func TestMountableLayerConcurrency(t *testing.T) {
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s/repo:tag", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	pulled, err := Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := pulled.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml, ok := layers[0].(*MountableLayer)
+	if !ok {
+		t.Fatalf("layer is %T, want *MountableLayer", layers[0])
+	}
+	ml.Annotations = map[string]string{"foo": "bar"}
+
+	var g errgroup.Group
+	for i := 0; i < 10; i++ {
+		g.Go(func() error {
+			if _, err := ml.Digest(); err != nil {
+				return err
+			}
+			if _, err := ml.DiffID(); err != nil {
+				return err
+			}
+			if _, err := ml.Size(); err != nil {
+				return err
+			}
+			if _, err := ml.MediaType(); err != nil {
+				return err
+			}
+			if _, err := ml.Exists(); err != nil {
+				return err
+			}
+			desc, err := ml.Descriptor()
+			if err != nil {
+				return err
+			}
+			desc.Annotations["baz"] = "quux"
+			return validate.Layer(ml)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -16,8 +16,8 @@ package remote
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/http"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -50,6 +50,12 @@ func MultiWrite(m map[name.Reference]Taggable, options ...Option) (rerr error) {
 	if err != nil {
 		return err
 	}
+	if o.layerTransform != nil {
+		return errors.New("WithLayerTransform is not supported by MultiWrite")
+	}
+	if o.manifestMediaType != "" {
+		return errors.New("WithManifestMediaType is not supported by MultiWrite")
+	}
 
 	// Collect unique blobs (layers and config blobs).
 	blobs := map[v1.Hash]v1.Layer{}
@@ -82,17 +88,14 @@ func MultiWrite(m map[name.Reference]Taggable, options ...Option) (rerr error) {
 		ls = append(ls, l)
 	}
 	scopes := scopesForUploadingImage(repo, ls)
-	tr, err := transport.NewWithContext(o.context, repo.Registry, o.auth, o.transport, scopes)
+	tr, err := transport.NewWithContext(o.context, repo.Registry, o.auth, o.transport, addScopes(scopes, o))
 	if err != nil {
 		return err
 	}
-	w := writer{
-		repo:      repo,
-		client:    &http.Client{Transport: tr},
-		context:   o.context,
-		backoff:   o.retryBackoff,
-		predicate: o.retryPredicate,
-	}
+	w := newWriter(repo, tr, o)
+	var report func()
+	w.summary, report = makeSummary(o)
+	defer report()
 
 	// Collect the total size of blobs and manifests we're about to write.
 	if o.updates != nil {
@@ -163,6 +166,15 @@ func MultiWrite(m map[name.Reference]Taggable, options ...Option) (rerr error) {
 	if err := g.Wait(); err != nil {
 		return err
 	}
+	if w.summary != nil {
+		for _, m := range append(newManifests, images) {
+			for _, t := range m {
+				if img, ok := t.(v1.Image); ok {
+					w.summary.configWritten(img)
+				}
+			}
+		}
+	}
 
 	commitMany := func(ctx context.Context, m map[name.Reference]Taggable) error {
 		g, ctx := errgroup.WithContext(ctx)
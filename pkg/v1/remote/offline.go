@@ -0,0 +1,98 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/go-containerregistry/internal/verify"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ErrOffline is returned when WithOffline is used and an operation needs to
+// make a request to a registry.
+type ErrOffline struct {
+	// Method and URL identify the request that would have been made.
+	Method string
+	URL    string
+}
+
+// Error implements error.
+func (e *ErrOffline) Error() string {
+	return fmt.Sprintf("offline: refusing to %s %s", e.Method, e.URL)
+}
+
+// offlineTransport fails every request with an *ErrOffline.
+type offlineTransport struct{}
+
+// RoundTrip implements http.RoundTripper.
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, &ErrOffline{Method: req.Method, URL: req.URL.String()}
+}
+
+// existingBlob returns the blob h from WithExistingBlobs, if it's there and
+// we're offline.
+func (f *fetcher) existingBlob(size int64, h v1.Hash) (io.ReadCloser, bool, error) {
+	if !f.offline || f.hasBlob == nil || !f.hasBlob(h) {
+		return nil, false, nil
+	}
+	rc, err := f.openBlob(h)
+	if err != nil {
+		return nil, true, err
+	}
+	rc, err = verify.ReadCloser(rc, size, h)
+	return rc, true, err
+}
+
+// existingManifest returns the manifest referenced by ref from
+// WithExistingBlobs, if ref is a digest, the manifest is there and we're
+// offline. Its media type is taken from its mediaType field.
+func (f *fetcher) existingManifest(ref name.Reference) ([]byte, *v1.Descriptor, bool, error) {
+	dgst, ok := ref.(name.Digest)
+	if !ok {
+		return nil, nil, false, nil
+	}
+	h, err := v1.NewHash(dgst.DigestStr())
+	if err != nil {
+		return nil, nil, false, err
+	}
+	rc, ok, err := f.existingBlob(verify.SizeUnknown, h)
+	if !ok || err != nil {
+		return nil, nil, ok, err
+	}
+	defer rc.Close()
+	manifest, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	var mf struct {
+		MediaType types.MediaType `json:"mediaType"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(manifest)).Decode(&mf); err != nil {
+		return nil, nil, true, fmt.Errorf("parsing manifest %s: %w", h, err)
+	}
+	return manifest, &v1.Descriptor{
+		Digest:    h,
+		Size:      int64(len(manifest)),
+		MediaType: mf.MediaType,
+	}, true, nil
+}
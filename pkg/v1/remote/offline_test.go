@@ -0,0 +1,157 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+// failTransport fails the test if it's ever used.
+type failTransport struct {
+	t *testing.T
+}
+
+func (f *failTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.t.Errorf("unexpected request: %s %s", req.Method, req.URL)
+	return nil, errors.New("unexpected request")
+}
+
+func TestOffline(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := map[v1.Hash][]byte{}
+	add := func(b []byte, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _, err := v1.SHA256(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		local[h] = b
+	}
+	add(img.RawManifest())
+	add(img.RawConfigFile())
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range ls {
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(ioutil.ReadAll(rc))
+		rc.Close()
+	}
+	has := func(h v1.Hash) bool {
+		_, ok := local[h]
+		return ok
+	}
+	open := func(h v1.Hash) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(local[h])), nil
+	}
+
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository("registry.example/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []Option{WithOffline(), WithExistingBlobs(has, open), WithTransport(&failTransport{t})}
+
+	t.Run("local pull", func(t *testing.T) {
+		got, err := Image(repo.Digest(d.String()), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validate.Image(got); err != nil {
+			t.Errorf("validate.Image() = %v", err)
+		}
+	})
+
+	t.Run("missing layer", func(t *testing.T) {
+		h, err := ls[1].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := local[h]
+		delete(local, h)
+		defer func() { local[h] = b }()
+
+		got, err := Image(repo.Digest(d.String()), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := got.LayerByDigest(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var oerr *ErrOffline
+		if _, err := l.Compressed(); !errors.As(err, &oerr) {
+			t.Errorf("Compressed() = %v, want *ErrOffline", err)
+		}
+	})
+
+	for _, tc := range []struct {
+		desc string
+		f    func() error
+	}{{
+		desc: "pull by tag",
+		f: func() error {
+			_, err := Image(repo.Tag("latest"), opts...)
+			return err
+		},
+	}, {
+		desc: "head",
+		f: func() error {
+			_, err := Head(repo.Digest(d.String()), opts...)
+			return err
+		},
+	}, {
+		desc: "write",
+		f: func() error {
+			return Write(repo.Tag("latest"), img, opts...)
+		},
+	}, {
+		desc: "list",
+		f: func() error {
+			_, err := List(repo, opts...)
+			return err
+		},
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var oerr *ErrOffline
+			if err := tc.f(); !errors.As(err, &oerr) {
+				t.Errorf("got %v, want *ErrOffline", err)
+			}
+		})
+	}
+}
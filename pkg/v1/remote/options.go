@@ -16,18 +16,23 @@ package remote
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"syscall"
 	"time"
 
 	"github.com/google/go-containerregistry/internal/retry"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 // Option is a functional option for remote operations.
@@ -38,6 +43,7 @@ type options struct {
 	keychain                       authn.Keychain
 	transport                      http.RoundTripper
 	platform                       v1.Platform
+	platformMatcher                func([]v1.Descriptor) (*v1.Descriptor, error)
 	context                        context.Context
 	jobs                           int
 	userAgent                      string
@@ -46,6 +52,47 @@ type options struct {
 	pageSize                       int
 	retryBackoff                   Backoff
 	retryPredicate                 retry.Predicate
+	maxRetriesPerBlob              int
+	uploadSession                  func(v1.Hash, string)
+	writeSummary                   func(WriteSummary)
+	parallelChunks                 int
+	chunkSizer                     ChunkSizer
+	blobAcceptEncoding             string
+	expectedDigest                 *v1.Hash
+	acceptedMediaTypes             []types.MediaType
+	scopes                         []string
+	layerTransform                 func(v1.Layer) (v1.Layer, error)
+	hasBlob                        func(v1.Hash) bool
+	openBlob                       func(v1.Hash) (io.ReadCloser, error)
+	metrics                        Metrics
+	referenceRewriter              func(name.Reference) name.Reference
+	maxConcurrentRequests          int
+	legacySchema1                  bool
+	caCerts                        []byte
+	clientCerts                    []tls.Certificate
+	insecureSkipVerify             bool
+	redactedHeaders                []string
+	foreignURLs                    map[v1.Hash][]string
+	uncompressedSizes              bool
+	transferCancel                 func(v1.Hash, context.CancelFunc)
+	rateLimitObserver              func(limit, remaining int)
+	insecureHosts                  []string
+	methodRetryBackoff             map[string]Backoff
+	resolvedRegistryObserver       func(registry string, base url.URL)
+	blobDigestMode                 BlobDigestMode
+	offline                        bool
+	layerScanner                   LayerScanner
+	maxManifestSize                int64
+	blobCache                      *blobCache
+	uncompressedTee                func(v1.Layer) (io.WriteCloser, error)
+	mountRepo                      *name.Repository
+	verifySampleLayers             int
+	blobWritten                    func(v1.Descriptor)
+	knownBlob                      func(v1.Hash) bool
+	manifestMediaType              types.MediaType
+	readBufferSize                 int
+	unknownPlatforms               bool
+	requireCompleteIndex           bool
 }
 
 var defaultPlatform = v1.Platform{
@@ -80,6 +127,10 @@ const (
 	// ECR returns an error if n > 1000:
 	// https://github.com/google/go-containerregistry/issues/1091
 	defaultPageSize = 1000
+
+	// Ask for blobs verbatim, so that transparent compression by a proxy
+	// can't change the bytes we verify against the digest.
+	defaultBlobAcceptEncoding = "identity"
 )
 
 // DefaultTransport is based on http.DefaultTransport with modifications
@@ -109,6 +160,9 @@ func makeOptions(target authn.Resource, opts ...Option) (*options, error) {
 		pageSize:       defaultPageSize,
 		retryPredicate: defaultRetryPredicate,
 		retryBackoff:   defaultRetryBackoff,
+
+		blobAcceptEncoding: defaultBlobAcceptEncoding,
+		maxManifestSize:    defaultMaxManifestSize,
 	}
 
 	for _, option := range opts {
@@ -132,6 +186,13 @@ func makeOptions(target authn.Resource, opts ...Option) (*options, error) {
 		o.auth = authn.Anonymous
 	}
 
+	if err := configureTLS(o); err != nil {
+		return nil, err
+	}
+	if o.offline {
+		o.transport = offlineTransport{}
+	}
+
 	// transport.Wrapper is a signal that consumers are opt-ing into providing their own transport without any additional wrapping.
 	// This is to allow consumers full control over the transports logic, such as providing retry logic.
 	if _, ok := o.transport.(*transport.Wrapper); !ok {
@@ -139,11 +200,39 @@ func makeOptions(target authn.Resource, opts ...Option) (*options, error) {
 		// It's expensive to generate the dumps, so skip it if we're writing
 		// to nothing.
 		if logs.Enabled(logs.Debug) {
-			o.transport = transport.NewLogger(o.transport)
+			o.transport = transport.NewLogger(o.transport, o.redactedHeaders...)
+		}
+
+		// Limit each attempt, so that retries also wait their turn.
+		if o.maxConcurrentRequests > 0 {
+			o.transport = newLimitTransport(o.transport, o.maxConcurrentRequests)
+		}
+
+		if len(o.insecureHosts) != 0 {
+			o.transport = newInsecureHostsTransport(o.transport, o.insecureHosts)
+		}
+
+		// Observe each hop of a redirected ping.
+		if o.resolvedRegistryObserver != nil {
+			o.transport = newResolveTransport(o.transport, o.resolvedRegistryObserver)
+		}
+
+		// Observe each attempt, so that a 429 that is retried is still seen.
+		if o.rateLimitObserver != nil {
+			o.transport = &rateLimitTransport{inner: o.transport, observe: o.rateLimitObserver}
 		}
 
 		// Wrap the transport in something that can retry network flakes.
-		o.transport = transport.NewRetry(o.transport)
+		retryOpts := []transport.Option{}
+		for method, backoff := range o.methodRetryBackoff {
+			retryOpts = append(retryOpts, transport.WithMethodRetryBackoff(method, backoff))
+		}
+		if o.metrics != nil {
+			// Report each attempt, and each retry, separately.
+			o.transport = &metricsTransport{inner: o.transport, metrics: o.metrics}
+			retryOpts = append(retryOpts, transport.WithRetryPredicate(retryWithMetrics(retry.IsTemporary, o.metrics)))
+		}
+		o.transport = transport.NewRetry(o.transport, retryOpts...)
 
 		// Wrap this last to prevent transport.New from double-wrapping.
 		if o.userAgent != "" {
@@ -154,6 +243,47 @@ func makeOptions(target authn.Resource, opts ...Option) (*options, error) {
 	return o, nil
 }
 
+// makeReferenceOptions is like makeOptions, but also applies any rewriter
+// passed to WithReferenceRewriter to ref, so that credentials are resolved for
+// the reference that will actually be requested.
+func makeReferenceOptions(ref name.Reference, opts ...Option) (name.Reference, *options, error) {
+	o, err := makeOptions(ref.Context(), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.referenceRewriter == nil {
+		return ref, o, nil
+	}
+	rewritten, err := rewriteReference(ref, o.referenceRewriter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rewritten.Context() == ref.Context() {
+		return rewritten, o, nil
+	}
+	o, err = makeOptions(rewritten.Context(), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rewritten, o, nil
+}
+
+// rewriteReference applies f to ref. If ref is a digest, the result always
+// refers to the same digest, so that content is still verified against it.
+func rewriteReference(ref name.Reference, f func(name.Reference) name.Reference) (name.Reference, error) {
+	rewritten := f(ref)
+	if rewritten == nil {
+		return nil, fmt.Errorf("reference rewriter returned nil for %s", ref)
+	}
+	if d, ok := ref.(name.Digest); ok {
+		if rd, ok := rewritten.(name.Digest); ok && rd.DigestStr() == d.DigestStr() {
+			return rd, nil
+		}
+		return rewritten.Context().Digest(d.DigestStr()), nil
+	}
+	return rewritten, nil
+}
+
 // WithTransport is a functional option for overriding the default transport
 // for remote operations.
 // If transport.Wrapper is provided, this signals that the consumer does *not* want any further wrapping to occur.
@@ -192,6 +322,15 @@ func WithAuthFromKeychain(keys authn.Keychain) Option {
 	}
 }
 
+// WithCredentialHelper is a functional option for authenticating with the
+// credentials printed by a Docker credential helper executable, e.g. "gcr"
+// for docker-credential-gcr on $PATH, or the path of one, for each registry.
+// See authn.NewKeychainFromHelperCommand. Like WithAuthFromKeychain, it can't
+// be combined with WithAuth.
+func WithCredentialHelper(helper string) Option {
+	return WithAuthFromKeychain(authn.NewKeychainFromHelperCommand(helper))
+}
+
 // WithPlatform is a functional option for overriding the default platform
 // that Image and Descriptor.Image use for resolving an index to an image.
 //
@@ -276,6 +415,11 @@ func WithPageSize(size int) Option {
 }
 
 // WithRetryBackoff sets the httpBackoff for retry HTTP operations.
+//
+// This applies to operations that know how to retry safely, like restarting
+// a blob upload in a new session or re-sending a manifest. Individual
+// requests that fail with a temporary network error are also retried by the
+// transport, but only if they're idempotent; see WithMethodRetryBackoff.
 func WithRetryBackoff(backoff Backoff) Option {
 	return func(o *options) error {
 		o.retryBackoff = backoff
@@ -290,3 +434,710 @@ func WithRetryPredicate(predicate retry.Predicate) Option {
 		return nil
 	}
 }
+
+// WithMaxRetriesPerBlob caps the number of attempts made to upload any single
+// blob, independent of the backoff set by WithRetryBackoff. This prevents one
+// persistently failing blob from consuming the entire retry budget of a large
+// parallel push. When the cap is reached, the returned error is an
+// *ErrBlobRetriesExhausted identifying the blob.
+//
+// The default is to use the number of steps in the retry backoff, and n never
+// allows more attempts than that.
+func WithMaxRetriesPerBlob(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return errors.New("max retries per blob must be greater than zero")
+		}
+		o.maxRetriesPerBlob = n
+		return nil
+	}
+}
+
+// WithUploadSession sets a callback that is invoked whenever a blob upload
+// session is created, with the digest of the blob being uploaded and the
+// absolute URL of the upload session. This allows external systems to track
+// the progress of (or resume) very large uploads out-of-band.
+//
+// The digest will be empty for streaming layers, since their digest isn't
+// known until the upload has completed.
+func WithUploadSession(f func(digest v1.Hash, location string)) Option {
+	return func(o *options) error {
+		o.uploadSession = f
+		return nil
+	}
+}
+
+// WithWriteSummary sets a callback that is invoked once a write completes,
+// with a summary of how many blobs (and bytes) were uploaded, mounted from
+// another repository, or skipped because they already existed. Mounted and
+// existing blobs count zero bytes towards BytesUploaded.
+//
+// The callback is invoked even if the write fails, describing the blobs that
+// were transferred before the failure. Manifests are not included in the blob
+// counts, but each tag that is written is counted as updated or unchanged,
+// which takes an extra HEAD request per tag. The summary's Blobs lists the
+// descriptor of every blob counted.
+func WithWriteSummary(f func(WriteSummary)) Option {
+	return func(o *options) error {
+		o.writeSummary = f
+		return nil
+	}
+}
+
+// WithParallelChunks uploads blobs larger than a single chunk by sending up to
+// n chunks at a time, rather than in a single request. This can speed up
+// pushing a very large layer to registries that accept chunks out of order.
+//
+// Registries aren't required to accept out of order chunks, so if a registry
+// rejects one, the blob is uploaded again sequentially, one chunk at a time.
+// Streaming layers are always uploaded in a single request.
+func WithParallelChunks(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return errors.New("parallel chunks must be greater than zero")
+		}
+		o.parallelChunks = n
+		return nil
+	}
+}
+
+// WithChunkSize uploads blobs in chunks whose sizes are chosen by s, rather
+// than in a single request, e.g. FixedChunkSize(8<<20) for 8 MiB chunks, or
+// AdaptiveChunkSize to grow the chunks on fast links and shrink them on slow
+// or flaky ones. Each chunk is sent once the previous one has been accepted,
+// unless WithParallelChunks is also used.
+//
+// Without WithChunkSize, WithParallelChunks sends chunks of 16 MiB. Streaming
+// layers are always uploaded in a single request.
+func WithChunkSize(s ChunkSizer) Option {
+	return func(o *options) error {
+		switch s := s.(type) {
+		case nil:
+			return errors.New("chunk sizer must not be nil")
+		case FixedChunkSize:
+			if s <= 0 {
+				return errors.New("chunk size must be greater than zero")
+			}
+		case *adaptiveChunkSize:
+			if s.min <= 0 || s.max < s.min {
+				return fmt.Errorf("invalid adaptive chunk size range %d-%d", s.min, s.max)
+			}
+		}
+		o.chunkSizer = s
+		return nil
+	}
+}
+
+// WithBlobAcceptEncoding sets the Accept-Encoding header sent when fetching
+// blobs, including the layers of images and their foreign URLs, which defaults to "identity" so that the response body contains the
+// exact bytes matching the blob's digest. Some registries and proxies apply
+// (or mislabel) gzip transfer compression otherwise, which corrupts digests.
+//
+// Passing an empty string omits the header, which lets the underlying
+// http.Transport negotiate compression and transparently decompress the
+// response.
+func WithBlobAcceptEncoding(enc string) Option {
+	return func(o *options) error {
+		o.blobAcceptEncoding = enc
+		return nil
+	}
+}
+
+// WithExpectedDigest pins the digest that a reference is expected to resolve
+// to. If the registry resolves the reference (typically a tag) to a different
+// digest, Get, Head, Image, Index and Layer fail with an *ErrDigestMismatch
+// instead of returning the unexpected content. This protects against a tag
+// being moved between when the caller resolved it and when it is pulled.
+func WithExpectedDigest(h v1.Hash) Option {
+	return func(o *options) error {
+		o.expectedDigest = &h
+		return nil
+	}
+}
+
+// WithAcceptedMediaTypes adds the given media types to the Accept header sent
+// by Get and Head, in addition to the image and index media types this
+// package understands. This is useful for fetching artifacts with manifest
+// media types that registries only serve when they are explicitly requested.
+func WithAcceptedMediaTypes(mts ...types.MediaType) Option {
+	return func(o *options) error {
+		o.acceptedMediaTypes = append(o.acceptedMediaTypes, mts...)
+		return nil
+	}
+}
+
+// WithScopes declares additional token scopes, e.g.
+// "repository:foo/bar:pull", to request along with the ones an operation
+// needs by default. This lets bulk operations that touch several repositories
+// (or need several actions on one) obtain a single token up front instead of
+// re-authenticating whenever the registry challenges a request for a scope the
+// current token doesn't cover.
+func WithScopes(scopes []string) Option {
+	return func(o *options) error {
+		o.scopes = append(o.scopes, scopes...)
+		return nil
+	}
+}
+
+// addScopes appends any scopes passed to WithScopes to scopes, skipping
+// duplicates. The defaults come first, since some registries only look at the
+// first scope.
+func addScopes(scopes []string, o *options) []string {
+	seen := map[string]bool{}
+	for _, s := range scopes {
+		seen[s] = true
+	}
+	for _, s := range o.scopes {
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// WithLayerTransform applies f to each layer of an image passed to Write
+// before anything is uploaded, e.g. to recompress layers for a registry that
+// prefers a different compression.
+//
+// The manifest is updated with the digests, sizes and media types of the
+// transformed layers. Transforms are expected to preserve each layer's
+// uncompressed contents (and so its diff ID), but if they don't, the config's
+// rootfs.diff_ids are updated to match. Returning the original layer leaves it
+// untouched, so it can still be mounted.
+//
+// Transforming an index would change the digests of its children, so
+// WriteIndex and MultiWrite return an error if this option is used.
+func WithLayerTransform(f func(v1.Layer) (v1.Layer, error)) Option {
+	return func(o *options) error {
+		o.layerTransform = f
+		return nil
+	}
+}
+
+// WithExistingBlobs lets images read from a registry use blobs that are
+// already available locally, e.g. in an OCI image layout, instead of
+// downloading them again.
+//
+// When an image's layers are constructed, has is consulted for each digest.
+// Layers for which it returns true read their contents from open, and are
+// verified against their digest as usual; the rest are fetched from the
+// registry. For example, with a layout.Path p:
+//
+//	remote.WithExistingBlobs(func(h v1.Hash) bool {
+//		_, err := os.Stat(filepath.Join(string(p), "blobs", h.Algorithm, h.Hex))
+//		return err == nil
+//	}, p.Blob)
+func WithExistingBlobs(has func(v1.Hash) bool, open func(v1.Hash) (io.ReadCloser, error)) Option {
+	return func(o *options) error {
+		if has == nil || open == nil {
+			return errors.New("WithExistingBlobs requires both has and open")
+		}
+		o.hasBlob = has
+		o.openBlob = open
+		return nil
+	}
+}
+
+// WithMetrics reports the requests made by remote operations to m, including
+// their latencies, the bytes they transfer and any retries. Metrics are not
+// collected when a transport.Wrapper is passed to WithTransport, since that
+// opts out of any additional wrapping.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) error {
+		o.metrics = m
+		return nil
+	}
+}
+
+// WithReferenceRewriter applies f to every reference before it is pulled,
+// e.g. to transparently redirect pulls from docker.io to an internal mirror.
+//
+// This applies to Get, Head, Image, Index and Layer. Credentials are resolved
+// for the rewritten reference, and images and layers that are pulled refer to
+// it, so subsequent cross-repository mounts and blob fetches also use the
+// mirror. Digest references keep their digest even if f drops it, so content
+// is still verified against the originally requested digest.
+func WithReferenceRewriter(f func(name.Reference) name.Reference) Option {
+	return func(o *options) error {
+		o.referenceRewriter = f
+		return nil
+	}
+}
+
+// WithMaxConcurrentRequests bounds the number of HTTP requests (of any method)
+// that a single remote operation has in flight at once, to protect
+// rate-limited registries.
+//
+// This is distinct from WithJobs and WithParallelChunks, which control how
+// many blobs or chunks are transferred concurrently: those goroutines still
+// run, but wait for one of the n request slots before each request. A slot is
+// held until the response headers are received, so streaming a response body
+// doesn't count against the limit. Like retries, this limit isn't applied
+// when a transport.Wrapper is passed to WithTransport.
+func WithMaxConcurrentRequests(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return errors.New("max concurrent requests must be greater than zero")
+		}
+		o.maxConcurrentRequests = n
+		return nil
+	}
+}
+
+// WithLegacySchema1 makes Write fall back to pushing a signed Docker v2
+// schema 1 manifest when the registry rejects the image's schema 2 or OCI
+// manifest with a 400 or 415, as some legacy registries do.
+//
+// Schema 1 manifests can only be pushed by tag. They are signed with a
+// throwaway key, since registries only check that the signature is valid and
+// not who made it. The image's blobs are uploaded as usual; only the manifest
+// differs, so the config blob is left dangling in the registry.
+func WithLegacySchema1() Option {
+	return func(o *options) error {
+		o.legacySchema1 = true
+		return nil
+	}
+}
+
+// WithCACerts adds the PEM-encoded certificates in pem to the system's pool
+// of trusted root CAs, e.g. to talk to a registry with a self-signed or
+// internal certificate.
+//
+// Like WithClientCert, this configures a copy of the transport passed to
+// WithTransport (DefaultTransport by default), which must be an
+// *http.Transport that doesn't already set RootCAs.
+func WithCACerts(pem []byte) Option {
+	return func(o *options) error {
+		o.caCerts = append(o.caCerts, pem...)
+		return nil
+	}
+}
+
+// WithClientCert presents cert to registries that require mutual TLS.
+//
+// It may be passed more than once to offer several certificates. Like
+// WithCACerts, this configures a copy of the transport passed to
+// WithTransport, which must be an *http.Transport that doesn't already set
+// client certificates.
+func WithClientCert(cert tls.Certificate) Option {
+	return func(o *options) error {
+		o.clientCerts = append(o.clientCerts, cert)
+		return nil
+	}
+}
+
+// WithRedactedHeaders masks the values of the named request and response
+// headers in the debug logs written to logs.Debug, like Authorization always
+// is. Use this for registries or proxies that send credentials in custom
+// headers.
+//
+// Like retries, this has no effect when a transport.Wrapper is passed to
+// WithTransport, since no logging transport is added.
+func WithRedactedHeaders(headers []string) Option {
+	return func(o *options) error {
+		o.redactedHeaders = append(o.redactedHeaders, headers...)
+		return nil
+	}
+}
+
+// WithForeignLayerURLs marks the layers of an image passed to Write whose
+// digests are keys of urls as foreign, e.g. the base layers of Windows images
+// that are served from Microsoft's CDN.
+//
+// Each such layer's descriptor in the manifest gets the given URLs and the
+// non-distributable equivalent of its media type. The blobs aren't uploaded,
+// or even checked for in the registry, regardless of
+// WithNondistributable.
+func WithForeignLayerURLs(urls map[v1.Hash][]string) Option {
+	return func(o *options) error {
+		for h, u := range urls {
+			if len(u) == 0 {
+				return fmt.Errorf("no URLs given for foreign layer %s", h)
+			}
+		}
+		o.foreignURLs = urls
+		return nil
+	}
+}
+
+// WithUncompressedSizeAnnotation makes Write annotate each layer's descriptor
+// in the manifest with UncompressedSizeAnnotation.
+//
+// This reads and decompresses every layer once more before the upload starts
+// (reading up to WithJobs layers at a time), so it's opt-in. Layers passed to
+// WithForeignLayerURLs aren't annotated, since their contents may not be
+// available. Images with a stream.Layer can't be annotated, since its contents
+// can only be read once, so Write fails for them.
+func WithUncompressedSizeAnnotation() Option {
+	return func(o *options) error {
+		o.uncompressedSizes = true
+		return nil
+	}
+}
+
+// WithTransferCancel calls f as the upload of each blob (with a known digest)
+// starts, with a func that cancels just that upload, e.g. so that a mirror
+// can abort a layer that violates its policy.
+//
+// Canceling an upload aborts its in-flight request, releasing the
+// connection. When writing an image, the image's other blobs are still
+// uploaded, but its manifest isn't written and an *ErrTransferCanceled
+// listing the canceled blobs is returned. Other operations fail as soon as
+// any upload is canceled. The cancel func may be called after the upload
+// has finished, which does nothing.
+func WithTransferCancel(f func(digest v1.Hash, cancel context.CancelFunc)) Option {
+	return func(o *options) error {
+		o.transferCancel = f
+		return nil
+	}
+}
+
+// WithRateLimitObserver calls f with the quota reported by the
+// RateLimit-Limit and RateLimit-Remaining headers (as sent by Docker Hub,
+// among others) of every response that includes them, so that long-running
+// jobs can back off before they are throttled with a 429.
+//
+// f may be called concurrently. Like WithMetrics, it isn't called when a
+// transport.Wrapper is passed to WithTransport.
+func WithRateLimitObserver(f func(limit, remaining int)) Option {
+	return func(o *options) error {
+		o.rateLimitObserver = f
+		return nil
+	}
+}
+
+// WithInsecureSkipTLSVerify disables verification of registries' TLS
+// certificates for the operation it's passed to. THIS IS ONLY FOR TESTING,
+// e.g. against a local registry with a self-signed certificate: it lets
+// anyone who can intercept the connection impersonate the registry, and read
+// or alter everything sent to or received from it, credentials included. Use
+// WithCACerts to trust a self-signed certificate instead.
+//
+// Like WithCACerts, this configures a copy of the transport passed to
+// WithTransport, which must be an *http.Transport, so it composes with the
+// other TLS options.
+func WithInsecureSkipTLSVerify() Option {
+	return func(o *options) error {
+		o.insecureSkipVerify = true
+		return nil
+	}
+}
+
+// WithAllowedInsecureHosts contacts only the given registry hosts over plain
+// HTTP, without having to parse every reference with name.Insecure, e.g. for
+// a single internal registry that doesn't serve TLS. Every other registry is
+// still contacted over HTTPS.
+//
+// A host with a port (e.g. "registry.internal:5000") only matches that port,
+// while a host without one matches any port. This rewrites the scheme of
+// requests in the transport, so it has no effect when a transport.Wrapper is
+// passed to WithTransport.
+func WithAllowedInsecureHosts(hosts []string) Option {
+	return func(o *options) error {
+		for _, h := range hosts {
+			if h == "" {
+				return errors.New("WithAllowedInsecureHosts: empty host")
+			}
+		}
+		o.insecureHosts = append(o.insecureHosts, hosts...)
+		return nil
+	}
+}
+
+// WithMethodRetryBackoff sets the backoff used by the transport to retry
+// individual requests with the given method after a temporary network error.
+//
+// By default, only GET, HEAD, OPTIONS and TRACE requests are retried this
+// way, since retrying e.g. a PUT that partially succeeded could conflict with
+// the first attempt. A backoff with a single step disables retries for a
+// method. Requests whose body can't be replayed, like the PATCH that streams
+// a blob, are never retried by the transport; blob uploads are retried by
+// starting a new upload session instead (see WithRetryBackoff). Like
+// WithMetrics, this has no effect when a transport.Wrapper is passed to
+// WithTransport.
+func WithMethodRetryBackoff(method string, backoff Backoff) Option {
+	return func(o *options) error {
+		if o.methodRetryBackoff == nil {
+			o.methodRetryBackoff = map[string]Backoff{}
+		}
+		o.methodRetryBackoff[method] = backoff
+		return nil
+	}
+}
+
+// WithResolvedRegistryObserver calls f whenever a registry is pinged (which
+// happens at the start of most operations), with the base URL that its /v2/
+// endpoint resolved to after following any redirects, e.g. to diagnose a
+// misconfigured reverse proxy. registry is the host that was pinged, and base
+// includes the scheme, host and any path before /v2/.
+//
+// f may be called concurrently. Like WithMetrics, it isn't called when a
+// transport.Wrapper is passed to WithTransport.
+func WithResolvedRegistryObserver(f func(registry string, base url.URL)) Option {
+	return func(o *options) error {
+		o.resolvedRegistryObserver = f
+		return nil
+	}
+}
+
+// BlobDigestMode controls how the digest of an uploaded blob is sent when the
+// upload is committed. See WithBlobDigestMode.
+type BlobDigestMode int
+
+const (
+	// BlobDigestAuto sends the digest as a query parameter, and falls back
+	// to BlobDigestHeader if the registry rejects that.
+	BlobDigestAuto BlobDigestMode = iota
+
+	// BlobDigestQuery only sends the digest as the "digest" query parameter,
+	// as the distribution spec requires.
+	BlobDigestQuery
+
+	// BlobDigestHeader only sends the digest in a Docker-Content-Digest
+	// header, for registries that don't accept it in the query.
+	BlobDigestHeader
+)
+
+// WithBlobDigestMode sets how the digest of an uploaded blob is sent in the
+// PUT that completes the upload. The default, BlobDigestAuto, works with
+// registries that follow the distribution spec and with most that don't;
+// forcing a mode avoids a rejected request per push for the latter.
+func WithBlobDigestMode(mode BlobDigestMode) Option {
+	return func(o *options) error {
+		switch mode {
+		case BlobDigestAuto, BlobDigestQuery, BlobDigestHeader:
+			o.blobDigestMode = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown blob digest mode %d", mode)
+		}
+	}
+}
+
+// WithOffline makes every request to a registry fail with an *ErrOffline,
+// e.g. to assert that tests or hermetic builds don't depend on the network.
+// Any transport passed to WithTransport is ignored.
+//
+// Combined with WithExistingBlobs, images can still be read by digest if
+// their manifests, configs and layers are all available locally: manifests
+// and blobs are read from there instead of the registry, and anything
+// missing fails with an *ErrOffline.
+func WithOffline() Option {
+	return func(o *options) error {
+		o.offline = true
+		return nil
+	}
+}
+
+// WithLayerScanner calls scan with a tar.Reader over the uncompressed
+// contents of each layer that's downloaded, e.g. by a security scanner, so
+// that the layer doesn't have to be downloaded a second time.
+//
+// The scan runs concurrently with whatever reads the layer: it sees the same
+// bytes, as they're downloaded. If scan returns an error, reading the layer
+// fails with that error; otherwise reading the layer only reaches io.EOF once
+// scan has returned. If the layer is closed before it has been read
+// completely, scan sees an error from the tar.Reader, and its result is
+// ignored. Layers read from WithExistingBlobs aren't scanned.
+func WithLayerScanner(scan LayerScanner) Option {
+	return func(o *options) error {
+		o.layerScanner = scan
+		return nil
+	}
+}
+
+// defaultMaxManifestSize is the default limit for WithMaxManifestSize. The
+// distribution spec only requires registries to accept manifests up to 4 MiB.
+const defaultMaxManifestSize = 4 << 20
+
+// WithMaxManifestSize sets the largest manifest, in bytes, that will be read
+// from a registry. Manifests are read into memory, so this prevents a
+// malicious registry from exhausting it with an enormous response; larger
+// manifests fail with an *ErrManifestExceedsLimit. The default is 4 MiB.
+func WithMaxManifestSize(n int64) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return errors.New("max manifest size must be greater than zero")
+		}
+		o.maxManifestSize = n
+		return nil
+	}
+}
+
+// WithPlatformMatcher is a functional option for choosing the child of an
+// index that Image and Descriptor.Image resolve to with match, rather than
+// with WithPlatform, e.g. to prefer arm64 but fall back to amd64.
+//
+// match is passed the descriptors of the index's manifests, and returns the
+// one to use. If it returns nil, resolving the index fails with an error
+// that names it. Nested indexes are resolved with match as well.
+func WithPlatformMatcher(match func([]v1.Descriptor) (*v1.Descriptor, error)) Option {
+	return func(o *options) error {
+		o.platformMatcher = match
+		return nil
+	}
+}
+
+// WithUnknownPlatforms is a functional option that makes Image and
+// Descriptor.Image consider the children of an index whose platform is
+// unknown/unknown, e.g. the attestation manifests that BuildKit adds to the
+// indexes it builds, when resolving the index to an image.
+//
+// By default, those children are skipped (unless WithPlatform asks for
+// unknown/unknown itself), and aren't passed to WithPlatformMatcher's match,
+// so that an attestation is never mistaken for the image it describes.
+// Copying an index with WriteIndex always includes them.
+func WithUnknownPlatforms() Option {
+	return func(o *options) error {
+		o.unknownPlatforms = true
+		return nil
+	}
+}
+
+// WithMemoryBlobCache keeps blobs downloaded from registries in memory, up to
+// a total of maxBytes, so that reading them again doesn't download them again,
+// e.g. for a server that serves the same popular layers repeatedly. When the
+// cache is full, the least recently used blobs are evicted first. Blobs are
+// only cached once they've been read completely and verified against their
+// digest, and blobs larger than maxBytes are never cached.
+//
+// The cache belongs to the returned Option, so pass the same Option to each
+// call that should share it. It's safe for concurrent use, and each read of a
+// cached blob gets its own reader.
+func WithMemoryBlobCache(maxBytes int64) Option {
+	c := newBlobCache(maxBytes)
+	return func(o *options) error {
+		if maxBytes <= 0 {
+			return errors.New("memory blob cache size must be greater than zero")
+		}
+		o.blobCache = c
+		return nil
+	}
+}
+
+// WithUncompressedTee passes the uncompressed contents of each layer that's
+// uploaded to a writer, as they're uploaded, e.g. so that an SBOM generator
+// can read them without downloading the layers again. It's opt-in, since
+// decompressing layers costs CPU. Layers that already exist in the registry or
+// are mounted aren't read, and so aren't passed to a writer, and neither is
+// the config blob.
+//
+// open is called each time a layer starts uploading, and the returned writer
+// is closed once it has received the whole layer. If writing to it fails, the
+// upload fails too. If the upload attempt stops early, e.g. to be retried, the
+// writer is closed with an error by its CloseWithError method, if it has one
+// (like *io.PipeWriter), and open is called again for the next attempt.
+//
+// The writer is fed from a goroutine, with a few MiB of buffering, so a
+// writer that's slower than the upload only slows it down once the buffer is
+// full.
+func WithUncompressedTee(open func(l v1.Layer) (io.WriteCloser, error)) Option {
+	return func(o *options) error {
+		o.uncompressedTee = open
+		return nil
+	}
+}
+
+// WithMountRepository makes Write, WriteIndex and MultiWrite try to mount each
+// blob that isn't already in the destination repository from repo instead of
+// wherever the blob came from, e.g. a repository in the destination registry
+// that's known to hold the base image's layers. Blobs that repo doesn't have
+// are uploaded as usual, since the registry falls back to an upload when a
+// mount fails. A pull scope for repo is requested along with the push scope.
+func WithMountRepository(repo name.Repository) Option {
+	return func(o *options) error {
+		o.mountRepo = &repo
+		o.scopes = append(o.scopes, repo.Scope(transport.PullScope))
+		return nil
+	}
+}
+
+// WithVerifySampleLayers makes VerifyImage download n of the image's layers,
+// picked at random, and validate their contents, in addition to checking that
+// every blob exists. It's zero by default, so that nothing is downloaded, and
+// a larger n than the image has layers validates all of them.
+func WithVerifySampleLayers(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return errors.New("the number of layers to sample can't be negative")
+		}
+		o.verifySampleLayers = n
+		return nil
+	}
+}
+
+// WithBlobWritten sets a callback that is invoked each time Write, WriteIndex,
+// MultiWrite or WriteLayer gets a blob into the destination repository,
+// whether by uploading it, mounting it, or finding that it was already there,
+// with the blob's descriptor. Unlike WithWriteSummary, it reports each blob as
+// soon as it's done, e.g. so that progress can be recorded in case the write
+// is interrupted. It may be called concurrently.
+func WithBlobWritten(f func(v1.Descriptor)) Option {
+	return func(o *options) error {
+		o.blobWritten = f
+		return nil
+	}
+}
+
+// WithKnownBlobs tells Write, WriteIndex, MultiWrite and WriteLayer that the
+// blobs for which has returns true are already in the destination repository,
+// so they're neither checked nor uploaded, but reported as existing. This is
+// useful to resume a write that recorded its progress with WithBlobWritten.
+// If has is wrong, the manifest refers to blobs that aren't there, and the
+// registry may reject it.
+func WithKnownBlobs(has func(v1.Hash) bool) Option {
+	return func(o *options) error {
+		o.knownBlob = has
+		return nil
+	}
+}
+
+// WithManifestMediaType makes Write push the image's manifest as mt, either
+// types.DockerManifestSchema2 or types.OCIManifestSchema1, regardless of the
+// media type the image declares, e.g. for a registry that only accepts one of
+// them. Both the manifest's mediaType field and the Content-Type of the PUT
+// are set to mt, which changes the manifest's digest.
+//
+// Write fails if the manifest's config or layers have media types that a
+// manifest of type mt can't refer to, like OCI layers in a Docker manifest.
+// MultiWrite and WriteIndex don't support it, and fail if it's set.
+func WithManifestMediaType(mt types.MediaType) Option {
+	return func(o *options) error {
+		if !mt.IsImage() {
+			return fmt.Errorf("%s is not an image manifest media type", mt)
+		}
+		o.manifestMediaType = mt
+		return nil
+	}
+}
+
+// WithRequireCompleteIndex makes WriteIndex check that every manifest the
+// index refers to, at any depth, and every blob those manifests refer to, can
+// be fetched from the index being written before it writes anything, so that
+// copying an index with a platform that's missing from the source fails
+// instead of publishing the platforms that are there. Blobs are checked up to
+// WithJobs at a time, and every missing manifest and blob is reported, not
+// just the first. Non-distributable layers are only checked if
+// WithNondistributable is also given.
+func WithRequireCompleteIndex() Option {
+	return func(o *options) error {
+		o.requireCompleteIndex = true
+		return nil
+	}
+}
+
+// WithReadBufferSize makes blobs be read from registries n bytes at a time,
+// rather than in whatever size pieces their consumer reads, e.g. the 32 KiB of
+// io.Copy, which means fewer, larger reads on high-bandwidth, high-latency
+// links. It applies to the layers read from images, indexes and Layer, and
+// to PullBlobToFile. By default, blobs are read as they're consumed.
+func WithReadBufferSize(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return errors.New("read buffer size must be greater than zero")
+		}
+		o.readBufferSize = n
+		return nil
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// PingResult describes how a registry responded to Ping.
+type PingResult = transport.PingResult
+
+// Ping checks that reg speaks the v2 registry API, and reports which API
+// version it claims and how it expects clients to authenticate, e.g. to
+// validate a registry's configuration before using it. It sends the same
+// GET /v2/ that every other operation starts with, over the transport
+// configured by options, but doesn't authenticate.
+func Ping(reg name.Registry, options ...Option) (*PingResult, error) {
+	o, err := makeOptions(reg, options...)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Ping(o.context, reg, o.transport)
+}
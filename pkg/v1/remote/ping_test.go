@@ -0,0 +1,94 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+func TestPing(t *testing.T) {
+	bearer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="example.com"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer bearer.Close()
+	anonymous := httptest.NewServer(registry.New())
+	defer anonymous.Close()
+	notV2 := httptest.NewServer(http.NotFoundHandler())
+	defer notV2.Close()
+
+	for _, tc := range []struct {
+		name    string
+		server  *httptest.Server
+		want    *PingResult
+		wantErr bool
+	}{{
+		name:   "bearer",
+		server: bearer,
+		want: &PingResult{
+			APIVersion: "registry/2.0",
+			Scheme:     "http",
+			Challenge:  "bearer",
+			Parameters: map[string]string{"realm": "https://auth.example.com/token", "service": "example.com"},
+		},
+	}, {
+		name:   "anonymous",
+		server: anonymous,
+		want: &PingResult{
+			APIVersion: "registry/2.0",
+			Scheme:     "http",
+			Challenge:  "anonymous",
+		},
+	}, {
+		name:    "not v2",
+		server:  notV2,
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg, err := name.NewRegistry(u.Host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Ping(reg)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Ping() = %+v, expected error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Ping() = %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Ping() (-want +got) = %s", diff)
+			}
+		})
+	}
+}
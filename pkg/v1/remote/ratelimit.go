@@ -0,0 +1,71 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rateLimitTransport reports the rate limit headers of every response that
+// passes through it to observe.
+type rateLimitTransport struct {
+	inner   http.RoundTripper
+	observe func(limit, remaining int)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitTransport) RoundTrip(in *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(in)
+	if err != nil {
+		return nil, err
+	}
+	if limit, remaining, ok := parseRateLimit(resp.Header); ok {
+		t.observe(limit, remaining)
+	}
+	return resp, nil
+}
+
+// parseRateLimit parses the RateLimit-Limit and RateLimit-Remaining headers
+// (or their X- prefixed equivalents), if both are present.
+func parseRateLimit(h http.Header) (limit, remaining int, ok bool) {
+	limit, ok = rateLimitHeader(h, "RateLimit-Limit")
+	if !ok {
+		return 0, 0, false
+	}
+	remaining, ok = rateLimitHeader(h, "RateLimit-Remaining")
+	if !ok {
+		return 0, 0, false
+	}
+	return limit, remaining, true
+}
+
+// rateLimitHeader parses the quota in a header like "100", "100;w=21600" or
+// "100, 100;w=60", ignoring the window and any other policies.
+func rateLimitHeader(h http.Header, key string) (int, bool) {
+	v := h.Get(key)
+	if v == "" {
+		v = h.Get("X-" + key)
+	}
+	if i := strings.IndexAny(v, ";,"); i >= 0 {
+		v = v[:i]
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		desc          string
+		header        http.Header
+		wantLimit     int
+		wantRemaining int
+		wantOK        bool
+	}{{
+		desc:   "missing",
+		header: http.Header{},
+	}, {
+		desc: "plain",
+		header: http.Header{
+			"Ratelimit-Limit":     {"100"},
+			"Ratelimit-Remaining": {"76"},
+		},
+		wantLimit:     100,
+		wantRemaining: 76,
+		wantOK:        true,
+	}, {
+		desc: "docker hub",
+		header: http.Header{
+			"Ratelimit-Limit":     {"100;w=21600"},
+			"Ratelimit-Remaining": {"0;w=21600"},
+		},
+		wantLimit:     100,
+		wantRemaining: 0,
+		wantOK:        true,
+	}, {
+		desc: "multiple policies",
+		header: http.Header{
+			"Ratelimit-Limit":     {"10, 10;w=1, 1000;w=3600"},
+			"Ratelimit-Remaining": {" 9 "},
+		},
+		wantLimit:     10,
+		wantRemaining: 9,
+		wantOK:        true,
+	}, {
+		desc: "x- prefixed",
+		header: http.Header{
+			"X-Ratelimit-Limit":     {"5000"},
+			"X-Ratelimit-Remaining": {"4999"},
+		},
+		wantLimit:     5000,
+		wantRemaining: 4999,
+		wantOK:        true,
+	}, {
+		desc: "only limit",
+		header: http.Header{
+			"Ratelimit-Limit": {"100"},
+		},
+	}, {
+		desc: "garbage",
+		header: http.Header{
+			"Ratelimit-Limit":     {"lots"},
+			"Ratelimit-Remaining": {"-1"},
+		},
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			limit, remaining, ok := parseRateLimit(tc.header)
+			if limit != tc.wantLimit || remaining != tc.wantRemaining || ok != tc.wantOK {
+				t.Errorf("parseRateLimit() = (%d, %d, %t), want (%d, %d, %t)", limit, remaining, ok, tc.wantLimit, tc.wantRemaining, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestWithRateLimitObserver(t *testing.T) {
+	reg := registry.New()
+	remaining := 10
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("RateLimit-Limit", "10;w=21600")
+			w.Header().Set("RateLimit-Remaining", fmt.Sprintf("%d;w=21600", remaining))
+			remaining--
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining = 10
+	var seen [][2]int
+	got, err := Image(ref, WithRateLimitObserver(func(limit, remaining int) {
+		seen = append(seen, [2]int{limit, remaining})
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := got.RawConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	// GET /v2/, the manifest and the config.
+	want := [][2]int{{10, 10}, {10, 9}, {10, 8}}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("observed %v, want %v", seen, want)
+	}
+}
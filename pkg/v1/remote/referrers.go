@@ -0,0 +1,203 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// referrer holds the fields of a manifest that matter to the referrers API.
+type referrer struct {
+	ArtifactType string `json:"artifactType,omitempty"`
+	Config       struct {
+		MediaType types.MediaType `json:"mediaType"`
+	} `json:"config"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Subject     *v1.Descriptor    `json:"subject,omitempty"`
+}
+
+// fallbackTag returns the tag that lists the referrers of h for registries
+// without the referrers API, e.g. "sha256-abc...".
+func fallbackTag(h v1.Hash) string {
+	return fmt.Sprintf("%s-%s", h.Algorithm, h.Hex)
+}
+
+// commitReferrer makes the manifest raw, described by desc, discoverable as
+// a referrer of its subject, if it has one, on registries that don't support
+// the referrers API. It's called after raw has been pushed, and the registry
+// didn't indicate that it processed the subject.
+//
+// If the registry serves the referrers API, it's left to maintain the
+// referrers itself. Otherwise, desc is added to the index in the subject's
+// fallback tag, as described by the OCI distribution spec.
+func (w *writer) commitReferrer(ctx context.Context, raw []byte, desc *v1.Descriptor) error {
+	var r referrer
+	if err := json.Unmarshal(raw, &r); err != nil || r.Subject == nil {
+		// Not a manifest with a subject, e.g. a schema 1 manifest.
+		return nil
+	}
+
+	supported, err := w.referrersSupported(ctx, r.Subject.Digest)
+	if err != nil {
+		return err
+	}
+	if supported {
+		return nil
+	}
+
+	tag := w.repo.Tag(fallbackTag(r.Subject.Digest))
+	index, err := w.fallbackIndex(ctx, tag.Identifier())
+	if err != nil {
+		return err
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == desc.Digest {
+			return nil
+		}
+	}
+	artifactType := r.ArtifactType
+	if artifactType == "" {
+		artifactType = string(r.Config.MediaType)
+	}
+	index.Manifests = append(index.Manifests, v1.Descriptor{
+		MediaType:    desc.MediaType,
+		Size:         desc.Size,
+		Digest:       desc.Digest,
+		Annotations:  r.Annotations,
+		ArtifactType: artifactType,
+	})
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	logs.Progress.Printf("adding %s to referrers fallback tag %s", desc.Digest, tag)
+	return w.commitManifest(ctx, &rawManifest{raw: b, mediaType: types.OCIImageIndex}, tag)
+}
+
+// referrersSupported returns whether the registry serves the referrers API,
+// by listing the referrers of h.
+func (w *writer) referrersSupported(ctx context.Context, h v1.Hash) (bool, error) {
+	u := w.url(fmt.Sprintf("/v2/%s/referrers/%s", w.repo.RepositoryStr(), h))
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", string(types.OCIImageIndex))
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// Registries without the API may serve anything from 404 to a generic
+	// error page, so only a successful response with an index counts.
+	return resp.StatusCode == http.StatusOK && types.MediaType(resp.Header.Get("Content-Type")) == types.OCIImageIndex, nil
+}
+
+// fallbackIndex returns the index in the fallback tag, or an empty index if
+// the tag doesn't exist yet.
+func (w *writer) fallbackIndex(ctx context.Context, tag string) (*v1.IndexManifest, error) {
+	u := w.url(fmt.Sprintf("/v2/%s/manifests/%s", w.repo.RepositoryStr(), tag))
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(types.OCIImageIndex))
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &v1.IndexManifest{
+			SchemaVersion: 2,
+			MediaType:     types.OCIImageIndex,
+			Manifests:     []v1.Descriptor{},
+		}, nil
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return v1.ParseIndexManifest(resp.Body)
+}
+
+// Referrers returns an index of the manifests whose subject is d, e.g. the
+// signatures and SBOMs attached to an image. It uses the referrers API if the
+// registry serves it, or the fallback tag that Write maintains otherwise, and
+// returns an empty index if there are no referrers.
+func Referrers(d name.Digest, options ...Option) (*v1.IndexManifest, error) {
+	rewritten, o, err := makeReferenceOptions(d, options...)
+	if err != nil {
+		return nil, err
+	}
+	// rewriteReference always preserves digests.
+	d = rewritten.(name.Digest)
+	h, err := v1.NewHash(d.Identifier())
+	if err != nil {
+		return nil, err
+	}
+	f, err := makeFetcher(d, o)
+	if err != nil {
+		return nil, err
+	}
+	return f.fetchReferrers(h)
+}
+
+// fetchReferrers lists the referrers of h, as described by Referrers.
+func (f *fetcher) fetchReferrers(h v1.Hash) (*v1.IndexManifest, error) {
+	u := f.url("referrers", h.String())
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(types.OCIImageIndex))
+	resp, err := f.Client.Do(req.WithContext(f.context))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Like referrersSupported, only a successful response with an index
+	// means that the registry serves the API.
+	if resp.StatusCode == http.StatusOK && types.MediaType(resp.Header.Get("Content-Type")) == types.OCIImageIndex {
+		return v1.ParseIndexManifest(resp.Body)
+	}
+
+	b, _, err := f.fetchManifest(f.Ref.Context().Tag(fallbackTag(h)), []types.MediaType{types.OCIImageIndex})
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return &v1.IndexManifest{
+			SchemaVersion: 2,
+			MediaType:     types.OCIImageIndex,
+			Manifests:     []v1.Descriptor{},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v1.ParseIndexManifest(bytes.NewReader(b))
+}
@@ -0,0 +1,255 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestWriteReferrersFallback(t *testing.T) {
+	for _, withAPI := range []bool{false, true} {
+		t.Run(fmt.Sprintf("referrers API %t", withAPI), func(t *testing.T) {
+			reg := registry.New()
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if withAPI {
+					// Pretend to implement the referrers API.
+					if strings.Contains(r.URL.Path, "/referrers/") {
+						w.Header().Set("Content-Type", string(types.OCIImageIndex))
+						fmt.Fprint(w, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+						return
+					}
+					if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+						w.Header().Set("OCI-Subject", "sha256:whatever")
+					}
+				}
+				reg.ServeHTTP(w, r)
+			}))
+			defer s.Close()
+			u, err := url.Parse(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host)).Context()
+
+			img, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Write(repo.Tag("latest"), img); err != nil {
+				t.Fatal(err)
+			}
+			subject, err := Head(repo.Tag("latest"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := static.NewLayer([]byte("{}"), "application/vnd.example.signature.config+json")
+			if err := WriteLayer(repo, config); err != nil {
+				t.Fatal(err)
+			}
+			cd, err := config.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			push := func(note string) v1.Hash {
+				m := v1.Manifest{
+					SchemaVersion: 2,
+					MediaType:     types.OCIManifestSchema1,
+					Config: v1.Descriptor{
+						MediaType: "application/vnd.example.signature.config+json",
+						Size:      2,
+						Digest:    cd,
+					},
+					Layers:      []v1.Descriptor{},
+					Annotations: map[string]string{"note": note},
+					Subject:     subject,
+				}
+				b, err := json.Marshal(m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw := &rawManifest{raw: b, mediaType: types.OCIManifestSchema1}
+				_, desc, err := unpackTaggable(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := Put(repo.Digest(desc.Digest.String()), raw); err != nil {
+					t.Fatal(err)
+				}
+				return desc.Digest
+			}
+			first := push("first")
+			second := push("second")
+			// Pushing the same manifest again doesn't duplicate it.
+			push("second")
+
+			d, err := Get(repo.Tag(fallbackTag(subject.Digest)))
+			if withAPI {
+				if err == nil {
+					t.Errorf("fallback tag exists for a registry with the referrers API: %s", d.Manifest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx, err := d.ImageIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			im, err := idx.IndexManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(im.Manifests) != 2 {
+				t.Fatalf("fallback index has %d manifests, want 2: %s", len(im.Manifests), d.Manifest)
+			}
+			for i, want := range []v1.Hash{first, second} {
+				got := im.Manifests[i]
+				if got.Digest != want {
+					t.Errorf("manifests[%d].digest = %s, want %s", i, got.Digest, want)
+				}
+				if got.ArtifactType != "application/vnd.example.signature.config+json" {
+					t.Errorf("manifests[%d].artifactType = %q", i, got.ArtifactType)
+				}
+			}
+			if got := im.Manifests[1].Annotations["note"]; got != "second" {
+				t.Errorf("manifests[1] annotation note = %q, want second", got)
+			}
+		})
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	h := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	listed := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":1,"digest":"sha256:%s"}]}`, strings.Repeat("b", 64))
+	for _, withAPI := range []bool{false, true} {
+		t.Run(fmt.Sprintf("referrers API %t", withAPI), func(t *testing.T) {
+			reg := registry.New()
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if withAPI && strings.Contains(r.URL.Path, "/referrers/") {
+					w.Header().Set("Content-Type", string(types.OCIImageIndex))
+					fmt.Fprint(w, listed)
+					return
+				}
+				reg.ServeHTTP(w, r)
+			}))
+			defer s.Close()
+			u, err := url.Parse(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host)).Context()
+
+			im, err := Referrers(repo.Digest(h.String()))
+			if err != nil {
+				t.Fatalf("Referrers() = %v", err)
+			}
+			want := 0
+			if withAPI {
+				want = 1
+			}
+			if len(im.Manifests) != want {
+				t.Errorf("Referrers() has %d manifests, want %d", len(im.Manifests), want)
+			}
+		})
+	}
+}
+
+func TestWriteReferrerConflict(t *testing.T) {
+	reg := registry.New()
+	referrers := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/referrers/") {
+			referrers++
+		}
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/sha256:") {
+			// Another push of the same manifest wins, and the 409 we get
+			// doesn't carry OCI-Subject.
+			reg.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host)).Context()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(repo.Tag("latest"), img); err != nil {
+		t.Fatal(err)
+	}
+	subject, err := Head(repo.Tag("latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := static.NewLayer([]byte("{}"), types.OCIEmptyJSON)
+	if err := WriteLayer(repo, config); err != nil {
+		t.Fatal(err)
+	}
+	cd, err := config.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: types.OCIEmptyJSON,
+			Size:      2,
+			Digest:    cd,
+		},
+		Layers:  []v1.Descriptor{},
+		Subject: subject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := &rawManifest{raw: b, mediaType: types.OCIManifestSchema1}
+	_, desc, err := unpackTaggable(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Put(repo.Digest(desc.Digest.String()), raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if referrers != 0 {
+		t.Errorf("%d referrers requests after a resolved conflict, want 0", referrers)
+	}
+	if d, err := Get(repo.Tag(fallbackTag(subject.Digest))); err == nil {
+		t.Errorf("fallback tag written after a resolved conflict: %s", d.Manifest)
+	}
+}
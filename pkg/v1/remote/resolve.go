@@ -0,0 +1,82 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/logs"
+)
+
+// resolveTransport follows the pings (GET /v2/) that pass through it across
+// any redirects, and reports where each registry's API actually resolved to.
+// See WithResolvedRegistryObserver.
+type resolveTransport struct {
+	inner   http.RoundTripper
+	observe func(registry string, base url.URL)
+
+	mu sync.Mutex
+	// redirects maps the target of a redirected ping to the registry that
+	// was originally pinged.
+	redirects map[string]string
+}
+
+func newResolveTransport(inner http.RoundTripper, observe func(string, url.URL)) *resolveTransport {
+	return &resolveTransport{
+		inner:     inner,
+		observe:   observe,
+		redirects: map[string]string{},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *resolveTransport) RoundTrip(in *http.Request) (*http.Response, error) {
+	if in.Method != http.MethodGet || !strings.HasSuffix(in.URL.Path, "/v2/") {
+		return t.inner.RoundTrip(in)
+	}
+
+	registry := in.URL.Host
+	t.mu.Lock()
+	if orig, ok := t.redirects[in.URL.String()]; ok {
+		registry = orig
+		delete(t.redirects, in.URL.String())
+	}
+	t.mu.Unlock()
+
+	resp, err := t.inner.RoundTrip(in)
+	if err != nil {
+		return nil, err
+	}
+	if loc, err := resp.Location(); err == nil && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		t.mu.Lock()
+		t.redirects[loc.String()] = registry
+		t.mu.Unlock()
+		return resp, nil
+	}
+
+	base := url.URL{
+		Scheme: in.URL.Scheme,
+		Host:   in.URL.Host,
+		Path:   strings.TrimSuffix(in.URL.Path, "v2/"),
+	}
+	if base.Host != registry || base.Path != "/" {
+		logs.Debug.Printf("registry %s resolved to %s", registry, base.String())
+	}
+	t.observe(registry, base)
+	return resp, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestWithResolvedRegistryObserver(t *testing.T) {
+	// The backend serves the registry API under /mirror/.
+	reg := registry.New()
+	back := httptest.NewServer(http.StripPrefix("/mirror", reg))
+	defer back.Close()
+	// The frontend redirects everything to the backend.
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, back.URL+"/mirror"+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer front.Close()
+
+	backURL, err := url.Parse(back.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontURL, err := url.Parse(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Push directly to the registry, whose /v2/ isn't redirected.
+	var seen []string
+	observe := WithResolvedRegistryObserver(func(registry string, base url.URL) {
+		seen = append(seen, registry+" "+base.String())
+	})
+	direct := httptest.NewServer(reg)
+	defer direct.Close()
+	directURL, err := url.Parse(direct.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(mustNewTag(t, directURL.Host+"/repo:latest"), img, observe); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%s http://%s/", directURL.Host, directURL.Host); len(seen) == 0 || seen[0] != want {
+		t.Errorf("direct: observed %q, want %q", seen, want)
+	}
+
+	// Pull through the frontend.
+	seen = nil
+	if _, err := Image(mustNewTag(t, frontURL.Host+"/repo:latest"), observe); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%s http://%s/mirror/", frontURL.Host, backURL.Host)
+	if strings.Join(seen, ",") != want {
+		t.Errorf("redirected: observed %q, want %q", seen, want)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// LayerScanner inspects the contents of a layer as it's downloaded. See
+// WithLayerScanner.
+type LayerScanner func(digest v1.Hash, tr *tar.Reader) error
+
+// errScanAbandoned is seen by a LayerScanner when the layer it's scanning is
+// closed before it has been read completely.
+var errScanAbandoned = errors.New("layer was closed before it was read completely")
+
+// scanBuffer is how much of a layer can be downloaded ahead of its
+// LayerScanner.
+const scanBuffer = 32 << 10
+
+// scanLayer returns a ReadCloser that reads rc, the compressed contents of
+// the layer h, while scan reads their uncompressed tar stream. If scan fails,
+// reading fails with its error; otherwise, the final read waits for scan to
+// return before reporting io.EOF.
+func scanLayer(rc io.ReadCloser, h v1.Hash, scan LayerScanner) io.ReadCloser {
+	return newDecompressingReadCloser(rc, scanBuffer, func(r io.Reader) error {
+		return scan(h, tar.NewReader(r))
+	}, nil, errScanAbandoned)
+}
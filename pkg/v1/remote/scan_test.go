@@ -0,0 +1,147 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+func TestWithLayerScanner(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	scanned := map[v1.Hash]int{}
+	got, err := Image(ref, WithLayerScanner(func(h v1.Hash, tr *tar.Reader) error {
+		files := 0
+		for {
+			if _, err := tr.Next(); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return err
+			}
+			files++
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		scanned[h] += files
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Fatalf("validate.Image() = %v", err)
+	}
+	ls, err := got.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != len(ls) {
+		t.Errorf("scanned %d blobs, want the %d layers", len(scanned), len(ls))
+	}
+	for _, l := range ls {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanned[h] == 0 {
+			t.Errorf("layer %s wasn't scanned", h)
+		}
+	}
+
+	// A failing scanner fails the read, without hanging.
+	errBad := errors.New("malware")
+	h, err := ls[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = Image(ref, WithLayerScanner(func(v1.Hash, *tar.Reader) error {
+		return errBad
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := got.LayerByDigest(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, rc); !errors.Is(err, errBad) {
+		t.Errorf("reading scanned layer = %v, want %v", err, errBad)
+	}
+	rc.Close()
+
+	// Closing a layer early doesn't hang, whatever the scanner does.
+	rc, err = l.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+
+	// Layers fetched with Layer are scanned too.
+	var layerScanned bool
+	rl, err := Layer(ref.Context().Digest(h.String()), WithLayerScanner(func(got v1.Hash, tr *tar.Reader) error {
+		layerScanned = got == h
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err = rl.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if !layerScanned {
+		t.Error("Layer() wasn't scanned")
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/legacy"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// schema1FSLayer is an entry in the fsLayers of a schema 1 manifest.
+type schema1FSLayer struct {
+	BlobSum v1.Hash `json:"blobSum"`
+}
+
+// schema1History is an entry in the history of a schema 1 manifest.
+type schema1History struct {
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+// schema1Manifest is a Docker image manifest, version 2, schema 1:
+// https://github.com/distribution/distribution/blob/main/docs/spec/manifest-v2-1.md
+type schema1Manifest struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	Name          string           `json:"name"`
+	Tag           string           `json:"tag"`
+	Architecture  string           `json:"architecture"`
+	FSLayers      []schema1FSLayer `json:"fsLayers"`
+	History       []schema1History `json:"history"`
+}
+
+// isSchema2Rejection returns whether err looks like a registry refusing a
+// schema 2 manifest because it only understands schema 1.
+func isSchema2Rejection(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	switch terr.StatusCode {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType:
+		return true
+	}
+	return false
+}
+
+// toSchema1 converts img into a signed schema 1 manifest for ref, using the
+// same v1 layer IDs that pkg/legacy/tarball does.
+func toSchema1(ref name.Reference, img v1.Image) ([]byte, error) {
+	tag, ok := ref.(name.Tag)
+	if !ok {
+		return nil, fmt.Errorf("schema 1 manifests can only be pushed by tag, got %s", ref)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	rawCfg, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	history := []v1.History{}
+	for _, h := range cfg.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+	if len(history) == 0 {
+		history = make([]v1.History, len(ls))
+	} else if len(history) != len(ls) {
+		return nil, fmt.Errorf("image has %d layers but %d non-empty history entries", len(ls), len(history))
+	}
+
+	m := schema1Manifest{
+		SchemaVersion: 1,
+		Name:          tag.RepositoryStr(),
+		Tag:           tag.TagStr(),
+		Architecture:  cfg.Architecture,
+	}
+	parent := ""
+	for i, l := range ls {
+		d, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		lc := legacy.LayerConfigFile{
+			ConfigFile: v1.ConfigFile{
+				Created: history[i].Created,
+				Author:  history[i].Author,
+			},
+			ContainerConfig: v1.Config{
+				Cmd: []string{history[i].CreatedBy},
+			},
+			Parent:  parent,
+			Comment: history[i].Comment,
+		}
+
+		idInput := fmt.Sprintf("%s %s", d.Hex, parent)
+		if i == len(ls)-1 {
+			// The top layer carries the image's configuration.
+			idInput = fmt.Sprintf("%s %s", idInput, rawCfg)
+			lc.Architecture = cfg.Architecture
+			lc.Container = cfg.Container
+			lc.DockerVersion = cfg.DockerVersion
+			lc.OS = cfg.OS
+			lc.Config = cfg.Config
+			lc.Created = cfg.Created
+		}
+		id := sha256.Sum256([]byte(idInput))
+		lc.ID = hex.EncodeToString(id[:])
+		parent = lc.ID
+
+		b, err := json.Marshal(lc)
+		if err != nil {
+			return nil, err
+		}
+		// Schema 1 lists layers from the top down.
+		m.FSLayers = append([]schema1FSLayer{{BlobSum: d}}, m.FSLayers...)
+		m.History = append([]schema1History{{V1Compatibility: string(b)}}, m.History...)
+	}
+
+	payload, err := json.MarshalIndent(m, "", "   ")
+	if err != nil {
+		return nil, err
+	}
+	return signSchema1(payload)
+}
+
+// jsonWebKey is the public half of the key used to sign a schema 1 manifest.
+type jsonWebKey struct {
+	Crv string `json:"crv"`
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwsHeader struct {
+	JWK jsonWebKey `json:"jwk"`
+	Alg string     `json:"alg"`
+}
+
+type jwsSignature struct {
+	Header    jwsHeader `json:"header"`
+	Signature string    `json:"signature"`
+	Protected string    `json:"protected"`
+}
+
+type jwsProtected struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+	Time         string `json:"time"`
+}
+
+// signSchema1 signs payload with an ephemeral ECDSA key, producing the
+// "pretty" JWS format (with an embedded "signatures" field) that registries
+// expect for types.DockerManifestSchema1Signed.
+func signSchema1(payload []byte) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := keyID(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signed payload is the manifest up to (but excluding) its closing
+	// brace, so that the signatures can be spliced in before it.
+	closing := bytes.LastIndexByte(payload, '}')
+	if closing < 0 {
+		return nil, errors.New("manifest is not a JSON object")
+	}
+	formatLength := bytes.LastIndexFunc(payload[:closing], func(r rune) bool {
+		return !strings.ContainsRune(" \t\r\n", r)
+	}) + 1
+	tail := payload[formatLength:]
+
+	protected, err := json.Marshal(jwsProtected{
+		FormatLength: formatLength,
+		FormatTail:   b64(tail),
+		Time:         time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	signingInput := b64(protected) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	sigs, err := json.MarshalIndent([]jwsSignature{{
+		Header: jwsHeader{
+			JWK: jsonWebKey{
+				Crv: "P-256",
+				Kid: kid,
+				Kty: "EC",
+				X:   b64(key.PublicKey.X.FillBytes(make([]byte, 32))),
+				Y:   b64(key.PublicKey.Y.FillBytes(make([]byte, 32))),
+			},
+			Alg: "ES256",
+		},
+		Signature: b64(sig),
+		Protected: b64(protected),
+	}}, "   ", "   ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(payload[:formatLength])
+	buf.WriteString(",\n   \"signatures\": ")
+	buf.Write(sigs)
+	buf.Write(tail)
+	return buf.Bytes(), nil
+}
+
+// keyID computes a libtrust-style key ID: the first 240 bits of the SHA256 of
+// the DER-encoded public key, base32 encoded in colon-separated groups of 4.
+func keyID(pub *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	s := strings.TrimRight(base32.StdEncoding.EncodeToString(sum[:30]), "=")
+	groups := []string{}
+	for i := 0; i < len(s); i += 4 {
+		groups = append(groups, s[i:i+4])
+	}
+	return strings.Join(groups, ":"), nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// commitSchema1 converts img to a signed schema 1 manifest and PUTs it.
+func (w *writer) commitSchema1(ctx context.Context, ref name.Reference, img v1.Image) error {
+	raw, err := toSchema1(ref, img)
+	if err != nil {
+		return fmt.Errorf("converting to schema 1: %w", err)
+	}
+	return w.commitManifest(ctx, &rawManifest{raw: raw, mediaType: types.DockerManifestSchema1Signed}, ref)
+}
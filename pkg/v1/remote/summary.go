@@ -0,0 +1,146 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"sort"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+)
+
+// WriteSummary describes how the blobs of a write were transferred to the
+// registry, and whether it changed any tags. See WithWriteSummary.
+type WriteSummary struct {
+	// BytesUploaded is the number of blob bytes sent to the registry.
+	BytesUploaded int64
+	// BytesMounted is the size of blobs that were mounted from another
+	// repository, which required no upload.
+	BytesMounted int64
+	// BytesExisting is the size of blobs that were already present in the
+	// target repository, which required no upload.
+	BytesExisting int64
+
+	BlobsUploaded int
+	BlobsMounted  int
+	BlobsExisting int
+
+	// TagsUpdated is the number of tags that were created or moved to a new
+	// manifest.
+	TagsUpdated int
+	// TagsUnchanged is the number of tags that already pointed at the
+	// manifest that was written, e.g. because the image was pushed before.
+	// A Write to a tag is a no-op if TagsUnchanged is 1.
+	TagsUnchanged int
+
+	// Blobs describes every blob (config or layer) that the write uploaded,
+	// mounted or found existing, sorted by digest, so everything the written
+	// manifests reference is known without pulling them again. Their media
+	// types, digests and sizes are those of the blobs as written, e.g. after
+	// WithLayerTransform.
+	Blobs []v1.Descriptor
+}
+
+// summary accumulates a WriteSummary from concurrent uploads.
+type summary struct {
+	sync.Mutex
+	WriteSummary
+}
+
+func (s *summary) uploaded(l v1.Layer) error {
+	if s == nil {
+		return nil
+	}
+	return s.add(l, &s.BytesUploaded, &s.BlobsUploaded)
+}
+
+func (s *summary) mounted(l v1.Layer) error {
+	if s == nil {
+		return nil
+	}
+	return s.add(l, &s.BytesMounted, &s.BlobsMounted)
+}
+
+func (s *summary) existing(l v1.Layer) error {
+	if s == nil {
+		return nil
+	}
+	return s.add(l, &s.BytesExisting, &s.BlobsExisting)
+}
+
+// add records the blob l, adding it to the given counters.
+func (s *summary) add(l v1.Layer, bytes *int64, blobs *int) error {
+	d, err := partial.Descriptor(l)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	*bytes += d.Size
+	*blobs++
+	s.Blobs = append(s.Blobs, *d)
+	return nil
+}
+
+// configWritten corrects the media type recorded for img's config blob,
+// which partial.ConfigLayer always reports as types.OCIConfigJSON, to the one
+// in img's manifest.
+func (s *summary) configWritten(img v1.Image) {
+	if s == nil {
+		return
+	}
+	m, err := img.Manifest()
+	if err != nil || m.Config.MediaType == "" {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.Blobs {
+		if s.Blobs[i].Digest == m.Config.Digest {
+			s.Blobs[i].MediaType = m.Config.MediaType
+		}
+	}
+}
+
+func (s *summary) tagged(unchanged bool) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if unchanged {
+		s.TagsUnchanged++
+	} else {
+		s.TagsUpdated++
+	}
+}
+
+// makeSummary returns a summary to record transfers in, if WithWriteSummary
+// was used, and a func that reports it to the callback.
+func makeSummary(o *options) (*summary, func()) {
+	if o.writeSummary == nil {
+		return nil, func() {}
+	}
+	s := &summary{}
+	return s, func() {
+		s.Lock()
+		defer s.Unlock()
+		sort.Slice(s.Blobs, func(i, j int) bool {
+			return s.Blobs[i].Digest.String() < s.Blobs[j].Digest.String()
+		})
+		o.writeSummary(s.WriteSummary)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+)
+
+// configureTLS applies any options that adjust the TLS configuration to a
+// copy of o.transport, which must be an *http.Transport for them to apply.
+func configureTLS(o *options) error {
+	if o.caCerts == nil && len(o.clientCerts) == 0 && !o.insecureSkipVerify {
+		return nil
+	}
+	t, ok := o.transport.(*http.Transport)
+	if !ok {
+		return errors.New("WithCACerts, WithClientCert and WithInsecureSkipTLSVerify require WithTransport to be given an *http.Transport")
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	cfg := t.TLSClientConfig
+
+	if o.caCerts != nil {
+		if cfg.RootCAs != nil {
+			return errors.New("WithCACerts conflicts with the RootCAs of the transport passed to WithTransport")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(o.caCerts) {
+			return errors.New("WithCACerts: no PEM certificates found")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(o.clientCerts) != 0 {
+		if len(cfg.Certificates) != 0 || cfg.GetClientCertificate != nil {
+			return errors.New("WithClientCert conflicts with the client certificates of the transport passed to WithTransport")
+		}
+		cfg.Certificates = o.clientCerts
+	}
+
+	if o.insecureSkipVerify {
+		cfg.InsecureSkipVerify = true
+	}
+
+	o.transport = t
+	return nil
+}
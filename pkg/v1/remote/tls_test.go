@@ -0,0 +1,165 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func mustClientCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestMutualTLS(t *testing.T) {
+	clientCert, clientX509 := mustClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+
+	s := httptest.NewUnstartedServer(registry.New())
+	s.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	s.StartTLS()
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Write(dst, img, WithCACerts(ca)); err == nil {
+		t.Error("Write() without client cert = nil, expected error")
+	}
+	if err := Write(dst, img, WithClientCert(clientCert)); err == nil {
+		t.Error("Write() without CA cert = nil, expected error")
+	}
+	if err := Write(dst, img, WithCACerts(ca), WithClientCert(clientCert)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if _, err := Image(dst, WithCACerts(ca), WithClientCert(clientCert)); err != nil {
+		t.Errorf("Image() = %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		opts []Option
+	}{{
+		desc: "bad pem",
+		opts: []Option{WithCACerts([]byte("not a certificate"))},
+	}, {
+		desc: "not an http.Transport",
+		opts: []Option{WithTransport(http.NewFileTransport(http.Dir("."))), WithCACerts(ca)},
+	}, {
+		desc: "conflicting RootCAs",
+		opts: []Option{WithTransport(&http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}}), WithCACerts(ca)},
+	}, {
+		desc: "conflicting client certs",
+		opts: []Option{WithTransport(&http.Transport{TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{clientCert}}}), WithClientCert(clientCert)},
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := Image(dst, tc.opts...); err == nil {
+				t.Error("Image() = nil, expected error")
+			}
+		})
+	}
+}
+
+func TestInsecureSkipTLSVerify(t *testing.T) {
+	s := httptest.NewTLSServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Write(dst, img); err == nil {
+		t.Error("Write() with a self-signed cert = nil, expected error")
+	}
+	if err := Write(dst, img, WithInsecureSkipTLSVerify()); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	// It only applies to the operation it's passed to.
+	if _, err := Image(dst); err == nil {
+		t.Error("Image() without WithInsecureSkipTLSVerify = nil, expected error")
+	}
+
+	// It composes with a transport and the other TLS options, without
+	// modifying the transport.
+	tr := &http.Transport{}
+	clientCert, _ := mustClientCert(t)
+	if _, err := Image(dst, WithTransport(tr), WithClientCert(clientCert), WithInsecureSkipTLSVerify()); err != nil {
+		t.Errorf("Image() = %v", err)
+	}
+	if tr.TLSClientConfig != nil && tr.TLSClientConfig.InsecureSkipVerify {
+		t.Error("WithInsecureSkipTLSVerify modified the transport")
+	}
+
+	if _, err := Image(dst, WithTransport(http.NewFileTransport(http.Dir("."))), WithInsecureSkipTLSVerify()); err == nil {
+		t.Error("Image() with a non-http.Transport = nil, expected error")
+	}
+}
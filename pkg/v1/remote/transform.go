@@ -0,0 +1,282 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// transformedImage is a v1.Image whose layers have been replaced by the
+// result of WithLayerTransform, with its manifest and config updated to match.
+type transformedImage struct {
+	v1.Image
+
+	layers    []v1.Layer
+	manifest  *v1.Manifest
+	rawConfig []byte
+}
+
+var _ v1.Image = (*transformedImage)(nil)
+
+// transformImage applies f to every layer of img.
+//
+// The manifest's layer descriptors are replaced with those of the transformed
+// layers. If a transform also changes a layer's uncompressed contents, the
+// config's rootfs.diff_ids are updated accordingly.
+func transformImage(img v1.Image, f func(v1.Layer) (v1.Layer, error)) (v1.Image, error) {
+	ls, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+
+	if len(ls) != len(m.Layers) || len(ls) != len(cf.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("image has %d layers, %d manifest layers and %d diff ids", len(ls), len(m.Layers), len(cf.RootFS.DiffIDs))
+	}
+
+	configChanged := false
+	transformed := make([]v1.Layer, 0, len(ls))
+	for i, l := range ls {
+		nl, err := f(l)
+		if err != nil {
+			return nil, fmt.Errorf("transforming layer %d: %w", i, err)
+		}
+		transformed = append(transformed, nl)
+		if nl == l {
+			continue
+		}
+
+		desc, err := partial.Descriptor(nl)
+		if err != nil {
+			return nil, err
+		}
+		// The transformed layer is different content, so anything pointing
+		// at the original blob no longer applies.
+		desc.URLs = nil
+		desc.Annotations = m.Layers[i].Annotations
+		m.Layers[i] = *desc
+
+		diffID, err := nl.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		if diffID != cf.RootFS.DiffIDs[i] {
+			cf.RootFS.DiffIDs[i] = diffID
+			configChanged = true
+		}
+	}
+
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if configChanged {
+		rawConfig, err = json.Marshal(cf)
+		if err != nil {
+			return nil, err
+		}
+		m.Config.Digest, m.Config.Size, err = v1.SHA256(bytes.NewReader(rawConfig))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &transformedImage{
+		Image:     img,
+		layers:    transformed,
+		manifest:  m,
+		rawConfig: rawConfig,
+	}, nil
+}
+
+// Layers implements v1.Image.
+func (i *transformedImage) Layers() ([]v1.Layer, error) {
+	return i.layers, nil
+}
+
+// Manifest implements v1.Image.
+func (i *transformedImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.Image.
+func (i *transformedImage) RawManifest() ([]byte, error) {
+	return json.Marshal(i.manifest)
+}
+
+// Digest implements v1.Image.
+func (i *transformedImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+// Size implements v1.Image.
+func (i *transformedImage) Size() (int64, error) {
+	return partial.Size(i)
+}
+
+// RawConfigFile implements v1.Image.
+func (i *transformedImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+// ConfigFile implements v1.Image.
+func (i *transformedImage) ConfigFile() (*v1.ConfigFile, error) {
+	return partial.ConfigFile(i)
+}
+
+// ConfigName implements v1.Image.
+func (i *transformedImage) ConfigName() (v1.Hash, error) {
+	return i.manifest.Config.Digest, nil
+}
+
+// LayerByDigest implements v1.Image.
+func (i *transformedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	if h == i.manifest.Config.Digest {
+		return partial.ConfigLayer(i)
+	}
+	for _, l := range i.layers {
+		d, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if d == h {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("layer not found: %s", h)
+}
+
+// LayerByDiffID implements v1.Image.
+func (i *transformedImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		d, err := l.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		if d == h {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("layer not found: %s", h)
+}
+
+// describedImage is a v1.Image whose layers' descriptors in the manifest have
+// been rewritten, without changing the layers' contents.
+type describedImage struct {
+	v1.Image
+
+	layers   []v1.Layer
+	manifest *v1.Manifest
+}
+
+var _ v1.Image = (*describedImage)(nil)
+
+// redescribeLayers calls f with each layer of img and a copy of its manifest
+// descriptor, which f may modify. f returns the layer to use in its place,
+// which should describe itself with the modified descriptor.
+func redescribeLayers(img v1.Image, f func(v1.Layer, *v1.Descriptor) (v1.Layer, error)) (v1.Image, error) {
+	ls, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	if len(ls) != len(m.Layers) {
+		return nil, fmt.Errorf("image has %d layers but %d manifest layers", len(ls), len(m.Layers))
+	}
+
+	layers := make([]v1.Layer, 0, len(ls))
+	for i, l := range ls {
+		nl, err := f(l, &m.Layers[i])
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, nl)
+	}
+	return &describedImage{
+		Image:    img,
+		layers:   layers,
+		manifest: m,
+	}, nil
+}
+
+// Layers implements v1.Image.
+func (i *describedImage) Layers() ([]v1.Layer, error) {
+	return i.layers, nil
+}
+
+// Manifest implements v1.Image.
+func (i *describedImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.Image.
+func (i *describedImage) RawManifest() ([]byte, error) {
+	return json.Marshal(i.manifest)
+}
+
+// Digest implements v1.Image.
+func (i *describedImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+// Size implements v1.Image.
+func (i *describedImage) Size() (int64, error) {
+	return partial.Size(i)
+}
+
+// LayerByDigest implements v1.Image.
+func (i *describedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	for j, l := range i.layers {
+		if i.manifest.Layers[j].Digest == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDigest(h)
+}
+
+// describedLayer is a layer with a rewritten descriptor.
+type describedLayer struct {
+	v1.Layer
+	desc v1.Descriptor
+}
+
+// MediaType implements v1.Layer.
+func (l *describedLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// Descriptor implements partial.Describable.
+func (l *describedLayer) Descriptor() (*v1.Descriptor, error) {
+	return l.desc.DeepCopy(), nil
+}
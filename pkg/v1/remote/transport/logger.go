@@ -25,13 +25,32 @@ import (
 )
 
 type logTransport struct {
-	inner http.RoundTripper
+	inner    http.RoundTripper
+	redacted []string
 }
 
 // NewLogger returns a transport that logs requests and responses to
 // github.com/google/go-containerregistry/pkg/logs.Debug.
-func NewLogger(inner http.RoundTripper) http.RoundTripper {
-	return &logTransport{inner}
+//
+// The values of the Authorization header, and of any redactedHeaders, are
+// replaced with "<redacted>" in both requests and responses.
+func NewLogger(inner http.RoundTripper, redactedHeaders ...string) http.RoundTripper {
+	return &logTransport{
+		inner:    inner,
+		redacted: append([]string{"Authorization"}, redactedHeaders...),
+	}
+}
+
+// redactHeaders replaces the values of sensitive headers in h, returning the
+// original headers so that they can be restored after logging.
+func (t *logTransport) redactHeaders(h http.Header) http.Header {
+	saved := h.Clone()
+	for _, k := range t.redacted {
+		if h.Get(k) != "" {
+			h.Set(k, "<redacted>")
+		}
+	}
+	return saved
 }
 
 func (t *logTransport) RoundTrip(in *http.Request) (out *http.Response, err error) {
@@ -45,10 +64,10 @@ func (t *logTransport) RoundTrip(in *http.Request) (out *http.Response, err erro
 		logs.Debug.Printf("--> %s %s", in.Method, in.URL)
 	}
 
-	// Save these headers so we can redact Authorization.
-	savedHeaders := in.Header.Clone()
-	if in.Header != nil && in.Header.Get("authorization") != "" {
-		in.Header.Set("authorization", "<redacted>")
+	// Save these headers so we can redact Authorization and friends.
+	var savedHeaders http.Header
+	if in.Header != nil {
+		savedHeaders = t.redactHeaders(in.Header)
 	}
 
 	b, err := httputil.DumpRequestOut(in, !omitBody)
@@ -80,12 +99,17 @@ func (t *logTransport) RoundTrip(in *http.Request) (out *http.Response, err erro
 
 		logs.Debug.Print(msg)
 
+		var savedHeaders http.Header
+		if out.Header != nil {
+			savedHeaders = t.redactHeaders(out.Header)
+		}
 		b, err := httputil.DumpResponse(out, !omitBody)
 		if err == nil {
 			logs.Debug.Println(string(b))
 		} else {
 			logs.Debug.Printf("Failed to dump response %s %s: %v", in.Method, in.URL, err)
 		}
+		out.Header = savedHeaders
 	}
 	return
 }
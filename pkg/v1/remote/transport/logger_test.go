@@ -91,3 +91,53 @@ func TestLoggerError(t *testing.T) {
 		t.Errorf("Expected logs to contain %s, got %s", canary, logged)
 	}
 }
+
+func TestLoggerRedactedHeaders(t *testing.T) {
+	canary := "logs.Debug canary"
+	reqSecret := "request secret do not log"
+	respSecret := "response secret do not log"
+	auth := "my token pls do not log"
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error during NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("X-Registry-Key", reqSecret)
+
+	var b bytes.Buffer
+	logs.Debug.SetOutput(&b)
+	cannedResponse := http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Foo":           []string{canary},
+			"X-Session-Key": []string{respSecret},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader("")),
+		Request: req,
+	}
+	tr := NewLogger(newRecorder(&cannedResponse, nil), "x-registry-key", "X-Session-Key")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unexpected error during RoundTrip: %v", err)
+	}
+
+	logged := b.String()
+	if !strings.Contains(logged, canary) {
+		t.Errorf("Expected logs to contain %s, got %s", canary, logged)
+	}
+	for _, secret := range []string{reqSecret, respSecret, auth} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("Expected logs NOT to contain %s, got %s", secret, logged)
+		}
+	}
+
+	// Redaction only applies to the logs.
+	if got := req.Header.Get("X-Registry-Key"); got != reqSecret {
+		t.Errorf("request header = %q, want %q", got, reqSecret)
+	}
+	if got := resp.Header.Get("X-Session-Key"); got != respSecret {
+		t.Errorf("response header = %q, want %q", got, respSecret)
+	}
+}
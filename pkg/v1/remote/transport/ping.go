@@ -44,6 +44,43 @@ type pingResp struct {
 
 	// The registry's scheme to use. Communicates whether we fell back to http.
 	scheme string
+
+	// The Docker-Distribution-API-Version header, if any.
+	apiVersion string
+}
+
+// PingResult describes how a registry responded to GET /v2/.
+type PingResult struct {
+	// APIVersion is the Docker-Distribution-API-Version header the registry
+	// sent, e.g. "registry/2.0", or empty if it didn't send one.
+	APIVersion string
+
+	// Scheme is "https", or "http" if the registry is insecure and https
+	// failed.
+	Scheme string
+
+	// Challenge is the lowercase auth scheme the registry asked for, e.g.
+	// "bearer" or "basic", or "anonymous" if it didn't ask for any.
+	Challenge string
+
+	// Parameters are the challenge's parameters, e.g. the realm and service
+	// of a bearer challenge.
+	Parameters map[string]string
+}
+
+// Ping sends GET /v2/ to reg using t, the way New does to find out how to
+// authenticate, and reports how the registry responded.
+func Ping(ctx context.Context, reg name.Registry, t http.RoundTripper) (*PingResult, error) {
+	pr, err := ping(ctx, reg, t)
+	if err != nil {
+		return nil, err
+	}
+	return &PingResult{
+		APIVersion: pr.apiVersion,
+		Scheme:     pr.scheme,
+		Challenge:  string(pr.challenge),
+		Parameters: pr.parameters,
+	}, nil
 }
 
 func (c challenge) Canonical() challenge {
@@ -99,12 +136,14 @@ func ping(ctx context.Context, reg name.Registry, t http.RoundTripper) (*pingRes
 			resp.Body.Close()
 		}()
 
+		apiVersion := resp.Header.Get("Docker-Distribution-API-Version")
 		switch resp.StatusCode {
 		case http.StatusOK:
 			// If we get a 200, then no authentication is needed.
 			return &pingResp{
-				challenge: anonymous,
-				scheme:    scheme,
+				challenge:  anonymous,
+				scheme:     scheme,
+				apiVersion: apiVersion,
 			}, nil
 		case http.StatusUnauthorized:
 			if challenges := authchallenge.ResponseChallenges(resp); len(challenges) != 0 {
@@ -114,12 +153,14 @@ func ping(ctx context.Context, reg name.Registry, t http.RoundTripper) (*pingRes
 					challenge:  challenge(wac.Scheme).Canonical(),
 					parameters: wac.Parameters,
 					scheme:     scheme,
+					apiVersion: apiVersion,
 				}, nil
 			}
 			// Otherwise, just return the challenge without parameters.
 			return &pingResp{
-				challenge: challenge(resp.Header.Get("WWW-Authenticate")).Canonical(),
-				scheme:    scheme,
+				challenge:  challenge(resp.Header.Get("WWW-Authenticate")).Canonical(),
+				scheme:     scheme,
+				apiVersion: apiVersion,
 			}, nil
 		default:
 			return nil, CheckError(resp, http.StatusOK, http.StatusUnauthorized)
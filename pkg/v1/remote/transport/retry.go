@@ -15,6 +15,7 @@
 package transport
 
 import (
+	"io"
 	"net/http"
 	"time"
 
@@ -31,19 +32,31 @@ var defaultBackoff = retry.Backoff{
 
 var _ http.RoundTripper = (*retryTransport)(nil)
 
+// idempotentMethods are retried with the transport's backoff by default.
+// Requests with other methods (e.g. a PUT that may have partially succeeded)
+// aren't retried unless WithMethodRetryBackoff opts them in.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
 // retryTransport wraps a RoundTripper and retries temporary network errors.
 type retryTransport struct {
-	inner     http.RoundTripper
-	backoff   retry.Backoff
-	predicate retry.Predicate
+	inner         http.RoundTripper
+	backoff       retry.Backoff
+	predicate     retry.Predicate
+	methodBackoff map[string]retry.Backoff
 }
 
 // Option is a functional option for retryTransport.
 type Option func(*options)
 
 type options struct {
-	backoff   retry.Backoff
-	predicate retry.Predicate
+	backoff       retry.Backoff
+	predicate     retry.Predicate
+	methodBackoff map[string]retry.Backoff
 }
 
 // Backoff is an alias of retry.Backoff to expose this configuration option to consumers of this lib
@@ -63,6 +76,21 @@ func WithRetryPredicate(predicate func(error) bool) Option {
 	}
 }
 
+// WithMethodRetryBackoff sets the backoff for retrying requests with the
+// given method, overriding WithRetryBackoff for them.
+//
+// By default, only idempotent requests (GET, HEAD, OPTIONS and TRACE) are
+// retried. Even with a backoff set here, requests with a body are only
+// retried if their body can be replayed via http.Request.GetBody.
+func WithMethodRetryBackoff(method string, backoff Backoff) Option {
+	return func(o *options) {
+		if o.methodBackoff == nil {
+			o.methodBackoff = map[string]retry.Backoff{}
+		}
+		o.methodBackoff[method] = backoff
+	}
+}
+
 // NewRetry returns a transport that retries errors.
 func NewRetry(inner http.RoundTripper, opts ...Option) http.RoundTripper {
 	o := &options{
@@ -75,17 +103,51 @@ func NewRetry(inner http.RoundTripper, opts ...Option) http.RoundTripper {
 	}
 
 	return &retryTransport{
-		inner:     inner,
-		backoff:   o.backoff,
-		predicate: o.predicate,
+		inner:         inner,
+		backoff:       o.backoff,
+		predicate:     o.predicate,
+		methodBackoff: o.methodBackoff,
+	}
+}
+
+// backoffFor returns the backoff to use for in. A backoff of a single step
+// means in isn't retried.
+func (t *retryTransport) backoffFor(in *http.Request) retry.Backoff {
+	if in == nil {
+		return t.backoff
+	}
+	backoff, ok := t.methodBackoff[in.Method]
+	if !ok {
+		backoff = t.backoff
+		if !idempotentMethods[in.Method] {
+			backoff.Steps = 1
+		}
+	}
+	if in.Body != nil && in.Body != http.NoBody && in.GetBody == nil {
+		// The body may have been (partially) consumed by the first attempt.
+		backoff.Steps = 1
 	}
+	return backoff
 }
 
 func (t *retryTransport) RoundTrip(in *http.Request) (out *http.Response, err error) {
+	backoff := t.backoffFor(in)
+	attempts := 0
 	roundtrip := func() error {
-		out, err = t.inner.RoundTrip(in)
+		req := in
+		if attempts > 0 && in != nil && in.GetBody != nil {
+			var body io.ReadCloser
+			if body, err = in.GetBody(); err != nil {
+				out = nil
+				return err
+			}
+			req = in.Clone(in.Context())
+			req.Body = body
+		}
+		attempts++
+		out, err = t.inner.RoundTrip(req)
 		return err
 	}
-	retry.Retry(roundtrip, t.predicate, t.backoff)
+	retry.Retry(roundtrip, t.predicate, backoff)
 	return
 }
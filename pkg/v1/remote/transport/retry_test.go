@@ -17,8 +17,11 @@ package transport
 import (
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -130,3 +133,102 @@ func TestTimeoutContext(t *testing.T) {
 		t.Fatalf("deadline was not recognized by transport")
 	}
 }
+
+// bodyTransport records the body of each request it receives, failing all
+// but the last with a temporary error.
+type bodyTransport struct {
+	fail   int
+	bodies []string
+}
+
+func (t *bodyTransport) RoundTrip(in *http.Request) (*http.Response, error) {
+	b := []byte{}
+	if in.Body != nil {
+		var err error
+		if b, err = ioutil.ReadAll(in.Body); err != nil {
+			return nil, err
+		}
+	}
+	t.bodies = append(t.bodies, string(b))
+	if len(t.bodies) <= t.fail {
+		return nil, temp{}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestRetryMethods(t *testing.T) {
+	backoff := retry.Backoff{Steps: 3}
+	for _, test := range []struct {
+		desc    string
+		method  string
+		getBody bool
+		opts    []Option
+		want    int
+	}{{
+		desc:    "GET is retried",
+		method:  http.MethodGet,
+		getBody: true,
+		want:    3,
+	}, {
+		desc:    "HEAD is retried",
+		method:  http.MethodHead,
+		getBody: true,
+		want:    3,
+	}, {
+		desc:    "PUT is not retried",
+		method:  http.MethodPut,
+		getBody: true,
+		want:    1,
+	}, {
+		desc:    "POST is not retried",
+		method:  http.MethodPost,
+		getBody: true,
+		want:    1,
+	}, {
+		desc:    "PUT is retried when opted in",
+		method:  http.MethodPut,
+		getBody: true,
+		opts:    []Option{WithMethodRetryBackoff(http.MethodPut, backoff)},
+		want:    3,
+	}, {
+		desc:   "PUT with a body that can't be replayed is never retried",
+		method: http.MethodPut,
+		opts:   []Option{WithMethodRetryBackoff(http.MethodPut, backoff)},
+		want:   1,
+	}, {
+		desc:    "GET can be opted out",
+		method:  http.MethodGet,
+		getBody: true,
+		opts:    []Option{WithMethodRetryBackoff(http.MethodGet, retry.Backoff{Steps: 1})},
+		want:    1,
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			bt := &bodyTransport{fail: 5}
+			opts := append([]Option{WithRetryBackoff(backoff)}, test.opts...)
+			tr := NewRetry(bt, opts...)
+
+			body := "hello"
+			req, err := http.NewRequest(test.method, "https://example.com", ioutil.NopCloser(strings.NewReader(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.getBody {
+				req.GetBody = func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader(body)), nil
+				}
+			}
+			if _, err := tr.RoundTrip(req); err == nil {
+				t.Fatal("RoundTrip() = nil, expected error")
+			}
+			if len(bt.bodies) != test.want {
+				t.Errorf("got %d attempts, want %d", len(bt.bodies), test.want)
+			}
+			// Every attempt sends the whole body.
+			for i, b := range bt.bodies {
+				if b != body {
+					t.Errorf("attempt %d sent body %q, want %q", i, b, body)
+				}
+			}
+		})
+	}
+}
@@ -39,6 +39,21 @@ func New(reg name.Registry, auth authn.Authenticator, t http.RoundTripper, scope
 // authentication was already done prior to this call, so it just returns
 // the provided RoundTripper without further action
 func NewWithContext(ctx context.Context, reg name.Registry, auth authn.Authenticator, t http.RoundTripper, scopes []string) (http.RoundTripper, error) {
+	return newTransport(ctx, reg, auth, t, scopes, false)
+}
+
+// NewLazyWithContext is like NewWithContext, but defers the bearer token
+// exchange until a request is actually challenged by the registry. Some
+// registries challenge the initial ping but allow anonymous access to
+// individual resources, so this can save a round trip to the token service.
+//
+// Requests are sent without a bearer token until the first challenge, so this
+// is only appropriate for requests that can be safely re-sent, e.g. HEADs.
+func NewLazyWithContext(ctx context.Context, reg name.Registry, auth authn.Authenticator, t http.RoundTripper, scopes []string) (http.RoundTripper, error) {
+	return newTransport(ctx, reg, auth, t, scopes, true)
+}
+
+func newTransport(ctx context.Context, reg name.Registry, auth authn.Authenticator, t http.RoundTripper, scopes []string, lazy bool) (http.RoundTripper, error) {
 	// When the transport provided is of the type Wrapper this function assumes that the caller already
 	// executed the necessary login and check.
 	switch t.(type) {
@@ -95,8 +110,10 @@ func NewWithContext(ctx context.Context, reg name.Registry, auth authn.Authentic
 			scopes:   scopes,
 			scheme:   pr.scheme,
 		}
-		if err := bt.refresh(ctx); err != nil {
-			return nil, err
+		if !lazy {
+			if err := bt.refresh(ctx); err != nil {
+				return nil, err
+			}
 		}
 		return &Wrapper{bt}, nil
 	default:
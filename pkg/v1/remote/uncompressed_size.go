@@ -0,0 +1,100 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	"golang.org/x/sync/errgroup"
+)
+
+// UncompressedSizeAnnotation is the layer descriptor annotation that
+// WithUncompressedSizeAnnotation sets to the layer's uncompressed size in
+// bytes, in decimal.
+const UncompressedSizeAnnotation = "dev.ggcr.layer.uncompressed-size"
+
+// withUncompressedSizes annotates each layer of img with its uncompressed
+// size, reading up to jobs layers at a time. Layers in skip are left alone.
+func withUncompressedSizes(img v1.Image, jobs int, skip map[v1.Hash][]string) (v1.Image, error) {
+	ls, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range ls {
+		if _, ok := l.(*stream.Layer); ok {
+			// Its contents can only be read once, by the upload.
+			return nil, errors.New("WithUncompressedSizeAnnotation doesn't support stream.Layer")
+		}
+	}
+	sizes := make([]int64, len(ls))
+	var g errgroup.Group
+	g.SetLimit(jobs)
+	for i, l := range ls {
+		i, l := i, l
+		if h, err := l.Digest(); err == nil && skip[h] != nil {
+			sizes[i] = -1
+			continue
+		}
+		g.Go(func() error {
+			n, err := uncompressedSize(l)
+			if err != nil {
+				return fmt.Errorf("computing uncompressed size of layer %d: %w", i, err)
+			}
+			sizes[i] = n
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	i := 0
+	return redescribeLayers(img, func(l v1.Layer, desc *v1.Descriptor) (v1.Layer, error) {
+		n := sizes[i]
+		i++
+		if n < 0 {
+			return l, nil
+		}
+		annotations := make(map[string]string, len(desc.Annotations)+1)
+		for k, v := range desc.Annotations {
+			annotations[k] = v
+		}
+		annotations[UncompressedSizeAnnotation] = strconv.FormatInt(n, 10)
+		desc.Annotations = annotations
+		if ml, ok := l.(*MountableLayer); ok {
+			// Keep it mountable, since writers only mount a *MountableLayer.
+			mounted := *ml
+			mounted.Layer = &describedLayer{Layer: ml.Layer, desc: *desc}
+			return &mounted, nil
+		}
+		return &describedLayer{Layer: l, desc: *desc}, nil
+	})
+}
+
+// uncompressedSize streams the layer's uncompressed contents to count them.
+func uncompressedSize(l v1.Layer) (int64, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(ioutil.Discard, rc)
+}
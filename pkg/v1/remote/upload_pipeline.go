@@ -0,0 +1,95 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"errors"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+)
+
+// pipelineThreshold is the size above which streamBlob reads a layer ahead of
+// the upload, so that compressing and hashing it overlaps with sending it.
+// Layers whose size isn't known yet, like streaming layers and layers that
+// still need compressing, are always read ahead. Zero disables reading ahead.
+var pipelineThreshold int64 = 32 << 20
+
+// pipelineBuffer is how much of a layer can be read ahead of the upload.
+const pipelineBuffer = 4 << 20
+
+// pipelined reports whether l should be read ahead of its upload.
+func pipelined(l v1.Layer) bool {
+	if pipelineThreshold <= 0 {
+		return false
+	}
+	if partial.NeedsCompression(l) {
+		// Size would compress the whole layer.
+		return true
+	}
+	size, err := l.Size()
+	return err != nil || size >= pipelineThreshold
+}
+
+// readAheadCloser reads rc in a goroutine into a bufferedPipe, so that
+// whatever work produces rc's contents isn't held up waiting for them to be
+// sent.
+type readAheadCloser struct {
+	pipe *bufferedPipe
+	done chan error
+	err  error
+}
+
+// readAhead returns a ReadCloser with the contents of rc, which are read
+// ahead of time by another goroutine. Errors reading or closing rc are
+// returned by Read; once Read returns io.EOF, rc has been closed, so e.g. a
+// stream.Layer has been finalized.
+func readAhead(rc io.ReadCloser) io.ReadCloser {
+	r := &readAheadCloser{
+		pipe: newBufferedPipe(pipelineBuffer),
+		done: make(chan error, 1),
+	}
+	go func() {
+		_, err := io.Copy(r.pipe, rc)
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+		r.pipe.closeWrite(err)
+		r.done <- err
+	}()
+	return r
+}
+
+// Read implements io.Reader.
+func (r *readAheadCloser) Read(p []byte) (int, error) {
+	return r.pipe.Read(p)
+}
+
+// Close implements io.Closer. It stops the goroutine reading ahead, if it's
+// still running, and waits for it to close the underlying ReadCloser.
+func (r *readAheadCloser) Close() error {
+	if r.done == nil {
+		return r.err
+	}
+	r.pipe.closeRead(errUploadAbandoned)
+	err := <-r.done
+	r.done = nil
+	if errors.Is(err, errUploadAbandoned) {
+		err = nil
+	}
+	r.err = err
+	return err
+}
@@ -0,0 +1,222 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+)
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	r      io.Reader
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestReadAhead(t *testing.T) {
+	want := bytes.Repeat([]byte("layer"), 1<<20)
+	src := &closeRecorder{r: bytes.NewReader(want), closed: make(chan struct{})}
+	rc := readAhead(src)
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, want %d", len(got), len(want))
+	}
+	// The source is closed before reads return io.EOF.
+	select {
+	case <-src.closed:
+	default:
+		t.Error("source wasn't closed at io.EOF")
+	}
+	if err := rc.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+
+	// Errors reading the source are returned by Read.
+	errBroken := errors.New("broken")
+	src = &closeRecorder{
+		r:      io.MultiReader(bytes.NewReader(want[:1024]), failingReader{errBroken}),
+		closed: make(chan struct{}),
+	}
+	rc = readAhead(src)
+	if _, err := ioutil.ReadAll(rc); !errors.Is(err, errBroken) {
+		t.Errorf("ReadAll() = %v, want %v", err, errBroken)
+	}
+	rc.Close()
+
+	// Closing early stops reading ahead, and closes the source.
+	src = &closeRecorder{r: neverEnding('x'), closed: make(chan struct{})}
+	rc = readAhead(src)
+	if _, err := rc.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	select {
+	case <-src.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("source wasn't closed")
+	}
+}
+
+// failingReader is a Reader that always fails.
+type failingReader struct{ err error }
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+// neverEnding is a Reader of endless bytes.
+type neverEnding byte
+
+func (b neverEnding) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
+
+func TestPipelinedStreamLayer(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := mustNewTag(t, fmt.Sprintf("%s/pipelined/stream:latest", u.Host)).Context()
+
+	b := make([]byte, 2*pipelineBuffer)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	l := stream.NewLayer(ioutil.NopCloser(bytes.NewReader(b)))
+	if !pipelined(l) {
+		t.Fatal("streaming layer isn't pipelined")
+	}
+	if err := WriteLayer(repo, l); err != nil {
+		t.Fatalf("WriteLayer() = %v", err)
+	}
+	h, err := l.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	got, err := Layer(repo.Digest(h.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := got.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	pulled, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pulled, b) {
+		t.Errorf("pulled %d bytes, want %d", len(pulled), len(b))
+	}
+}
+
+// slowServer accepts uploads at a limited rate, like a registry over a slow
+// network.
+func slowServer(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch || r.Method == http.MethodPut {
+			r.Body = ioutil.NopCloser(&slowReader{r: r.Body})
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type slowReader struct {
+	r io.Reader
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	time.Sleep(200 * time.Microsecond)
+	return s.r.Read(p)
+}
+
+func BenchmarkPipelinedUpload(b *testing.B) {
+	// Random bytes, half of which are replaced with text, so that compressing
+	// them takes a while and makes them smaller.
+	contents := make([]byte, 64<<20)
+	if _, err := rand.Read(contents); err != nil {
+		b.Fatal(err)
+	}
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 24))
+	for i := 0; i < len(contents); i += 2 * len(text) {
+		copy(contents[i:], text)
+	}
+
+	for _, bc := range []struct {
+		name      string
+		threshold int64
+	}{
+		{"serial", 0},
+		{"pipelined", pipelineThreshold},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			defer func(old int64) { pipelineThreshold = old }(pipelineThreshold)
+			pipelineThreshold = bc.threshold
+
+			s := httptest.NewServer(slowServer(registry.New()))
+			defer s.Close()
+			repo, err := name.NewRepository(strings.TrimPrefix(s.URL, "http://") + "/bench/pipeline")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(int64(len(contents)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Vary the contents so that every upload is new.
+				contents[0] = byte(i)
+				l := stream.NewLayer(ioutil.NopCloser(bytes.NewReader(contents)))
+				if err := WriteLayer(repo, l); err != nil {
+					b.Fatalf("WriteLayer() = %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"errors"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// uncompressedTeeBuffer is how much of a layer's compressed contents can be
+// buffered for a WithUncompressedTee writer that's fallen behind the upload.
+const uncompressedTeeBuffer = 4 << 20
+
+// errUploadAbandoned is passed to CloseWithError of a WithUncompressedTee
+// writer when the upload attempt it was receiving stops before the end of the
+// layer.
+var errUploadAbandoned = errors.New("upload stopped before the layer was read completely")
+
+// compressed returns the compressed contents of l to upload, passing their
+// uncompressed contents to WithUncompressedTee as they're read.
+func (w *writer) compressed(l v1.Layer) (io.ReadCloser, error) {
+	rc, err := l.Compressed()
+	if err != nil || w.uncompressedTee == nil {
+		return rc, err
+	}
+	// Config blobs, and the empty JSON blob that artifacts use in place of
+	// one, aren't layers.
+	if mt, err := l.MediaType(); err != nil {
+		rc.Close()
+		return nil, err
+	} else if mt == types.OCIConfigJSON || mt == types.DockerConfigJSON || mt == types.OCIEmptyJSON {
+		return rc, nil
+	}
+	dst, err := w.uncompressedTee(l)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return teeUncompressed(rc, dst), nil
+}
+
+// teeUncompressed returns a ReadCloser that reads rc while writing its
+// uncompressed contents to dst. If writing to dst fails, reading fails with
+// its error; otherwise, the final read waits for dst to receive everything and
+// closes it before reporting io.EOF.
+func teeUncompressed(rc io.ReadCloser, dst io.WriteCloser) io.ReadCloser {
+	copyTo := func(r io.Reader) error {
+		_, err := io.Copy(dst, r)
+		return err
+	}
+	finish := func(err error) error {
+		if err != nil {
+			closeWithError(dst, err)
+			return err
+		}
+		return dst.Close()
+	}
+	return newDecompressingReadCloser(rc, uncompressedTeeBuffer, copyTo, finish, errUploadAbandoned)
+}
+
+// closeWithError closes w with err if it supports that, like io.PipeWriter,
+// and just closes it otherwise.
+func closeWithError(w io.WriteCloser, err error) error {
+	if cw, ok := w.(interface{ CloseWithError(error) error }); ok {
+		return cw.CloseWithError(err)
+	}
+	return w.Close()
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// teeBuffer collects what's written to it, slowly.
+type teeBuffer struct {
+	buf    bytes.Buffer
+	closed bool
+	fail   error
+}
+
+func (b *teeBuffer) Write(p []byte) (int, error) {
+	if b.fail != nil {
+		return 0, b.fail
+	}
+	time.Sleep(time.Millisecond)
+	return b.buf.Write(p)
+}
+
+func (b *teeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestUncompressedTee(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/upload/tee:latest", u.Host))
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	tees := map[v1.Hash]*teeBuffer{}
+	open := func(l v1.Layer) (io.WriteCloser, error) {
+		h, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		tees[h] = &teeBuffer{}
+		return tees[h], nil
+	}
+	if err := Write(ref, img, WithUncompressedTee(open)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the layers are passed on, not the config.
+	if len(tees) != len(ls) {
+		t.Errorf("opened %d writers, want %d", len(tees), len(ls))
+	}
+	for _, l := range ls {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := l.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tee, ok := tees[h]
+		if !ok {
+			t.Errorf("layer %s wasn't passed on", h)
+			continue
+		}
+		if !bytes.Equal(tee.buf.Bytes(), want) {
+			t.Errorf("layer %s: writer got %d bytes, want its %d uncompressed bytes", h, tee.buf.Len(), len(want))
+		}
+		if !tee.closed {
+			t.Errorf("layer %s: writer wasn't closed", h)
+		}
+	}
+
+	// A failing writer fails the upload.
+	errFull := errors.New("disk full")
+	failing := func(v1.Layer) (io.WriteCloser, error) {
+		return &teeBuffer{fail: errFull}, nil
+	}
+	other, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, other, WithUncompressedTee(failing)); !errors.Is(err, errFull) {
+		t.Errorf("Write() = %v, want %v", err, errFull)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"golang.org/x/sync/errgroup"
+)
+
+// VerifyImage checks that the image ref can be pulled, e.g. right after
+// pushing it, without downloading all of it: the manifest is fetched and its
+// digest checked, and then the config and every layer are HEADed, up to
+// WithJobs at a time, to confirm that they exist and have the sizes the
+// manifest says. Non-distributable layers, which aren't expected to be in the
+// registry, are skipped.
+//
+// With WithVerifySampleLayers, once every blob has been found, that many
+// layers, picked at random, are also downloaded and checked against their
+// digests, diff IDs and sizes.
+//
+// If ref refers to an index, the child matching WithPlatform is verified.
+// Every problem found is reported, not just the first.
+func VerifyImage(ref name.Reference, options ...Option) error {
+	ref, o, err := makeReferenceOptions(ref, options...)
+	if err != nil {
+		return err
+	}
+	acceptable := append([]types.MediaType{}, acceptableImageMediaTypes...)
+	acceptable = append(acceptable, acceptableIndexMediaTypes...)
+	desc, err := getWithOptions(ref, acceptable, o)
+	if err != nil {
+		return err
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu       sync.Mutex
+		problems []string
+	)
+	problem := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	var g errgroup.Group
+	g.SetLimit(o.jobs)
+	for _, d := range append([]v1.Descriptor{m.Config}, m.Layers...) {
+		d := d
+		if !d.MediaType.IsDistributable() {
+			continue
+		}
+		g.Go(func() error {
+			resp, err := desc.fetcher.headBlob(d.Digest)
+			if err != nil {
+				problem("%s: %v", d.Digest, err)
+				return nil
+			}
+			resp.Body.Close()
+			if resp.ContentLength >= 0 && resp.ContentLength != d.Size {
+				problem("%s: registry has %d bytes, manifest says %d", d.Digest, resp.ContentLength, d.Size)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if sample := o.verifySampleLayers; sample > 0 && len(problems) == 0 {
+		ls, err := img.Layers()
+		if err != nil {
+			return err
+		}
+		for _, i := range rand.Perm(len(ls)) {
+			if sample == 0 {
+				break
+			}
+			l := ls[i]
+			if mt, err := l.MediaType(); err != nil {
+				return err
+			} else if !mt.IsDistributable() {
+				continue
+			}
+			sample--
+			g.Go(func() error {
+				if err := validate.Layer(l); err != nil {
+					h, _ := l.Digest()
+					problem("%s: %v", h, err)
+				}
+				return nil
+			})
+		}
+		_ = g.Wait()
+	}
+
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s: %d blobs failed verification: %s", ref, len(problems), strings.Join(problems, ", "))
+	}
+	return nil
+}
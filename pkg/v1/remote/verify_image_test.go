@@ -0,0 +1,129 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestVerifyImage(t *testing.T) {
+	var (
+		gets    int32
+		missing atomic.Value // of string, a blob path to 404
+		corrupt atomic.Value // of string, a blob path to serve garbage for
+	)
+	missing.Store("")
+	corrupt.Store("")
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/sha256:") {
+			if r.URL.Path == missing.Load().(string) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodGet {
+				atomic.AddInt32(&gets, 1)
+				if r.URL.Path == corrupt.Load().(string) {
+					w.Write([]byte("not the layer you're looking for"))
+					return
+				}
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/verify/image:latest", u.Host))
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerPath := func(i int) string {
+		return fmt.Sprintf("/v2/verify/image/blobs/%s", m.Layers[i].Digest)
+	}
+
+	if err := VerifyImage(ref); err != nil {
+		t.Errorf("VerifyImage() = %v", err)
+	}
+	if got := atomic.LoadInt32(&gets); got != 0 {
+		t.Errorf("VerifyImage() made %d blob GETs, want 0", got)
+	}
+	if err := VerifyImage(ref, WithVerifySampleLayers(1)); err != nil {
+		t.Errorf("VerifyImage(1 sample) = %v", err)
+	}
+	if got := atomic.LoadInt32(&gets); got == 0 {
+		t.Error("VerifyImage(1 sample) didn't download a layer")
+	}
+
+	// Corrupt layers are only noticed when they're sampled.
+	corrupt.Store(layerPath(1))
+	if err := VerifyImage(ref); err != nil {
+		t.Errorf("VerifyImage() = %v", err)
+	}
+	if err := VerifyImage(ref, WithVerifySampleLayers(10)); err == nil {
+		t.Error("VerifyImage(all sampled) succeeded with a corrupt layer, expected error")
+	} else if !strings.Contains(err.Error(), m.Layers[1].Digest.String()) {
+		t.Errorf("VerifyImage(all sampled) = %v, expected it to mention %s", err, m.Layers[1].Digest)
+	}
+	corrupt.Store("")
+
+	// Missing blobs always are.
+	missing.Store(layerPath(2))
+	if err := VerifyImage(ref); err == nil {
+		t.Error("VerifyImage() succeeded with a missing layer, expected error")
+	} else if !strings.Contains(err.Error(), m.Layers[2].Digest.String()) {
+		t.Errorf("VerifyImage() = %v, expected it to mention %s", err, m.Layers[2].Digest)
+	}
+
+	if err := VerifyImage(ref, WithVerifySampleLayers(-1)); err == nil {
+		t.Error("WithVerifySampleLayers(-1) succeeded, expected error")
+	}
+	missing.Store("")
+
+	// The reference is only rewritten once, and the rewritten one is verified.
+	rewrites := 0
+	rewriter := WithReferenceRewriter(func(name.Reference) name.Reference {
+		rewrites++
+		return ref
+	})
+	other := mustNewTag(t, fmt.Sprintf("%s/verify/other:latest", u.Host))
+	if err := VerifyImage(other, rewriter); err != nil {
+		t.Errorf("VerifyImage(rewritten) = %v", err)
+	}
+	if rewrites != 1 {
+		t.Errorf("reference rewritten %d times, want 1", rewrites)
+	}
+}
@@ -17,18 +17,24 @@ package remote
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/go-containerregistry/internal/redact"
 	"github.com/google/go-containerregistry/internal/retry"
 	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/stream"
@@ -42,16 +48,56 @@ type Taggable interface {
 }
 
 // Write pushes the provided img to the specified image reference.
-func Write(ref name.Reference, img v1.Image, options ...Option) (rerr error) {
+func Write(ref name.Reference, img v1.Image, options ...Option) error {
 	o, err := makeOptions(ref.Context(), options...)
 	if err != nil {
 		return err
 	}
+	img, err = prepareImage(img, o)
+	if err != nil {
+		return err
+	}
+	return write(ref, img, o)
+}
+
+// prepareImage applies the options that rewrite img's manifest, returning the
+// image that's actually pushed.
+func prepareImage(img v1.Image, o *options) (v1.Image, error) {
+	var err error
+	if o.layerTransform != nil {
+		img, err = transformImage(img, o.layerTransform)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.uncompressedSizes {
+		img, err = withUncompressedSizes(img, o.jobs, o.foreignURLs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.foreignURLs != nil {
+		img, err = withForeignURLs(img, o.foreignURLs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.manifestMediaType != "" {
+		img, err = withManifestMediaType(img, o.manifestMediaType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
 
+// write pushes img, which prepareImage has already rewritten.
+func write(ref name.Reference, img v1.Image, o *options) (rerr error) {
 	var p *progress
 	if o.updates != nil {
 		p = &progress{updates: o.updates}
 		p.lastUpdate = &v1.Update{}
+		var err error
 		p.lastUpdate.Total, err = countImage(img, o.allowNondistributableArtifacts)
 		if err != nil {
 			return err
@@ -59,26 +105,91 @@ func Write(ref name.Reference, img v1.Image, options ...Option) (rerr error) {
 		defer close(o.updates)
 		defer func() { _ = p.err(rerr) }()
 	}
-	return writeImage(o.context, ref, img, o, p)
+	s, report := makeSummary(o)
+	defer report()
+	return writeImage(o.context, ref, img, o, p, s)
 }
 
-func writeImage(ctx context.Context, ref name.Reference, img v1.Image, o *options, progress *progress) error {
+// WriteWithDigest pushes the provided img to the specified image reference,
+// like Write, and then also PUTs the manifest by digest, returning the
+// resulting name.Digest. This gives callers pushing to a tag a stable
+// reference to exactly what they pushed.
+//
+// Some registries don't allow pushing manifests by digest. If the registry
+// rejects the by-digest PUT, WriteWithDigest instead verifies that the
+// registry serves a manifest with the expected digest.
+func WriteWithDigest(ref name.Reference, img v1.Image, options ...Option) (name.Digest, error) {
+	o, err := makeOptions(ref.Context(), options...)
+	if err != nil {
+		return name.Digest{}, err
+	}
+	// The digest is that of the image that's actually pushed.
+	img, err = prepareImage(img, o)
+	if err != nil {
+		return name.Digest{}, err
+	}
+	if err := write(ref, img, o); err != nil {
+		return name.Digest{}, err
+	}
+	h, err := img.Digest()
+	if err != nil {
+		return name.Digest{}, err
+	}
+	dig := ref.Context().Digest(h.String())
+	if _, ok := ref.(name.Digest); ok {
+		// We just pushed by digest.
+		return dig, nil
+	}
+
+	err = Put(dig, img, options...)
+	if err == nil {
+		return dig, nil
+	}
+	var terr *transport.Error
+	if !errors.As(err, &terr) || terr.StatusCode >= http.StatusInternalServerError {
+		return name.Digest{}, err
+	}
+
+	logs.Warn.Printf("pushing %s by digest failed, verifying instead: %v", dig, err)
+	desc, err := Head(dig, options...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("verifying %s: %w", dig, err)
+	}
+	if desc.Digest != h {
+		return name.Digest{}, fmt.Errorf("verifying %s: registry returned digest %s", dig, desc.Digest)
+	}
+	return dig, nil
+}
+
+func writeImage(ctx context.Context, ref name.Reference, img v1.Image, o *options, progress *progress, summary *summary) error {
 	ls, err := img.Layers()
 	if err != nil {
 		return err
 	}
 	scopes := scopesForUploadingImage(ref.Context(), ls)
-	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, scopes)
+	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, addScopes(scopes, o))
 	if err != nil {
 		return err
 	}
-	w := writer{
-		repo:      ref.Context(),
-		client:    &http.Client{Transport: tr},
-		context:   ctx,
-		progress:  progress,
-		backoff:   o.retryBackoff,
-		predicate: o.retryPredicate,
+	w := newWriter(ref.Context(), tr, o)
+	w.context = ctx
+	w.progress = progress
+	w.summary = summary
+
+	// Blobs whose uploads are canceled through WithTransferCancel don't stop
+	// the others, but do stop the manifest from being written.
+	var canceledMu sync.Mutex
+	canceled := &ErrTransferCanceled{}
+	upload := func(ctx context.Context, l v1.Layer) error {
+		err := w.uploadOne(ctx, l)
+		var cerr *ErrTransferCanceled
+		if errors.As(err, &cerr) {
+			canceledMu.Lock()
+			defer canceledMu.Unlock()
+			canceled.Digests = append(canceled.Digests, cerr.Digests...)
+			return nil
+		}
+		return err
 	}
 
 	// Upload individual blobs and collect any errors.
@@ -88,7 +199,7 @@ func writeImage(ctx context.Context, ref name.Reference, img v1.Image, o *option
 		// Start N workers consuming blobs to upload.
 		g.Go(func() error {
 			for b := range blobChan {
-				if err := w.uploadOne(gctx, b); err != nil {
+				if err := upload(gctx, b); err != nil {
 					return err
 				}
 			}
@@ -96,16 +207,29 @@ func writeImage(ctx context.Context, ref name.Reference, img v1.Image, o *option
 		})
 	}
 
+	// The config is deduped along with the layers, since artifacts may use
+	// the same blob, e.g. the empty JSON blob, as both.
+	cl, configErr := partial.ConfigLayer(img)
+
 	// Upload individual layers in goroutines and collect any errors.
 	// If we can dedupe by the layer digest, try to do so. If we can't determine
 	// the digest for whatever reason, we can't dedupe and might re-upload.
 	g.Go(func() error {
 		defer close(blobChan)
 		uploaded := map[v1.Hash]bool{}
+		if configErr == nil {
+			if h, err := cl.Digest(); err == nil {
+				uploaded[h] = true
+			}
+		}
 		for _, l := range ls {
 			l := l
 
 			// Handle foreign layers.
+			if _, ok := l.(*foreignLayer); ok {
+				// These only exist at their URLs.
+				continue
+			}
 			mt, err := l.MediaType()
 			if err != nil {
 				return err
@@ -116,7 +240,7 @@ func writeImage(ctx context.Context, ref name.Reference, img v1.Image, o *option
 
 			// Streaming layers calculate their digests while uploading them. Assume
 			// an error here indicates we need to upload the layer.
-			h, err := l.Digest()
+			h, err := uploadDigest(l)
 			if err == nil {
 				// If we can determine the layer's digest ahead of
 				// time, use it to dedupe uploads.
@@ -134,7 +258,7 @@ func writeImage(ctx context.Context, ref name.Reference, img v1.Image, o *option
 		return nil
 	})
 
-	if l, err := partial.ConfigLayer(img); err != nil {
+	if configErr != nil {
 		// We can't read the ConfigLayer, possibly because of streaming layers,
 		// since the layer DiffIDs haven't been calculated yet. Attempt to wait
 		// for the other layers to be uploaded, then try the config again.
@@ -147,13 +271,13 @@ func writeImage(ctx context.Context, ref name.Reference, img v1.Image, o *option
 		if err != nil {
 			return err
 		}
-		if err := w.uploadOne(ctx, l); err != nil {
+		if err := upload(ctx, l); err != nil {
 			return err
 		}
 	} else {
 		// We *can* read the ConfigLayer, so upload it concurrently with the layers.
 		g.Go(func() error {
-			return w.uploadOne(gctx, l)
+			return upload(gctx, cl)
 		})
 
 		// Wait for the layers + config.
@@ -161,10 +285,19 @@ func writeImage(ctx context.Context, ref name.Reference, img v1.Image, o *option
 			return err
 		}
 	}
+	if len(canceled.Digests) != 0 {
+		return canceled
+	}
+	w.summary.configWritten(img)
 
 	// With all of the constituent elements uploaded, upload the manifest
 	// to commit the image.
-	return w.commitManifest(ctx, img, ref)
+	err = w.commitManifest(ctx, img, ref)
+	if err != nil && o.legacySchema1 && isSchema2Rejection(err) {
+		logs.Warn.Printf("registry rejected manifest for %s, retrying with schema 1: %v", ref, err)
+		return w.commitSchema1(ctx, ref, img)
+	}
+	return err
 }
 
 // writer writes the elements of an image to a remote image reference.
@@ -176,6 +309,142 @@ type writer struct {
 	progress  *progress
 	backoff   Backoff
 	predicate retry.Predicate
+
+	// metrics, if set by WithMetrics, is told about each retry.
+	metrics Metrics
+
+	// maxBlobAttempts, if positive, caps the attempts made by uploadOne.
+	maxBlobAttempts int
+
+	// uploadSession, if set, is called when a blob upload is initiated.
+	uploadSession func(v1.Hash, string)
+
+	// summary, if set, records how each blob was transferred.
+	summary *summary
+
+	// parallelChunks, if positive, enables chunked uploads. See streamChunks.
+	parallelChunks int
+
+	// chunkSizer, if set, enables chunked uploads and sizes the chunks.
+	chunkSizer ChunkSizer
+
+	// transferCancel, if set, is given a func to cancel each blob upload.
+	transferCancel func(v1.Hash, context.CancelFunc)
+
+	// digestMode is how commitBlob sends the blob's digest.
+	digestMode BlobDigestMode
+	// digestInHeader is set once a registry has rejected the digest in the
+	// query but accepted it in a header. See commitBlob.
+	digestInHeader int32
+
+	// uncompressedTee is set by WithUncompressedTee.
+	uncompressedTee func(v1.Layer) (io.WriteCloser, error)
+
+	// mountRepo, if set by WithMountRepository, is where blobs are mounted
+	// from.
+	mountRepo *name.Repository
+
+	// blobWritten, if set, is called once each blob is in the repository.
+	blobWritten func(v1.Descriptor)
+
+	// knownBlob, if set by WithKnownBlobs, reports blobs that are already in
+	// the repository without checking.
+	knownBlob func(v1.Hash) bool
+}
+
+// newWriter returns a writer that writes to repo through tr, as configured by
+// o. Callers set progress and summary if they report them.
+func newWriter(repo name.Repository, tr http.RoundTripper, o *options) *writer {
+	return &writer{
+		repo:            repo,
+		client:          &http.Client{Transport: tr},
+		context:         o.context,
+		backoff:         o.retryBackoff,
+		predicate:       o.retryPredicate,
+		metrics:         o.metrics,
+		maxBlobAttempts: o.maxRetriesPerBlob,
+		uploadSession:   o.uploadSession,
+		parallelChunks:  o.parallelChunks,
+		chunkSizer:      o.chunkSizer,
+		transferCancel:  o.transferCancel,
+		digestMode:      o.blobDigestMode,
+		mountRepo:       o.mountRepo,
+		blobWritten:     o.blobWritten,
+		uncompressedTee: o.uncompressedTee,
+		knownBlob:       o.knownBlob,
+	}
+}
+
+// written passes the descriptor of l, which is now in the repository, to the
+// WithBlobWritten callback.
+func (w *writer) written(l v1.Layer) error {
+	if w.blobWritten == nil {
+		return nil
+	}
+	d, err := partial.Descriptor(l)
+	if err != nil {
+		return err
+	}
+	w.blobWritten(*d)
+	return nil
+}
+
+// ErrTransferCanceled is returned when blob uploads were canceled by the
+// funcs passed to the callback of WithTransferCancel.
+type ErrTransferCanceled struct {
+	// Digests are the digests of the blobs whose uploads were canceled.
+	Digests []v1.Hash
+}
+
+// Error implements error.
+func (e *ErrTransferCanceled) Error() string {
+	return fmt.Sprintf("canceled upload of %d blob(s): %v", len(e.Digests), e.Digests)
+}
+
+// Unwrap returns context.Canceled, so that errors.Is(err, context.Canceled)
+// holds for these errors.
+func (e *ErrTransferCanceled) Unwrap() error {
+	return context.Canceled
+}
+
+// ErrBlobRetriesExhausted is returned when a blob could not be uploaded within
+// the number of attempts allowed by WithMaxRetriesPerBlob.
+type ErrBlobRetriesExhausted struct {
+	// Digest is the digest of the blob that failed to upload. It may be
+	// empty for streaming layers whose digest was never computed.
+	Digest   v1.Hash
+	Attempts int
+	Err      error
+}
+
+// Error implements error.
+func (e *ErrBlobRetriesExhausted) Error() string {
+	return fmt.Sprintf("uploading blob %s: giving up after %d attempts: %v", e.Digest, e.Attempts, e.Err)
+}
+
+// Unwrap returns the last error encountered while uploading the blob.
+func (e *ErrBlobRetriesExhausted) Unwrap() error {
+	return e.Err
+}
+
+// ErrManifestTooLarge is returned when the registry (or a proxy in front of
+// it) rejects a manifest PUT because the body is too large. Callers pushing
+// very large indexes can use Size to decide how to split them.
+type ErrManifestTooLarge struct {
+	Reference name.Reference
+	// Size is the size of the rejected manifest, in bytes.
+	Size int64
+	Err  error
+}
+
+// Error implements error.
+func (e *ErrManifestTooLarge) Error() string {
+	return fmt.Sprintf("manifest for %s is too large (%d bytes): %v", e.Reference, e.Size, e.Err)
+}
+
+// Unwrap returns the error returned by the registry.
+func (e *ErrManifestTooLarge) Unwrap() error {
+	return e.Err
 }
 
 // url returns a url.Url for the specified path in the context of this remote image reference.
@@ -316,17 +585,29 @@ func (w *writer) streamBlob(ctx context.Context, layer v1.Layer, streamLocation
 			reset()
 		}
 	}()
-	blob, err := layer.Compressed()
+	compressed := w.compressed
+	if pipelined(layer) {
+		compressed = func(l v1.Layer) (io.ReadCloser, error) {
+			rc, err := w.compressed(l)
+			if err != nil {
+				return nil, err
+			}
+			return readAhead(rc), nil
+		}
+	}
+	getBody := func() (io.ReadCloser, error) {
+		return compressed(layer)
+	}
+	blob, err := getBody()
 	if err != nil {
 		return "", err
 	}
 
-	getBody := layer.Compressed
 	if w.progress != nil {
 		var count int64
 		blob = &progressReader{rc: blob, progress: w.progress, count: &count}
 		getBody = func() (io.ReadCloser, error) {
-			blob, err := layer.Compressed()
+			blob, err := compressed(layer)
 			if err != nil {
 				return nil, err
 			}
@@ -362,22 +643,221 @@ func (w *writer) streamBlob(ctx context.Context, layer v1.Layer, streamLocation
 	return w.nextLocation(resp)
 }
 
+// parallelChunkSize is the size of each chunk sent by streamChunks, unless
+// WithChunkSize is used.
+var parallelChunkSize int64 = 16 << 20
+
+// errChunkOutOfOrder is returned by patchChunk when the registry rejects a
+// chunk because it doesn't start where the previous chunk ended.
+var errChunkOutOfOrder = errors.New("registry requires chunks in order")
+
+// streamChunks uploads the contents of the blob to the specified location in
+// chunks sized by nextChunkSize, up to w.parallelChunks at a time. If the
+// registry rejects a chunk that arrives out of order, this starts over in a
+// new upload session and sends the chunks sequentially. Like streamBlob, this
+// returns the location header indicating how to commit the blob.
+func (w *writer) streamChunks(ctx context.Context, layer v1.Layer, location string) (string, error) {
+	n := w.parallelChunks
+	if n <= 0 {
+		n = 1
+	}
+	commitLocation, sent, err := w.uploadChunks(ctx, layer, location, n)
+	if n == 1 || !errors.Is(err, errChunkOutOfOrder) {
+		return commitLocation, err
+	}
+
+	logs.Warn.Printf("registry rejected out of order chunks, uploading sequentially")
+	w.incrProgress(-sent)
+	go w.cancelUpload(location)
+	location, _, err = w.initiateUpload("", "", "")
+	if err != nil {
+		return "", err
+	}
+	commitLocation, _, err = w.uploadChunks(ctx, layer, location, 1)
+	return commitLocation, err
+}
+
+// uploadChunks reads the compressed contents of layer and PATCHes them to
+// location, up to n chunks at a time. When n is 1, each chunk is sent to the
+// location returned for the previous chunk. It returns the location to
+// commit the blob and the number of bytes that were successfully sent.
+func (w *writer) uploadChunks(ctx context.Context, layer v1.Layer, location string, n int) (string, int64, error) {
+	rc, err := w.compressed(layer)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	var (
+		mu             sync.Mutex
+		sent           int64
+		lastOffset     int64 = -1
+		commitLocation string
+
+		// last is the most recent chunk to finish that nextChunkSize
+		// hasn't been told about yet.
+		last ChunkResult
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(n)
+	for offset := int64(0); gctx.Err() == nil; {
+		mu.Lock()
+		size := w.nextChunkSize(last)
+		last = ChunkResult{}
+		mu.Unlock()
+
+		b := make([]byte, size)
+		k, err := io.ReadFull(rc, b)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			_ = g.Wait()
+			return "", sent, err
+		}
+		chunk, start := b[:k], offset
+		offset += int64(k)
+
+		if n == 1 {
+			began := time.Now()
+			location, err = w.patchChunk(ctx, location, start, chunk)
+			last = ChunkResult{Size: int64(k), Duration: time.Since(began), Err: err}
+			if err != nil {
+				w.chunkFailed(last)
+				return "", sent, err
+			}
+			sent += int64(k)
+			commitLocation = location
+			continue
+		}
+
+		g.Go(func() error {
+			began := time.Now()
+			next, err := w.patchChunk(gctx, location, start, chunk)
+			mu.Lock()
+			defer mu.Unlock()
+			last = ChunkResult{Size: int64(len(chunk)), Duration: time.Since(began), Err: err}
+			if err != nil {
+				return err
+			}
+			sent += int64(len(chunk))
+			if start > lastOffset {
+				lastOffset, commitLocation = start, next
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		w.chunkFailed(last)
+		return "", sent, err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", sent, err
+	}
+	return commitLocation, sent, nil
+}
+
+// nextChunkSize returns the size of the next chunk to upload, given how the
+// previous one went. See WithChunkSize.
+func (w *writer) nextChunkSize(prev ChunkResult) int64 {
+	if w.chunkSizer == nil {
+		return parallelChunkSize
+	}
+	if size := w.chunkSizer.Next(prev); size > 0 {
+		return size
+	}
+	return parallelChunkSize
+}
+
+// chunkFailed tells the ChunkSizer, if any, about a chunk that failed, so
+// that the next attempt can use smaller chunks. Chunks that the registry
+// rejected for arriving out of order don't say anything about the link.
+func (w *writer) chunkFailed(r ChunkResult) {
+	if w.chunkSizer != nil && r.Err != nil && !errors.Is(r.Err, errChunkOutOfOrder) {
+		w.chunkSizer.Next(r)
+	}
+}
+
+// patchChunk sends b to location as the chunk starting at offset, returning
+// the location header for the next request in the upload sequence.
+func (w *writer) patchChunk(ctx context.Context, location string, offset int64, b []byte) (string, error) {
+	req, err := http.NewRequest(http.MethodPatch, location, bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(b))-1))
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return "", errChunkOutOfOrder
+	}
+	if err := transport.CheckError(resp, http.StatusNoContent, http.StatusAccepted, http.StatusCreated); err != nil {
+		return "", err
+	}
+	w.incrProgress(int64(len(b)))
+	return w.nextLocation(resp)
+}
+
 // commitBlob commits this blob by sending a PUT to the location returned from
 // streaming the blob.
+//
+// The digest is sent as the "digest" query parameter, as the distribution
+// spec requires, or in a Docker-Content-Digest header, depending on
+// w.digestMode. With BlobDigestAuto, a PUT rejected with 400 Bad Request is
+// retried once with the header instead, and subsequent blobs are committed
+// with the header too.
 func (w *writer) commitBlob(location, digest string) error {
+	mode := w.digestMode
+	if mode == BlobDigestAuto && atomic.LoadInt32(&w.digestInHeader) != 0 {
+		mode = BlobDigestHeader
+	}
+	err := w.putBlob(location, digest, mode)
+	if mode != BlobDigestAuto {
+		return err
+	}
+	var terr *transport.Error
+	if !errors.As(err, &terr) || terr.StatusCode != http.StatusBadRequest {
+		return err
+	}
+	logs.Debug.Printf("retrying commit of %s with the digest in a header: %v", digest, err)
+	if herr := w.putBlob(location, digest, BlobDigestHeader); herr != nil {
+		// Report the error for the standard form.
+		return err
+	}
+	atomic.StoreInt32(&w.digestInHeader, 1)
+	return nil
+}
+
+// putBlob sends the PUT that commits a blob upload, with the digest in the
+// query for BlobDigestAuto and BlobDigestQuery, or in a header for
+// BlobDigestHeader.
+func (w *writer) putBlob(location, digest string, mode BlobDigestMode) error {
 	u, err := url.Parse(location)
 	if err != nil {
 		return err
 	}
-	v := u.Query()
-	v.Set("digest", digest)
-	u.RawQuery = v.Encode()
+	if mode != BlobDigestHeader {
+		v := u.Query()
+		v.Set("digest", digest)
+		u.RawQuery = v.Encode()
+	}
 
 	req, err := http.NewRequest(http.MethodPut, u.String(), nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
+	if mode == BlobDigestHeader {
+		req.Header.Set("Docker-Content-Digest", digest)
+	}
 
 	resp, err := w.client.Do(req.WithContext(w.context))
 	if err != nil {
@@ -388,6 +868,40 @@ func (w *writer) commitBlob(location, digest string) error {
 	return transport.CheckError(resp, http.StatusCreated)
 }
 
+// useChunks returns true if WithChunkSize is used, or if WithParallelChunks is
+// used and l is large enough to be split into chunks.
+func (w *writer) useChunks(l v1.Layer) bool {
+	if w.parallelChunks <= 0 && w.chunkSizer == nil {
+		return false
+	}
+	if _, ok := l.(*stream.Layer); ok {
+		return false
+	}
+	if partial.NeedsCompression(l) {
+		return false
+	}
+	if w.chunkSizer != nil {
+		return true
+	}
+	size, err := l.Size()
+	return err == nil && size > parallelChunkSize
+}
+
+// errDigestNotComputed is returned by uploadDigest for layers whose digest is
+// computed while they are uploaded.
+var errDigestNotComputed = errors.New("digest is computed during upload")
+
+// uploadDigest returns l's digest, unless computing it would mean compressing
+// the whole layer (see partial.NeedsCompression). Like streaming layers, such
+// layers are uploaded without an existence check, and their digest is
+// computed as they're compressed for the upload.
+func uploadDigest(l v1.Layer) (v1.Hash, error) {
+	if partial.NeedsCompression(l) {
+		return v1.Hash{}, errDigestNotComputed
+	}
+	return l.Digest()
+}
+
 // incrProgress increments and sends a progress update, if WithProgress is used.
 func (w *writer) incrProgress(written int64) {
 	if w.progress == nil {
@@ -397,15 +911,41 @@ func (w *writer) incrProgress(written int64) {
 }
 
 // uploadOne performs a complete upload of a single layer.
-func (w *writer) uploadOne(ctx context.Context, l v1.Layer) error {
+func (w *writer) uploadOne(ctx context.Context, l v1.Layer) (rerr error) {
+	predicate := w.predicate
+	if h, err := uploadDigest(l); err == nil && w.transferCancel != nil {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		w.transferCancel(h, cancel)
+
+		// Don't retry after a cancellation, and report it distinctly from
+		// the whole write being canceled.
+		predicate = func(err error) bool {
+			return ctx.Err() == nil && w.predicate(err)
+		}
+		defer func() {
+			if rerr != nil && ctx.Err() != nil && parent.Err() == nil {
+				rerr = &ErrTransferCanceled{Digests: []v1.Hash{h}}
+			}
+		}()
+	}
+
 	tryUpload := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		var from, mount, origin string
-		if h, err := l.Digest(); err == nil {
+		if h, err := uploadDigest(l); err == nil {
 			// If we know the digest, this isn't a streaming layer. Do an existence
 			// check so we can skip uploading the layer if possible.
-			existing, err := w.checkExistingBlob(h)
-			if err != nil {
-				return err
+			existing := w.knownBlob != nil && w.knownBlob(h)
+			if !existing {
+				var err error
+				if existing, err = w.checkExistingBlob(h); err != nil {
+					return err
+				}
 			}
 			if existing {
 				size, err := l.Size()
@@ -413,6 +953,12 @@ func (w *writer) uploadOne(ctx context.Context, l v1.Layer) error {
 					return err
 				}
 				w.incrProgress(size)
+				if err := w.summary.existing(l); err != nil {
+					return err
+				}
+				if err := w.written(l); err != nil {
+					return err
+				}
 				logs.Progress.Printf("existing blob: %v", h)
 				return nil
 			}
@@ -423,6 +969,10 @@ func (w *writer) uploadOne(ctx context.Context, l v1.Layer) error {
 			from = ml.Reference.Context().RepositoryStr()
 			origin = ml.Reference.Context().RegistryStr()
 		}
+		if w.mountRepo != nil && mount != "" {
+			from = w.mountRepo.RepositoryStr()
+			origin = w.mountRepo.RegistryStr()
+		}
 
 		location, mounted, err := w.initiateUpload(from, mount, origin)
 		if err != nil {
@@ -433,6 +983,12 @@ func (w *writer) uploadOne(ctx context.Context, l v1.Layer) error {
 				return err
 			}
 			w.incrProgress(size)
+			if err := w.summary.mounted(l); err != nil {
+				return err
+			}
+			if err := w.written(l); err != nil {
+				return err
+			}
 			h, err := l.Digest()
 			if err != nil {
 				return err
@@ -441,6 +997,12 @@ func (w *writer) uploadOne(ctx context.Context, l v1.Layer) error {
 			return nil
 		}
 
+		if w.uploadSession != nil {
+			// Digest may fail for streaming layers, in which case we leave it empty.
+			h, _ := uploadDigest(l)
+			w.uploadSession(h, location)
+		}
+
 		// Only log layers with +json or +yaml. We can let through other stuff if it becomes popular.
 		// TODO(opencontainers/image-spec#791): Would be great to have an actual parser.
 		mt, err := l.MediaType()
@@ -452,7 +1014,11 @@ func (w *writer) uploadOne(ctx context.Context, l v1.Layer) error {
 			ctx = redact.NewContext(ctx, "omitting binary blobs from logs")
 		}
 
-		location, err = w.streamBlob(ctx, l, location)
+		if w.useChunks(l) {
+			location, err = w.streamChunks(ctx, l, location)
+		} else {
+			location, err = w.streamBlob(ctx, l, location)
+		}
 		if err != nil {
 			return err
 		}
@@ -466,11 +1032,40 @@ func (w *writer) uploadOne(ctx context.Context, l v1.Layer) error {
 		if err := w.commitBlob(location, digest); err != nil {
 			return err
 		}
+		if err := w.summary.uploaded(l); err != nil {
+			return err
+		}
+		if err := w.written(l); err != nil {
+			return err
+		}
 		logs.Progress.Printf("pushed blob: %s", digest)
 		return nil
 	}
 
-	return retry.Retry(tryUpload, w.predicate, w.backoff)
+	if w.maxBlobAttempts <= 0 {
+		return retry.Retry(tryUpload, retryWithMetrics(predicate, w.metrics), w.backoff)
+	}
+
+	// The cap can only lower the number of attempts the backoff allows.
+	backoff := w.backoff
+	if w.maxBlobAttempts < backoff.Steps {
+		backoff.Steps = w.maxBlobAttempts
+	}
+	attempts := 0
+	err := retry.Retry(func() error {
+		attempts++
+		return tryUpload()
+	}, retryWithMetrics(predicate, w.metrics), backoff)
+	if err != nil && attempts >= backoff.Steps && predicate(err) {
+		// Digest may fail for streaming layers, in which case we leave it empty.
+		h, _ := uploadDigest(l)
+		return &ErrBlobRetriesExhausted{
+			Digest:   h,
+			Attempts: attempts,
+			Err:      err,
+		}
+	}
+	return err
 }
 
 type withLayer interface {
@@ -514,7 +1109,7 @@ func (w *writer) writeIndex(ctx context.Context, ref name.Reference, ii v1.Image
 			if err != nil {
 				return err
 			}
-			if err := writeImage(ctx, ref, img, o, w.progress); err != nil {
+			if err := writeImage(ctx, ref, img, o, w.progress, w.summary); err != nil {
 				return err
 			}
 		default:
@@ -580,8 +1175,18 @@ func unpackTaggable(t Taggable) ([]byte, *v1.Descriptor, error) {
 
 // commitManifest does a PUT of the image's manifest.
 func (w *writer) commitManifest(ctx context.Context, t Taggable, ref name.Reference) error {
+	var (
+		raw  []byte
+		desc *v1.Descriptor
+		// ociSubject is set by registries that process the manifest's subject.
+		ociSubject string
+		// raced is set if another push of the same manifest won, in which
+		// case that push is responsible for its subject.
+		raced bool
+	)
 	tryUpload := func() error {
-		raw, desc, err := unpackTaggable(t)
+		var err error
+		raw, desc, err = unpackTaggable(t)
 		if err != nil {
 			return err
 		}
@@ -602,16 +1207,130 @@ func (w *writer) commitManifest(ctx context.Context, t Taggable, ref name.Refere
 		defer resp.Body.Close()
 
 		if err := transport.CheckError(resp, http.StatusOK, http.StatusCreated, http.StatusAccepted); err != nil {
-			return err
+			switch resp.StatusCode {
+			case http.StatusRequestEntityTooLarge:
+				return &ErrManifestTooLarge{
+					Reference: ref,
+					Size:      int64(len(raw)),
+					Err:       err,
+				}
+			case http.StatusConflict:
+				if err := w.checkConflict(ctx, ref, desc, err); err != nil {
+					return err
+				}
+				// Someone else pushed the same manifest at the same time,
+				// which is as good as us pushing it. The 409 won't tell us
+				// whether the registry processed the subject.
+				raced = true
+			default:
+				return err
+			}
 		}
 
 		// The image was successfully pushed!
 		logs.Progress.Printf("%v: digest: %v size: %d", ref, desc.Digest, desc.Size)
 		w.incrProgress(int64(len(raw)))
+		ociSubject = resp.Header.Get("OCI-Subject")
 		return nil
 	}
 
-	return retry.Retry(tryUpload, w.predicate, w.backoff)
+	tag, isTag := ref.(name.Tag)
+	var unchanged bool
+	if isTag && w.summary != nil {
+		unchanged = w.tagUnchanged(ctx, tag, t)
+	}
+
+	predicate := func(err error) bool {
+		var cerr *concurrentPushError
+		return errors.As(err, &cerr) || w.predicate(err)
+	}
+	if err := retry.Retry(tryUpload, retryWithMetrics(predicate, w.metrics), w.backoff); err != nil {
+		return err
+	}
+	if isTag {
+		w.summary.tagged(unchanged)
+	}
+	if ociSubject == "" && !raced {
+		return w.commitReferrer(ctx, raw, desc)
+	}
+	return nil
+}
+
+// tagUnchanged returns whether tag already points at the manifest of t, by
+// comparing t's digest to the one the registry reports for a HEAD of tag.
+// This only feeds the summary, so if the HEAD fails (e.g. because we're only
+// allowed to push) the tag is counted as updated rather than failing the write.
+func (w *writer) tagUnchanged(ctx context.Context, tag name.Tag, t Taggable) bool {
+	_, desc, err := unpackTaggable(t)
+	if err != nil {
+		return false
+	}
+	found, digest, err := w.headManifest(ctx, tag, desc.MediaType)
+	if err != nil {
+		logs.Warn.Printf("checking whether %s changed: %v", tag, err)
+		return false
+	}
+	// Without a digest header we can't tell, so assume the tag moved.
+	return found && digest == desc.Digest.String()
+}
+
+// headManifest returns whether ref exists and, if the registry reports it,
+// the digest of the manifest it refers to.
+func (w *writer) headManifest(ctx context.Context, ref name.Reference, mt types.MediaType) (bool, string, error) {
+	u := w.url(fmt.Sprintf("/v2/%s/manifests/%s", w.repo.RepositoryStr(), ref.Identifier()))
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Accept", string(mt))
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusNotFound); err != nil {
+		return false, "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, "", nil
+	}
+	return true, resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// concurrentPushError is a conflict that may be caused by a concurrent push
+// of the same manifest that hasn't finished yet, so the PUT is retried.
+type concurrentPushError struct {
+	error
+}
+
+func (e *concurrentPushError) Unwrap() error {
+	return e.error
+}
+
+// checkConflict decides what err, a 409 Conflict in response to a PUT of the
+// manifest desc to ref, means. Some registries return a conflict when the
+// same manifest is being written concurrently, so:
+//   - If ref already refers to desc, the other push won, and nil is returned.
+//   - If ref doesn't exist yet, the other push may still be in progress, and
+//     a *concurrentPushError is returned so that the PUT is retried.
+//   - Otherwise, ref refers to different content, or we can't tell, so the
+//     conflict is genuine and err is returned.
+func (w *writer) checkConflict(ctx context.Context, ref name.Reference, desc *v1.Descriptor, err error) error {
+	found, digest, herr := w.headManifest(ctx, ref, desc.MediaType)
+	if herr != nil {
+		logs.Warn.Printf("checking %v after conflict: %v", ref, herr)
+		return err
+	}
+	if !found {
+		return &concurrentPushError{err}
+	}
+	if digest == desc.Digest.String() {
+		logs.Debug.Printf("%v: conflict pushing %v, which was already pushed", ref, desc.Digest)
+		return nil
+	}
+	return err
 }
 
 func scopesForUploadingImage(repo name.Repository, layers []v1.Layer) []string {
@@ -647,19 +1366,27 @@ func WriteIndex(ref name.Reference, ii v1.ImageIndex, options ...Option) (rerr e
 	if err != nil {
 		return err
 	}
+	if o.layerTransform != nil {
+		return errors.New("WithLayerTransform is not supported by WriteIndex")
+	}
+	if o.manifestMediaType != "" {
+		return errors.New("WithManifestMediaType is not supported by WriteIndex")
+	}
+	if o.requireCompleteIndex {
+		if err := checkIndexComplete(ii, o); err != nil {
+			return fmt.Errorf("not writing %s: %w", ref, err)
+		}
+	}
 
 	scopes := []string{ref.Scope(transport.PushScope)}
-	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, scopes)
+	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, addScopes(scopes, o))
 	if err != nil {
 		return err
 	}
-	w := writer{
-		repo:      ref.Context(),
-		client:    &http.Client{Transport: tr},
-		context:   o.context,
-		backoff:   o.retryBackoff,
-		predicate: o.retryPredicate,
-	}
+	w := newWriter(ref.Context(), tr, o)
+	var report func()
+	w.summary, report = makeSummary(o)
+	defer report()
 
 	if o.updates != nil {
 		w.progress = &progress{updates: o.updates}
@@ -688,6 +1415,9 @@ func countImage(img v1.Image, allowNondistributableArtifacts bool) (int64, error
 	seen := map[v1.Hash]bool{}
 	for _, l := range ls {
 		// Handle foreign layers.
+		if _, ok := l.(*foreignLayer); ok {
+			continue
+		}
 		mt, err := l.MediaType()
 		if err != nil {
 			return 0, err
@@ -786,23 +1516,24 @@ func countIndex(idx v1.ImageIndex, allowNondistributableArtifacts bool) (int64,
 }
 
 // WriteLayer uploads the provided Layer to the specified repo.
+//
+// A layer from partial.UncompressedToLayer whose digest hasn't been computed
+// yet is compressed while it's uploaded, and its digest is computed from the
+// uploaded bytes, so its Uncompressed contents are only read once.
 func WriteLayer(repo name.Repository, layer v1.Layer, options ...Option) (rerr error) {
 	o, err := makeOptions(repo, options...)
 	if err != nil {
 		return err
 	}
 	scopes := scopesForUploadingImage(repo, []v1.Layer{layer})
-	tr, err := transport.NewWithContext(o.context, repo.Registry, o.auth, o.transport, scopes)
+	tr, err := transport.NewWithContext(o.context, repo.Registry, o.auth, o.transport, addScopes(scopes, o))
 	if err != nil {
 		return err
 	}
-	w := writer{
-		repo:      repo,
-		client:    &http.Client{Transport: tr},
-		context:   o.context,
-		backoff:   o.retryBackoff,
-		predicate: o.retryPredicate,
-	}
+	w := newWriter(repo, tr, o)
+	var report func()
+	w.summary, report = makeSummary(o)
+	defer report()
 
 	if o.updates != nil {
 		w.progress = &progress{updates: o.updates}
@@ -824,6 +1555,28 @@ func WriteLayer(repo name.Repository, layer v1.Layer, options ...Option) (rerr e
 	return w.uploadOne(o.context, layer)
 }
 
+// CopyBlob copies the blob src into dstRepo, returning a descriptor for it.
+//
+// If dstRepo is on the same registry as src, the blob is cross-repository
+// mounted; otherwise (or if the registry declines to mount it) it's streamed
+// from src to dstRepo. Nothing is transferred if dstRepo already has the blob.
+//
+// The same options are used to read from src and write to dstRepo, so pass
+// WithAuthFromKeychain to authenticate to different registries.
+//
+// Since a blob carries no media type of its own, the returned descriptor's
+// MediaType is only a placeholder; callers that know it should override it.
+func CopyBlob(src name.Digest, dstRepo name.Repository, options ...Option) (*v1.Descriptor, error) {
+	l, err := Layer(src, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteLayer(dstRepo, l, options...); err != nil {
+		return nil, err
+	}
+	return partial.Descriptor(l)
+}
+
 // Tag adds a tag to the given Taggable via PUT /v2/.../manifests/<tag>
 //
 // Notable implementations of Taggable are v1.Image, v1.ImageIndex, and
@@ -863,17 +1616,107 @@ func Put(ref name.Reference, t Taggable, options ...Option) error {
 	// * Allow callers to pass in a transport.Transport, typecheck
 	//   it to allow them to reuse the transport across multiple calls.
 	// * WithTag option to do multiple manifest PUTs in commitManifest.
-	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, scopes)
+	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, addScopes(scopes, o))
 	if err != nil {
 		return err
 	}
-	w := writer{
-		repo:      ref.Context(),
-		client:    &http.Client{Transport: tr},
-		context:   o.context,
-		backoff:   o.retryBackoff,
-		predicate: o.retryPredicate,
-	}
+	w := newWriter(ref.Context(), tr, o)
 
 	return w.commitManifest(o.context, t, ref)
 }
+
+// rawManifest is a Taggable for manifests that were serialized by the caller.
+type rawManifest struct {
+	raw       []byte
+	mediaType types.MediaType
+}
+
+// RawManifest implements Taggable.
+func (r *rawManifest) RawManifest() ([]byte, error) {
+	return r.raw, nil
+}
+
+// MediaType implements withMediaType.
+func (r *rawManifest) MediaType() (types.MediaType, error) {
+	return r.mediaType, nil
+}
+
+// WriteManifestFromDescriptors builds an image manifest referencing the given
+// config and layer blobs and PUTs it to ref, returning the manifest's digest.
+//
+// This composes with WriteLayer for callers that upload blobs themselves and
+// don't want to construct a full v1.Image. Every referenced blob must already
+// exist in ref's repository, otherwise no manifest is written, except for
+// empty.JSON, the config of artifacts that don't need one, which is uploaded
+// if it's missing. Non-distributable layers are not checked unless
+// WithNondistributable is used.
+//
+// The manifest is an OCI manifest if config is an OCI config or
+// empty.JSONDescriptor, and a Docker schema 2 manifest otherwise.
+func WriteManifestFromDescriptors(ref name.Reference, config v1.Descriptor, layers []v1.Descriptor, options ...Option) (v1.Hash, error) {
+	o, err := makeOptions(ref.Context(), options...)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	scopes := []string{ref.Scope(transport.PushScope)}
+	tr, err := transport.NewWithContext(o.context, ref.Context().Registry, o.auth, o.transport, addScopes(scopes, o))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	w := newWriter(ref.Context(), tr, o)
+
+	m := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config:        config,
+		Layers:        layers,
+	}
+	if config.MediaType == types.OCIConfigJSON || config.MediaType == types.OCIEmptyJSON {
+		m.MediaType = types.OCIManifestSchema1
+	}
+
+	blobs := []v1.Descriptor{config}
+	seen := map[v1.Hash]bool{config.Digest: true}
+	for _, l := range layers {
+		if (l.MediaType.IsDistributable() || o.allowNondistributableArtifacts) && !seen[l.Digest] {
+			seen[l.Digest] = true
+			blobs = append(blobs, l)
+		}
+	}
+	var g errgroup.Group
+	g.SetLimit(o.jobs)
+	for _, desc := range blobs {
+		desc := desc
+		g.Go(func() error {
+			exists, err := w.checkExistingBlob(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				// The empty JSON blob is well-known, so it needn't have been
+				// uploaded first.
+				if desc.Digest == empty.JSONDescriptor.Digest {
+					return w.uploadOne(o.context, empty.JSON)
+				}
+				return fmt.Errorf("blob %s does not exist in %s", desc.Digest, ref.Context())
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return v1.Hash{}, err
+	}
+
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	h, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := w.commitManifest(o.context, &rawManifest{raw: raw, mediaType: m.MediaType}, ref); err != nil {
+		return v1.Hash{}, err
+	}
+	return h, nil
+}
@@ -15,21 +15,31 @@
 package remote
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -41,6 +51,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
 	"github.com/google/go-containerregistry/pkg/v1/stream"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
@@ -1014,6 +1025,601 @@ func TestWriteWithErrors(t *testing.T) {
 	}
 }
 
+func TestWriteMaxRetriesPerBlob(t *testing.T) {
+	img := setupImage(t)
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := ls[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	badPath := fmt.Sprintf("/v2/write/time/blobs/%s", bad)
+
+	var attempts int32
+	reg := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && r.URL.Path == badPath {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := mustNewTag(t, fmt.Sprintf("%s/write/time:latest", u.Host))
+
+	for _, tc := range []struct {
+		name  string
+		steps int
+		max   int
+		want  int32
+	}{{
+		name:  "cap below backoff",
+		steps: 10,
+		max:   2,
+		want:  2,
+	}, {
+		// The cap never adds attempts beyond the backoff's.
+		name:  "cap above backoff",
+		steps: 3,
+		max:   10,
+		want:  3,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&attempts, 0)
+			backoff := Backoff{Duration: time.Millisecond, Factor: 1.0, Steps: tc.steps}
+			err := Write(tag, img, WithRetryBackoff(backoff), WithMaxRetriesPerBlob(tc.max))
+
+			var rerr *ErrBlobRetriesExhausted
+			if !errors.As(err, &rerr) {
+				t.Fatalf("Write() = %v, wanted *ErrBlobRetriesExhausted", err)
+			}
+			if rerr.Digest != bad {
+				t.Errorf("Digest = %s, want %s", rerr.Digest, bad)
+			}
+			if got := atomic.LoadInt32(&attempts); got != tc.want {
+				t.Errorf("attempts = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteUploadSession(t *testing.T) {
+	img := setupImage(t)
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := mustNewTag(t, fmt.Sprintf("%s/write/session:latest", u.Host))
+
+	var mu sync.Mutex
+	sessions := map[v1.Hash]string{}
+	if err := Write(tag, img, WithUploadSession(func(h v1.Hash, location string) {
+		mu.Lock()
+		defer mu.Unlock()
+		sessions[h] = location
+	})); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []v1.Hash{mustConfigName(t, img)}
+	for _, l := range ls {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, h)
+	}
+	if len(sessions) != len(want) {
+		t.Errorf("got %d upload sessions, want %d", len(sessions), len(want))
+	}
+	for _, h := range want {
+		loc, ok := sessions[h]
+		if !ok {
+			t.Errorf("no upload session for %s", h)
+			continue
+		}
+		if !strings.HasPrefix(loc, s.URL+"/v2/write/session/blobs/uploads/") {
+			t.Errorf("upload session for %s = %q, want absolute URL", h, loc)
+		}
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	// The fake registry shares blobs between repositories and doesn't
+	// support mounting, so pretend that the base layers can be mounted
+	// (and don't already exist) on the first push.
+	reg := registry.New()
+	mountable := map[string]bool{}
+	first := int32(1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&first) == 1 && strings.HasPrefix(r.URL.Path, "/v2/summary/app/blobs/") {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodPost && mountable[r.URL.Query().Get("mount")] {
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := func(l v1.Layer) int64 {
+		n, err := l.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseRef := mustNewTag(t, fmt.Sprintf("%s/summary/base:latest", u.Host))
+	if err := Write(baseRef, base); err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := Image(baseRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseLayers, err := pulled.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(pulled, top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := partial.ConfigLayer(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range baseLayers {
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mountable[h.String()] = true
+	}
+
+	// Blobs is covered by TestWriteSummaryBlobs.
+	ignoreBlobs := cmpopts.IgnoreFields(WriteSummary{}, "Blobs")
+	var got WriteSummary
+	ref := mustNewTag(t, fmt.Sprintf("%s/summary/app:latest", u.Host))
+	if err := Write(ref, img, WithWriteSummary(func(s WriteSummary) {
+		got = s
+	})); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	// Base layers are mounted, and only the top layer and config are uploaded.
+	want := WriteSummary{
+		BytesUploaded: size(top) + size(cfg),
+		BytesMounted:  size(baseLayers[0]) + size(baseLayers[1]),
+		BlobsUploaded: 2,
+		BlobsMounted:  2,
+		TagsUpdated:   1,
+	}
+	if diff := cmp.Diff(want, got, ignoreBlobs); diff != "" {
+		t.Errorf("WriteSummary (-want +got) = %s", diff)
+	}
+
+	// Writing again uploads nothing, and doesn't move the tag.
+	atomic.StoreInt32(&first, 0)
+	if err := Write(ref, img, WithWriteSummary(func(s WriteSummary) {
+		got = s
+	})); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	want = WriteSummary{
+		BytesExisting: want.BytesUploaded + want.BytesMounted,
+		BlobsExisting: 4,
+		TagsUnchanged: 1,
+	}
+	if diff := cmp.Diff(want, got, ignoreBlobs); diff != "" {
+		t.Errorf("WriteSummary (-want +got) = %s", diff)
+	}
+
+	// Writing a different image to the same tag moves it.
+	if err := Write(ref, base, WithWriteSummary(func(s WriteSummary) {
+		got = s
+	})); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if got.TagsUpdated != 1 || got.TagsUnchanged != 0 {
+		t.Errorf("TagsUpdated, TagsUnchanged = %d, %d; want 1, 0", got.TagsUpdated, got.TagsUnchanged)
+	}
+}
+
+func TestWriteSummaryTagHeadFails(t *testing.T) {
+	// A registry that only lets us push, not read manifests.
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/manifests/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got WriteSummary
+	ref := mustNewTag(t, fmt.Sprintf("%s/summary/app:latest", u.Host))
+	if err := Write(ref, img, WithWriteSummary(func(s WriteSummary) {
+		got = s
+	})); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if got.TagsUpdated != 1 || got.TagsUnchanged != 0 {
+		t.Errorf("TagsUpdated, TagsUnchanged = %d, %d; want 1, 0", got.TagsUpdated, got.TagsUnchanged)
+	}
+}
+
+// outOfOrderChunks wraps a registry to accept chunks in any order, assembling
+// them before the upload is committed.
+type outOfOrderChunks struct {
+	http.Handler
+
+	mu      sync.Mutex
+	chunks  map[string]map[int64][]byte
+	patches int
+	t       *testing.T
+}
+
+func (h *outOfOrderChunks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.URL.Path, "/blobs/uploads/") || (r.Method == http.MethodPatch && r.Header.Get("Content-Range") == "") {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPatch:
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil {
+			h.t.Errorf("bad Content-Range: %v", err)
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			h.t.Error(err)
+		}
+		if int64(len(b)) != end-start+1 {
+			h.t.Errorf("chunk %d-%d has %d bytes", start, end, len(b))
+		}
+		h.mu.Lock()
+		if h.chunks[r.URL.Path] == nil {
+			h.chunks[r.URL.Path] = map[int64][]byte{}
+		}
+		h.chunks[r.URL.Path][start] = b
+		h.patches++
+		h.mu.Unlock()
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case http.MethodPut:
+		// Reassemble the chunks and forward them to the registry in one go.
+		h.mu.Lock()
+		chunks := h.chunks[r.URL.Path]
+		h.mu.Unlock()
+		if chunks != nil {
+			var buf bytes.Buffer
+			for len(chunks) > 0 {
+				b, ok := chunks[int64(buf.Len())]
+				if !ok {
+					h.t.Errorf("missing chunk at offset %d", buf.Len())
+					break
+				}
+				delete(chunks, int64(buf.Len()))
+				buf.Write(b)
+			}
+			req := httptest.NewRequest(http.MethodPatch, r.URL.Path, &buf)
+			rec := httptest.NewRecorder()
+			h.Handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNoContent {
+				h.t.Errorf("forwarding chunks: %d", rec.Code)
+			}
+		}
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestWriteParallelChunks(t *testing.T) {
+	defer func(size int64) {
+		parallelChunkSize = size
+	}(parallelChunkSize)
+	parallelChunkSize = 1000
+
+	for _, tc := range []struct {
+		name    string
+		handler func(t *testing.T) http.Handler
+	}{{
+		name: "out of order",
+		handler: func(t *testing.T) http.Handler {
+			return &outOfOrderChunks{
+				Handler: registry.New(),
+				chunks:  map[string]map[int64][]byte{},
+				t:       t,
+			}
+		},
+	}, {
+		// The fake registry requires chunks to be sent in order, so delay
+		// the first chunk to force a fallback to uploading sequentially.
+		name: "sequential",
+		handler: func(t *testing.T) http.Handler {
+			reg := registry.New()
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.Header.Get("Content-Range"), "0-") {
+					time.Sleep(50 * time.Millisecond)
+				}
+				reg.ServeHTTP(w, r)
+			})
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := tc.handler(t)
+			s := httptest.NewServer(h)
+			defer s.Close()
+			u, err := url.Parse(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			img, err := random.Image(10*parallelChunkSize, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tag := mustNewTag(t, fmt.Sprintf("%s/write/chunks:latest", u.Host))
+			if err := Write(tag, img, WithParallelChunks(4)); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+
+			if ooo, ok := h.(*outOfOrderChunks); ok && ooo.patches < 20 {
+				t.Errorf("got %d PATCHes, want at least 20", ooo.patches)
+			}
+
+			got, err := Image(tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := validate.Image(got); err != nil {
+				t.Errorf("validate.Image() = %v", err)
+			}
+		})
+	}
+
+	if _, err := makeOptions(name.MustParseReference("example.com/repo").Context(), WithParallelChunks(0)); err == nil {
+		t.Error("WithParallelChunks(0) succeeded, want error")
+	}
+}
+
+func TestWriteChunkSize(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		sizes []int64
+	)
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			var start, end int64
+			if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil {
+				t.Errorf("bad Content-Range %q", r.Header.Get("Content-Range"))
+			}
+			mu.Lock()
+			sizes = append(sizes, end-start+1)
+			mu.Unlock()
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		sizer ChunkSizer
+		// want are the sizes of the first chunks.
+		want []int64
+	}{{
+		name:  "fixed",
+		sizer: FixedChunkSize(1000),
+		want:  []int64{1000, 1000, 1000, 1000},
+	}, {
+		name:  "func",
+		sizer: ChunkSizerFunc(func(ChunkResult) int64 { return 3000 }),
+		want:  []int64{3000, 3000},
+	}, {
+		// Chunks sent to a local registry are fast, so they keep growing.
+		name:  "adaptive",
+		sizer: AdaptiveChunkSize(1000, 8000),
+		want:  []int64{1000, 2000, 4000, 8000, 8000},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			sizes = nil
+			l, err := random.Layer(50000, types.DockerLayer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Computing the digest up front means the layer is uploaded in
+			// chunks, rather than compressed as it's streamed.
+			h, err := l.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo, err := name.NewRepository(fmt.Sprintf("%s/write/chunk/%s", u.Host, tc.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteLayer(repo, l, WithChunkSize(tc.sizer)); err != nil {
+				t.Fatalf("WriteLayer() = %v", err)
+			}
+			if len(sizes) < len(tc.want) {
+				t.Fatalf("got %d PATCHes, want at least %d", len(sizes), len(tc.want))
+			}
+			if diff := cmp.Diff(tc.want, sizes[:len(tc.want)]); diff != "" {
+				t.Errorf("chunk sizes (-want +got) = %s", diff)
+			}
+
+			got, err := Layer(repo.Digest(h.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := validate.Layer(got); err != nil {
+				t.Errorf("validate.Layer() = %v", err)
+			}
+		})
+	}
+
+	adaptive := AdaptiveChunkSize(1000, 8000)
+	for _, r := range []ChunkResult{{}, {Size: 1000, Duration: time.Millisecond}, {Size: 2000, Duration: time.Millisecond}} {
+		adaptive.Next(r)
+	}
+	if got := adaptive.Next(ChunkResult{Size: 4000, Err: errors.New("broken pipe")}); got != 2000 {
+		t.Errorf("Next() after a failed chunk = %d, want 2000", got)
+	}
+	if got := adaptive.Next(ChunkResult{Size: 2000, Duration: time.Minute}); got != 1000 {
+		t.Errorf("Next() after a slow chunk = %d, want 1000", got)
+	}
+
+	ref := name.MustParseReference("example.com/repo").Context()
+	for _, s := range []ChunkSizer{nil, FixedChunkSize(0), AdaptiveChunkSize(0, 10), AdaptiveChunkSize(10, 5)} {
+		if _, err := makeOptions(ref, WithChunkSize(s)); err == nil {
+			t.Errorf("WithChunkSize(%v) succeeded, want error", s)
+		}
+	}
+}
+
+func TestWriteWithDigest(t *testing.T) {
+	img := setupImage(t)
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		rejectDigests bool
+	}{{
+		name: "put by digest",
+	}, {
+		name:          "verify",
+		rejectDigests: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := registry.New()
+			var digestPuts int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/manifests/"+h.String()) {
+					atomic.AddInt32(&digestPuts, 1)
+					if tc.rejectDigests {
+						w.WriteHeader(http.StatusMethodNotAllowed)
+						return
+					}
+				}
+				reg.ServeHTTP(w, r)
+			}))
+			defer s.Close()
+			u, err := url.Parse(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tag := mustNewTag(t, fmt.Sprintf("%s/write/digest:latest", u.Host))
+
+			got, err := WriteWithDigest(tag, img)
+			if err != nil {
+				t.Fatalf("WriteWithDigest() = %v", err)
+			}
+			if want := tag.Context().Digest(h.String()); got != want {
+				t.Errorf("WriteWithDigest() = %v, want %v", got, want)
+			}
+			if n := atomic.LoadInt32(&digestPuts); n != 1 {
+				t.Errorf("got %d PUTs by digest, want 1", n)
+			}
+			if _, err := Head(got); err != nil {
+				t.Errorf("Head(%v) = %v", got, err)
+			}
+		})
+	}
+}
+
+func TestWriteIndexTooLarge(t *testing.T) {
+	idx, err := random.Index(1024, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := idx.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a proxy in front of the registry that limits request bodies
+	// to less than the size of the index.
+	limit := int64(len(raw) - 1)
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := mustNewTag(t, fmt.Sprintf("%s/write/index:large", u.Host))
+
+	err = WriteIndex(tag, idx)
+	var tooLarge *ErrManifestTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("WriteIndex() = %v, want ErrManifestTooLarge", err)
+	}
+	if got, want := tooLarge.Size, int64(len(raw)); got != want {
+		t.Errorf("Size = %d, want %d", got, want)
+	}
+	if got, want := tooLarge.Reference.String(), tag.String(); got != want {
+		t.Errorf("Reference = %s, want %s", got, want)
+	}
+	var terr *transport.Error
+	if !errors.As(err, &terr) || terr.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("WriteIndex() = %v, want to wrap a 413 transport.Error", err)
+	}
+}
+
 func TestDockerhubScopes(t *testing.T) {
 	src, err := name.ParseReference("busybox")
 	if err != nil {
@@ -1471,34 +2077,237 @@ func TestWriteForeignLayerIfOptionSet(t *testing.T) {
 	}
 }
 
-func TestTag(t *testing.T) {
-	idx := setupIndex(t, 3)
-	// Set up a fake registry.
-	s := httptest.NewServer(registry.New())
-	defer s.Close()
-	u, err := url.Parse(s.URL)
+func TestWriteForeignLayerURLs(t *testing.T) {
+	base, err := random.Layer(1024, types.DockerLayer)
 	if err != nil {
 		t.Fatal(err)
 	}
-	src := fmt.Sprintf("%s/test/tag:src", u.Host)
-	srcRef, err := name.NewTag(src)
+	app, err := random.Layer(1024, types.DockerLayer)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if err := WriteIndex(srcRef, idx); err != nil {
+	img, err := mutate.AppendLayers(empty.Image, base, app)
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	dst := fmt.Sprintf("%s/test/tag:dst", u.Host)
-	dstRef, err := name.NewTag(dst)
+	baseDigest, err := base.Digest()
 	if err != nil {
 		t.Fatal(err)
 	}
+	urls := []string{"https://mcr.example.com/blobs/" + baseDigest.String()}
 
-	if err := Tag(dstRef, idx); err != nil {
-		t.Fatal(err)
-	}
+	reg := registry.New()
+	var foreignRequests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), baseDigest.Hex) {
+			atomic.AddInt32(&foreignRequests, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/windows:latest", u.Host))
+
+	// Even with WithNondistributable, the foreign blob isn't touched.
+	if err := Write(dst, img, WithForeignLayerURLs(map[v1.Hash][]string{baseDigest: urls}), WithNondistributable); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if n := atomic.LoadInt32(&foreignRequests); n != 0 {
+		t.Errorf("got %d requests for the foreign layer, want 0", n)
+	}
+
+	got, err := Image(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := got.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 2 {
+		t.Fatalf("got %d layers, want 2", len(m.Layers))
+	}
+	if diff := cmp.Diff(urls, m.Layers[0].URLs); diff != "" {
+		t.Errorf("foreign layer URLs (-want +got) = %s", diff)
+	}
+	if m.Layers[0].MediaType != types.DockerForeignLayer {
+		t.Errorf("foreign layer MediaType = %s, want %s", m.Layers[0].MediaType, types.DockerForeignLayer)
+	}
+	if m.Layers[1].URLs != nil || m.Layers[1].MediaType != types.DockerLayer {
+		t.Errorf("other layer = %+v, want it unchanged", m.Layers[1])
+	}
+
+	if err := Write(dst, img, WithForeignLayerURLs(map[v1.Hash][]string{baseDigest: nil})); err == nil {
+		t.Error("Write() with empty URLs = nil, expected error")
+	}
+}
+
+func TestWriteUncompressedSizeAnnotation(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	base, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotated, err := random.Layer(2048, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.Append(base, mutate.Addendum{
+		Layer:       annotated,
+		Annotations: map[string]string{"foo": "bar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(dst, img, WithUncompressedSizeAnnotation()); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	got, err := Image(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := got.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range ls {
+		want, err := uncompressedSize(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := m.Layers[i].Annotations[UncompressedSizeAnnotation]; a != fmt.Sprint(want) {
+			t.Errorf("layer %d: %s = %q, want %d", i, UncompressedSizeAnnotation, a, want)
+		}
+	}
+	if a := m.Layers[3].Annotations["foo"]; a != "bar" {
+		t.Errorf("existing annotation foo = %q, want bar", a)
+	}
+}
+
+func TestWriteUncompressedSizeAnnotationMount(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		mounts []string
+	)
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The registry shares blobs between repositories, so hide them from
+		// dst to make the writer mount them.
+		if r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/v2/dst/blobs/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPost && r.URL.Query().Get("mount") != "" {
+			mu.Lock()
+			mounts = append(mounts, r.URL.Query().Get("mount"))
+			mu.Unlock()
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := mustNewTag(t, fmt.Sprintf("%s/src:latest", u.Host))
+	dst := mustNewTag(t, fmt.Sprintf("%s/dst:latest", u.Host))
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(src, img); err != nil {
+		t.Fatal(err)
+	}
+	// The layers of a remote image are mountable into other repositories.
+	rimg, err := Image(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts = nil
+	if err := Write(dst, rimg, WithUncompressedSizeAnnotation()); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range m.Layers {
+		found := false
+		for _, h := range mounts {
+			found = found || h == l.Digest.String()
+		}
+		if !found {
+			t.Errorf("layer %s wasn't mounted, mounts = %v", l.Digest, mounts)
+		}
+	}
+	got, err := Image(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gm, err := got.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range gm.Layers {
+		if l.Annotations[UncompressedSizeAnnotation] == "" {
+			t.Errorf("layer %d isn't annotated", i)
+		}
+	}
+
+	sl := stream.NewLayer(ioutil.NopCloser(strings.NewReader("streamed")))
+	simg, err := mutate.AppendLayers(img, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(dst, simg, WithUncompressedSizeAnnotation()); err == nil {
+		t.Error("Write() with a stream.Layer = nil, expected error")
+	}
+}
+
+func TestTag(t *testing.T) {
+	idx := setupIndex(t, 3)
+	// Set up a fake registry.
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := fmt.Sprintf("%s/test/tag:src", u.Host)
+	srcRef, err := name.NewTag(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteIndex(srcRef, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := fmt.Sprintf("%s/test/tag:dst", u.Host)
+	dstRef, err := name.NewTag(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Tag(dstRef, idx); err != nil {
+		t.Fatal(err)
+	}
 
 	got, err := Index(dstRef)
 	if err != nil {
@@ -1643,3 +2452,1379 @@ func BenchmarkWrite(b *testing.B) {
 		}
 	}
 }
+
+func TestWriteWithScopes(t *testing.T) {
+	extra := "repository:src:pull"
+	for _, tc := range []struct {
+		name    string
+		options []Option
+		reauth  bool
+	}{{
+		name:   "default scopes",
+		reauth: true,
+	}, {
+		name:    "with scopes",
+		options: []Option{WithScopes([]string{extra})},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var tokens int32
+			reg := registry.New()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				challenge := fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host)
+				switch {
+				case r.URL.Path == "/v2/":
+					w.Header().Set("WWW-Authenticate", challenge)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				case r.URL.Path == "/token":
+					atomic.AddInt32(&tokens, 1)
+					// The token is just the scopes it was granted.
+					token := url.QueryEscape(strings.Join(r.URL.Query()["scope"], " "))
+					fmt.Fprintf(w, `{"token": %q}`, token)
+					return
+				}
+				granted, err := url.QueryUnescape(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Pretend that this registry wants pull access to src before it
+				// will tell us whether blobs exist in dst.
+				if r.Method == http.MethodHead && !strings.Contains(granted, extra) {
+					w.Header().Set("WWW-Authenticate", challenge+fmt.Sprintf(`,scope=%q`, extra))
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				reg.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+			u, err := url.Parse(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			img, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := mustNewTag(t, fmt.Sprintf("%s/dst:latest", u.Host))
+			if err := Write(dst, img, tc.options...); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			got := atomic.LoadInt32(&tokens)
+			if tc.reauth && got < 2 {
+				t.Errorf("token requests = %d, expected re-authentication", got)
+			} else if !tc.reauth && got != 1 {
+				t.Errorf("token requests = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestWriteWithLayerTransform(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDiffIDs, err := partial.DiffIDs(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recompress := func(l v1.Layer) (v1.Layer, error) {
+		return tarball.LayerFromOpener(l.Uncompressed, tarball.WithCompressionLevel(gzip.NoCompression))
+	}
+	if err := Write(dst, img, WithLayerTransform(recompress)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	got, err := Image(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Errorf("validate.Image() = %v", err)
+	}
+	gotDiffIDs, err := partial.DiffIDs(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantDiffIDs, gotDiffIDs); diff != "" {
+		t.Errorf("DiffIDs (-want +got) = %s", diff)
+	}
+
+	wantLayers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotLayers, err := got.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range wantLayers {
+		want, err := wantLayers[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := gotLayers[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == got {
+			t.Errorf("layer %d digest unchanged: %s", i, got)
+		}
+	}
+
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: img})
+	if err := WriteIndex(dst, idx, WithLayerTransform(recompress)); err == nil {
+		t.Error("WriteIndex() = nil, expected error")
+	}
+}
+
+func TestWriteWithDigestLayerTransform(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:digest", u.Host))
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recompress := func(l v1.Layer) (v1.Layer, error) {
+		return tarball.LayerFromOpener(l.Uncompressed, tarball.WithCompressionLevel(gzip.NoCompression))
+	}
+	dig, err := WriteWithDigest(dst, img, WithLayerTransform(recompress))
+	if err != nil {
+		t.Fatalf("WriteWithDigest() = %v", err)
+	}
+	if dig.DigestStr() == orig.String() {
+		t.Errorf("WriteWithDigest() = %v, the digest of the untransformed image", dig)
+	}
+
+	// The digest is what the tag points at, and all its blobs were pushed.
+	desc, err := Head(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest.String() != dig.DigestStr() {
+		t.Errorf("tag points at %v, want %v", desc.Digest, dig.DigestStr())
+	}
+	got, err := Image(dig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Errorf("validate.Image() = %v", err)
+	}
+}
+
+func TestWriteManifestFromDescriptors(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := partial.ConfigLayer(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range append(ls, cl) {
+		if err := WriteLayer(dst.Context(), l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Referencing a blob that wasn't uploaded should fail without writing.
+	missing := v1.Descriptor{
+		MediaType: types.DockerLayer,
+		Size:      1,
+		Digest:    v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)},
+	}
+	if _, err := WriteManifestFromDescriptors(dst, m.Config, append(m.Layers, missing)); err == nil {
+		t.Error("WriteManifestFromDescriptors() = nil, expected missing blob")
+	}
+	if _, err := Head(dst); err == nil {
+		t.Error("Head() = nil, expected manifest not to be written")
+	}
+
+	h, err := WriteManifestFromDescriptors(dst, m.Config, m.Layers)
+	if err != nil {
+		t.Fatalf("WriteManifestFromDescriptors() = %v", err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != want {
+		t.Errorf("WriteManifestFromDescriptors() = %s, want %s", h, want)
+	}
+	got, err := Image(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Errorf("validate.Image() = %v", err)
+	}
+}
+
+func TestWriteMaxConcurrentRequests(t *testing.T) {
+	const max = 2
+	reg := registry.New()
+	var inflight, peak int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		// Give other requests a chance to pile up.
+		time.Sleep(5 * time.Millisecond)
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	img, err := random.Image(1024, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(dst, img, WithJobs(8), WithMaxConcurrentRequests(max)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if got := atomic.LoadInt32(&peak); got > max {
+		t.Errorf("peak concurrent requests = %d, want <= %d", got, max)
+	}
+
+	if _, err := Image(dst, WithMaxConcurrentRequests(0)); err == nil {
+		t.Error("WithMaxConcurrentRequests(0) = nil, expected error")
+	}
+}
+
+func TestWriteLegacySchema1(t *testing.T) {
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") &&
+			r.Header.Get("Content-Type") != string(types.DockerManifestSchema1Signed) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":[{"code":"MANIFEST_INVALID","message":"manifest invalid"}]}`))
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(dst, img); err == nil {
+		t.Fatal("Write() without WithLegacySchema1 = nil, expected error")
+	}
+	if err := Write(dst, img, WithLegacySchema1()); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := Write(dst.Digest("sha256:"+strings.Repeat("a", 64)), img, WithLegacySchema1()); err == nil {
+		t.Error("Write() by digest with WithLegacySchema1 = nil, expected error")
+	}
+
+	desc, err := Get(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.MediaType != types.DockerManifestSchema1Signed {
+		t.Errorf("MediaType = %s, want %s", desc.MediaType, types.DockerManifestSchema1Signed)
+	}
+
+	var got struct {
+		schema1Manifest
+		Signatures []jwsSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(desc.Manifest, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "repo" || got.Tag != "latest" {
+		t.Errorf("name:tag = %s:%s, want repo:latest", got.Name, got.Tag)
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.FSLayers) != len(ls) || len(got.History) != len(ls) {
+		t.Fatalf("got %d fsLayers and %d history, want %d", len(got.FSLayers), len(got.History), len(ls))
+	}
+	for i, l := range ls {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := got.FSLayers[len(ls)-1-i].BlobSum; d != want {
+			t.Errorf("fsLayers[%d] = %s, want %s", len(ls)-1-i, want, d)
+		}
+	}
+
+	if len(got.Signatures) != 1 {
+		t.Fatalf("got %d signatures, want 1", len(got.Signatures))
+	}
+	sig := got.Signatures[0]
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var protected jwsProtected
+	if err := json.Unmarshal(decode(sig.Protected), &protected); err != nil {
+		t.Fatal(err)
+	}
+	payload := append(desc.Manifest[:protected.FormatLength:protected.FormatLength], decode(protected.FormatTail)...)
+	key := ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(decode(sig.Header.JWK.X)),
+		Y:     new(big.Int).SetBytes(decode(sig.Header.JWK.Y)),
+	}
+	sum := sha256.Sum256([]byte(sig.Protected + "." + base64.RawURLEncoding.EncodeToString(payload)))
+	rs := decode(sig.Signature)
+	if !ecdsa.Verify(&key, sum[:], new(big.Int).SetBytes(rs[:32]), new(big.Int).SetBytes(rs[32:])) {
+		t.Error("schema 1 signature does not verify")
+	}
+}
+
+func TestCopyBlob(t *testing.T) {
+	var mounts, blobGets int32
+	newRegistry := func(fakeMount bool) (*httptest.Server, string) {
+		reg := registry.New()
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The in-memory registry shares blobs between repositories and
+			// doesn't implement mounting, so fake both for dst.
+			if fakeMount && r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/v2/dst/blobs/") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if q := r.URL.Query(); fakeMount && r.Method == http.MethodPost && q.Get("mount") != "" && q.Get("origin") == r.Host {
+				atomic.AddInt32(&mounts, 1)
+				w.Header().Set("Location", "/v2/dst/blobs/"+q.Get("mount"))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+				atomic.AddInt32(&blobGets, 1)
+			}
+			reg.ServeHTTP(w, r)
+		}))
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, u.Host
+	}
+	s1, host1 := newRegistry(true)
+	defer s1.Close()
+	s2, host2 := newRegistry(false)
+	defer s2.Close()
+
+	l, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := partial.Descriptor(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcRepo, err := name.NewRepository(host1 + "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLayer(srcRepo, l); err != nil {
+		t.Fatal(err)
+	}
+	src := srcRepo.Digest(want.Digest.String())
+
+	for _, tc := range []struct {
+		desc     string
+		dst      string
+		mounts   int32
+		blobGets int32
+	}{{
+		desc:   "same registry mounts",
+		dst:    host1 + "/dst",
+		mounts: 1,
+	}, {
+		desc:     "other registry streams",
+		dst:      host2 + "/dst",
+		blobGets: 1,
+	}, {
+		desc: "already present",
+		dst:  host2 + "/dst",
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			atomic.StoreInt32(&mounts, 0)
+			atomic.StoreInt32(&blobGets, 0)
+			dst, err := name.NewRepository(tc.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := CopyBlob(src, dst)
+			if err != nil {
+				t.Fatalf("CopyBlob() = %v", err)
+			}
+			if got.Digest != want.Digest || got.Size != want.Size {
+				t.Errorf("CopyBlob() = %s (%d bytes), want %s (%d bytes)", got.Digest, got.Size, want.Digest, want.Size)
+			}
+			if n := atomic.LoadInt32(&mounts); n != tc.mounts {
+				t.Errorf("got %d mounts, want %d", n, tc.mounts)
+			}
+			if n := atomic.LoadInt32(&blobGets); n != tc.blobGets {
+				t.Errorf("got %d blob GETs, want %d", n, tc.blobGets)
+			}
+		})
+	}
+
+	missing := srcRepo.Digest("sha256:" + strings.Repeat("a", 64))
+	if _, err := CopyBlob(missing, mustNewTag(t, host2+"/dst:latest").Context()); err == nil {
+		t.Error("CopyBlob() of missing blob = nil, expected error")
+	}
+}
+
+// rawIndex overrides the manifest of an index, keeping its children.
+type rawIndex struct {
+	base     v1.ImageIndex
+	manifest *v1.IndexManifest
+}
+
+func (i *rawIndex) MediaType() (types.MediaType, error)         { return i.manifest.MediaType, nil }
+func (i *rawIndex) IndexManifest() (*v1.IndexManifest, error)   { return i.manifest, nil }
+func (i *rawIndex) RawManifest() ([]byte, error)                { return json.Marshal(i.manifest) }
+func (i *rawIndex) Digest() (v1.Hash, error)                    { return partial.Digest(i) }
+func (i *rawIndex) Size() (int64, error)                        { return partial.Size(i) }
+func (i *rawIndex) Image(h v1.Hash) (v1.Image, error)           { return i.base.Image(h) }
+func (i *rawIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) { return i.base.ImageIndex(h) }
+
+func TestWriteIndexArtifactType(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjectRef := mustNewTag(t, fmt.Sprintf("%s/repo:subject", u.Host))
+	if err := Write(subjectRef, subject); err != nil {
+		t.Fatal(err)
+	}
+	subjectDesc, err := partial.Descriptor(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attestation, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := mutate.IndexMediaType(mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: attestation}), types.OCIImageIndex)
+	m, err := base.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = m.DeepCopy()
+	m.ArtifactType = "application/vnd.example.attestations"
+	m.Subject = subjectDesc
+	idx := &rawIndex{base: base, manifest: m}
+
+	ref := mustNewTag(t, fmt.Sprintf("%s/repo:attestations", u.Host))
+	if err := WriteIndex(ref, idx); err != nil {
+		t.Fatalf("WriteIndex() = %v", err)
+	}
+
+	desc, err := Get(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, err := idx.Digest(); err != nil {
+		t.Fatal(err)
+	} else if desc.Digest != want {
+		t.Errorf("Digest = %s, want %s", desc.Digest, want)
+	}
+	got, err := desc.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotManifest, err := got.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotManifest.ArtifactType != m.ArtifactType {
+		t.Errorf("ArtifactType = %q, want %q", gotManifest.ArtifactType, m.ArtifactType)
+	}
+	if diff := cmp.Diff(m.Subject, gotManifest.Subject); diff != "" {
+		t.Errorf("Subject (-want +got) = %s", diff)
+	}
+
+	// The fields survive mutation, too.
+	mutated, err := mutate.Annotations(got, map[string]string{"foo": "bar"}).(v1.ImageIndex).IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutated.ArtifactType != m.ArtifactType || mutated.Subject == nil {
+		t.Errorf("mutate.Annotations() dropped artifactType or subject: %+v", mutated)
+	}
+}
+
+func TestWriteTransferCancel(t *testing.T) {
+	img, err := random.Image(1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := ls[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the upload of target until its request is canceled.
+	reg := registry.New()
+	stalled := make(chan struct{})
+	var once sync.Once
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if h, _, _ := v1.SHA256(bytes.NewReader(b)); h == target {
+				once.Do(func() { close(stalled) })
+				<-r.Context().Done()
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+
+	var mu sync.Mutex
+	cancels := map[v1.Hash]context.CancelFunc{}
+	go func() {
+		<-stalled
+		mu.Lock()
+		defer mu.Unlock()
+		cancels[target]()
+	}()
+
+	err = Write(dst, img, WithTransferCancel(func(h v1.Hash, cancel context.CancelFunc) {
+		mu.Lock()
+		defer mu.Unlock()
+		cancels[h] = cancel
+	}))
+	var cerr *ErrTransferCanceled
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Write() = %v, want ErrTransferCanceled", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("errors.Is(%v, context.Canceled) = false", err)
+	}
+	if diff := cmp.Diff([]v1.Hash{target}, cerr.Digests); diff != "" {
+		t.Errorf("Digests (-want +got) = %s", diff)
+	}
+
+	// The other layers were still uploaded, but the manifest wasn't.
+	for i, l := range ls {
+		if i == 1 {
+			continue
+		}
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl, err := Layer(dst.Context().Digest(h.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := partial.Exists(rl); err != nil || !ok {
+			t.Errorf("layer %d: Exists() = %t, %v", i, ok, err)
+		}
+	}
+	if _, err := Head(dst); err == nil {
+		t.Error("Head() = nil, expected the manifest not to be written")
+	}
+}
+
+// oneShotLayer is an UncompressedLayer backed by a reader that can only be
+// read once.
+type oneShotLayer struct {
+	diffID v1.Hash
+	rc     io.ReadCloser
+	opened int
+}
+
+func (l *oneShotLayer) DiffID() (v1.Hash, error) { return l.diffID, nil }
+
+func (l *oneShotLayer) MediaType() (types.MediaType, error) { return types.DockerLayer, nil }
+
+func (l *oneShotLayer) Uncompressed() (io.ReadCloser, error) {
+	l.opened++
+	if l.opened > 1 {
+		return nil, errors.New("already read")
+	}
+	return l.rc, nil
+}
+
+func TestWriteUncompressedLayer(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	contents := bytes.Repeat([]byte("hello "), 1024)
+	if err := tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID, _, err := v1.SHA256(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository(fmt.Sprintf("%s/repo", u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ul := &oneShotLayer{diffID: diffID, rc: ioutil.NopCloser(&buf)}
+	l, err := partial.UncompressedToLayer(ul)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial.NeedsCompression(l) {
+		t.Fatal("NeedsCompression() = false before the layer was read")
+	}
+	if err := WriteLayer(repo, l); err != nil {
+		t.Fatalf("WriteLayer() = %v", err)
+	}
+	if ul.opened != 1 {
+		t.Errorf("layer was read %d times, want 1", ul.opened)
+	}
+
+	// The digest was computed while uploading.
+	if partial.NeedsCompression(l) {
+		t.Error("NeedsCompression() = true after the layer was uploaded")
+	}
+	h, err := l.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	got, err := Layer(repo.Digest(h.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Layer(got); err != nil {
+		t.Errorf("validate.Layer() = %v", err)
+	}
+	if gotDiffID, err := got.DiffID(); err != nil {
+		t.Fatal(err)
+	} else if gotDiffID != diffID {
+		t.Errorf("DiffID() = %s, want %s", gotDiffID, diffID)
+	}
+	size, err := l.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotSize, err := got.Size(); err != nil {
+		t.Fatal(err)
+	} else if gotSize != size {
+		t.Errorf("Size() = %d, want %d", gotSize, size)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyPutTransport fails the first manifest PUT with a temporary error.
+type flakyPutTransport struct {
+	inner http.RoundTripper
+	puts  int32
+}
+
+func (t *flakyPutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/manifests/") {
+		if atomic.AddInt32(&t.puts, 1) == 1 {
+			return nil, temporaryError{}
+		}
+	}
+	return t.inner.RoundTrip(req)
+}
+
+func TestWriteDoesNotRetryPutsBlindly(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host))
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Disable Write's own retries, so that only the transport could retry.
+	noRetries := WithRetryBackoff(Backoff{Steps: 1})
+
+	tr := &flakyPutTransport{inner: http.DefaultTransport}
+	if err := Write(ref, img, WithTransport(tr), noRetries); err == nil {
+		t.Error("Write() = nil, expected the failed PUT not to be retried")
+	}
+	if got := atomic.LoadInt32(&tr.puts); got != 1 {
+		t.Errorf("manifest was PUT %d times, want 1", got)
+	}
+
+	tr = &flakyPutTransport{inner: http.DefaultTransport}
+	if err := Write(ref, img, WithTransport(tr), noRetries, WithMethodRetryBackoff(http.MethodPut, Backoff{Steps: 2})); err != nil {
+		t.Errorf("Write() = %v", err)
+	}
+	if got := atomic.LoadInt32(&tr.puts); got != 2 {
+		t.Errorf("manifest was PUT %d times, want 2", got)
+	}
+}
+
+func TestWriteBlobDigestMode(t *testing.T) {
+	// headerOnly wraps a registry that rejects the digest in the query and
+	// requires it in a Docker-Content-Digest header instead.
+	headerOnly := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/") {
+				q := r.URL.Query()
+				digest := r.Header.Get("Docker-Content-Digest")
+				if q.Get("digest") != "" || digest == "" {
+					http.Error(w, `{"errors":[{"code":"DIGEST_INVALID"}]}`, http.StatusBadRequest)
+					return
+				}
+				q.Set("digest", digest)
+				r.URL.RawQuery = q.Encode()
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	for _, tc := range []struct {
+		desc       string
+		headerOnly bool
+		mode       BlobDigestMode
+		wantErr    bool
+		wantPuts   int32
+	}{{
+		desc:     "auto, query registry",
+		mode:     BlobDigestAuto,
+		wantPuts: 1,
+	}, {
+		desc:       "auto, header registry",
+		headerOnly: true,
+		mode:       BlobDigestAuto,
+		wantPuts:   2,
+	}, {
+		desc:     "query, query registry",
+		mode:     BlobDigestQuery,
+		wantPuts: 1,
+	}, {
+		desc:       "query, header registry",
+		headerOnly: true,
+		mode:       BlobDigestQuery,
+		wantErr:    true,
+		wantPuts:   1,
+	}, {
+		desc:       "header, header registry",
+		headerOnly: true,
+		mode:       BlobDigestHeader,
+		wantPuts:   1,
+	}, {
+		desc:     "header, query registry",
+		mode:     BlobDigestHeader,
+		wantErr:  true,
+		wantPuts: 1,
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var puts int32
+			var h http.Handler = registry.New()
+			if tc.headerOnly {
+				h = headerOnly(h)
+			}
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/") {
+					atomic.AddInt32(&puts, 1)
+				}
+				h.ServeHTTP(w, r)
+			}))
+			defer s.Close()
+			u, err := url.Parse(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := random.Layer(1024, types.DockerLayer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo := mustNewTag(t, fmt.Sprintf("%s/repo:latest", u.Host)).Context()
+
+			err = WriteLayer(repo, l, WithBlobDigestMode(tc.mode))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("WriteLayer() = %v, wanted error: %t", err, tc.wantErr)
+			}
+			if got := atomic.LoadInt32(&puts); got != tc.wantPuts {
+				t.Errorf("blob was PUT %d times, want %d", got, tc.wantPuts)
+			}
+		})
+	}
+
+	if _, err := makeOptions(nil, WithBlobDigestMode(BlobDigestMode(42))); err == nil {
+		t.Error("WithBlobDigestMode(42) = nil")
+	}
+}
+
+func TestWriteSummaryBlobs(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/summary/blobs:latest", u.Host))
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got WriteSummary
+	if err := Write(ref, img, WithWriteSummary(func(s WriteSummary) {
+		got = s
+	})); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]v1.Descriptor{m.Config}, m.Layers...)
+	sort.Slice(want, func(i, j int) bool {
+		return want[i].Digest.String() < want[j].Digest.String()
+	})
+	if diff := cmp.Diff(want, got.Blobs); diff != "" {
+		t.Errorf("Blobs (-want +got) = %s", diff)
+	}
+}
+
+func TestWithBlobWritten(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/written/app:latest", u.Host))
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[v1.Hash]int64{m.Config.Digest: m.Config.Size}
+	for _, l := range m.Layers {
+		want[l.Digest] = l.Size
+	}
+
+	// Blobs are reported whether they're uploaded or already exist.
+	for _, attempt := range []string{"upload", "existing"} {
+		var mu sync.Mutex
+		got := map[v1.Hash]int64{}
+		written := func(desc v1.Descriptor) {
+			mu.Lock()
+			defer mu.Unlock()
+			got[desc.Digest] = desc.Size
+		}
+		if err := Write(ref, img, WithBlobWritten(written)); err != nil {
+			t.Fatalf("%s: Write() = %v", attempt, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s: written blobs (-want +got) = %s", attempt, diff)
+		}
+	}
+}
+
+// emptyConfigArtifact is an OCI artifact whose config is empty.JSON.
+type emptyConfigArtifact struct {
+	layers []v1.Layer
+}
+
+func (a *emptyConfigArtifact) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (a *emptyConfigArtifact) RawConfigFile() ([]byte, error) {
+	return []byte("{}"), nil
+}
+
+func (a *emptyConfigArtifact) RawManifest() ([]byte, error) {
+	m := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config:        empty.JSONDescriptor,
+	}
+	for _, l := range a.layers {
+		desc, err := partial.Descriptor(l)
+		if err != nil {
+			return nil, err
+		}
+		m.Layers = append(m.Layers, *desc)
+	}
+	return json.Marshal(m)
+}
+
+func (a *emptyConfigArtifact) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, l := range append(a.layers, empty.JSON) {
+		if d, err := l.Digest(); err == nil && d == h {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown blob %s", h)
+}
+
+func TestWriteEmptyConfigArtifact(t *testing.T) {
+	var emptyUploads int32
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Query().Get("digest") == empty.JSONDescriptor.Digest.String() {
+			atomic.AddInt32(&emptyUploads, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := partial.Descriptor(empty.JSON); err != nil {
+		t.Fatal(err)
+	} else if diff := cmp.Diff(&empty.JSONDescriptor, d); diff != "" {
+		t.Errorf("empty.JSONDescriptor doesn't describe empty.JSON (-want +got): %s", diff)
+	}
+
+	// An artifact that uses the empty blob as its config and as a layer
+	// only uploads it once.
+	sbom := static.NewLayer([]byte(`{"spdxVersion":"SPDX-2.3"}`), "application/spdx+json")
+	ref := mustNewTag(t, fmt.Sprintf("%s/artifact/sbom:latest", u.Host))
+	img, err := partial.CompressedToImage(&emptyConfigArtifact{layers: []v1.Layer{sbom, empty.JSON}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ref, img); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if got := atomic.LoadInt32(&emptyUploads); got != 1 {
+		t.Errorf("empty blob uploaded %d times, want 1", got)
+	}
+	got, err := Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := got.RawConfigFile(); err != nil {
+		t.Fatal(err)
+	} else if string(cfg) != "{}" {
+		t.Errorf("RawConfigFile() = %q, want {}", cfg)
+	}
+
+	// WriteManifestFromDescriptors uploads the empty blob itself, and writes
+	// an OCI manifest.
+	atomic.StoreInt32(&emptyUploads, 0)
+	sig := mustNewTag(t, fmt.Sprintf("%s/artifact/sig:latest", u.Host))
+	payload := static.NewLayer([]byte(`{"critical":{}}`), "application/vnd.dev.cosign.simplesigning.v1+json")
+	if err := WriteLayer(sig.Context(), payload); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := partial.Descriptor(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteManifestFromDescriptors(sig, empty.JSONDescriptor, []v1.Descriptor{*desc}); err != nil {
+		t.Fatalf("WriteManifestFromDescriptors() = %v", err)
+	}
+	d, err := Get(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.MediaType != types.OCIManifestSchema1 {
+		t.Errorf("manifest media type = %s, want %s", d.MediaType, types.OCIManifestSchema1)
+	}
+	// The fake registry shares blobs between repositories, so the blob
+	// uploaded for the first artifact is found.
+	if got := atomic.LoadInt32(&emptyUploads); got != 0 {
+		t.Errorf("empty blob uploaded %d times, want 0", got)
+	}
+}
+
+func TestWriteManifestMediaType(t *testing.T) {
+	s := httptest.NewServer(registry.New())
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		manifest, config, layer types.MediaType
+	}{
+		{types.DockerManifestSchema2, types.DockerConfigJSON, types.DockerLayer},
+		{types.OCIManifestSchema1, types.OCIConfigJSON, types.OCILayer},
+	} {
+		t.Run(string(tc.manifest), func(t *testing.T) {
+			l, err := random.Layer(1024, tc.layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := mutate.AppendLayers(empty.Image, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img = mutate.ConfigMediaType(img, tc.config)
+			// The manifest declares the other media type, which the
+			// option overrides.
+			other := types.OCIManifestSchema1
+			if tc.manifest == other {
+				other = types.DockerManifestSchema2
+			}
+			img = mutate.MediaType(img, other)
+
+			ref := mustNewTag(t, fmt.Sprintf("%s/media/type:latest", u.Host))
+			dig, err := WriteWithDigest(ref, img, WithManifestMediaType(tc.manifest))
+			if err != nil {
+				t.Fatalf("WriteWithDigest() = %v", err)
+			}
+
+			desc, err := Get(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.MediaType != tc.manifest {
+				t.Errorf("Content-Type = %s, want %s", desc.MediaType, tc.manifest)
+			}
+			if desc.Digest.String() != dig.DigestStr() {
+				t.Errorf("Digest = %s, want %s", desc.Digest, dig.DigestStr())
+			}
+			m, err := v1.ParseManifest(bytes.NewReader(desc.Manifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.MediaType != tc.manifest {
+				t.Errorf("mediaType = %s, want %s", m.MediaType, tc.manifest)
+			}
+
+			// Blobs of the other vendor's media types can't be referenced.
+			if err := Write(ref, img, WithManifestMediaType(other)); err == nil {
+				t.Errorf("Write() with %s = nil, expected error", other)
+			}
+		})
+	}
+
+	if _, err := makeOptions(mustNewTag(t, "example.com/repo").Context(), WithManifestMediaType(types.OCIImageIndex)); err == nil {
+		t.Error("WithManifestMediaType(OCIImageIndex) = nil, expected error")
+	}
+
+	// Rather than silently pushing the manifests as they are, MultiWrite and
+	// WriteIndex refuse the option.
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := random.Index(1024, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mustNewTag(t, fmt.Sprintf("%s/media/type:unsupported", u.Host))
+	opt := WithManifestMediaType(types.OCIManifestSchema1)
+	if err := MultiWrite(map[name.Reference]Taggable{ref: img}, opt); err == nil {
+		t.Error("MultiWrite() with WithManifestMediaType = nil, expected error")
+	}
+	if err := WriteIndex(ref, idx, opt); err == nil {
+		t.Error("WriteIndex() with WithManifestMediaType = nil, expected error")
+	}
+}
+
+func TestWriteIndexRequireComplete(t *testing.T) {
+	amd64, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: amd64,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+		},
+	}, mutate.IndexAddendum{
+		Add: arm64,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: "linux", Architecture: "arm64"},
+		},
+	})
+
+	// The source hides whatever's missing.
+	missing := ""
+	reg := registry.New()
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if missing != "" && strings.HasSuffix(r.URL.Path, missing) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer src.Close()
+	writes := 0
+	dstReg := registry.New()
+	dst := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writes++
+		}
+		dstReg.ServeHTTP(w, r)
+	}))
+	defer dst.Close()
+
+	srcRef := mustNewTag(t, fmt.Sprintf("%s/complete/index:latest", strings.TrimPrefix(src.URL, "http://")))
+	if err := WriteIndex(srcRef, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	arm64Layers, err := arm64.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, err := arm64Layers[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc    string
+		missing v1.Hash
+	}{
+		{"manifest", mustDigest(t, arm64)},
+		{"layer", layerDigest},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			missing, writes = tc.missing.String(), 0
+			idx, err := Index(srcRef)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dstRef := mustNewTag(t, fmt.Sprintf("%s/complete/%s:latest", strings.TrimPrefix(dst.URL, "http://"), tc.desc))
+			err = WriteIndex(dstRef, idx, WithRequireCompleteIndex())
+			if err == nil {
+				t.Fatal("WriteIndex() = nil, expected error")
+			}
+			if !strings.Contains(err.Error(), tc.missing.String()) {
+				t.Errorf("WriteIndex() = %v, expected it to name %s", err, tc.missing)
+			}
+			if writes != 0 {
+				t.Errorf("WriteIndex() made %d writes, expected none", writes)
+			}
+		})
+	}
+
+	missing = ""
+	idx2, err := Index(srcRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstRef := mustNewTag(t, fmt.Sprintf("%s/complete/all:latest", strings.TrimPrefix(dst.URL, "http://")))
+	if err := WriteIndex(dstRef, idx2, WithRequireCompleteIndex()); err != nil {
+		t.Fatalf("WriteIndex() = %v", err)
+	}
+}
+
+func TestWriteManifestConflict(t *testing.T) {
+	reg := registry.New()
+
+	// conflict, if set, handles manifest PUTs that race with another push.
+	var conflict func(w http.ResponseWriter, r *http.Request)
+	puts := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+			puts++
+			if conflict != nil {
+				conflict(w, r)
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respondConflict := func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusConflict)
+	}
+	// pushFirst simulates another push of the same manifest that finishes
+	// just before ours.
+	pushFirst := func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		reg.ServeHTTP(httptest.NewRecorder(), r)
+		respondConflict(w)
+	}
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []Option{WithRetryBackoff(Backoff{Duration: time.Millisecond, Steps: 3})}
+
+	for _, tc := range []struct {
+		name     string
+		conflict func(w http.ResponseWriter, r *http.Request)
+		// existing is already at the tag, if set.
+		existing v1.Image
+		wantErr  bool
+		wantPuts int
+	}{{
+		name:     "identical",
+		conflict: pushFirst,
+		wantPuts: 1,
+	}, {
+		name: "in progress",
+		conflict: func(w http.ResponseWriter, r *http.Request) {
+			if puts == 1 {
+				respondConflict(w)
+				return
+			}
+			reg.ServeHTTP(w, r)
+		},
+		wantPuts: 2,
+	}, {
+		name:     "different",
+		conflict: func(w http.ResponseWriter, r *http.Request) { respondConflict(w) },
+		existing: other,
+		wantErr:  true,
+		wantPuts: 1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tag, err := name.NewTag(fmt.Sprintf("%s/write/conflict:%s", u.Host, strings.ReplaceAll(tc.name, " ", "-")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conflict = nil
+			if tc.existing != nil {
+				if err := Write(tag, tc.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conflict, puts = tc.conflict, 0
+			err = Write(tag, img, opts...)
+			if tc.wantErr {
+				var terr *transport.Error
+				if !errors.As(err, &terr) || terr.StatusCode != http.StatusConflict {
+					t.Errorf("Write() = %v, want conflict", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			if puts != tc.wantPuts {
+				t.Errorf("%d manifest PUTs, want %d", puts, tc.wantPuts)
+			}
+
+			want := img
+			if tc.existing != nil {
+				want = tc.existing
+			}
+			wantDigest, err := want.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conflict = nil
+			desc, err := Head(tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.Digest != wantDigest {
+				t.Errorf("tag points at %v, want %v", desc.Digest, wantDigest)
+			}
+		})
+	}
+}
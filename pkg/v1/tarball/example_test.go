@@ -0,0 +1,74 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball_test
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// upload stands in for an object storage client that consumes a stream, e.g.
+// the Upload method of an S3 multipart uploader. This one just lists the
+// entries of the tarball it receives.
+func upload(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == "manifest.json" {
+			fmt.Println(hdr.Name)
+		} else {
+			fmt.Println("blob")
+		}
+	}
+}
+
+// Write can stream a tarball straight to object storage through an io.Pipe,
+// without writing it to disk first.
+func ExampleWrite_upload() {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tag, err := name.NewTag("example.com/stream:latest")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		// Closing with the result of Write ends the upload, and fails it
+		// if Write failed.
+		pw.CloseWithError(tarball.Write(tag, img, pw))
+	}()
+	if err := upload(pr); err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// blob
+	// blob
+	// manifest.json
+}
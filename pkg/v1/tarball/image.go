@@ -87,6 +87,11 @@ func LoadManifest(opener Opener) (Manifest, error) {
 }
 
 // Image exposes an image from the tarball at the provided path.
+//
+// Tarballs in the format that `docker save` wrote before Docker 1.10, with a
+// repositories file and a directory for each layer but no manifest.json, are
+// supported too. Their image config is made from the metadata of the image's
+// layers, so every layer is read when the image is loaded.
 func Image(opener Opener, tag *name.Tag) (v1.Image, error) {
 	img := &image{
 		opener: opener,
@@ -172,6 +177,10 @@ func (i *image) areLayersCompressed() (bool, error) {
 func (i *image) loadTarDescriptorAndConfig() error {
 	m, err := extractFileFromTar(i.opener, "manifest.json")
 	if err != nil {
+		// Tarballs saved before Docker 1.10 have no manifest.json.
+		if lerr := i.loadLegacy(); !errors.Is(lerr, errNotLegacy) {
+			return lerr
+		}
 		return err
 	}
 	defer m.Close()
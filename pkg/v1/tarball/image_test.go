@@ -15,9 +15,16 @@
 package tarball
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
 	"io/ioutil"
+	"reflect"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/legacy"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/validate"
@@ -57,7 +64,18 @@ func TestNullManifest(t *testing.T) {
 }
 
 func TestNoManifest(t *testing.T) {
+	// no_manifest.tar still has the repositories file and layer directories
+	// of the legacy format, so it loads like a tarball saved by old Docker.
 	img, err := ImageFromPath("testdata/no_manifest.tar", nil)
+	if err != nil {
+		t.Fatalf("Error loading image: %v", err)
+	}
+	if err := validate.Image(img); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	// content.tar is just a layer, with neither.
+	img, err = ImageFromPath("testdata/content.tar", nil)
 	if err == nil {
 		t.Fatalf("Error expected loading image: %v", img)
 	}
@@ -137,3 +155,112 @@ func TestLoadManifest(t *testing.T) {
 		t.Fatalf("get nothing")
 	}
 }
+
+func TestLegacyImage(t *testing.T) {
+	// The layers of a tarball saved by Docker before 1.10, from the bottom
+	// up. The middle one made no changes to the filesystem.
+	layers := []struct {
+		id        string
+		createdBy []string
+		throwaway bool
+	}{
+		{id: "base", createdBy: []string{"/bin/sh", "-c", "#(nop) ADD file:abc in /"}},
+		{id: "env", createdBy: []string{"/bin/sh", "-c", "#(nop) ENV FOO=bar"}, throwaway: true},
+		{id: "top", createdBy: []string{"/bin/sh", "-c", "echo hi > /hi"}},
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(name string, b []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wantDiffIDs []v1.Hash
+	parent := ""
+	for _, l := range layers {
+		cfg := legacy.LayerConfigFile{
+			ID:              l.id,
+			Parent:          parent,
+			Throwaway:       l.throwaway,
+			ContainerConfig: v1.Config{Cmd: l.createdBy},
+		}
+		if l.id == "top" {
+			cfg.Architecture = "amd64"
+			cfg.OS = "linux"
+			cfg.Config = v1.Config{Env: []string{"FOO=bar"}, Cmd: []string{"/bin/sh"}}
+		}
+		b, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(l.id+"/VERSION", []byte("1.0"))
+		write(l.id+"/json", b)
+		if !l.throwaway {
+			var contents bytes.Buffer
+			lw := tar.NewWriter(&contents)
+			b := []byte("contents of " + l.id)
+			if err := lw.WriteHeader(&tar.Header{Name: l.id, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := lw.Write(b); err != nil {
+				t.Fatal(err)
+			}
+			if err := lw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			write(l.id+"/layer.tar", contents.Bytes())
+			diffID, _, err := v1.SHA256(bytes.NewReader(contents.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantDiffIDs = append(wantDiffIDs, diffID)
+		}
+		parent = l.id
+	}
+	write("repositories", []byte(`{"legacy/image":{"latest":"top"}}`))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opener := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+
+	tag, err := name.NewTag("legacy/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []*name.Tag{nil, &tag} {
+		img, err := Image(opener, tag)
+		if err != nil {
+			t.Fatalf("Image() = %v", err)
+		}
+		if err := validate.Image(img); err != nil {
+			t.Errorf("validate.Image() = %v", err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(wantDiffIDs, cfg.RootFS.DiffIDs); diff != "" {
+			t.Errorf("DiffIDs (-want +got) = %s", diff)
+		}
+		if cfg.OS != "linux" || cfg.Architecture != "amd64" || !reflect.DeepEqual(cfg.Config.Env, []string{"FOO=bar"}) {
+			t.Errorf("config wasn't taken from the top layer: %+v", cfg)
+		}
+		if len(cfg.History) != 3 || !cfg.History[1].EmptyLayer || cfg.History[2].CreatedBy != "/bin/sh -c echo hi > /hi" {
+			t.Errorf("History = %+v", cfg.History)
+		}
+	}
+
+	other, err := name.NewTag("legacy/image:other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Image(opener, &other); err == nil {
+		t.Error("Image() with a missing tag = nil, expected error")
+	}
+}
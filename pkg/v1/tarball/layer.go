@@ -41,6 +41,31 @@ type layer struct {
 	annotations        map[string]string
 	estgzopts          []estargz.Option
 	mediaType          types.MediaType
+	recompressed       bool
+	expectedDigest     *v1.Hash
+}
+
+// ErrDigestMismatch is returned by LayerFromOpener when the layer's compressed
+// digest doesn't match the one passed to WithExpectedDigest.
+type ErrDigestMismatch struct {
+	Expected v1.Hash
+	Actual   v1.Hash
+
+	// Recompressed is true if the compressed layer was produced by
+	// compressing an uncompressed tarball (at CompressionLevel), rather than
+	// read verbatim.
+	Recompressed     bool
+	CompressionLevel int
+}
+
+// Error implements error.
+func (e *ErrDigestMismatch) Error() string {
+	if e.Recompressed {
+		// gzip output isn't stable across implementations or levels, so the
+		// only way to reproduce a compressed layer reliably is to keep it.
+		return fmt.Sprintf("compressing layer at level %d produced digest %s, expected %s (use the original compressed tarball to preserve its bytes)", e.CompressionLevel, e.Actual, e.Expected)
+	}
+	return fmt.Sprintf("compressed layer has digest %s, expected %s", e.Actual, e.Expected)
 }
 
 // Descriptor implements partial.withDescriptor.
@@ -105,6 +130,18 @@ func WithMediaType(mt types.MediaType) LayerOption {
 	}
 }
 
+// WithExpectedDigest is a functional option that makes LayerFromOpener return
+// an *ErrDigestMismatch if the layer's compressed digest isn't h, e.g. to
+// check that re-exporting a layer reproduces a known artifact.
+//
+// Compressed tarballs are always used verbatim, so only a mismatch for an
+// uncompressed tarball can be caused by gzip output that isn't reproducible.
+func WithExpectedDigest(h v1.Hash) LayerOption {
+	return func(l *layer) {
+		l.expectedDigest = &h
+	}
+}
+
 // WithCompressedCaching is a functional option that overrides the
 // logic for accessing the compressed bytes to memoize the result
 // and avoid expensive repeated gzips.
@@ -178,6 +215,7 @@ func WithEstargz(l *layer) {
 
 	l.compressedopener = estargz
 	l.uncompressedopener = uncompressed
+	l.recompressed = true
 }
 
 // LayerFromFile returns a v1.Layer given a tarball
@@ -230,6 +268,7 @@ func LayerFromOpener(opener Opener, opts ...LayerOption) (v1.Layer, error) {
 			return ggzip.UnzipReadCloser(urc)
 		}
 	} else {
+		layer.recompressed = true
 		layer.uncompressedopener = opener
 		layer.compressedopener = func() (io.ReadCloser, error) {
 			crc, err := opener()
@@ -247,6 +286,14 @@ func LayerFromOpener(opener Opener, opts ...LayerOption) (v1.Layer, error) {
 	if layer.digest, layer.size, err = computeDigest(layer.compressedopener); err != nil {
 		return nil, err
 	}
+	if layer.expectedDigest != nil && *layer.expectedDigest != layer.digest {
+		return nil, &ErrDigestMismatch{
+			Expected:         *layer.expectedDigest,
+			Actual:           layer.digest,
+			Recompressed:     layer.recompressed,
+			CompressionLevel: layer.compression,
+		}
+	}
 
 	empty := v1.Hash{}
 	if layer.diffID == empty {
@@ -17,13 +17,16 @@ package tarball
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/google/go-containerregistry/internal/compare"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/go-containerregistry/pkg/v1/validate"
 )
@@ -255,6 +258,57 @@ func TestWithMediaType(t *testing.T) {
 	}
 }
 
+func TestWithExpectedDigest(t *testing.T) {
+	setupFixtures(t)
+	defer teardownFixtures(t)
+
+	gz, err := LayerFromFile("gzip_content.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := gz.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compressed tarballs are preserved verbatim.
+	if _, err := LayerFromFile("gzip_content.tgz", WithExpectedDigest(want)); err != nil {
+		t.Errorf("LayerFromFile(compressed) = %v", err)
+	}
+
+	// Recompressing at the same level reproduces the digest.
+	tar, err := LayerFromFile("testdata/content.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	speed, err := tar.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LayerFromFile("testdata/content.tar", WithExpectedDigest(speed)); err != nil {
+		t.Errorf("LayerFromFile(uncompressed) = %v", err)
+	}
+
+	// But not at a different one.
+	_, err = LayerFromFile("testdata/content.tar", WithExpectedDigest(speed), WithCompressionLevel(gzip.BestCompression))
+	var mismatch *ErrDigestMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("LayerFromFile() = %v, expected *ErrDigestMismatch", err)
+	}
+	if !mismatch.Recompressed || mismatch.CompressionLevel != gzip.BestCompression || mismatch.Expected != speed {
+		t.Errorf("unexpected mismatch: %+v", mismatch)
+	}
+
+	other := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}
+	_, err = LayerFromFile("gzip_content.tgz", WithExpectedDigest(other))
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("LayerFromFile() = %v, expected *ErrDigestMismatch", err)
+	}
+	if mismatch.Recompressed || mismatch.Actual != want {
+		t.Errorf("unexpected mismatch: %+v", mismatch)
+	}
+}
+
 func TestLayerFromReader(t *testing.T) {
 	setupFixtures(t)
 	defer teardownFixtures(t)
@@ -0,0 +1,224 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/legacy"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// errNotLegacy is returned by readLegacyTarball for tarballs that have no
+// repositories file.
+var errNotLegacy = errors.New("tarball has no repositories file")
+
+// legacyTarball is what we need from a tarball in the format that
+// `docker save` wrote before Docker 1.10, which has no manifest.json or image
+// config. Instead, a "repositories" file maps each repository to its tags,
+// and each tag to the ID of the image's top layer, and each layer has a
+// directory, named after its ID, with its metadata (including its parent's
+// ID) in "json" and its contents in "layer.tar". See:
+// https://github.com/moby/moby/blob/master/image/spec/v1.md
+type legacyTarball struct {
+	repos map[string]map[string]string
+
+	// configs and diffIDs are indexed by layer ID.
+	configs map[string]*legacy.LayerConfigFile
+	diffIDs map[string]v1.Hash
+}
+
+// readLegacyTarball reads the metadata of every layer in the tarball, and
+// hashes every layer.tar, in a single pass.
+func readLegacyTarball(opener Opener) (*legacyTarball, error) {
+	f, err := opener()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lt := &legacyTarball{
+		configs: map[string]*legacy.LayerConfigFile{},
+		diffIDs: map[string]v1.Hash{},
+	}
+	// links maps layer IDs whose layer.tar is a link to the file it's
+	// linked to, and hashes maps each layer.tar to its hash.
+	links := map[string]string{}
+	hashes := map[string]v1.Hash{}
+
+	tf := tar.NewReader(f)
+	for {
+		hdr, err := tf.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if name == "repositories" {
+			if err := json.NewDecoder(tf).Decode(&lt.repos); err != nil {
+				return nil, fmt.Errorf("parsing repositories: %w", err)
+			}
+			continue
+		}
+		id, file := path.Split(name)
+		id = strings.TrimSuffix(id, "/")
+		if id == "" || strings.Contains(id, "/") {
+			continue
+		}
+		switch file {
+		case "json":
+			cfg := &legacy.LayerConfigFile{}
+			if err := json.NewDecoder(tf).Decode(cfg); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", name, err)
+			}
+			lt.configs[id] = cfg
+		case "layer.tar":
+			if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+				// Resolved like extractFileFromTar does.
+				links[id] = path.Join(id, path.Clean(hdr.Linkname))
+				continue
+			}
+			h, _, err := v1.SHA256(tf)
+			if err != nil {
+				return nil, err
+			}
+			hashes[name] = h
+			lt.diffIDs[id] = h
+		}
+	}
+	if lt.repos == nil {
+		return nil, errNotLegacy
+	}
+	for id, target := range links {
+		h, ok := hashes[target]
+		if !ok {
+			return nil, fmt.Errorf("%s/layer.tar links to %s, which is not a layer", id, target)
+		}
+		lt.diffIDs[id] = h
+	}
+	return lt, nil
+}
+
+// find returns the ID of the top layer of the image with the given tag, or of
+// the only image if tag is nil, and the tags that refer to it.
+func (lt *legacyTarball) find(tag *name.Tag) (string, []string, error) {
+	tops := map[string][]string{}
+	for repo, tags := range lt.repos {
+		for t, id := range tags {
+			tops[id] = append(tops[id], repo+":"+t)
+		}
+	}
+	if tag == nil {
+		if len(tops) != 1 {
+			return "", nil, errors.New("tarball must contain only a single image to be used with tarball.Image")
+		}
+		for id, tags := range tops {
+			sort.Strings(tags)
+			return id, tags, nil
+		}
+	}
+	for id, tags := range tops {
+		for _, tagStr := range tags {
+			repoTag, err := name.NewTag(tagStr)
+			if err != nil {
+				return "", nil, err
+			}
+			if repoTag.Name() == tag.Name() {
+				sort.Strings(tags)
+				return id, tags, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("tag %s not found in tarball", tag)
+}
+
+// loadLegacy loads the image from a tarball in the format `docker save` wrote
+// before Docker 1.10. Since there's no image config, one is made from the
+// metadata of the image's layers.
+func (i *image) loadLegacy() error {
+	lt, err := readLegacyTarball(i.opener)
+	if err != nil {
+		return err
+	}
+	top, tags, err := lt.find(i.tag)
+	if err != nil {
+		return err
+	}
+
+	// Follow the parents down from the top layer.
+	var ids []string
+	for id := top; id != ""; {
+		cfg, ok := lt.configs[id]
+		if !ok {
+			return fmt.Errorf("layer %s has no json", id)
+		}
+		if len(ids) > len(lt.configs) {
+			return fmt.Errorf("layer %s is its own ancestor", id)
+		}
+		ids = append(ids, id)
+		id = cfg.Parent
+	}
+
+	topCfg := lt.configs[top]
+	cfg := v1.ConfigFile{
+		Architecture:  topCfg.Architecture,
+		Author:        topCfg.Author,
+		Container:     topCfg.Container,
+		Created:       topCfg.Created,
+		DockerVersion: topCfg.DockerVersion,
+		OS:            topCfg.OS,
+		Config:        topCfg.Config,
+		RootFS:        v1.RootFS{Type: "layers"},
+	}
+	desc := &Descriptor{RepoTags: tags}
+	for n := len(ids) - 1; n >= 0; n-- {
+		id := ids[n]
+		lc := lt.configs[id]
+		cfg.History = append(cfg.History, v1.History{
+			Author:     lc.Author,
+			Created:    lc.Created,
+			CreatedBy:  strings.Join(lc.ContainerConfig.Cmd, " "),
+			Comment:    lc.Comment,
+			EmptyLayer: lc.Throwaway,
+		})
+		if lc.Throwaway {
+			continue
+		}
+		diffID, ok := lt.diffIDs[id]
+		if !ok {
+			return fmt.Errorf("layer %s has no layer.tar", id)
+		}
+		cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, diffID)
+		desc.Layers = append(desc.Layers, id+"/layer.tar")
+	}
+
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	i.imgDescriptor = desc
+	i.config = b
+	return nil
+}
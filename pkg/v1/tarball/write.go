@@ -17,9 +17,11 @@ package tarball
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"sort"
@@ -87,18 +89,21 @@ func MultiWrite(tagToImage map[name.Tag]v1.Image, w io.Writer, opts ...WriteOpti
 // One manifest.json file at the top level containing information about several images.
 // One file for each layer, named after the layer's SHA.
 // One file for the config blob, named after its SHA.
+//
+// w is only ever written to, sequentially: it's never seeked, read or
+// closed, so it can be a pipe, a network connection, or the writer side of an
+// upload to object storage, e.g. an S3 multipart upload fed by an io.Pipe.
+// Layers are streamed to w as they're read, so memory use doesn't grow with
+// the size of the images; only the configs and manifest.json are held in
+// memory. A multipart uploader buffers (at least) one part at a time on top of
+// that, e.g. 5 MiB per concurrent part for S3's minimum part size.
 func MultiRefWrite(refToImage map[name.Reference]v1.Image, w io.Writer, opts ...WriteOption) error {
-	// process options
-	o := &writeOptions{
-		updates: nil,
-	}
-	for _, option := range opts {
-		if err := option(o); err != nil {
-			return err
-		}
+	o, err := makeWriteOptions(opts...)
+	if err != nil {
+		return err
 	}
 
-	size, mBytes, err := getSizeAndManifest(refToImage)
+	size, mBytes, err := getSizeAndManifest(refToImage, o.layerName)
 	if err != nil {
 		return sendUpdateReturn(o, err)
 	}
@@ -129,7 +134,10 @@ func writeImagesToTar(refToImage map[name.Reference]v1.Image, m []byte, size int
 	if w == nil {
 		return sendUpdateReturn(o, errors.New("must pass valid writer"))
 	}
-	imageToTags := dedupRefToImage(refToImage)
+	imageToTags, err := dedupRefToImage(refToImage)
+	if err != nil {
+		return sendUpdateReturn(o, err)
+	}
 
 	tw := w
 	var pw *progressWriter
@@ -148,7 +156,11 @@ func writeImagesToTar(refToImage map[name.Reference]v1.Image, m []byte, size int
 	tf := tar.NewWriter(tw)
 	defer tf.Close()
 
-	seenLayerDigests := make(map[string]struct{})
+	// Blobs are written once per entry name, however many images (or layers
+	// of an image) refer to them. By default, entries are named by digest, so
+	// each blob is written once.
+	seenLayerFiles := make(map[string]struct{})
+	seenConfigs := make(map[v1.Hash]struct{})
 
 	for img := range imageToTags {
 		// Write the config.
@@ -156,12 +168,15 @@ func writeImagesToTar(refToImage map[name.Reference]v1.Image, m []byte, size int
 		if err != nil {
 			return sendProgressWriterReturn(pw, err)
 		}
-		cfgBlob, err := img.RawConfigFile()
-		if err != nil {
-			return sendProgressWriterReturn(pw, err)
-		}
-		if err := writeTarEntry(tf, cfgName.String(), bytes.NewReader(cfgBlob), int64(len(cfgBlob))); err != nil {
-			return sendProgressWriterReturn(pw, err)
+		if _, ok := seenConfigs[cfgName]; !ok {
+			seenConfigs[cfgName] = struct{}{}
+			cfgBlob, err := img.RawConfigFile()
+			if err != nil {
+				return sendProgressWriterReturn(pw, err)
+			}
+			if err := writeTarEntry(tf, cfgName.String(), bytes.NewReader(cfgBlob), int64(len(cfgBlob)), cfgName); err != nil {
+				return sendProgressWriterReturn(pw, err)
+			}
 		}
 
 		// Write the layers.
@@ -175,21 +190,16 @@ func writeImagesToTar(refToImage map[name.Reference]v1.Image, m []byte, size int
 			if err != nil {
 				return sendProgressWriterReturn(pw, err)
 			}
-			// Munge the file name to appease ancient technology.
-			//
-			// tar assumes anything with a colon is a remote tape drive:
-			// https://www.gnu.org/software/tar/manual/html_section/tar_45.html
-			// Drop the algorithm prefix, e.g. "sha256:"
-			hex := d.Hex
-
-			// gunzip expects certain file extensions:
-			// https://www.gnu.org/software/gzip/manual/html_node/Overview.html
-			layerFiles[i] = fmt.Sprintf("%s.tar.gz", hex)
+			desc, err := partial.BlobDescriptor(img, d)
+			if err != nil {
+				return sendProgressWriterReturn(pw, err)
+			}
+			layerFiles[i] = o.layerName(*desc)
 
-			if _, ok := seenLayerDigests[hex]; ok {
+			if _, ok := seenLayerFiles[layerFiles[i]]; ok {
 				continue
 			}
-			seenLayerDigests[hex] = struct{}{}
+			seenLayerFiles[layerFiles[i]] = struct{}{}
 
 			r, err := l.Compressed()
 			if err != nil {
@@ -200,12 +210,14 @@ func writeImagesToTar(refToImage map[name.Reference]v1.Image, m []byte, size int
 				return sendProgressWriterReturn(pw, err)
 			}
 
-			if err := writeTarEntry(tf, layerFiles[i], r, blobSize); err != nil {
+			err = writeTarEntry(tf, layerFiles[i], r, blobSize, d)
+			r.Close()
+			if err != nil {
 				return sendProgressWriterReturn(pw, err)
 			}
 		}
 	}
-	if err := writeTarEntry(tf, "manifest.json", bytes.NewReader(m), int64(len(m))); err != nil {
+	if err := writeTarEntry(tf, "manifest.json", bytes.NewReader(m), int64(len(m)), v1.Hash{}); err != nil {
 		return sendProgressWriterReturn(pw, err)
 	}
 
@@ -219,13 +231,28 @@ func writeImagesToTar(refToImage map[name.Reference]v1.Image, m []byte, size int
 }
 
 // calculateManifest calculates the manifest and optionally the size of the tar file
-func calculateManifest(refToImage map[name.Reference]v1.Image) (m Manifest, err error) {
-	imageToTags := dedupRefToImage(refToImage)
+func calculateManifest(refToImage map[name.Reference]v1.Image, layerName func(v1.Descriptor) string) (m Manifest, err error) {
+	imageToTags, err := dedupRefToImage(refToImage)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(imageToTags) == 0 {
 		return nil, errors.New("set of images is empty")
 	}
 
+	// Different blobs can't share an entry, and layers can't take the names
+	// of the configs or manifest.json.
+	named := make(map[string]v1.Hash)
+	reserved := map[string]bool{"manifest.json": true}
+	for img := range imageToTags {
+		cfgName, err := img.ConfigName()
+		if err != nil {
+			return nil, err
+		}
+		reserved[cfgName.String()] = true
+	}
+
 	for img, tags := range imageToTags {
 		cfgName, err := img.ConfigName()
 		if err != nil {
@@ -246,22 +273,23 @@ func calculateManifest(refToImage map[name.Reference]v1.Image) (m Manifest, err
 			if err != nil {
 				return nil, err
 			}
-			// Munge the file name to appease ancient technology.
-			//
-			// tar assumes anything with a colon is a remote tape drive:
-			// https://www.gnu.org/software/tar/manual/html_section/tar_45.html
-			// Drop the algorithm prefix, e.g. "sha256:"
-			hex := d.Hex
-
-			// gunzip expects certain file extensions:
-			// https://www.gnu.org/software/gzip/manual/html_node/Overview.html
-			layerFiles[i] = fmt.Sprintf("%s.tar.gz", hex)
-
-			// Add to LayerSources if it's a foreign layer.
 			desc, err := partial.BlobDescriptor(img, d)
 			if err != nil {
 				return nil, err
 			}
+			layerFiles[i] = layerName(*desc)
+			if layerFiles[i] == "" {
+				return nil, fmt.Errorf("layer %s was given an empty name", d)
+			}
+			if reserved[layerFiles[i]] {
+				return nil, fmt.Errorf("layer %s can't be named %q, which is taken by a config or manifest.json", d, layerFiles[i])
+			}
+			if other, ok := named[layerFiles[i]]; ok && other != d {
+				return nil, fmt.Errorf("layers %s and %s are both named %q", other, d, layerFiles[i])
+			}
+			named[layerFiles[i]] = d
+
+			// Add to LayerSources if it's a foreign layer.
 			if !desc.MediaType.IsDistributable() {
 				diffid, err := partial.BlobToDiffID(img, d)
 				if err != nil {
@@ -289,13 +317,18 @@ func calculateManifest(refToImage map[name.Reference]v1.Image) (m Manifest, err
 }
 
 // CalculateSize calculates the expected complete size of the output tar file
-func CalculateSize(refToImage map[name.Reference]v1.Image) (size int64, err error) {
-	size, _, err = getSizeAndManifest(refToImage)
+// written with opts.
+func CalculateSize(refToImage map[name.Reference]v1.Image, opts ...WriteOption) (size int64, err error) {
+	o, err := makeWriteOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	size, _, err = getSizeAndManifest(refToImage, o.layerName)
 	return size, err
 }
 
-func getSizeAndManifest(refToImage map[name.Reference]v1.Image) (int64, []byte, error) {
-	m, err := calculateManifest(refToImage)
+func getSizeAndManifest(refToImage map[name.Reference]v1.Image, layerName func(v1.Descriptor) string) (int64, []byte, error) {
+	m, err := calculateManifest(refToImage, layerName)
 	if err != nil {
 		return 0, nil, fmt.Errorf("unable to calculate manifest: %w", err)
 	}
@@ -304,7 +337,7 @@ func getSizeAndManifest(refToImage map[name.Reference]v1.Image) (int64, []byte,
 		return 0, nil, fmt.Errorf("could not marshall manifest to bytes: %w", err)
 	}
 
-	size, err := calculateTarballSize(refToImage, mBytes)
+	size, err := calculateTarballSize(refToImage, mBytes, layerName)
 	if err != nil {
 		return 0, nil, fmt.Errorf("error calculating tarball size: %w", err)
 	}
@@ -312,16 +345,29 @@ func getSizeAndManifest(refToImage map[name.Reference]v1.Image) (int64, []byte,
 }
 
 // calculateTarballSize calculates the size of the tar file
-func calculateTarballSize(refToImage map[name.Reference]v1.Image, mBytes []byte) (size int64, err error) {
-	imageToTags := dedupRefToImage(refToImage)
+func calculateTarballSize(refToImage map[name.Reference]v1.Image, mBytes []byte, layerName func(v1.Descriptor) string) (size int64, err error) {
+	imageToTags, err := dedupRefToImage(refToImage)
+	if err != nil {
+		return size, err
+	}
 
+	// Count each blob once, as writeImagesToTar writes it.
+	seenLayers := make(map[string]struct{})
+	seenConfigs := make(map[v1.Hash]struct{})
 	for img, name := range imageToTags {
 		manifest, err := img.Manifest()
 		if err != nil {
 			return size, fmt.Errorf("unable to get manifest for img %s: %w", name, err)
 		}
-		size += calculateSingleFileInTarSize(manifest.Config.Size)
+		if _, ok := seenConfigs[manifest.Config.Digest]; !ok {
+			seenConfigs[manifest.Config.Digest] = struct{}{}
+			size += calculateSingleFileInTarSize(manifest.Config.Size)
+		}
 		for _, l := range manifest.Layers {
+			if _, ok := seenLayers[layerName(l)]; ok {
+				continue
+			}
+			seenLayers[layerName(l)] = struct{}{}
 			size += calculateSingleFileInTarSize(l.Size)
 		}
 	}
@@ -333,10 +379,23 @@ func calculateTarballSize(refToImage map[name.Reference]v1.Image, mBytes []byte)
 	return size, nil
 }
 
-func dedupRefToImage(refToImage map[name.Reference]v1.Image) map[v1.Image][]string {
+// dedupRefToImage groups the references by image. Images with the same
+// digest are treated as the same image, even if they're distinct v1.Images,
+// so that their blobs are only written once.
+func dedupRefToImage(refToImage map[name.Reference]v1.Image) (map[v1.Image][]string, error) {
 	imageToTags := make(map[v1.Image][]string)
+	byDigest := make(map[v1.Hash]v1.Image)
 
 	for ref, img := range refToImage {
+		h, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if first, ok := byDigest[h]; ok {
+			img = first
+		} else {
+			byDigest[h] = img
+		}
 		if tag, ok := ref.(name.Tag); ok {
 			if tags, ok := imageToTags[img]; !ok || tags == nil {
 				imageToTags[img] = []string{}
@@ -359,11 +418,22 @@ func dedupRefToImage(refToImage map[name.Reference]v1.Image) map[v1.Image][]stri
 		}
 	}
 
-	return imageToTags
+	return imageToTags, nil
 }
 
-// writeTarEntry writes a file to the provided writer with a corresponding tar header
-func writeTarEntry(tf *tar.Writer, path string, r io.Reader, size int64) error {
+// writeTarEntry writes a file to the provided writer with a corresponding tar header.
+// If h is not empty, the contents of r are hashed as they are written, and an
+// error is returned if they don't match h.
+func writeTarEntry(tf *tar.Writer, path string, r io.Reader, size int64, h v1.Hash) error {
+	var hasher hash.Hash
+	if h != (v1.Hash{}) {
+		var err error
+		hasher, err = v1.Hasher(h.Algorithm)
+		if err != nil {
+			return err
+		}
+		r = io.TeeReader(r, hasher)
+	}
 	hdr := &tar.Header{
 		Mode:     0644,
 		Typeflag: tar.TypeReg,
@@ -373,20 +443,45 @@ func writeTarEntry(tf *tar.Writer, path string, r io.Reader, size int64) error {
 	if err := tf.WriteHeader(hdr); err != nil {
 		return err
 	}
-	_, err := io.Copy(tf, r)
-	return err
+	if _, err := io.Copy(tf, r); err != nil {
+		return err
+	}
+	if hasher != nil {
+		if got := hex.EncodeToString(hasher.Sum(nil)); got != h.Hex {
+			return fmt.Errorf("writing %s: got digest %s:%s, want %s", path, h.Algorithm, got, h)
+		}
+	}
+	return nil
 }
 
 // ComputeManifest get the manifest.json that will be written to the tarball
-// for multiple references
-func ComputeManifest(refToImage map[name.Reference]v1.Image) (Manifest, error) {
-	return calculateManifest(refToImage)
+// for multiple references, with opts
+func ComputeManifest(refToImage map[name.Reference]v1.Image, opts ...WriteOption) (Manifest, error) {
+	o, err := makeWriteOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return calculateManifest(refToImage, o.layerName)
 }
 
 // WriteOption a function option to pass to Write()
 type WriteOption func(*writeOptions) error
 type writeOptions struct {
-	updates chan<- v1.Update
+	updates   chan<- v1.Update
+	layerName func(v1.Descriptor) string
+}
+
+func makeWriteOptions(opts ...WriteOption) (*writeOptions, error) {
+	o := &writeOptions{
+		updates:   nil,
+		layerName: defaultLayerName,
+	}
+	for _, option := range opts {
+		if err := option(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
 }
 
 // WithProgress create a WriteOption for passing to Write() that enables
@@ -398,6 +493,40 @@ func WithProgress(updates chan<- v1.Update) WriteOption {
 	}
 }
 
+// WithLayerNamer creates a WriteOption for passing to Write() that names the
+// tarball entry of each layer with f, given the layer's descriptor from its
+// image's manifest, instead of "<hex>.tar.gz". manifest.json refers to the
+// layers by the names f returns, e.g. "<hex>/layer.tar" for loaders that
+// expect docker save's directory layout. The layers' contents are written as
+// they are, compressed or not, whatever the names say.
+//
+// Blobs that f gives the same name are written once. Writing fails if f gives
+// different blobs the same name, or gives a layer an empty name or the name of
+// a config file or manifest.json. Pass the same option to CalculateSize and
+// ComputeManifest to account for the names.
+func WithLayerNamer(f func(v1.Descriptor) string) WriteOption {
+	return func(o *writeOptions) error {
+		if f == nil {
+			return errors.New("WithLayerNamer: nil namer")
+		}
+		o.layerName = f
+		return nil
+	}
+}
+
+// defaultLayerName names a layer's tarball entry after its digest.
+func defaultLayerName(desc v1.Descriptor) string {
+	// Munge the file name to appease ancient technology.
+	//
+	// tar assumes anything with a colon is a remote tape drive:
+	// https://www.gnu.org/software/tar/manual/html_section/tar_45.html
+	// Drop the algorithm prefix, e.g. "sha256:"
+	//
+	// gunzip expects certain file extensions:
+	// https://www.gnu.org/software/gzip/manual/html_node/Overview.html
+	return fmt.Sprintf("%s.tar.gz", desc.Digest.Hex)
+}
+
 // progressWriter is a writer which will send the download progress
 type progressWriter struct {
 	w              io.Writer
@@ -29,6 +29,7 @@ import (
 	"github.com/google/go-containerregistry/internal/compare"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
@@ -501,3 +502,261 @@ func getLayersFilenames(hashes []string) []string {
 	}
 	return filenames
 }
+
+// corruptLayer flips a bit of the compressed contents of the embedded layer
+// without changing its reported digest or size.
+type corruptLayer struct {
+	v1.Layer
+}
+
+func (l *corruptLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	b[len(b)-1] ^= 1
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestWriteVerifiesDigests(t *testing.T) {
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, &corruptLayer{layer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag("gcr.io/foo/bar:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tarball.Write(tag, img, ioutil.Discard)
+	if err == nil {
+		t.Fatal("Write() = nil, expected digest mismatch")
+	}
+	if !strings.Contains(err.Error(), "digest") {
+		t.Errorf("Write() = %v, expected digest mismatch", err)
+	}
+}
+
+// distinctImage is the same image as the one it wraps, but a different
+// v1.Image, as if it had been fetched twice.
+type distinctImage struct {
+	v1.Image
+}
+
+func TestWriteDuplicateDigests(t *testing.T) {
+	base, err := random.Image(256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := base.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first layer appears twice in the image.
+	img, err := mutate.AppendLayers(base, layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag1, err := name.NewTag("gcr.io/foo/bar:one", name.StrictValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag2, err := name.NewTag("gcr.io/foo/bar:two", name.StrictValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refToImage := map[name.Reference]v1.Image{
+		tag1: img,
+		tag2: &distinctImage{img},
+	}
+
+	var buf bytes.Buffer
+	if err := tarball.MultiRefWrite(refToImage, &buf); err != nil {
+		t.Fatalf("MultiRefWrite() = %v", err)
+	}
+	size, err := tarball.CalculateSize(refToImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(buf.Len()) {
+		t.Errorf("CalculateSize() = %d, wrote %d bytes", size, buf.Len())
+	}
+
+	// The config, two distinct layers and manifest.json, once each.
+	entries := map[string]int{}
+	var m tarball.Manifest
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name]++
+		if hdr.Name == "manifest.json" {
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(entries) != 4 {
+		t.Errorf("wrote %d distinct entries, want 4: %v", len(entries), entries)
+	}
+	for name, n := range entries {
+		if n != 1 {
+			t.Errorf("entry %s written %d times", name, n)
+		}
+	}
+
+	// But the manifest still lists every layer of the image.
+	if len(m) != 1 {
+		t.Fatalf("manifest.json has %d entries, want 1", len(m))
+	}
+	if got := len(m[0].RepoTags); got != 2 {
+		t.Errorf("RepoTags = %v, want both tags", m[0].RepoTags)
+	}
+	if got := len(m[0].Layers); got != 3 {
+		t.Errorf("Layers = %v, want 3 layers", m[0].Layers)
+	}
+	if m[0].Layers[0] != m[0].Layers[2] {
+		t.Errorf("Layers = %v, want the first layer repeated", m[0].Layers)
+	}
+}
+
+func TestWriteLayerNamer(t *testing.T) {
+	img, err := random.Image(256, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag("gcr.io/foo/bar:latest", name.StrictValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like docker save's layout.
+	namer := func(desc v1.Descriptor) string {
+		return desc.Digest.Hex + "/layer.tar"
+	}
+
+	var buf bytes.Buffer
+	if err := tarball.Write(tag, img, &buf, tarball.WithLayerNamer(namer)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{}
+	for _, desc := range m.Layers {
+		want = append(want, namer(desc))
+	}
+	var tm tarball.Manifest
+	entries := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = true
+		if hdr.Name == "manifest.json" {
+			if err := json.NewDecoder(tr).Decode(&tm); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(tm) != 1 {
+		t.Fatalf("manifest.json has %d entries, want 1", len(tm))
+	}
+	if got := strings.Join(tm[0].Layers, ","); got != strings.Join(want, ",") {
+		t.Errorf("Layers = %v, want %v", tm[0].Layers, want)
+	}
+	for _, name := range want {
+		if !entries[name] {
+			t.Errorf("no entry named %s", name)
+		}
+	}
+
+	// The tarball can be read back.
+	opener := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+	got, err := tarball.Image(opener, &tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compare.Images(img, got); err != nil {
+		t.Errorf("compare.Images: %v", err)
+	}
+
+	// CalculateSize and ComputeManifest account for the names.
+	refToImage := map[name.Reference]v1.Image{tag: img}
+	size, err := tarball.CalculateSize(refToImage, tarball.WithLayerNamer(namer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(buf.Len()) {
+		t.Errorf("CalculateSize() = %d, wrote %d bytes", size, buf.Len())
+	}
+	cm, err := tarball.ComputeManifest(refToImage, tarball.WithLayerNamer(namer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cm[0].Layers, ","); got != strings.Join(want, ",") {
+		t.Errorf("ComputeManifest() Layers = %v, want %v", cm[0].Layers, want)
+	}
+
+	cfgName, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// renameFirst gives the first layer another name.
+	renameFirst := func(to string) func(v1.Descriptor) string {
+		return func(desc v1.Descriptor) string {
+			if desc.Digest == m.Layers[0].Digest {
+				return to
+			}
+			return namer(desc)
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		namer func(v1.Descriptor) string
+	}{{
+		// Different layers can't share a name.
+		name:  "colliding names",
+		namer: renameFirst(namer(m.Layers[1])),
+	}, {
+		name:  "manifest.json",
+		namer: renameFirst("manifest.json"),
+	}, {
+		name:  "config name",
+		namer: renameFirst(cfgName.String()),
+	}, {
+		name:  "empty name",
+		namer: renameFirst(""),
+	}, {
+		name: "nil",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tarball.Write(tag, img, &bytes.Buffer{}, tarball.WithLayerNamer(tc.namer)); err == nil {
+				t.Error("Write() = nil, expected error")
+			}
+		})
+	}
+}
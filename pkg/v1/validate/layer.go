@@ -25,6 +25,8 @@ import (
 	"io/ioutil"
 	"strings"
 
+	ggzip "github.com/google/go-containerregistry/internal/gzip"
+	"github.com/google/go-containerregistry/pkg/compression"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 )
@@ -128,10 +130,31 @@ func computeLayer(layer v1.Layer) (*computedLayer, error) {
 		pw.CloseWithError(compressed.Close())
 	}()
 
-	// Read the bytes through gzip.Reader to compute the DiffID.
-	uncompressed, err := gzip.NewReader(pr)
-	if err != nil {
-		return nil, err
+	// Read the bytes through the decompressor registered for the layer's
+	// media type, or gzip.Reader, to compute the DiffID.
+	var uncompressed io.ReadCloser
+	if decompress, ok := registeredDecompressor(layer); ok {
+		if uncompressed, err = decompress(ioutil.NopCloser(pr)); err != nil {
+			pr.CloseWithError(err)
+			return nil, err
+		}
+	} else {
+		// Layers that claim to be gzip-compressed are sometimes mislabeled by
+		// tools that don't actually compress them, which gzip.Reader would
+		// only report as an invalid header. Check for the magic bytes first.
+		gzipped, ppr, err := ggzip.Peek(pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			return nil, err
+		}
+		if !gzipped {
+			err := mislabeled(layer)
+			pr.CloseWithError(err)
+			return nil, err
+		}
+		if uncompressed, err = gzip.NewReader(ppr); err != nil {
+			return nil, err
+		}
 	}
 	diffider := sha256.New()
 	hashUncompressed := io.TeeReader(uncompressed, diffider)
@@ -190,3 +213,26 @@ func computeLayer(layer v1.Layer) (*computedLayer, error) {
 		uncompressedSize:   usize,
 	}, nil
 }
+
+// registeredDecompressor returns the compression.Decompressor registered for
+// layer's media type, if any.
+func registeredDecompressor(layer v1.Layer) (compression.Decompressor, bool) {
+	mt, err := layer.MediaType()
+	if err != nil {
+		return nil, false
+	}
+	return compression.Lookup(mt)
+}
+
+// mislabeled returns an error describing a layer whose compressed contents
+// aren't gzip-compressed.
+func mislabeled(layer v1.Layer) error {
+	desc := "layer"
+	if digest, err := layer.Digest(); err == nil {
+		desc = fmt.Sprintf("layer %s", digest)
+	}
+	if mt, err := layer.MediaType(); err == nil {
+		desc = fmt.Sprintf("%s (%s)", desc, mt)
+	}
+	return fmt.Errorf("%s is not gzip-compressed: its compressed contents don't start with the gzip magic bytes, so it is probably mislabeled as compressed", desc)
+}
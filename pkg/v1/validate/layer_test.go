@@ -0,0 +1,65 @@
+// Copyright 2022 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validate_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+func TestLayerMislabeled(t *testing.T) {
+	l, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Layer(l); err != nil {
+		t.Errorf("validate.Layer(random) = %v", err)
+	}
+
+	// An uncompressed tarball with a gzip media type.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: 5, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bad := static.NewLayer(buf.Bytes(), types.OCILayer)
+	h, err := bad.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = validate.Layer(bad)
+	if err == nil {
+		t.Fatal("validate.Layer(mislabeled) = nil")
+	}
+	for _, want := range []string{h.String(), string(types.OCILayer), "not gzip-compressed"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validate.Layer(mislabeled) = %v, want it to mention %q", err, want)
+		}
+	}
+}